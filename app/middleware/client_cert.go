@@ -0,0 +1,108 @@
+package middleware
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"slices"
+
+	"github.com/nao1215/hurrah/config"
+)
+
+// ClientCertificate is the identity of a verified TLS client certificate.
+type ClientCertificate struct {
+	Subject     string   // Subject is the distinguished name of the subject. e.g., CN=partner.example.com,O=Partner
+	CommonName  string   // CommonName is the common name of the subject.
+	SANs        []string // SANs is the DNS, email, IP and URI subject alternative names.
+	Fingerprint string   // Fingerprint is the hex encoded SHA-256 fingerprint of the certificate.
+	Raw         []byte   // Raw is the DER encoded certificate.
+}
+
+// clientCertKey is the context key for ClientCertificate.
+type clientCertKey struct{}
+
+// ClientCertificateFromContext returns the verified client certificate stored in ctx.
+func ClientCertificateFromContext(ctx context.Context) (*ClientCertificate, bool) {
+	cert, ok := ctx.Value(clientCertKey{}).(*ClientCertificate)
+	return cert, ok
+}
+
+// newClientCertificate returns the identity of the certificate.
+func newClientCertificate(cert *x509.Certificate) *ClientCertificate {
+	sans := slices.Clone(cert.DNSNames)
+	sans = append(sans, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+	fingerprint := sha256.Sum256(cert.Raw)
+	return &ClientCertificate{
+		Subject:     cert.Subject.String(),
+		CommonName:  cert.Subject.CommonName,
+		SANs:        sans,
+		Fingerprint: hex.EncodeToString(fingerprint[:]),
+		Raw:         cert.Raw,
+	}
+}
+
+// ClientCert is a middleware that authorizes clients by the TLS client certificate
+// verified by the listener (see server.tls.client_ca_file). The identity of the
+// certificate is stored in the request context (see ClientCertificateFromContext),
+// and the certificate can be forwarded to the backend in a header as a base64
+// encoded DER byte sequence (RFC 9440).
+func ClientCert(cfg config.ClientCert) Middleware {
+	return func(next HandlerWithCtx) HandlerWithCtx {
+		return func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			if cfg.ForwardHeader != "" {
+				r.Header.Del(cfg.ForwardHeader) // Never trust the header sent by the client.
+			}
+
+			if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+				if cfg.Required {
+					return NewError(http.StatusUnauthorized, "client certificate is required")
+				}
+				return next(ctx, w, r)
+			}
+
+			cert := newClientCertificate(r.TLS.VerifiedChains[0][0])
+			if !clientCertAllowed(cfg, cert) {
+				slog.Warn("middleware: client certificate is not allowed",
+					slog.String("path", r.URL.Path),
+					slog.String("subject", cert.Subject),
+					slog.String("fingerprint", cert.Fingerprint))
+				return NewError(http.StatusForbidden, "client certificate is not allowed")
+			}
+
+			if cfg.ForwardHeader != "" {
+				r.Header.Set(cfg.ForwardHeader, ":"+base64.StdEncoding.EncodeToString(cert.Raw)+":")
+			}
+			ctx = context.WithValue(ctx, clientCertKey{}, cert)
+			return next(ctx, w, r.WithContext(ctx))
+		}
+	}
+}
+
+// clientCertAllowed reports whether the certificate matches the allowed subjects or SANs.
+// Any certificate is allowed if neither is configured.
+func clientCertAllowed(cfg config.ClientCert, cert *ClientCertificate) bool {
+	if len(cfg.AllowedSubjects) == 0 && len(cfg.AllowedSANs) == 0 {
+		return true
+	}
+	for _, subject := range cfg.AllowedSubjects {
+		if subject == cert.CommonName || subject == cert.Subject {
+			return true
+		}
+	}
+	for _, san := range cfg.AllowedSANs {
+		if slices.Contains(cert.SANs, san) {
+			return true
+		}
+	}
+	return false
+}
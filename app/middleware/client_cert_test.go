@@ -0,0 +1,138 @@
+package middleware
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/nao1215/hurrah/config"
+)
+
+// newTestClientCertificate returns a self-signed certificate.
+func newTestClientCertificate(t *testing.T, commonName string, dnsNames ...string) *x509.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName, Organization: []string{"Partner"}},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestClientCert(t *testing.T) {
+	partner := newTestClientCertificate(t, "partner.example.com", "api.partner.example.com")
+	other := newTestClientCertificate(t, "other.example.com")
+
+	var (
+		gotHeader string
+		gotCert   *ClientCertificate
+	)
+	backend := func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+		gotHeader = r.Header.Get("X-Client-Cert")
+		gotCert, _ = ClientCertificateFromContext(ctx)
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+
+	tests := []struct {
+		name   string
+		cfg    config.ClientCert
+		cert   *x509.Certificate
+		want   int
+		wantCN string
+	}{
+		{
+			name:   "allowed by subject",
+			cfg:    config.ClientCert{Required: true, AllowedSubjects: []string{"partner.example.com"}, ForwardHeader: "X-Client-Cert"},
+			cert:   partner,
+			want:   http.StatusOK,
+			wantCN: "partner.example.com",
+		},
+		{
+			name:   "allowed by SAN",
+			cfg:    config.ClientCert{Required: true, AllowedSANs: []string{"api.partner.example.com"}, ForwardHeader: "X-Client-Cert"},
+			cert:   partner,
+			want:   http.StatusOK,
+			wantCN: "partner.example.com",
+		},
+		{
+			name: "not allowed",
+			cfg:  config.ClientCert{Required: true, AllowedSubjects: []string{"partner.example.com"}},
+			cert: other,
+			want: http.StatusForbidden,
+		},
+		{
+			name: "required but not given",
+			cfg:  config.ClientCert{Required: true},
+			want: http.StatusUnauthorized,
+		},
+		{
+			name: "optional and not given",
+			cfg:  config.ClientCert{ForwardHeader: "X-Client-Cert"},
+			want: http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotHeader, gotCert = "", nil
+			req := httptest.NewRequest(http.MethodGet, "/partner", nil)
+			req.Header.Set("X-Client-Cert", "spoofed")
+			if tt.cert != nil {
+				req.TLS = &tls.ConnectionState{
+					PeerCertificates: []*x509.Certificate{tt.cert},
+					VerifiedChains:   [][]*x509.Certificate{{tt.cert}},
+				}
+			}
+			rec := httptest.NewRecorder()
+			Chain(backend, ClientCert(tt.cfg)).AdaptHandler().ServeHTTP(rec, req)
+
+			if diff := cmp.Diff(tt.want, rec.Code); diff != "" {
+				t.Errorf("status mismatch (-want +got):\n%s", diff)
+			}
+			if rec.Code != http.StatusOK {
+				return
+			}
+			if tt.cert == nil {
+				if gotHeader != "" {
+					t.Errorf("spoofed header is forwarded: %q", gotHeader)
+				}
+				return
+			}
+			if diff := cmp.Diff(":"+base64.StdEncoding.EncodeToString(tt.cert.Raw)+":", gotHeader); diff != "" {
+				t.Errorf("forwarded header mismatch (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tt.wantCN, gotCert.CommonName); diff != "" {
+				t.Errorf("common name mismatch (-want +got):\n%s", diff)
+			}
+			if len(gotCert.Fingerprint) != 64 {
+				t.Errorf("fingerprint %q is not a hex encoded SHA-256", gotCert.Fingerprint)
+			}
+		})
+	}
+}
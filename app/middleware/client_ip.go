@@ -0,0 +1,154 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// clientIPKey is the context key for the client IP address.
+type clientIPKey struct{}
+
+// ClientIPFromContext returns the client IP address derived by the ClientIP middleware.
+func ClientIPFromContext(ctx context.Context) (netip.Addr, bool) {
+	addr, ok := ctx.Value(clientIPKey{}).(netip.Addr)
+	return addr, ok
+}
+
+// clientIP returns the client IP address of the request. If the ClientIP middleware
+// has not run, the address of the peer is returned.
+func clientIP(ctx context.Context, r *http.Request) netip.Addr {
+	if addr, ok := ClientIPFromContext(ctx); ok {
+		return addr
+	}
+	return peerIP(r)
+}
+
+// ParsePrefixes parses IP addresses and CIDRs. A single address is treated as a /32 or /128 prefix.
+func ParsePrefixes(values []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(values))
+	for _, v := range values {
+		p, err := parsePrefix(v)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, p)
+	}
+	return prefixes, nil
+}
+
+// parsePrefix parses an IP address or a CIDR.
+func parsePrefix(s string) (netip.Prefix, error) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("middleware: invalid CIDR %q: %w", s, err)
+		}
+		return p.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("middleware: invalid IP address %q: %w", s, err)
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// ClientIP is a middleware that derives the client IP address and stores it in the
+// request context (see ClientIPFromContext). The X-Forwarded-For and Forwarded
+// headers are honored only if the request comes from one of the trusted proxies.
+// The headers are read from right to left, and the first address that is not a
+// trusted proxy is the client.
+func ClientIP(trustedProxies []netip.Prefix) Middleware {
+	trusted := func(addr netip.Addr) bool {
+		for _, p := range trustedProxies {
+			if p.Contains(addr) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return func(next HandlerWithCtx) HandlerWithCtx {
+		return func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			addr := peerIP(r)
+			if addr.IsValid() && trusted(addr) {
+				forwarded := forwardedFor(r.Header)
+				for i := len(forwarded) - 1; i >= 0; i-- {
+					addr = forwarded[i]
+					if !trusted(addr) {
+						break
+					}
+				}
+			}
+			ctx = context.WithValue(ctx, clientIPKey{}, addr)
+			return next(ctx, w, r.WithContext(ctx))
+		}
+	}
+}
+
+// peerIP returns the IP address of the peer. It returns the zero Addr if the address can not be parsed.
+func peerIP(r *http.Request) netip.Addr {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addr.Unmap()
+}
+
+// forwardedFor returns the addresses in the Forwarded header (RFC 7239), or in the
+// X-Forwarded-For header if the Forwarded header is absent. The addresses are in
+// the order of the proxies. Invalid or obfuscated addresses end the list, because
+// the addresses before them can not be trusted.
+func forwardedFor(header http.Header) []netip.Addr {
+	var values []string
+	if forwarded := header.Values("Forwarded"); len(forwarded) > 0 {
+		for _, line := range forwarded {
+			for _, element := range strings.Split(line, ",") {
+				for _, pair := range strings.Split(element, ";") {
+					key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+					if ok && strings.EqualFold(key, "for") {
+						values = append(values, value)
+					}
+				}
+			}
+		}
+	} else {
+		for _, line := range header.Values("X-Forwarded-For") {
+			values = append(values, strings.Split(line, ",")...)
+		}
+	}
+
+	addrs := make([]netip.Addr, 0, len(values))
+	for _, v := range values {
+		addr, ok := parseForwardedAddr(v)
+		if !ok {
+			addrs = addrs[:0]
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+// parseForwardedAddr parses a node of the forwarding headers. e.g., 192.0.2.1, "[2001:db8::1]:4711"
+func parseForwardedAddr(s string) (netip.Addr, bool) {
+	s = strings.Trim(strings.TrimSpace(s), `"`)
+	if addrPort, err := netip.ParseAddrPort(s); err == nil {
+		return addrPort.Addr().Unmap(), true
+	}
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
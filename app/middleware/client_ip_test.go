@@ -0,0 +1,108 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestClientIP(t *testing.T) {
+	t.Parallel()
+
+	trusted, err := ParsePrefixes([]string{"10.0.0.0/8", "2001:db8::1"})
+	if err != nil {
+		t.Fatalf("ParsePrefixes() error = %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     http.Header
+		want       string
+	}{
+		{
+			name:       "direct client",
+			remoteAddr: "192.0.2.1:1234",
+			want:       "192.0.2.1",
+		},
+		{
+			name:       "X-Forwarded-For from an untrusted peer is ignored",
+			remoteAddr: "192.0.2.1:1234",
+			header:     http.Header{"X-Forwarded-For": {"198.51.100.7"}},
+			want:       "192.0.2.1",
+		},
+		{
+			name:       "X-Forwarded-For from a trusted proxy",
+			remoteAddr: "10.0.0.2:1234",
+			header:     http.Header{"X-Forwarded-For": {"203.0.113.9, 198.51.100.7, 10.0.0.3"}},
+			want:       "198.51.100.7",
+		},
+		{
+			name:       "multiple X-Forwarded-For headers",
+			remoteAddr: "10.0.0.2:1234",
+			header:     http.Header{"X-Forwarded-For": {"203.0.113.9", "198.51.100.7"}},
+			want:       "198.51.100.7",
+		},
+		{
+			name:       "Forwarded takes precedence over X-Forwarded-For",
+			remoteAddr: "[2001:db8::1]:1234",
+			header: http.Header{
+				"Forwarded":       {`for=192.0.2.60;proto=https, for="[2001:db8:cafe::17]:4711"`},
+				"X-Forwarded-For": {"203.0.113.9"},
+			},
+			want: "2001:db8:cafe::17",
+		},
+		{
+			name:       "obfuscated identifier stops the walk",
+			remoteAddr: "10.0.0.2:1234",
+			header:     http.Header{"Forwarded": {"for=192.0.2.60, for=_hidden, for=10.0.0.5"}},
+			want:       "10.0.0.5",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			var got netip.Addr
+			handler := func(ctx context.Context, _ http.ResponseWriter, _ *http.Request) error {
+				got, _ = ClientIPFromContext(ctx)
+				return nil
+			}
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for k, v := range tt.header {
+				req.Header[k] = v
+			}
+			Chain(handler, ClientIP(trusted)).AdaptHandler().ServeHTTP(httptest.NewRecorder(), req)
+
+			if diff := cmp.Diff(tt.want, got.String()); diff != "" {
+				t.Errorf("client IP mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParsePrefixes(t *testing.T) {
+	t.Parallel()
+
+	got, err := ParsePrefixes([]string{"192.0.2.1", "10.1.2.3/8", "2001:db8::/32"})
+	if err != nil {
+		t.Fatalf("ParsePrefixes() error = %v", err)
+	}
+	want := []string{"192.0.2.1/32", "10.0.0.0/8", "2001:db8::/32"}
+	gotStrings := make([]string, 0, len(got))
+	for _, p := range got {
+		gotStrings = append(gotStrings, p.String())
+	}
+	if diff := cmp.Diff(want, gotStrings); diff != "" {
+		t.Errorf("ParsePrefixes() mismatch (-want +got):\n%s", diff)
+	}
+
+	if _, err := ParsePrefixes([]string{"not-an-ip"}); err == nil {
+		t.Error("ParsePrefixes() error = nil, want error")
+	}
+}
@@ -0,0 +1,245 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/nao1215/hurrah/config"
+)
+
+// corsDefaultMethods is the methods allowed by default. They are the CORS-safelisted methods.
+var corsDefaultMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+
+// cors is the CORS policy of a route.
+type cors struct {
+	cfg        config.CORS
+	anyOrigin  bool
+	origins    map[string]struct{} // origins is the exact origins in lower case.
+	subdomains []wildcardOrigin
+	patterns   []*regexp.Regexp
+	methods    map[string]struct{}
+	anyHeader  bool
+	headers    map[string]struct{} // headers is the canonical header names.
+}
+
+// wildcardOrigin is an origin with a wildcard subdomain, e.g., "https://*.example.com".
+type wildcardOrigin struct {
+	prefix string // prefix is the scheme and "://". e.g., "https://"
+	suffix string // suffix is the parent domain and the port. e.g., ".example.com"
+}
+
+// CORS is a middleware that handles Cross-Origin Resource Sharing.
+// Preflight requests are answered by the gateway without reaching the backend,
+// and the CORS headers of the backend responses are replaced with the ones of
+// the route, so that the backends do not need to handle CORS.
+// Requests from origins that are not allowed reach the backend without CORS
+// headers, and browsers block the responses; their preflight requests get 403.
+func CORS(cfg config.CORS) (Middleware, error) {
+	c, err := newCORS(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return c.handle, nil
+}
+
+// AllowOrigin returns a function that reports whether the origin is allowed by
+// the origins in the same format as allow_origins of the cors middleware.
+func AllowOrigin(origins []string) (func(origin string) bool, error) {
+	c, err := newCORS(config.CORS{AllowOrigins: origins})
+	if err != nil {
+		return nil, err
+	}
+	return c.allowOrigin, nil
+}
+
+// newCORS validates the settings and returns a new cors.
+func newCORS(cfg config.CORS) (*cors, error) {
+	if len(cfg.AllowMethods) == 0 {
+		cfg.AllowMethods = corsDefaultMethods
+	}
+	c := &cors{
+		cfg:     cfg,
+		origins: map[string]struct{}{},
+		methods: map[string]struct{}{},
+		headers: map[string]struct{}{},
+	}
+
+	for _, origin := range cfg.AllowOrigins {
+		origin = strings.ToLower(strings.TrimSuffix(origin, "/"))
+		switch {
+		case origin == "*":
+			c.anyOrigin = true
+		case strings.Contains(origin, "://*."):
+			scheme, host, _ := strings.Cut(origin, "://*")
+			c.subdomains = append(c.subdomains, wildcardOrigin{prefix: scheme + "://", suffix: host})
+		case strings.Contains(origin, "*"):
+			return nil, fmt.Errorf("middleware: invalid cors origin %q: a wildcard is allowed only as the first label", origin)
+		default:
+			c.origins[origin] = struct{}{}
+		}
+	}
+	for _, pattern := range cfg.AllowOriginPatterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("middleware: invalid cors origin pattern %q: %w", pattern, err)
+		}
+		c.patterns = append(c.patterns, re)
+	}
+	if c.anyOrigin && cfg.AllowCredentials {
+		return nil, errors.New("middleware: cors cannot allow credentials for any origin; list the origins instead")
+	}
+
+	for _, method := range cfg.AllowMethods {
+		c.methods[strings.ToUpper(method)] = struct{}{}
+	}
+	for _, header := range cfg.AllowHeaders {
+		if header == "*" {
+			c.anyHeader = true
+			continue
+		}
+		c.headers[http.CanonicalHeaderKey(header)] = struct{}{}
+	}
+	return c, nil
+}
+
+// allowOrigin returns true if the origin is allowed.
+func (c *cors) allowOrigin(origin string) bool {
+	if c.anyOrigin {
+		return true
+	}
+	lower := strings.ToLower(origin)
+	if _, ok := c.origins[lower]; ok {
+		return true
+	}
+	for _, w := range c.subdomains {
+		if strings.HasPrefix(lower, w.prefix) && strings.HasSuffix(lower, w.suffix) &&
+			len(lower) > len(w.prefix)+len(w.suffix) {
+			return true
+		}
+	}
+	for _, re := range c.patterns {
+		if re.MatchString(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// deniedHeaders returns the requested headers that are not allowed.
+func (c *cors) deniedHeaders(requested []string) []string {
+	if c.anyHeader {
+		return nil
+	}
+	var denied []string
+	for _, header := range requested {
+		if _, ok := c.headers[http.CanonicalHeaderKey(header)]; !ok {
+			denied = append(denied, header)
+		}
+	}
+	return denied
+}
+
+// handle is the Middleware of the cors.
+func (c *cors) handle(next HandlerWithCtx) HandlerWithCtx {
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return next(ctx, w, r)
+		}
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			return c.preflight(w, r, origin)
+		}
+
+		allowed := c.allowOrigin(origin)
+		hw := newHeaderWriter(w, func(h http.Header) {
+			deleteCORSHeaders(h)
+			addVary(h, "Origin")
+			if !allowed {
+				return
+			}
+			c.setAllowOrigin(h, origin)
+			if len(c.cfg.ExposeHeaders) > 0 {
+				h.Set("Access-Control-Expose-Headers", strings.Join(c.cfg.ExposeHeaders, ", "))
+			}
+		})
+		return hw.done(next(ctx, hw, r))
+	}
+}
+
+// preflight answers the preflight request.
+func (c *cors) preflight(w http.ResponseWriter, r *http.Request, origin string) error {
+	h := w.Header()
+	addVary(h, "Origin", "Access-Control-Request-Method", "Access-Control-Request-Headers")
+
+	if !c.allowOrigin(origin) {
+		slog.Debug("middleware: cors origin is not allowed", slog.String("origin", origin))
+		return NewError(http.StatusForbidden, "origin is not allowed")
+	}
+	method := r.Header.Get("Access-Control-Request-Method")
+	if _, ok := c.methods[method]; !ok {
+		return NewError(http.StatusForbidden, fmt.Sprintf("method %s is not allowed", method))
+	}
+	requested := splitList(strings.Join(r.Header.Values("Access-Control-Request-Headers"), ","))
+	if denied := c.deniedHeaders(requested); len(denied) > 0 {
+		e := NewError(http.StatusForbidden, "request headers are not allowed")
+		e.Extensions = map[string]any{"headers": denied}
+		return e
+	}
+
+	c.setAllowOrigin(h, origin)
+	h.Set("Access-Control-Allow-Methods", strings.Join(c.cfg.AllowMethods, ", "))
+	if len(requested) > 0 {
+		// The requested headers are echoed back because "*" is not a wildcard with credentials.
+		h.Set("Access-Control-Allow-Headers", strings.Join(requested, ", "))
+	}
+	if c.cfg.MaxAge > 0 {
+		h.Set("Access-Control-Max-Age", strconv.FormatInt(c.cfg.MaxAge, 10))
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// setAllowOrigin sets the Access-Control-Allow-Origin and Access-Control-Allow-Credentials headers.
+func (c *cors) setAllowOrigin(h http.Header, origin string) {
+	if c.anyOrigin {
+		h.Set("Access-Control-Allow-Origin", "*")
+		return
+	}
+	h.Set("Access-Control-Allow-Origin", origin)
+	if c.cfg.AllowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// deleteCORSHeaders deletes the CORS response headers set by the backend.
+func deleteCORSHeaders(h http.Header) {
+	for key := range h {
+		if strings.HasPrefix(key, "Access-Control-") {
+			h.Del(key)
+		}
+	}
+}
+
+// addVary adds the header names to the Vary header without duplicates.
+func addVary(h http.Header, names ...string) {
+	existing := splitList(strings.Join(h.Values("Vary"), ","))
+	for _, name := range names {
+		found := false
+		for _, v := range existing {
+			if strings.EqualFold(v, name) || v == "*" {
+				found = true
+				break
+			}
+		}
+		if !found {
+			existing = append(existing, name)
+		}
+	}
+	h.Set("Vary", strings.Join(existing, ", "))
+}
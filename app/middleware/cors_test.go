@@ -0,0 +1,209 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/nao1215/hurrah/config"
+)
+
+func TestCORS(t *testing.T) {
+	t.Parallel()
+
+	cfg := config.CORS{
+		AllowOrigins:        []string{"https://app.example.com", "https://*.example.org"},
+		AllowOriginPatterns: []string{`^https://pr-[0-9]+\.example\.net$`},
+		AllowMethods:        []string{"GET", "PUT"},
+		AllowHeaders:        []string{"Authorization", "content-type"},
+		ExposeHeaders:       []string{"X-Request-Id"},
+		AllowCredentials:    true,
+		MaxAge:              600,
+	}
+	m, err := CORS(cfg)
+	if err != nil {
+		t.Fatalf("CORS() error = %v", err)
+	}
+	var backendCalled bool
+	backend := func(_ context.Context, w http.ResponseWriter, _ *http.Request) error {
+		backendCalled = true
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Vary", "Accept-Encoding")
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+	h := Chain(backend, m).AdaptHandler()
+
+	tests := []struct {
+		name        string
+		method      string
+		header      http.Header
+		wantStatus  int
+		wantBackend bool
+		wantHeader  http.Header
+	}{
+		{
+			name:        "request without Origin",
+			method:      http.MethodGet,
+			wantStatus:  http.StatusOK,
+			wantBackend: true,
+			wantHeader: http.Header{
+				"Access-Control-Allow-Origin": {"*"},
+				"Vary":                        {"Accept-Encoding"},
+			},
+		},
+		{
+			name:        "request from an exact origin",
+			method:      http.MethodGet,
+			header:      http.Header{"Origin": {"https://app.example.com"}},
+			wantStatus:  http.StatusOK,
+			wantBackend: true,
+			wantHeader: http.Header{
+				"Access-Control-Allow-Origin":      {"https://app.example.com"},
+				"Access-Control-Allow-Credentials": {"true"},
+				"Access-Control-Expose-Headers":    {"X-Request-Id"},
+				"Vary":                             {"Accept-Encoding, Origin"},
+			},
+		},
+		{
+			name:        "request from a disallowed origin",
+			method:      http.MethodGet,
+			header:      http.Header{"Origin": {"https://evil.example"}},
+			wantStatus:  http.StatusOK,
+			wantBackend: true,
+			wantHeader:  http.Header{"Vary": {"Accept-Encoding, Origin"}},
+		},
+		{
+			name:   "preflight from a wildcard subdomain",
+			method: http.MethodOptions,
+			header: http.Header{
+				"Origin":                         {"https://a.b.example.org"},
+				"Access-Control-Request-Method":  {"PUT"},
+				"Access-Control-Request-Headers": {"authorization,Content-Type"},
+			},
+			wantStatus: http.StatusNoContent,
+			wantHeader: http.Header{
+				"Access-Control-Allow-Origin":      {"https://a.b.example.org"},
+				"Access-Control-Allow-Credentials": {"true"},
+				"Access-Control-Allow-Methods":     {"GET, PUT"},
+				"Access-Control-Allow-Headers":     {"authorization, Content-Type"},
+				"Access-Control-Max-Age":           {"600"},
+				"Vary":                             {"Origin, Access-Control-Request-Method, Access-Control-Request-Headers"},
+			},
+		},
+		{
+			name:   "preflight from a pattern",
+			method: http.MethodOptions,
+			header: http.Header{
+				"Origin":                        {"https://pr-42.example.net"},
+				"Access-Control-Request-Method": {"GET"},
+			},
+			wantStatus: http.StatusNoContent,
+			wantHeader: http.Header{
+				"Access-Control-Allow-Origin":      {"https://pr-42.example.net"},
+				"Access-Control-Allow-Credentials": {"true"},
+				"Access-Control-Allow-Methods":     {"GET, PUT"},
+				"Access-Control-Max-Age":           {"600"},
+				"Vary":                             {"Origin, Access-Control-Request-Method, Access-Control-Request-Headers"},
+			},
+		},
+		{
+			name:   "preflight of the parent domain of a wildcard",
+			method: http.MethodOptions,
+			header: http.Header{
+				"Origin":                        {"https://example.org"},
+				"Access-Control-Request-Method": {"GET"},
+			},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:   "preflight with a disallowed method",
+			method: http.MethodOptions,
+			header: http.Header{
+				"Origin":                        {"https://app.example.com"},
+				"Access-Control-Request-Method": {"DELETE"},
+			},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:   "preflight with a disallowed header",
+			method: http.MethodOptions,
+			header: http.Header{
+				"Origin":                         {"https://app.example.com"},
+				"Access-Control-Request-Method":  {"GET"},
+				"Access-Control-Request-Headers": {"X-Debug"},
+			},
+			wantStatus: http.StatusForbidden,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Not parallel because backendCalled is shared.
+			backendCalled = false
+			req := httptest.NewRequest(tt.method, "/", nil)
+			for k, v := range tt.header {
+				req.Header[k] = v
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if diff := cmp.Diff(tt.wantStatus, rec.Code); diff != "" {
+				t.Errorf("status mismatch (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tt.wantBackend, backendCalled); diff != "" {
+				t.Errorf("backend called mismatch (-want +got):\n%s", diff)
+			}
+			for k, want := range tt.wantHeader {
+				if diff := cmp.Diff(want, rec.Header().Values(k)); diff != "" {
+					t.Errorf("%s header mismatch (-want +got):\n%s", k, diff)
+				}
+			}
+			if tt.wantHeader != nil {
+				for k := range rec.Header() {
+					if _, ok := tt.wantHeader[k]; !ok && k != "Content-Type" {
+						t.Errorf("unexpected header %s: %v", k, rec.Header().Values(k))
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestCORS_errorResponse(t *testing.T) {
+	t.Parallel()
+
+	m, err := CORS(config.CORS{AllowOrigins: []string{"https://app.example.com"}})
+	if err != nil {
+		t.Fatalf("CORS() error = %v", err)
+	}
+	unauthorized := func(_ context.Context, _ http.ResponseWriter, _ *http.Request) error {
+		return NewError(http.StatusUnauthorized, "missing token")
+	}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	rec := httptest.NewRecorder()
+	Chain(unauthorized, m).AdaptHandler().ServeHTTP(rec, req)
+
+	if diff := cmp.Diff(http.StatusUnauthorized, rec.Code); diff != "" {
+		t.Errorf("status mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff("https://app.example.com", rec.Header().Get("Access-Control-Allow-Origin")); diff != "" {
+		t.Errorf("Access-Control-Allow-Origin mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestCORS_invalidSettings(t *testing.T) {
+	t.Parallel()
+
+	for _, cfg := range []config.CORS{
+		{AllowOrigins: []string{"*"}, AllowCredentials: true},
+		{AllowOrigins: []string{"https://app.*.example.com"}},
+		{AllowOriginPatterns: []string{"("}},
+	} {
+		if _, err := CORS(cfg); err == nil {
+			t.Errorf("CORS(%+v) error = nil, want error", cfg)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/nao1215/hurrah/config"
+)
+
+const (
+	// extAuthzFailClosed rejects requests when the authorization service is unavailable.
+	extAuthzFailClosed = "closed"
+	// extAuthzFailOpen allows requests when the authorization service is unavailable.
+	extAuthzFailOpen = "open"
+	// maxExtAuthzBodySize is the maximum size of a denying response body relayed to the client.
+	maxExtAuthzBodySize = 64 * 1024
+)
+
+// extAuthz is the external authorization.
+type extAuthz struct {
+	cfg    config.ExtAuthz
+	client *http.Client
+}
+
+// ExtAuthz is a middleware that asks an external HTTP authorization service
+// whether to allow the request. The method, URI and host of the request are sent
+// in the X-Forwarded-Method, X-Forwarded-Uri and X-Forwarded-Host headers with
+// the selected request headers. A 2xx response allows the request, and any other
+// response is returned to the client as it is.
+func ExtAuthz(cfg config.ExtAuthz, timeout time.Duration) (Middleware, error) {
+	if cfg.URL == "" {
+		return nil, errors.New("middleware: ext_authz requires url")
+	}
+	if _, err := url.Parse(cfg.URL); err != nil {
+		return nil, fmt.Errorf("middleware: failed to parse ext_authz url: %w", err)
+	}
+	switch cfg.FailureMode {
+	case "":
+		cfg.FailureMode = extAuthzFailClosed
+	case extAuthzFailClosed, extAuthzFailOpen:
+	default:
+		return nil, fmt.Errorf("middleware: unknown ext_authz failure_mode %q", cfg.FailureMode)
+	}
+	if cfg.TimeoutMS > 0 {
+		timeout = time.Duration(cfg.TimeoutMS) * time.Millisecond
+	}
+
+	e := &extAuthz{
+		cfg: cfg,
+		client: &http.Client{
+			Timeout: timeout,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse // Redirects such as a login page are returned to the client.
+			},
+		},
+	}
+	return e.handle, nil
+}
+
+// handle is the Middleware of the extAuthz.
+func (e *extAuthz) handle(next HandlerWithCtx) HandlerWithCtx {
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+		resp, err := e.check(ctx, r)
+		// Only the authorization service sets the upstream headers, so the values the client sent are removed.
+		for _, name := range e.cfg.UpstreamHeaders {
+			r.Header.Del(name)
+		}
+		if err != nil {
+			slog.Error("middleware: ext_authz is unavailable",
+				slog.String("failure_mode", e.cfg.FailureMode), slog.String("error", err.Error()))
+			if e.cfg.FailureMode == extAuthzFailOpen {
+				return next(ctx, w, r)
+			}
+			return NewError(http.StatusForbidden, "authorization service is unavailable")
+		}
+		defer resp.Body.Close() //nolint:errcheck
+
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			for _, name := range e.cfg.UpstreamHeaders {
+				for _, v := range resp.Header.Values(name) {
+					r.Header.Add(name, v)
+				}
+			}
+			return next(ctx, w, r)
+		}
+
+		slog.Info("middleware: ext_authz denied the request",
+			slog.String("method", r.Method), slog.String("path", r.URL.Path), slog.Int("status", resp.StatusCode))
+		for _, name := range e.cfg.ClientHeaders {
+			for _, v := range resp.Header.Values(name) {
+				w.Header().Add(name, v)
+			}
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != "" {
+			w.Header().Set("Content-Type", ct)
+		}
+		w.WriteHeader(resp.StatusCode)
+		if _, err := io.Copy(w, io.LimitReader(resp.Body, maxExtAuthzBodySize)); err != nil {
+			slog.Debug("middleware: failed to relay the ext_authz response", slog.String("error", err.Error()))
+		}
+		return nil
+	}
+}
+
+// check sends the authorization request.
+func (e *extAuthz) check(ctx context.Context, r *http.Request) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, e.cfg.URL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create an authorization request: %w", err)
+	}
+	for _, name := range e.cfg.Headers {
+		for _, v := range r.Header.Values(name) {
+			req.Header.Add(name, v)
+		}
+	}
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	req.Header.Set("X-Forwarded-Method", r.Method)
+	req.Header.Set("X-Forwarded-Uri", r.URL.RequestURI())
+	req.Header.Set("X-Forwarded-Host", r.Host)
+	req.Header.Set("X-Forwarded-Proto", proto)
+
+	resp, err := e.client.Do(req) //nolint:bodyclose // The caller closes the body.
+	if err != nil {
+		return nil, fmt.Errorf("failed to send an authorization request: %w", err)
+	}
+	if resp.StatusCode >= http.StatusInternalServerError {
+		resp.Body.Close() //nolint:errcheck
+		return nil, fmt.Errorf("authorization service returned status %d", resp.StatusCode)
+	}
+	return resp, nil
+}
@@ -0,0 +1,135 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/nao1215/hurrah/config"
+)
+
+func TestExtAuthz(t *testing.T) {
+	authz := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Header.Get("X-Forwarded-Uri") == "/slow":
+			time.Sleep(200 * time.Millisecond)
+		case r.Header.Get("Authorization") == "Bearer good" && r.Header.Get("X-Forwarded-Method") == http.MethodGet:
+			w.Header().Set("X-User-ID", "alice")
+			w.WriteHeader(http.StatusOK)
+		case r.Header.Get("Authorization") == "Bearer anonymous":
+			w.WriteHeader(http.StatusOK) // The response has no X-User-ID.
+		default:
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte("denied by policy")) // The write error is not important in this test.
+		}
+	}))
+	defer authz.Close()
+
+	var gotUserID string
+	backend := func(_ context.Context, w http.ResponseWriter, r *http.Request) error {
+		gotUserID = r.Header.Get("X-User-ID")
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+	cfg := config.ExtAuthz{
+		URL:             authz.URL,
+		TimeoutMS:       50,
+		Headers:         []string{"Authorization"},
+		UpstreamHeaders: []string{"X-User-ID"},
+		ClientHeaders:   []string{"WWW-Authenticate"},
+	}
+
+	tests := []struct {
+		name          string
+		failureMode   string
+		method        string
+		path          string
+		authorization string
+		wantStatus    int
+		wantUserID    string
+		wantBody      string
+	}{
+		{
+			name:          "allowed with upstream headers",
+			method:        http.MethodGet,
+			path:          "/orders",
+			authorization: "Bearer good",
+			wantStatus:    http.StatusOK,
+			wantUserID:    "alice",
+		},
+		{
+			name:          "spoofed upstream header is removed if the response omits it",
+			method:        http.MethodGet,
+			path:          "/orders",
+			authorization: "Bearer anonymous",
+			wantStatus:    http.StatusOK,
+			wantUserID:    "",
+		},
+		{
+			name:          "denied response is relayed",
+			method:        http.MethodDelete,
+			path:          "/orders",
+			authorization: "Bearer good",
+			wantStatus:    http.StatusUnauthorized,
+			wantBody:      "denied by policy",
+		},
+		{
+			name:          "timeout fails closed",
+			method:        http.MethodGet,
+			path:          "/slow",
+			authorization: "Bearer good",
+			wantStatus:    http.StatusForbidden,
+		},
+		{
+			name:          "timeout fails open",
+			failureMode:   "open",
+			method:        http.MethodGet,
+			path:          "/slow",
+			authorization: "Bearer good",
+			wantStatus:    http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotUserID = ""
+			c := cfg
+			c.FailureMode = tt.failureMode
+			m, err := ExtAuthz(c, time.Second)
+			if err != nil {
+				t.Fatalf("ExtAuthz() error = %v", err)
+			}
+
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			req.Header.Set("Authorization", tt.authorization)
+			req.Header.Set("X-User-ID", "spoofed")
+			rec := httptest.NewRecorder()
+			Chain(backend, m).AdaptHandler().ServeHTTP(rec, req)
+
+			if diff := cmp.Diff(tt.wantStatus, rec.Code); diff != "" {
+				t.Errorf("status mismatch (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tt.wantUserID, gotUserID); diff != "" {
+				t.Errorf("upstream header mismatch (-want +got):\n%s", diff)
+			}
+			if tt.wantBody != "" {
+				if diff := cmp.Diff(tt.wantBody, rec.Body.String()); diff != "" {
+					t.Errorf("body mismatch (-want +got):\n%s", diff)
+				}
+				if diff := cmp.Diff("Bearer", rec.Header().Get("WWW-Authenticate")); diff != "" {
+					t.Errorf("client header mismatch (-want +got):\n%s", diff)
+				}
+			}
+		})
+	}
+
+	t.Run("unknown failure mode", func(t *testing.T) {
+		if _, err := ExtAuthz(config.ExtAuthz{URL: authz.URL, FailureMode: "maybe"}, time.Second); err == nil {
+			t.Error("ExtAuthz() error = nil, want error")
+		}
+	})
+}
@@ -0,0 +1,156 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// gRPC status codes. See https://grpc.github.io/grpc/core/md_doc_statuscodes.html
+const (
+	grpcCodeOK                 = 0
+	grpcCodeCanceled           = 1
+	grpcCodeUnknown            = 2
+	grpcCodeInvalidArgument    = 3
+	grpcCodeDeadlineExceeded   = 4
+	grpcCodeNotFound           = 5
+	grpcCodeAlreadyExists      = 6
+	grpcCodePermissionDenied   = 7
+	grpcCodeResourceExhausted  = 8
+	grpcCodeFailedPrecondition = 9
+	grpcCodeAborted            = 10
+	grpcCodeOutOfRange         = 11
+	grpcCodeUnimplemented      = 12
+	grpcCodeInternal           = 13
+	grpcCodeUnavailable        = 14
+	grpcCodeUnauthenticated    = 16
+)
+
+// statusClientClosedRequest is the de facto HTTP status of canceled requests.
+const statusClientClosedRequest = 499
+
+// GRPCErrors is a middleware for gRPC routes that writes the errors of the
+// following middlewares as gRPC status instead of problem details JSON, so that
+// gRPC clients get, e.g., UNAUTHENTICATED instead of an HTTP status they cannot read.
+// The errors of other requests, e.g., JSON requests of grpc_transcoding, are
+// returned as they are.
+func GRPCErrors(next HandlerWithCtx) HandlerWithCtx {
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+		err := next(ctx, w, r)
+		if err == nil || !isGRPCRequest(r) {
+			return err
+		}
+		WriteGRPCError(w, err)
+		return nil
+	}
+}
+
+// isGRPCRequest returns true if the request is gRPC or gRPC-Web.
+func isGRPCRequest(r *http.Request) bool {
+	return strings.HasPrefix(strings.ToLower(r.Header.Get("Content-Type")), "application/grpc")
+}
+
+// WriteGRPCError writes the error as a Trailers-Only gRPC response: HTTP 200 with
+// the grpc-status and grpc-message headers. The status of an *Error is converted
+// to the gRPC status code, and other errors are logged and written as INTERNAL.
+func WriteGRPCError(w http.ResponseWriter, err error) {
+	code, message := grpcCodeInternal, "internal error"
+	var e *Error
+	if errors.As(err, &e) {
+		code, message = grpcCode(e.Status), e.Detail
+	} else {
+		slog.Error("middleware: failed to handle the gRPC request", slog.String("error", err.Error()))
+	}
+
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", "application/grpc")
+	h.Set("Grpc-Status", strconv.Itoa(code))
+	h.Set("Grpc-Message", encodeGRPCMessage(message))
+	w.WriteHeader(http.StatusOK)
+}
+
+// grpcCode converts the HTTP status written by the gateway to the gRPC status code.
+func grpcCode(status int) int {
+	switch status {
+	case http.StatusBadRequest, http.StatusRequestURITooLong, http.StatusRequestHeaderFieldsTooLarge, http.StatusUnsupportedMediaType:
+		return grpcCodeInvalidArgument
+	case http.StatusUnauthorized:
+		return grpcCodeUnauthenticated
+	case http.StatusForbidden:
+		return grpcCodePermissionDenied
+	case http.StatusNotFound:
+		return grpcCodeNotFound
+	case http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		return grpcCodeUnimplemented
+	case http.StatusRequestEntityTooLarge, http.StatusTooManyRequests:
+		return grpcCodeResourceExhausted
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		return grpcCodeUnavailable
+	case http.StatusGatewayTimeout:
+		return grpcCodeDeadlineExceeded
+	case http.StatusInternalServerError:
+		return grpcCodeInternal
+	default:
+		return grpcCodeUnknown
+	}
+}
+
+// httpStatus converts the gRPC status code of the backend to the HTTP status.
+func httpStatus(code int) int {
+	switch code {
+	case grpcCodeOK:
+		return http.StatusOK
+	case grpcCodeCanceled:
+		return statusClientClosedRequest
+	case grpcCodeInvalidArgument, grpcCodeFailedPrecondition, grpcCodeOutOfRange:
+		return http.StatusBadRequest
+	case grpcCodeDeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case grpcCodeNotFound:
+		return http.StatusNotFound
+	case grpcCodeAlreadyExists, grpcCodeAborted:
+		return http.StatusConflict
+	case grpcCodePermissionDenied:
+		return http.StatusForbidden
+	case grpcCodeUnauthenticated:
+		return http.StatusUnauthorized
+	case grpcCodeResourceExhausted:
+		return http.StatusTooManyRequests
+	case grpcCodeUnimplemented:
+		return http.StatusNotImplemented
+	case grpcCodeUnavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// encodeGRPCMessage percent-encodes the message as the grpc-message header requires.
+func encodeGRPCMessage(message string) string {
+	var b strings.Builder
+	for i := 0; i < len(message); i++ {
+		c := message[i]
+		if c >= ' ' && c <= '~' && c != '%' {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+// decodeGRPCMessage decodes the percent-encoded grpc-message header. The message
+// is returned as it is if it is not encoded correctly.
+func decodeGRPCMessage(message string) string {
+	decoded, err := url.PathUnescape(message)
+	if err != nil {
+		return message
+	}
+	return decoded
+}
@@ -0,0 +1,88 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestGRPCErrors(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		err        error
+		wantHeader http.Header
+	}{
+		{
+			name: "gateway error",
+			err:  NewError(http.StatusTooManyRequests, "rate limit exceeded: 100%"),
+			wantHeader: http.Header{
+				"Content-Type": {"application/grpc"},
+				"Grpc-Status":  {"8"},
+				"Grpc-Message": {"rate limit exceeded: 100%25"},
+			},
+		},
+		{
+			name: "non-ASCII message",
+			err:  NewError(http.StatusUnauthorized, "トークン"),
+			wantHeader: http.Header{
+				"Content-Type": {"application/grpc"},
+				"Grpc-Status":  {"16"},
+				"Grpc-Message": {"%E3%83%88%E3%83%BC%E3%82%AF%E3%83%B3"},
+			},
+		},
+		{
+			name: "unexpected error",
+			err:  errors.New("boom"),
+			wantHeader: http.Header{
+				"Content-Type": {"application/grpc"},
+				"Grpc-Status":  {"13"},
+				"Grpc-Message": {"internal error"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			failing := func(_ context.Context, _ http.ResponseWriter, _ *http.Request) error {
+				return tt.err
+			}
+			req := httptest.NewRequest(http.MethodPost, "/helloworld.Greeter/SayHello", nil)
+			req.Header.Set("Content-Type", "application/grpc")
+			rec := httptest.NewRecorder()
+			Chain(failing, GRPCErrors).AdaptHandler().ServeHTTP(rec, req)
+
+			if diff := cmp.Diff(http.StatusOK, rec.Code); diff != "" {
+				t.Errorf("status mismatch (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tt.wantHeader, rec.Header()); diff != "" {
+				t.Errorf("header mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestGRPCErrors_notGRPC(t *testing.T) {
+	t.Parallel()
+
+	failing := func(_ context.Context, _ http.ResponseWriter, _ *http.Request) error {
+		return NewError(http.StatusNotFound, "no gRPC method is bound to the path")
+	}
+	req := httptest.NewRequest(http.MethodGet, "/v1/greeting", nil)
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	Chain(failing, GRPCErrors).AdaptHandler().ServeHTTP(rec, req)
+
+	if diff := cmp.Diff(http.StatusNotFound, rec.Code); diff != "" {
+		t.Errorf("status mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff("application/problem+json", rec.Header().Get("Content-Type")); diff != "" {
+		t.Errorf("Content-Type mismatch (-want +got):\n%s", diff)
+	}
+}
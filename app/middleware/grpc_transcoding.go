@@ -0,0 +1,596 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/nao1215/hurrah/config"
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// defaultGRPCTranscodingMaxBytes is the default maximum size of the JSON request
+// body and the gRPC response, the same as the default message size limit of gRPC.
+const defaultGRPCTranscodingMaxBytes = 4 << 20
+
+// grpcTranscodingMarshalOptions is the options of the JSON responses. The fields
+// with the default values are written, so that REST clients always find them.
+var grpcTranscodingMarshalOptions = protojson.MarshalOptions{EmitUnpopulated: true}
+
+// grpcBinding is a binding of an HTTP method and path to a gRPC method.
+type grpcBinding struct {
+	httpMethod   string
+	template     *pathTemplate
+	method       protoreflect.MethodDescriptor
+	grpcPath     string // grpcPath is the path of the gRPC method. e.g., /helloworld.Greeter/SayHello
+	body         string // body is "*", the field of the request message the body is bound to, or "" if the body is not used.
+	responseBody string // responseBody is the field of the response message written as the body, or "" for the whole message.
+	// boundFields is the fields bound to the path variables and the body, which
+	// query parameters cannot set. e.g., ["name", "book.id"]
+	boundFields []string
+}
+
+// grpcTranscoding transcodes JSON/REST requests to gRPC.
+type grpcTranscoding struct {
+	bindings         []*grpcBinding
+	maxBodyBytes     int64 // maxBodyBytes is the maximum size of the JSON request body.
+	maxResponseBytes int64 // maxResponseBytes is the maximum size of the gRPC response buffered to transcode it.
+}
+
+// GRPCTranscoding is a middleware for gRPC routes that exposes the unary gRPC
+// methods annotated with google.api.http in the descriptor set as JSON/REST
+// endpoints. The path variables, query parameters and body of a request are
+// transcoded to the request message, and the response message is written as
+// JSON. The gRPC status of the backend is converted to the HTTP status, e.g.,
+// NOT_FOUND to 404, and written as problem details JSON. Request bodies larger
+// than max_body_bytes get 413, and responses larger than max_response_bytes get
+// 502. gRPC and gRPC-Web requests are forwarded as they are.
+func GRPCTranscoding(cfg config.GRPCTranscoding) (Middleware, error) {
+	services, err := loadGRPCServices(cfg)
+	if err != nil {
+		return nil, err
+	}
+	t := &grpcTranscoding{maxBodyBytes: cfg.MaxBodyBytes, maxResponseBytes: cfg.MaxResponseBytes}
+	if t.maxBodyBytes <= 0 {
+		t.maxBodyBytes = defaultGRPCTranscodingMaxBytes
+	}
+	if t.maxResponseBytes <= 0 {
+		t.maxResponseBytes = defaultGRPCTranscodingMaxBytes
+	}
+	for _, service := range services {
+		methods := service.Methods()
+		for i := range methods.Len() {
+			bindings, err := newGRPCBindings(methods.Get(i))
+			if err != nil {
+				return nil, err
+			}
+			t.bindings = append(t.bindings, bindings...)
+		}
+	}
+	if len(t.bindings) == 0 {
+		return nil, fmt.Errorf("middleware: no methods have the google.api.http annotation in %s", cfg.DescriptorSet)
+	}
+	return t.handle, nil
+}
+
+// loadGRPCServices loads the services of the descriptor set. If services are not
+// set, all services in the descriptor set are returned.
+func loadGRPCServices(cfg config.GRPCTranscoding) ([]protoreflect.ServiceDescriptor, error) {
+	if cfg.DescriptorSet == "" {
+		return nil, errors.New("middleware: grpc_transcoding requires descriptor_set")
+	}
+	data, err := os.ReadFile(cfg.DescriptorSet)
+	if err != nil {
+		return nil, fmt.Errorf("middleware: failed to read the descriptor set: %w", err)
+	}
+	set := &descriptorpb.FileDescriptorSet{}
+	if err := proto.Unmarshal(data, set); err != nil {
+		return nil, fmt.Errorf("middleware: failed to parse the descriptor set %s: %w", cfg.DescriptorSet, err)
+	}
+	files, err := protodesc.NewFiles(set)
+	if err != nil {
+		return nil, fmt.Errorf("middleware: invalid descriptor set %s (build it with --include_imports): %w", cfg.DescriptorSet, err)
+	}
+
+	var services []protoreflect.ServiceDescriptor
+	if len(cfg.Services) == 0 {
+		files.RangeFiles(func(file protoreflect.FileDescriptor) bool {
+			for i := range file.Services().Len() {
+				services = append(services, file.Services().Get(i))
+			}
+			return true
+		})
+		return services, nil
+	}
+	for _, name := range cfg.Services {
+		d, err := files.FindDescriptorByName(protoreflect.FullName(name))
+		if errors.Is(err, protoregistry.NotFound) {
+			return nil, fmt.Errorf("middleware: service %s is not in the descriptor set %s", name, cfg.DescriptorSet)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("middleware: failed to find service %s: %w", name, err)
+		}
+		service, ok := d.(protoreflect.ServiceDescriptor)
+		if !ok {
+			return nil, fmt.Errorf("middleware: %s is not a service", name)
+		}
+		services = append(services, service)
+	}
+	return services, nil
+}
+
+// newGRPCBindings creates the bindings of the google.api.http annotation of the
+// method, including the additional bindings. Streaming methods are not supported
+// and skipped.
+func newGRPCBindings(method protoreflect.MethodDescriptor) ([]*grpcBinding, error) {
+	options, ok := method.Options().(*descriptorpb.MethodOptions)
+	if !ok || !proto.HasExtension(options, annotations.E_Http) {
+		return nil, nil
+	}
+	if method.IsStreamingClient() || method.IsStreamingServer() {
+		slog.Warn("middleware: streaming methods are not transcoded", slog.String("method", string(method.FullName())))
+		return nil, nil
+	}
+	rule, ok := proto.GetExtension(options, annotations.E_Http).(*annotations.HttpRule)
+	if !ok {
+		return nil, fmt.Errorf("middleware: invalid google.api.http annotation of %s", method.FullName())
+	}
+
+	rules := append([]*annotations.HttpRule{rule}, rule.GetAdditionalBindings()...)
+	bindings := make([]*grpcBinding, 0, len(rules))
+	for _, rule := range rules {
+		b, err := newGRPCBinding(method, rule)
+		if err != nil {
+			return nil, fmt.Errorf("middleware: invalid google.api.http annotation of %s: %w", method.FullName(), err)
+		}
+		bindings = append(bindings, b)
+	}
+	return bindings, nil
+}
+
+// newGRPCBinding creates a binding of the HTTP rule.
+func newGRPCBinding(method protoreflect.MethodDescriptor, rule *annotations.HttpRule) (*grpcBinding, error) {
+	var httpMethod, path string
+	switch pattern := rule.GetPattern().(type) {
+	case *annotations.HttpRule_Get:
+		httpMethod, path = http.MethodGet, pattern.Get
+	case *annotations.HttpRule_Put:
+		httpMethod, path = http.MethodPut, pattern.Put
+	case *annotations.HttpRule_Post:
+		httpMethod, path = http.MethodPost, pattern.Post
+	case *annotations.HttpRule_Delete:
+		httpMethod, path = http.MethodDelete, pattern.Delete
+	case *annotations.HttpRule_Patch:
+		httpMethod, path = http.MethodPatch, pattern.Patch
+	case *annotations.HttpRule_Custom:
+		httpMethod, path = pattern.Custom.GetKind(), pattern.Custom.GetPath()
+	default:
+		return nil, errors.New("no HTTP method")
+	}
+	template, err := parsePathTemplate(path)
+	if err != nil {
+		return nil, err
+	}
+	var boundFields []string
+	for _, v := range template.variables {
+		bound, err := protoFieldPath(method.Input(), v.fieldPath)
+		if err != nil {
+			return nil, err
+		}
+		boundFields = append(boundFields, bound)
+	}
+	if body := rule.GetBody(); body != "" && body != "*" {
+		bound, err := protoFieldPath(method.Input(), []string{body})
+		if err != nil {
+			return nil, err
+		}
+		boundFields = append(boundFields, bound)
+	}
+	if responseBody := rule.GetResponseBody(); responseBody != "" {
+		if _, err := findFieldPath(method.Output(), []string{responseBody}); err != nil {
+			return nil, err
+		}
+	}
+	return &grpcBinding{
+		httpMethod:   httpMethod,
+		template:     template,
+		method:       method,
+		grpcPath:     fmt.Sprintf("/%s/%s", method.Parent().FullName(), method.Name()),
+		body:         rule.GetBody(),
+		responseBody: rule.GetResponseBody(),
+		boundFields:  boundFields,
+	}, nil
+}
+
+// handle transcodes the request of the binding that matches the method and path.
+func (t *grpcTranscoding) handle(next HandlerWithCtx) HandlerWithCtx {
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+		if isGRPCRequest(r) {
+			return next(ctx, w, r)
+		}
+		var allowed []string
+		for _, b := range t.bindings {
+			values, ok := b.template.match(r.URL.EscapedPath())
+			if !ok {
+				continue
+			}
+			if b.httpMethod != r.Method {
+				allowed = append(allowed, b.httpMethod)
+				continue
+			}
+			if b.body != "" && hasBody(r) {
+				if r.ContentLength > t.maxBodyBytes {
+					return NewError(http.StatusRequestEntityTooLarge, fmt.Sprintf("request body exceeds %d bytes", t.maxBodyBytes))
+				}
+				r.Body = http.MaxBytesReader(w, r.Body, t.maxBodyBytes)
+			}
+			return b.transcode(ctx, w, r, values, next, t.maxResponseBytes)
+		}
+		if len(allowed) > 0 {
+			w.Header().Set("Allow", strings.Join(slices.Compact(slices.Sorted(slices.Values(allowed))), ", "))
+			return NewError(http.StatusMethodNotAllowed, fmt.Sprintf("method %s is not allowed", r.Method))
+		}
+		return NewError(http.StatusNotFound, "no gRPC method is bound to the path")
+	}
+}
+
+// transcode sends the request to the gRPC method and writes the response as JSON.
+// The response larger than maxResponseBytes is not buffered and gets 502.
+func (b *grpcBinding) transcode(ctx context.Context, w http.ResponseWriter, r *http.Request, values []string, next HandlerWithCtx, maxResponseBytes int64) error {
+	message, err := b.newRequestMessage(r, values)
+	if err != nil {
+		return err
+	}
+	payload, err := proto.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("middleware: failed to marshal the gRPC request: %w", err)
+	}
+	frame := make([]byte, 5, 5+len(payload))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(payload))) //nolint:gosec // A message is smaller than 4 GiB.
+	frame = append(frame, payload...)
+
+	grpcReq := r.Clone(ctx)
+	grpcReq.Method = http.MethodPost
+	grpcReq.URL.Path, grpcReq.URL.RawPath, grpcReq.URL.RawQuery = b.grpcPath, "", ""
+	grpcReq.Header.Set("Content-Type", "application/grpc+proto")
+	grpcReq.Header.Set("Te", "trailers")
+	grpcReq.Header.Del("Content-Length")
+	grpcReq.Header.Del("Accept-Encoding")
+	grpcReq.Body = io.NopCloser(bytes.NewReader(frame))
+	grpcReq.ContentLength = int64(len(frame))
+
+	rec := &grpcResponseRecorder{header: make(http.Header), limit: maxResponseBytes}
+	if err := next(ctx, rec, grpcReq); err != nil {
+		return err
+	}
+	if rec.exceeded {
+		slog.Warn("middleware: the gRPC response is too large to transcode", slog.String("method", b.grpcPath), slog.Int64("max_response_bytes", maxResponseBytes))
+		return NewError(http.StatusBadGateway, fmt.Sprintf("gRPC response exceeds %d bytes", maxResponseBytes))
+	}
+	response, err := b.responseJSON(rec)
+	if err != nil {
+		return err
+	}
+
+	h := w.Header()
+	for key, values := range rec.sentHeader {
+		switch {
+		case key == "Content-Type", key == "Content-Length", key == "Trailer", strings.HasPrefix(key, "Grpc-"):
+		default:
+			h[key] = values
+		}
+	}
+	h.Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(response) // The client has gone if it fails.
+	return nil
+}
+
+// newRequestMessage creates the request message from the body, path variables
+// and query parameters of the request, in this order. Query parameters cannot set
+// the fields bound to the path variables or the body.
+func (b *grpcBinding) newRequestMessage(r *http.Request, values []string) (*dynamicpb.Message, error) {
+	message := dynamicpb.NewMessage(b.method.Input())
+	if b.body != "" {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				return nil, NewError(http.StatusRequestEntityTooLarge, fmt.Sprintf("request body exceeds %d bytes", maxBytesErr.Limit))
+			}
+			return nil, NewError(http.StatusBadRequest, "failed to read the request body")
+		}
+		if len(bytes.TrimSpace(body)) > 0 {
+			if err := b.setBody(message, body); err != nil {
+				return nil, NewError(http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+			}
+		}
+	}
+
+	for i, v := range b.template.variables {
+		if err := setField(message, v.fieldPath, []string{values[i]}); err != nil {
+			return nil, NewError(http.StatusBadRequest, fmt.Sprintf("invalid path parameter %s: %v", strings.Join(v.fieldPath, "."), err))
+		}
+	}
+
+	if b.body == "*" {
+		return message, nil
+	}
+	for key, vs := range r.URL.Query() {
+		if b.isBound(strings.Split(key, ".")) {
+			return nil, NewError(http.StatusBadRequest, fmt.Sprintf("invalid query parameter %s: the field is bound to the path or the body", key))
+		}
+		if err := setField(message, strings.Split(key, "."), vs); err != nil {
+			return nil, NewError(http.StatusBadRequest, fmt.Sprintf("invalid query parameter %s: %v", key, err))
+		}
+	}
+	return message, nil
+}
+
+// setBody sets the JSON body to the message, or to the field the body is bound to.
+// The body must be a single JSON value, so that it cannot set other fields.
+func (b *grpcBinding) setBody(message *dynamicpb.Message, body []byte) error {
+	if b.body == "*" {
+		return protojson.Unmarshal(body, message)
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	var value json.RawMessage
+	if err := dec.Decode(&value); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); !errors.Is(err, io.EOF) {
+		return errors.New("the body has more than one JSON value")
+	}
+
+	fd, _ := findFieldPath(b.method.Input(), []string{b.body}) // The field is checked on start.
+	if fd.Kind() == protoreflect.MessageKind && !fd.IsList() && !fd.IsMap() {
+		return protojson.Unmarshal(value, message.Mutable(fd).Message().Interface())
+	}
+	// Repeated, map and scalar fields are set by the JSON object that has only the field.
+	field, err := json.Marshal(map[string]json.RawMessage{fd.JSONName(): value})
+	if err != nil {
+		return err
+	}
+	return protojson.Unmarshal(field, message)
+}
+
+// isBound reports whether the field path is, or is in, a field bound to the path
+// variables or the body. Unknown fields are not bound; setField reports them.
+func (b *grpcBinding) isBound(fieldPath []string) bool {
+	path, err := protoFieldPath(b.method.Input(), fieldPath)
+	if err != nil {
+		return false
+	}
+	for _, bound := range b.boundFields {
+		if path == bound || strings.HasPrefix(path, bound+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// responseJSON converts the recorded gRPC response to JSON. A gRPC status other
+// than OK is returned as an *Error.
+func (b *grpcBinding) responseJSON(rec *grpcResponseRecorder) ([]byte, error) {
+	status := rec.header.Get("Grpc-Status")
+	if status == "" {
+		status = rec.header.Get(http.TrailerPrefix + "Grpc-Status")
+	}
+	code, err := strconv.Atoi(status)
+	if rec.code != http.StatusOK || err != nil {
+		slog.Warn("middleware: the backend did not return a gRPC status", slog.String("method", b.grpcPath), slog.Int("status", rec.code))
+		return nil, NewError(http.StatusBadGateway, "invalid gRPC response from the backend")
+	}
+	if code != grpcCodeOK {
+		message := rec.header.Get("Grpc-Message")
+		if message == "" {
+			message = rec.header.Get(http.TrailerPrefix + "Grpc-Message")
+		}
+		return nil, NewError(httpStatus(code), decodeGRPCMessage(message))
+	}
+
+	body := rec.body.Bytes()
+	if len(body) < 5 || body[0] != 0 || int(binary.BigEndian.Uint32(body[1:5])) != len(body)-5 {
+		slog.Warn("middleware: the backend returned an invalid gRPC message", slog.String("method", b.grpcPath))
+		return nil, NewError(http.StatusBadGateway, "invalid gRPC response from the backend")
+	}
+	message := dynamicpb.NewMessage(b.method.Output())
+	if err := proto.Unmarshal(body[5:], message); err != nil {
+		return nil, NewError(http.StatusBadGateway, "invalid gRPC response from the backend")
+	}
+	response, err := grpcTranscodingMarshalOptions.Marshal(message)
+	if err != nil {
+		return nil, fmt.Errorf("middleware: failed to marshal the gRPC response: %w", err)
+	}
+	if b.responseBody == "" {
+		return response, nil
+	}
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(response, &fields); err != nil {
+		return nil, fmt.Errorf("middleware: failed to read the gRPC response: %w", err)
+	}
+	fd, _ := findFieldPath(b.method.Output(), []string{b.responseBody}) // The field is checked on start.
+	return fields[fd.JSONName()], nil
+}
+
+// findFieldPath finds the field of the message by the field path. The fields are
+// found by the names in the proto file or the JSON names.
+func findFieldPath(md protoreflect.MessageDescriptor, fieldPath []string) (protoreflect.FieldDescriptor, error) {
+	var fd protoreflect.FieldDescriptor
+	for i, name := range fieldPath {
+		if i > 0 {
+			if fd.Kind() != protoreflect.MessageKind || fd.IsList() || fd.IsMap() {
+				return nil, fmt.Errorf("field %s of %s is not a message", fd.Name(), md.FullName())
+			}
+			md = fd.Message()
+		}
+		fd = md.Fields().ByName(protoreflect.Name(name))
+		if fd == nil {
+			fd = md.Fields().ByJSONName(name)
+		}
+		if fd == nil {
+			return nil, fmt.Errorf("%s has no field %s", md.FullName(), name)
+		}
+	}
+	return fd, nil
+}
+
+// protoFieldPath returns the field path with the names in the proto file, so that
+// the paths with the JSON names are compared to them. e.g., "book.author_id"
+func protoFieldPath(md protoreflect.MessageDescriptor, fieldPath []string) (string, error) {
+	names := make([]string, len(fieldPath))
+	for i := range fieldPath {
+		fd, err := findFieldPath(md, fieldPath[:i+1])
+		if err != nil {
+			return "", err
+		}
+		names[i] = string(fd.Name())
+	}
+	return strings.Join(names, "."), nil
+}
+
+// setField sets the values to the field of the message. Repeated fields get all
+// values, and other fields get the last value.
+func setField(message protoreflect.Message, fieldPath []string, values []string) error {
+	fd, err := findFieldPath(message.Descriptor(), fieldPath)
+	if err != nil {
+		return err
+	}
+	for _, name := range fieldPath[:len(fieldPath)-1] {
+		parent, _ := findFieldPath(message.Descriptor(), []string{name}) // The path is found above.
+		message = message.Mutable(parent).Message()
+	}
+	if fd.IsMap() {
+		return fmt.Errorf("map field %s cannot be set from a string", fd.Name())
+	}
+	if fd.IsList() {
+		list := message.Mutable(fd).List()
+		for _, s := range values {
+			v, err := parseFieldValue(fd, s, list.NewElement)
+			if err != nil {
+				return err
+			}
+			list.Append(v)
+		}
+		return nil
+	}
+	v, err := parseFieldValue(fd, values[len(values)-1], func() protoreflect.Value { return message.NewField(fd) })
+	if err != nil {
+		return err
+	}
+	message.Set(fd, v)
+	return nil
+}
+
+// parseFieldValue parses the string as the value of the field. Messages are
+// parsed from the JSON of the well-known types, e.g., "2006-01-02T15:04:05Z" for
+// google.protobuf.Timestamp.
+func parseFieldValue(fd protoreflect.FieldDescriptor, s string, newValue func() protoreflect.Value) (protoreflect.Value, error) {
+	switch fd.Kind() {
+	case protoreflect.StringKind:
+		return protoreflect.ValueOfString(s), nil
+	case protoreflect.BoolKind:
+		v, err := strconv.ParseBool(s)
+		return protoreflect.ValueOfBool(v), err
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		v, err := strconv.ParseInt(s, 10, 32)
+		return protoreflect.ValueOfInt32(int32(v)), err
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		v, err := strconv.ParseInt(s, 10, 64)
+		return protoreflect.ValueOfInt64(v), err
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		v, err := strconv.ParseUint(s, 10, 32)
+		return protoreflect.ValueOfUint32(uint32(v)), err
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		v, err := strconv.ParseUint(s, 10, 64)
+		return protoreflect.ValueOfUint64(v), err
+	case protoreflect.FloatKind:
+		v, err := strconv.ParseFloat(s, 32)
+		return protoreflect.ValueOfFloat32(float32(v)), err
+	case protoreflect.DoubleKind:
+		v, err := strconv.ParseFloat(s, 64)
+		return protoreflect.ValueOfFloat64(v), err
+	case protoreflect.BytesKind:
+		v, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			v, err = base64.URLEncoding.DecodeString(s)
+		}
+		return protoreflect.ValueOfBytes(v), err
+	case protoreflect.EnumKind:
+		if ev := fd.Enum().Values().ByName(protoreflect.Name(s)); ev != nil {
+			return protoreflect.ValueOfEnum(ev.Number()), nil
+		}
+		v, err := strconv.ParseInt(s, 10, 32)
+		return protoreflect.ValueOfEnum(protoreflect.EnumNumber(v)), err
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		v := newValue()
+		quoted, _ := json.Marshal(s) // Marshaling a string does not fail.
+		if err := protojson.Unmarshal(quoted, v.Message().Interface()); err != nil {
+			if err := protojson.Unmarshal([]byte(s), v.Message().Interface()); err != nil {
+				return v, err
+			}
+		}
+		return v, nil
+	default:
+		return protoreflect.Value{}, fmt.Errorf("unsupported field type %s", fd.Kind())
+	}
+}
+
+// grpcResponseRecorder records the gRPC response of the backend to transcode it.
+type grpcResponseRecorder struct {
+	header     http.Header
+	sentHeader http.Header // sentHeader is the header when WriteHeader is called, without the trailers.
+	code       int
+	body       bytes.Buffer
+	limit      int64 // limit is the maximum size of the body.
+	exceeded   bool  // exceeded is whether the body is larger than the limit. The rest of the body is discarded.
+}
+
+// Header returns the header. The trailers are set to it after the body.
+func (r *grpcResponseRecorder) Header() http.Header {
+	return r.header
+}
+
+// WriteHeader records the status code and the header.
+func (r *grpcResponseRecorder) WriteHeader(code int) {
+	if r.code != 0 {
+		return
+	}
+	r.code = code
+	r.sentHeader = r.header.Clone()
+}
+
+// Write records the body.
+func (r *grpcResponseRecorder) Write(p []byte) (int, error) {
+	if r.code == 0 {
+		r.WriteHeader(http.StatusOK)
+	}
+	if r.exceeded || int64(r.body.Len()+len(p)) > r.limit {
+		// The write succeeds so that the proxy does not abort the client connection.
+		r.exceeded = true
+		r.body.Reset()
+		return len(p), nil
+	}
+	return r.body.Write(p)
+}
+
+// Flush does nothing; the response is written after it is transcoded.
+func (r *grpcResponseRecorder) Flush() {}
@@ -0,0 +1,146 @@
+package middleware
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// pathTemplate is a path template of the google.api.http annotation.
+// e.g., /v1/{name=shelves/*/books/*}:publish
+// See https://github.com/googleapis/googleapis/blob/master/google/api/http.proto
+type pathTemplate struct {
+	segments  []string       // segments is the literals, "*" (one segment) and "**" (the rest of the path).
+	verb      string         // verb is the custom verb after ":" at the end of the path.
+	variables []pathVariable // variables is the fields bound to the segments.
+}
+
+// pathVariable is a variable of a path template.
+type pathVariable struct {
+	fieldPath  []string // fieldPath is the field of the request message. e.g., [book, name]
+	start, end int      // start and end is the range of the segments the variable is bound to.
+}
+
+// parsePathTemplate parses a path template of the google.api.http annotation.
+func parsePathTemplate(template string) (*pathTemplate, error) {
+	if !strings.HasPrefix(template, "/") {
+		return nil, fmt.Errorf("path template %q must start with /", template)
+	}
+	t := &pathTemplate{}
+	rest := template[1:]
+	if i := strings.LastIndex(rest, ":"); i >= 0 && i > strings.LastIndex(rest, "/") && i > strings.LastIndex(rest, "}") {
+		rest, t.verb = rest[:i], rest[i+1:]
+	}
+
+	for _, token := range splitPathTemplate(rest) {
+		if !strings.HasPrefix(token, "{") {
+			if err := t.addSegment(token, template); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		fieldPath, segments, ok := strings.Cut(strings.TrimSuffix(token[1:], "}"), "=")
+		if !ok {
+			segments = "*"
+		}
+		if !strings.HasSuffix(token, "}") || fieldPath == "" || strings.ContainsAny(fieldPath, "{}") {
+			return nil, fmt.Errorf("invalid variable %q in path template %q", token, template)
+		}
+		variable := pathVariable{fieldPath: strings.Split(fieldPath, "."), start: len(t.segments)}
+		for _, segment := range strings.Split(segments, "/") {
+			if err := t.addSegment(segment, template); err != nil {
+				return nil, err
+			}
+		}
+		variable.end = len(t.segments)
+		t.variables = append(t.variables, variable)
+	}
+	if len(t.segments) == 0 {
+		return nil, fmt.Errorf("path template %q has no segments", template)
+	}
+	return t, nil
+}
+
+// splitPathTemplate splits the path template by "/" outside the variables.
+func splitPathTemplate(template string) []string {
+	var tokens []string
+	depth, start := 0, 0
+	for i, c := range template {
+		switch c {
+		case '{':
+			depth++
+		case '}':
+			depth--
+		case '/':
+			if depth == 0 {
+				tokens = append(tokens, template[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(tokens, template[start:])
+}
+
+// addSegment adds a segment of the path template. "**" must be the last segment.
+func (t *pathTemplate) addSegment(segment, template string) error {
+	if segment == "" || strings.ContainsAny(segment, "{}=") {
+		return fmt.Errorf("invalid segment %q in path template %q", segment, template)
+	}
+	if len(t.segments) > 0 && t.segments[len(t.segments)-1] == "**" {
+		return fmt.Errorf("** must be the last segment in path template %q", template)
+	}
+	t.segments = append(t.segments, segment)
+	return nil
+}
+
+// match matches the escaped path against the template. It returns the values of
+// the variables, or false if the path does not match.
+func (t *pathTemplate) match(path string) ([]string, bool) {
+	if t.verb != "" {
+		var ok bool
+		if path, ok = strings.CutSuffix(path, ":"+t.verb); !ok {
+			return nil, false
+		}
+	}
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	decoded := make([]string, len(parts))
+	for i, part := range parts {
+		s, err := url.PathUnescape(part)
+		if err != nil {
+			return nil, false
+		}
+		decoded[i] = s
+	}
+
+	last := len(t.segments) - 1
+	if t.segments[last] == "**" {
+		if len(parts) < last {
+			return nil, false
+		}
+	} else if len(parts) != len(t.segments) {
+		return nil, false
+	}
+	for i, segment := range t.segments {
+		switch segment {
+		case "**": // It is the last segment and matches zero or more segments.
+		case "*":
+			if decoded[i] == "" {
+				return nil, false
+			}
+		default:
+			if decoded[i] != segment {
+				return nil, false
+			}
+		}
+	}
+
+	values := make([]string, len(t.variables))
+	for i, v := range t.variables {
+		end := v.end
+		if t.segments[end-1] == "**" {
+			end = len(decoded)
+		}
+		values[i] = strings.Join(decoded[v.start:end], "/")
+	}
+	return values, true
+}
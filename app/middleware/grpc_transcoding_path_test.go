@@ -0,0 +1,65 @@
+package middleware
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestPathTemplate_match(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		template   string
+		path       string
+		wantValues []string
+		wantMatch  bool
+	}{
+		{name: "literal", template: "/v1/health", path: "/v1/health", wantValues: []string{}, wantMatch: true},
+		{name: "variable", template: "/v1/users/{id}", path: "/v1/users/42", wantValues: []string{"42"}, wantMatch: true},
+		{name: "escaped variable", template: "/v1/users/{id}", path: "/v1/users/a%2Fb", wantValues: []string{"a/b"}, wantMatch: true},
+		{name: "nested field", template: "/v1/{book.name=shelves/*/books/*}", path: "/v1/shelves/1/books/2", wantValues: []string{"shelves/1/books/2"}, wantMatch: true},
+		{name: "double wildcard", template: "/v1/files/{path=**}", path: "/v1/files/a/b/c", wantValues: []string{"a/b/c"}, wantMatch: true},
+		{name: "double wildcard matches no segments", template: "/v1/files/{path=**}", path: "/v1/files", wantValues: []string{""}, wantMatch: true},
+		{name: "verb", template: "/v1/{name=operations/*}:cancel", path: "/v1/operations/7:cancel", wantValues: []string{"operations/7"}, wantMatch: true},
+		{name: "missing verb", template: "/v1/{name=operations/*}:cancel", path: "/v1/operations/7", wantMatch: false},
+		{name: "different literal", template: "/v1/users/{id}", path: "/v2/users/42", wantMatch: false},
+		{name: "empty segment", template: "/v1/users/{id}", path: "/v1/users/", wantMatch: false},
+		{name: "too many segments", template: "/v1/users/{id}", path: "/v1/users/42/posts", wantMatch: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			template, err := parsePathTemplate(tt.template)
+			if err != nil {
+				t.Fatalf("parsePathTemplate() error = %v", err)
+			}
+			values, ok := template.match(tt.path)
+			if ok != tt.wantMatch {
+				t.Fatalf("match() = %v, want %v", ok, tt.wantMatch)
+			}
+			if diff := cmp.Diff(tt.wantValues, values); diff != "" {
+				t.Errorf("values mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParsePathTemplate_invalid(t *testing.T) {
+	t.Parallel()
+
+	for _, template := range []string{
+		"v1/users",
+		"/v1//users",
+		"/v1/{id",
+		"/v1/{=*}",
+		"/v1/{path=**}/children",
+		"/v1/users{id}",
+	} {
+		if _, err := parsePathTemplate(template); err == nil {
+			t.Errorf("parsePathTemplate(%q) error = nil, want error", template)
+		}
+	}
+}
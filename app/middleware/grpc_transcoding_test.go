@@ -0,0 +1,325 @@
+package middleware
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/nao1215/hurrah/config"
+	"google.golang.org/genproto/googleapis/api/annotations"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// writeHealthDescriptorSet writes the descriptor set of the gRPC health service
+// with the google.api.http annotations of the methods.
+func writeHealthDescriptorSet(t *testing.T, rules map[string]*annotations.HttpRule) string {
+	t.Helper()
+
+	file := protodesc.ToFileDescriptorProto(healthpb.File_grpc_health_v1_health_proto)
+	for _, method := range file.GetService()[0].GetMethod() {
+		if rule, ok := rules[method.GetName()]; ok {
+			method.Options = &descriptorpb.MethodOptions{}
+			proto.SetExtension(method.Options, annotations.E_Http, rule)
+		}
+	}
+	data, err := proto.Marshal(&descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{file}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "health.pb")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// healthBackend is a gRPC health service for the tests. Only "greeter" is serving.
+func healthBackend(_ context.Context, w http.ResponseWriter, r *http.Request) error {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	req := &healthpb.HealthCheckRequest{}
+	if r.URL.Path != "/grpc.health.v1.Health/Check" || r.Header.Get("Content-Type") != "application/grpc+proto" || len(body) < 5 {
+		return NewError(http.StatusNotImplemented, "unexpected request")
+	}
+	if err := proto.Unmarshal(body[5:], req); err != nil {
+		return err
+	}
+	if req.GetService() != "greeter" {
+		WriteGRPCError(w, NewError(http.StatusNotFound, "unknown service "+req.GetService()))
+		return nil
+	}
+
+	resp, err := proto.Marshal(&healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVING})
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status")
+	w.Header().Set("X-Request-Id", "req-1")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(binary.BigEndian.AppendUint32([]byte{0}, uint32(len(resp)))) //nolint:gosec // The message is small.
+	_, _ = w.Write(resp)
+	w.Header().Set("Grpc-Status", "0")
+	return nil
+}
+
+func TestGRPCTranscoding(t *testing.T) {
+	t.Parallel()
+
+	descriptorSet := writeHealthDescriptorSet(t, map[string]*annotations.HttpRule{
+		"Check": {
+			Pattern: &annotations.HttpRule_Get{Get: "/v1/health/{service}"},
+			AdditionalBindings: []*annotations.HttpRule{
+				{Pattern: &annotations.HttpRule_Post{Post: "/v1/health:check"}, Body: "*"},
+				{Pattern: &annotations.HttpRule_Post{Post: "/v1/health/service:check"}, Body: "service"},
+				{Pattern: &annotations.HttpRule_Get{Get: "/v1/health"}},
+				{Pattern: &annotations.HttpRule_Get{Get: "/v1/health/{service}/status"}, ResponseBody: "status"},
+				{Pattern: &annotations.HttpRule_Get{Get: "/v1/services/{service=**}"}},
+			},
+		},
+		"Watch": {Pattern: &annotations.HttpRule_Get{Get: "/v1/health/{service}:watch"}},
+	})
+	m, err := GRPCTranscoding(config.GRPCTranscoding{DescriptorSet: descriptorSet})
+	if err != nil {
+		t.Fatalf("GRPCTranscoding() error = %v", err)
+	}
+	h := Chain(healthBackend, GRPCErrors, m).AdaptHandler()
+
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		body       string
+		wantStatus int
+		wantBody   any
+	}{
+		{
+			name:       "path variable",
+			method:     http.MethodGet,
+			target:     "/v1/health/greeter",
+			wantStatus: http.StatusOK,
+			wantBody:   map[string]any{"status": "SERVING"},
+		},
+		{
+			name:       "body",
+			method:     http.MethodPost,
+			target:     "/v1/health:check",
+			body:       `{"service": "greeter"}`,
+			wantStatus: http.StatusOK,
+			wantBody:   map[string]any{"status": "SERVING"},
+		},
+		{
+			name:       "body bound to a field",
+			method:     http.MethodPost,
+			target:     "/v1/health/service:check",
+			body:       `"greeter"`,
+			wantStatus: http.StatusOK,
+			wantBody:   map[string]any{"status": "SERVING"},
+		},
+		{
+			name:       "body bound to a field has another field",
+			method:     http.MethodPost,
+			target:     "/v1/health/service:check",
+			body:       `"other", "service": "greeter"`,
+			wantStatus: http.StatusBadRequest,
+			wantBody:   map[string]any{"type": "about:blank", "title": "Bad Request", "status": float64(http.StatusBadRequest), "detail": "invalid request body: the body has more than one JSON value"},
+		},
+		{
+			name:       "query parameter overrides a path variable",
+			method:     http.MethodGet,
+			target:     "/v1/health/greeter?service=other",
+			wantStatus: http.StatusBadRequest,
+			wantBody:   map[string]any{"type": "about:blank", "title": "Bad Request", "status": float64(http.StatusBadRequest), "detail": "invalid query parameter service: the field is bound to the path or the body"},
+		},
+		{
+			name:       "query parameter overrides the body",
+			method:     http.MethodPost,
+			target:     "/v1/health/service:check?service=other",
+			body:       `"greeter"`,
+			wantStatus: http.StatusBadRequest,
+			wantBody:   map[string]any{"type": "about:blank", "title": "Bad Request", "status": float64(http.StatusBadRequest), "detail": "invalid query parameter service: the field is bound to the path or the body"},
+		},
+		{
+			name:       "query parameter",
+			method:     http.MethodGet,
+			target:     "/v1/health?service=greeter",
+			wantStatus: http.StatusOK,
+			wantBody:   map[string]any{"status": "SERVING"},
+		},
+		{
+			name:       "response body",
+			method:     http.MethodGet,
+			target:     "/v1/health/greeter/status",
+			wantStatus: http.StatusOK,
+			wantBody:   "SERVING",
+		},
+		{
+			name:       "gRPC status is converted to HTTP status",
+			method:     http.MethodGet,
+			target:     "/v1/services/a%2Fb/c",
+			wantStatus: http.StatusNotFound,
+			wantBody:   map[string]any{"type": "about:blank", "title": "Not Found", "status": float64(http.StatusNotFound), "detail": "unknown service a/b/c"},
+		},
+		{
+			name:       "method not allowed",
+			method:     http.MethodDelete,
+			target:     "/v1/health/greeter",
+			wantStatus: http.StatusMethodNotAllowed,
+			wantBody:   map[string]any{"type": "about:blank", "title": "Method Not Allowed", "status": float64(http.StatusMethodNotAllowed), "detail": "method DELETE is not allowed"},
+		},
+		{
+			name:       "no binding",
+			method:     http.MethodGet,
+			target:     "/v2/health",
+			wantStatus: http.StatusNotFound,
+			wantBody:   map[string]any{"type": "about:blank", "title": "Not Found", "status": float64(http.StatusNotFound), "detail": "no gRPC method is bound to the path"},
+		},
+		{
+			name:       "unknown query parameter",
+			method:     http.MethodGet,
+			target:     "/v1/health?name=greeter",
+			wantStatus: http.StatusBadRequest,
+			wantBody:   map[string]any{"type": "about:blank", "title": "Bad Request", "status": float64(http.StatusBadRequest), "detail": "invalid query parameter name: grpc.health.v1.HealthCheckRequest has no field name"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if diff := cmp.Diff(tt.wantStatus, rec.Code); diff != "" {
+				t.Errorf("status mismatch (-want +got):\n%s", diff)
+			}
+			var got any
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatalf("failed to decode the body %q: %v", rec.Body.String(), err)
+			}
+			if diff := cmp.Diff(tt.wantBody, got); diff != "" {
+				t.Errorf("body mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	t.Run("headers", func(t *testing.T) {
+		t.Parallel()
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/health/greeter", nil))
+
+		want := http.Header{"Content-Type": {"application/json"}, "X-Request-Id": {"req-1"}}
+		if diff := cmp.Diff(want, rec.Header()); diff != "" {
+			t.Errorf("header mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("invalid body", func(t *testing.T) {
+		t.Parallel()
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/health:check", strings.NewReader(`{"service": 1`)))
+
+		if diff := cmp.Diff(http.StatusBadRequest, rec.Code); diff != "" {
+			t.Errorf("status mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("body over max_body_bytes", func(t *testing.T) {
+		t.Parallel()
+
+		m, err := GRPCTranscoding(config.GRPCTranscoding{DescriptorSet: descriptorSet, MaxBodyBytes: 8})
+		if err != nil {
+			t.Fatalf("GRPCTranscoding() error = %v", err)
+		}
+		h := Chain(healthBackend, GRPCErrors, m).AdaptHandler()
+		for _, contentLength := range []int64{22, -1} {
+			req := httptest.NewRequest(http.MethodPost, "/v1/health:check", strings.NewReader(`{"service": "greeter"}`))
+			req.ContentLength = contentLength
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if diff := cmp.Diff(http.StatusRequestEntityTooLarge, rec.Code); diff != "" {
+				t.Errorf("status with Content-Length %d mismatch (-want +got):\n%s", contentLength, diff)
+			}
+		}
+	})
+
+	t.Run("response over max_response_bytes", func(t *testing.T) {
+		t.Parallel()
+
+		m, err := GRPCTranscoding(config.GRPCTranscoding{DescriptorSet: descriptorSet, MaxResponseBytes: 4})
+		if err != nil {
+			t.Fatalf("GRPCTranscoding() error = %v", err)
+		}
+		rec := httptest.NewRecorder()
+		Chain(healthBackend, GRPCErrors, m).AdaptHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/health/greeter", nil))
+
+		if diff := cmp.Diff(http.StatusBadGateway, rec.Code); diff != "" {
+			t.Errorf("status mismatch (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestGRPCTranscoding_invalid(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		cfg  func(t *testing.T) config.GRPCTranscoding
+	}{
+		{
+			name: "descriptor set does not exist",
+			cfg: func(t *testing.T) config.GRPCTranscoding {
+				return config.GRPCTranscoding{DescriptorSet: filepath.Join(t.TempDir(), "missing.pb")}
+			},
+		},
+		{
+			name: "no annotations",
+			cfg: func(t *testing.T) config.GRPCTranscoding {
+				return config.GRPCTranscoding{DescriptorSet: writeHealthDescriptorSet(t, nil)}
+			},
+		},
+		{
+			name: "unknown service",
+			cfg: func(t *testing.T) config.GRPCTranscoding {
+				return config.GRPCTranscoding{
+					DescriptorSet: writeHealthDescriptorSet(t, map[string]*annotations.HttpRule{"Check": {Pattern: &annotations.HttpRule_Get{Get: "/v1/health"}}}),
+					Services:      []string{"helloworld.Greeter"},
+				}
+			},
+		},
+		{
+			name: "unknown field in the path",
+			cfg: func(t *testing.T) config.GRPCTranscoding {
+				return config.GRPCTranscoding{
+					DescriptorSet: writeHealthDescriptorSet(t, map[string]*annotations.HttpRule{"Check": {Pattern: &annotations.HttpRule_Get{Get: "/v1/health/{name}"}}}),
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if _, err := GRPCTranscoding(tt.cfg(t)); err == nil {
+				t.Error("GRPCTranscoding() error = nil, want error")
+			}
+		})
+	}
+}
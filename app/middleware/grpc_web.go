@@ -0,0 +1,234 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/nao1215/hurrah/config"
+)
+
+const (
+	// grpcWebContentType is the content type of binary gRPC-Web messages.
+	grpcWebContentType = "application/grpc-web"
+	// grpcWebTextContentType is the content type of base64 encoded gRPC-Web messages.
+	grpcWebTextContentType = "application/grpc-web-text"
+	// grpcWebTrailerFlag is the flag of the frame that has the trailers in the response body.
+	grpcWebTrailerFlag = 0x80
+)
+
+// grpcWebAllowHeaders is the request headers that the gRPC-Web clients send.
+var grpcWebAllowHeaders = []string{"content-type", "x-grpc-web", "x-user-agent", "grpc-timeout"}
+
+// grpcWebExposeHeaders is the response headers that the gRPC-Web clients read.
+var grpcWebExposeHeaders = []string{"grpc-status", "grpc-message", "grpc-status-details-bin"}
+
+// GRPCWeb is a middleware for gRPC routes that translates gRPC-Web requests from
+// browsers, in binary or text (base64), to native gRPC. The trailers of the
+// response are sent in the last frame of the body, because browsers cannot read
+// HTTP trailers. Native gRPC requests are forwarded as they are. If allow_origins
+// is set, the CORS preflight requests for the gRPC-Web headers are answered.
+func GRPCWeb(cfg config.GRPCWeb) (Middleware, error) {
+	if len(cfg.AllowOrigins) == 0 {
+		return grpcWeb, nil
+	}
+	cors, err := CORS(config.CORS{
+		AllowOrigins:     cfg.AllowOrigins,
+		AllowMethods:     []string{http.MethodPost},
+		AllowHeaders:     append(slices.Clone(grpcWebAllowHeaders), cfg.AllowHeaders...),
+		ExposeHeaders:    grpcWebExposeHeaders,
+		AllowCredentials: cfg.AllowCredentials,
+		MaxAge:           cfg.MaxAge,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return func(next HandlerWithCtx) HandlerWithCtx {
+		return cors(grpcWeb(next))
+	}, nil
+}
+
+// grpcWeb translates gRPC-Web requests to gRPC.
+func grpcWeb(next HandlerWithCtx) HandlerWithCtx {
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+		contentType, ok := grpcWebRequestContentType(r)
+		if !ok {
+			return next(ctx, w, r)
+		}
+
+		text := strings.HasPrefix(contentType, grpcWebTextContentType)
+		r.Header.Set("Content-Type", "application/grpc"+strings.TrimPrefix(strings.TrimPrefix(contentType, grpcWebTextContentType), grpcWebContentType))
+		r.Header.Set("Te", "trailers")
+		r.Header.Del("Content-Length")
+		if text {
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{&base64Reader{r: r.Body}, r.Body}
+			r.ContentLength = -1
+		}
+
+		gw := &grpcWebWriter{ResponseWriter: w, contentType: contentType, text: text}
+		if err := next(ctx, gw, r); err != nil && !gw.wroteHeader {
+			WriteGRPCError(gw, err)
+		}
+		gw.finish()
+		return nil
+	}
+}
+
+// grpcWebRequestContentType returns the content type of the gRPC-Web request.
+// It returns false if the request is not gRPC-Web.
+func grpcWebRequestContentType(r *http.Request) (string, bool) {
+	contentType := strings.ToLower(strings.TrimSpace(strings.Split(r.Header.Get("Content-Type"), ";")[0]))
+	for _, base := range []string{grpcWebTextContentType, grpcWebContentType} {
+		if contentType == base || strings.HasPrefix(contentType, base+"+") {
+			return contentType, true
+		}
+	}
+	return "", false
+}
+
+// grpcWebWriter is a http.ResponseWriter that translates the gRPC response to gRPC-Web.
+type grpcWebWriter struct {
+	http.ResponseWriter
+	contentType  string
+	text         bool
+	wroteHeader  bool
+	trailerNames []string // trailerNames is the trailers announced by the Trailer header.
+	pending      []byte   // pending is the bytes not yet base64 encoded, so that the chunks are padded only when flushed.
+}
+
+// WriteHeader writes the header with the gRPC-Web content type. The trailers
+// announced by the Trailer header are written in the body instead.
+func (w *grpcWebWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	h := w.Header()
+	for _, v := range h.Values("Trailer") {
+		for _, name := range strings.Split(v, ",") {
+			w.trailerNames = append(w.trailerNames, strings.TrimSpace(name))
+		}
+	}
+	h.Del("Trailer")
+	h.Del("Content-Length")
+	h.Set("Content-Type", w.contentType)
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Write writes the message frames, base64 encoded in text mode.
+func (w *grpcWebWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.text {
+		return w.ResponseWriter.Write(p)
+	}
+	w.pending = append(w.pending, p...)
+	n := len(w.pending) / 3 * 3
+	if n == 0 {
+		return len(p), nil
+	}
+	if _, err := w.ResponseWriter.Write([]byte(base64.StdEncoding.EncodeToString(w.pending[:n]))); err != nil {
+		return 0, err
+	}
+	w.pending = append(w.pending[:0], w.pending[n:]...)
+	return len(p), nil
+}
+
+// Flush flushes the frames to the client for streaming responses. In text mode,
+// the pending bytes are encoded with padding; the clients decode the body as
+// the concatenation of padded chunks.
+func (w *grpcWebWriter) Flush() {
+	w.flushPending()
+	_ = http.NewResponseController(w.ResponseWriter).Flush() // The client gets the rest at the end if flushing is not supported.
+}
+
+// flushPending writes the pending bytes of text mode with padding.
+func (w *grpcWebWriter) flushPending() {
+	if len(w.pending) == 0 {
+		return
+	}
+	_, _ = w.ResponseWriter.Write([]byte(base64.StdEncoding.EncodeToString(w.pending))) // The client has gone if it fails.
+	w.pending = w.pending[:0]
+}
+
+// finish writes the trailers of the gRPC response as the last frame of the body.
+// The write errors are ignored because they mean that the client has gone.
+func (w *grpcWebWriter) finish() {
+	h := w.Header()
+	var trailers bytes.Buffer
+	writeTrailer := func(name string, values []string) {
+		for _, v := range values {
+			fmt.Fprintf(&trailers, "%s: %s\r\n", strings.ToLower(name), v)
+		}
+	}
+	for _, name := range w.trailerNames {
+		key := http.CanonicalHeaderKey(name)
+		writeTrailer(name, h[key])
+		delete(h, key)
+	}
+	for key, values := range h {
+		if name, ok := strings.CutPrefix(key, http.TrailerPrefix); ok {
+			writeTrailer(name, values)
+			delete(h, key)
+		}
+	}
+
+	if trailers.Len() > 0 {
+		frame := make([]byte, 5, 5+trailers.Len())
+		frame[0] = grpcWebTrailerFlag
+		binary.BigEndian.PutUint32(frame[1:], uint32(trailers.Len())) //nolint:gosec // The trailers are far smaller than 4 GiB.
+		_, _ = w.Write(append(frame, trailers.Bytes()...))
+	}
+	w.flushPending()
+}
+
+// base64Reader decodes the base64 request body of gRPC-Web text. The body may be
+// the concatenation of padded chunks, so it is decoded by 4 characters.
+type base64Reader struct {
+	r       io.Reader
+	buf     []byte // buf is the characters not yet decoded.
+	decoded []byte // decoded is the bytes not yet read.
+	err     error
+}
+
+// Read reads the decoded bytes.
+func (b *base64Reader) Read(p []byte) (int, error) {
+	for len(b.decoded) == 0 {
+		if b.err != nil {
+			if b.err == io.EOF && len(b.buf) > 0 { //nolint:errorlint // io.EOF is not wrapped by readers.
+				return 0, io.ErrUnexpectedEOF
+			}
+			return 0, b.err
+		}
+		chunk := make([]byte, 4096)
+		n, err := b.r.Read(chunk)
+		b.err = err
+		for _, c := range chunk[:n] {
+			if c != '\r' && c != '\n' && c != ' ' && c != '\t' {
+				b.buf = append(b.buf, c)
+			}
+		}
+		for len(b.buf) >= 4 {
+			var out [3]byte
+			m, err := base64.StdEncoding.Decode(out[:], b.buf[:4])
+			if err != nil {
+				return 0, NewError(http.StatusBadRequest, "invalid base64 in the gRPC-Web text body")
+			}
+			b.decoded = append(b.decoded, out[:m]...)
+			b.buf = b.buf[4:]
+		}
+	}
+	n := copy(p, b.decoded)
+	b.decoded = b.decoded[n:]
+	return n, nil
+}
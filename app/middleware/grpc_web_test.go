@@ -0,0 +1,187 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/nao1215/hurrah/config"
+)
+
+// grpcFrame returns a length-prefixed gRPC message frame.
+func grpcFrame(flag byte, message string) []byte {
+	n := len(message)
+	return append([]byte{flag, byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)}, message...)
+}
+
+func TestGRPCWeb(t *testing.T) {
+	t.Parallel()
+
+	request := grpcFrame(0, "hello")
+	response := grpcFrame(0, "world!")
+	// backend behaves like the reverse proxy: the trailers that are not announced
+	// are set with http.TrailerPrefix after the body.
+	backend := func(_ context.Context, w http.ResponseWriter, r *http.Request) error {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return NewError(http.StatusBadRequest, err.Error())
+		}
+		if !bytes.Equal(request, body) {
+			return NewError(http.StatusBadRequest, "unexpected body")
+		}
+		if r.Header.Get("Content-Type") != "application/grpc+proto" || r.Header.Get("Te") != "trailers" {
+			return NewError(http.StatusBadRequest, "unexpected header: "+r.Header.Get("Content-Type"))
+		}
+		w.Header().Set("Content-Type", "application/grpc+proto")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(response) // The recorder does not fail.
+		w.(http.Flusher).Flush() //nolint:forcetypeassert // The gRPC-Web writer is a Flusher.
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", "")
+		return nil
+	}
+	m, err := GRPCWeb(config.GRPCWeb{})
+	if err != nil {
+		t.Fatalf("GRPCWeb() error = %v", err)
+	}
+	h := Chain(backend, m).AdaptHandler()
+	wantBody := append(append([]byte{}, response...), grpcFrame(0x80, "grpc-status: 0\r\ngrpc-message: \r\n")...)
+
+	t.Run("binary", func(t *testing.T) {
+		t.Parallel()
+
+		req := httptest.NewRequest(http.MethodPost, "/helloworld.Greeter/SayHello", bytes.NewReader(request))
+		req.Header.Set("Content-Type", "application/grpc-web+proto")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		if diff := cmp.Diff("application/grpc-web+proto", rec.Header().Get("Content-Type")); diff != "" {
+			t.Errorf("Content-Type mismatch (-want +got):\n%s", diff)
+		}
+		if diff := cmp.Diff(wantBody, rec.Body.Bytes()); diff != "" {
+			t.Errorf("body mismatch (-want +got):\n%s", diff)
+		}
+		if len(rec.Result().Trailer) != 0 {
+			t.Errorf("unexpected HTTP trailers: %v", rec.Result().Trailer)
+		}
+	})
+
+	t.Run("text", func(t *testing.T) {
+		t.Parallel()
+
+		// The body is two padded chunks, as the clients may send.
+		body := base64.StdEncoding.EncodeToString(request[:4]) + "\r\n" + base64.StdEncoding.EncodeToString(request[4:])
+		req := httptest.NewRequest(http.MethodPost, "/helloworld.Greeter/SayHello", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/grpc-web-text+proto")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		if diff := cmp.Diff("application/grpc-web-text+proto", rec.Header().Get("Content-Type")); diff != "" {
+			t.Errorf("Content-Type mismatch (-want +got):\n%s", diff)
+		}
+		// The response is flushed after the message, so it has two padded chunks.
+		if strings.Count(rec.Body.String(), "=") == 0 {
+			t.Errorf("body %q is not flushed in chunks", rec.Body.String())
+		}
+		got, err := io.ReadAll(&base64Reader{r: rec.Body})
+		if err != nil {
+			t.Fatalf("failed to decode the body: %v", err)
+		}
+		if diff := cmp.Diff(wantBody, got); diff != "" {
+			t.Errorf("body mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("invalid text", func(t *testing.T) {
+		t.Parallel()
+
+		req := httptest.NewRequest(http.MethodPost, "/helloworld.Greeter/SayHello", strings.NewReader("!!!!"))
+		req.Header.Set("Content-Type", "application/grpc-web-text")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		if diff := cmp.Diff("3", rec.Header().Get("Grpc-Status")); diff != "" {
+			t.Errorf("grpc-status mismatch (-want +got):\n%s", diff)
+		}
+		if diff := cmp.Diff("application/grpc-web-text", rec.Header().Get("Content-Type")); diff != "" {
+			t.Errorf("Content-Type mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("native gRPC is forwarded as it is", func(t *testing.T) {
+		t.Parallel()
+
+		req := httptest.NewRequest(http.MethodPost, "/helloworld.Greeter/SayHello", bytes.NewReader(request))
+		req.Header.Set("Content-Type", "application/grpc+proto")
+		req.Header.Set("Te", "trailers")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		if diff := cmp.Diff("application/grpc+proto", rec.Header().Get("Content-Type")); diff != "" {
+			t.Errorf("Content-Type mismatch (-want +got):\n%s", diff)
+		}
+		if diff := cmp.Diff(response, rec.Body.Bytes()); diff != "" {
+			t.Errorf("body mismatch (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestGRPCWeb_cors(t *testing.T) {
+	t.Parallel()
+
+	m, err := GRPCWeb(config.GRPCWeb{AllowOrigins: []string{"https://app.example.com"}, AllowHeaders: []string{"authorization"}})
+	if err != nil {
+		t.Fatalf("GRPCWeb() error = %v", err)
+	}
+	unauthenticated := func(_ context.Context, _ http.ResponseWriter, _ *http.Request) error {
+		return NewError(http.StatusUnauthorized, "missing token")
+	}
+	h := Chain(unauthenticated, m).AdaptHandler()
+
+	t.Run("preflight", func(t *testing.T) {
+		t.Parallel()
+
+		req := httptest.NewRequest(http.MethodOptions, "/helloworld.Greeter/SayHello", nil)
+		req.Header.Set("Origin", "https://app.example.com")
+		req.Header.Set("Access-Control-Request-Method", "POST")
+		req.Header.Set("Access-Control-Request-Headers", "content-type,x-grpc-web,x-user-agent,authorization")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		if diff := cmp.Diff(http.StatusNoContent, rec.Code); diff != "" {
+			t.Errorf("status mismatch (-want +got):\n%s", diff)
+		}
+		if diff := cmp.Diff("content-type, x-grpc-web, x-user-agent, authorization", rec.Header().Get("Access-Control-Allow-Headers")); diff != "" {
+			t.Errorf("Access-Control-Allow-Headers mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("error response", func(t *testing.T) {
+		t.Parallel()
+
+		req := httptest.NewRequest(http.MethodPost, "/helloworld.Greeter/SayHello", bytes.NewReader(grpcFrame(0, "")))
+		req.Header.Set("Origin", "https://app.example.com")
+		req.Header.Set("Content-Type", "application/grpc-web+proto")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		want := http.Header{
+			"Access-Control-Allow-Origin":   {"https://app.example.com"},
+			"Access-Control-Expose-Headers": {"grpc-status, grpc-message, grpc-status-details-bin"},
+			"Content-Type":                  {"application/grpc-web+proto"},
+			"Grpc-Message":                  {"missing token"},
+			"Grpc-Status":                   {"16"},
+			"Vary":                          {"Origin"},
+		}
+		if diff := cmp.Diff(want, rec.Header()); diff != "" {
+			t.Errorf("header mismatch (-want +got):\n%s", diff)
+		}
+	})
+}
@@ -0,0 +1,55 @@
+package middleware
+
+import "net/http"
+
+// headerWriter is an http.ResponseWriter that calls modify right before the
+// response header is written, so that middlewares can change the headers set by
+// the backend.
+type headerWriter struct {
+	http.ResponseWriter
+	modify      func(http.Header)
+	wroteHeader bool
+}
+
+// newHeaderWriter returns a new headerWriter.
+func newHeaderWriter(w http.ResponseWriter, modify func(http.Header)) *headerWriter {
+	return &headerWriter{ResponseWriter: w, modify: modify}
+}
+
+// WriteHeader modifies the header and writes it with the status code.
+// Informational (1xx) responses are written as they are.
+func (w *headerWriter) WriteHeader(code int) {
+	if code >= http.StatusContinue && code < http.StatusOK {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.modify(w.Header())
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Write writes the data, writing the header first if it has not been written.
+func (w *headerWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// done modifies the header if the handler returned an error without writing the
+// response, because AdaptHandler writes the error with the original http.ResponseWriter.
+// It returns the error as it is.
+func (w *headerWriter) done(err error) error {
+	if err != nil && !w.wroteHeader {
+		w.wroteHeader = true
+		w.modify(w.Header())
+	}
+	return err
+}
+
+// Unwrap returns the original http.ResponseWriter for http.ResponseController.
+func (w *headerWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
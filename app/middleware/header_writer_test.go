@@ -0,0 +1,38 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func Test_headerWriter(t *testing.T) {
+	t.Parallel()
+
+	rec := httptest.NewRecorder()
+	calls := 0
+	w := newHeaderWriter(rec, func(h http.Header) {
+		calls++
+		h.Del("Server")
+	})
+	w.Header().Set("Server", "backend/1.0")
+	if _, err := w.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	w.WriteHeader(http.StatusInternalServerError) // Ignored because the header is already written.
+
+	if diff := cmp.Diff(1, calls); diff != "" {
+		t.Errorf("number of modify calls mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(http.StatusOK, rec.Code); diff != "" {
+		t.Errorf("status mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff("", rec.Header().Get("Server")); diff != "" {
+		t.Errorf("Server header mismatch (-want +got):\n%s", diff)
+	}
+	if err := http.NewResponseController(w).Flush(); err != nil {
+		t.Errorf("Flush() error = %v", err)
+	}
+}
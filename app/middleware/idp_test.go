@@ -0,0 +1,194 @@
+package middleware
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testIdP is a small OpenID Provider for tests.
+// It issues RS256 signed tokens for any authorization code it has handed out.
+type testIdP struct {
+	*httptest.Server
+	t         *testing.T
+	key       *rsa.PrivateKey
+	clientID  string
+	expiresIn int64
+	claims    map[string]any // claims is added to the ID tokens.
+
+	mu            sync.Mutex
+	codes         map[string]testIdPCode // codes is the issued authorization codes.
+	refreshTokens map[string]string      // refreshTokens maps a refresh token to the subject.
+	refreshCount  int
+}
+
+// testIdPCode is an authorization code and the parameters of the authorization request.
+type testIdPCode struct {
+	nonce         string
+	codeChallenge string
+}
+
+// newTestIdP starts a new testIdP. The server is closed when the test ends.
+func newTestIdP(t *testing.T, clientID string) *testIdP {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &testIdP{
+		t:             t,
+		key:           key,
+		clientID:      clientID,
+		expiresIn:     3600,
+		codes:         map[string]testIdPCode{},
+		refreshTokens: map[string]string{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", idp.discovery)
+	mux.HandleFunc("/jwks", idp.jwks)
+	mux.HandleFunc("/authorize", idp.authorize)
+	mux.HandleFunc("/token", idp.token)
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+// discovery serves the provider metadata.
+func (idp *testIdP) discovery(w http.ResponseWriter, _ *http.Request) {
+	idp.writeJSON(w, map[string]string{
+		"issuer":                 idp.URL,
+		"authorization_endpoint": idp.URL + "/authorize",
+		"token_endpoint":         idp.URL + "/token",
+		"jwks_uri":               idp.URL + "/jwks",
+		"end_session_endpoint":   idp.URL + "/logout",
+	})
+}
+
+// jwks serves the public key.
+func (idp *testIdP) jwks(w http.ResponseWriter, _ *http.Request) {
+	idp.writeJSON(w, map[string]any{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test-key",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(idp.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(idp.key.E)).Bytes()),
+		}},
+	})
+}
+
+// authorize issues an authorization code and redirects back to redirect_uri
+// as if the user had logged in.
+func (idp *testIdP) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	code := randomString()
+	idp.mu.Lock()
+	idp.codes[code] = testIdPCode{nonce: q.Get("nonce"), codeChallenge: q.Get("code_challenge")}
+	idp.mu.Unlock()
+
+	redirect := q.Get("redirect_uri") + "?" + url.Values{"code": {code}, "state": {q.Get("state")}}.Encode()
+	http.Redirect(w, r, redirect, http.StatusFound)
+}
+
+// token exchanges an authorization code or a refresh token.
+func (idp *testIdP) token(w http.ResponseWriter, r *http.Request) {
+	if id, _, ok := r.BasicAuth(); !ok || id != idp.clientID {
+		http.Error(w, "invalid_client", http.StatusUnauthorized)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "invalid_request", http.StatusBadRequest)
+		return
+	}
+
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+
+	var nonce string
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		code, ok := idp.codes[r.PostForm.Get("code")]
+		delete(idp.codes, r.PostForm.Get("code"))
+		challenge := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if !ok || base64.RawURLEncoding.EncodeToString(challenge[:]) != code.codeChallenge {
+			http.Error(w, "invalid_grant", http.StatusBadRequest)
+			return
+		}
+		nonce = code.nonce
+	case "refresh_token":
+		if _, ok := idp.refreshTokens[r.PostForm.Get("refresh_token")]; !ok {
+			http.Error(w, "invalid_grant", http.StatusBadRequest)
+			return
+		}
+		delete(idp.refreshTokens, r.PostForm.Get("refresh_token"))
+		idp.refreshCount++
+	default:
+		http.Error(w, "unsupported_grant_type", http.StatusBadRequest)
+		return
+	}
+
+	refreshToken := randomString()
+	idp.refreshTokens[refreshToken] = "alice"
+	claims := map[string]any{
+		"iss":   idp.URL,
+		"sub":   "alice",
+		"aud":   idp.clientID,
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"iat":   time.Now().Unix(),
+		"email": "alice@example.com",
+	}
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+	for name, value := range idp.claims {
+		claims[name] = value
+	}
+	idp.writeJSON(w, map[string]any{
+		"access_token":  randomString(),
+		"token_type":    "Bearer",
+		"id_token":      idp.sign(claims),
+		"refresh_token": refreshToken,
+		"expires_in":    idp.expiresIn,
+	})
+}
+
+// sign returns a RS256 signed JWT of the claims.
+func (idp *testIdP) sign(claims map[string]any) string {
+	idp.t.Helper()
+
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "kid": "test-key", "typ": "JWT"})
+	if err != nil {
+		idp.t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		idp.t.Fatal(err)
+	}
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(input))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, digest[:])
+	if err != nil {
+		idp.t.Fatal(err)
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// writeJSON writes v as a JSON response.
+func (idp *testIdP) writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		idp.t.Errorf("json.Encode() error = %v", err)
+	}
+}
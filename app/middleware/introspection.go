@@ -0,0 +1,213 @@
+package middleware
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nao1215/hurrah/config"
+)
+
+// maxIntrospectionCacheEntries is the maximum number of cached introspection results.
+const maxIntrospectionCacheEntries = 10000
+
+// introspectionEntry is a cached result of an active token.
+type introspectionEntry struct {
+	claims  Claims
+	expires time.Time
+}
+
+// TokenInfo is the subject, client and scopes of an active token in the
+// introspection response.
+type TokenInfo struct {
+	Subject  string   // Subject is the "sub" of the token. e.g., "alice"
+	ClientID string   // ClientID is the "client_id" of the client the token was issued to.
+	Scopes   []string // Scopes is the space separated "scope" of the token. e.g., ["orders.read", "orders.write"]
+}
+
+// newTokenInfo returns the TokenInfo of the introspection response.
+func newTokenInfo(claims Claims) TokenInfo {
+	return TokenInfo{
+		Subject:  claims.String("sub"),
+		ClientID: claims.String("client_id"),
+		Scopes:   claimValues(claims, "scope"),
+	}
+}
+
+// tokenInfoKey is the context key for TokenInfo.
+type tokenInfoKey struct{}
+
+// TokenInfoFromContext returns the TokenInfo of the token validated by the
+// introspection middleware.
+func TokenInfoFromContext(ctx context.Context) (TokenInfo, bool) {
+	info, ok := ctx.Value(tokenInfoKey{}).(TokenInfo)
+	return info, ok
+}
+
+// HasScope reports whether the token has the scope.
+func (t TokenInfo) HasScope(scope string) bool {
+	return slices.Contains(t.Scopes, scope)
+}
+
+// introspection is the OAuth2 token introspection (RFC 7662).
+type introspection struct {
+	cfg    config.Introspection
+	client *http.Client
+	now    func() time.Time
+
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]introspectionEntry
+}
+
+// Introspection is a middleware that validates opaque bearer tokens by calling
+// the introspection endpoint. Active results are cached until the token expires.
+// The introspection response is stored in the request context as Claims (see
+// ClaimsFromContext), and its "sub", "client_id" and "scope" as TokenInfo (see
+// TokenInfoFromContext).
+func Introspection(cfg config.Introspection, timeout time.Duration) (Middleware, error) {
+	i, err := newIntrospection(cfg, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return i.handle, nil
+}
+
+// newIntrospection validates the settings and returns a new introspection.
+func newIntrospection(cfg config.Introspection, timeout time.Duration) (*introspection, error) {
+	if cfg.Endpoint == "" {
+		return nil, errors.New("middleware: introspection requires endpoint")
+	}
+	if _, err := url.Parse(cfg.Endpoint); err != nil {
+		return nil, fmt.Errorf("middleware: failed to parse introspection endpoint: %w", err)
+	}
+	return &introspection{
+		cfg:    cfg,
+		client: &http.Client{Timeout: timeout},
+		now:    time.Now,
+		cache:  map[[sha256.Size]byte]introspectionEntry{},
+	}, nil
+}
+
+// handle is the Middleware of the introspection.
+func (i *introspection) handle(next HandlerWithCtx) HandlerWithCtx {
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+		token, ok := bearerToken(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			return NewError(http.StatusUnauthorized, "bearer token is required")
+		}
+
+		claims, err := i.introspect(ctx, token)
+		if err != nil {
+			slog.Error("middleware: token introspection failed", slog.String("error", err.Error()))
+			return NewError(http.StatusServiceUnavailable, "token introspection is unavailable")
+		}
+		if claims == nil {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			return NewError(http.StatusUnauthorized, "token is not active")
+		}
+
+		ctx = withClaims(ctx, claims)
+		ctx = context.WithValue(ctx, tokenInfoKey{}, newTokenInfo(claims))
+		return next(ctx, w, r.WithContext(ctx))
+	}
+}
+
+// introspect returns the claims of the active token. It returns nil claims if the token is not active.
+func (i *introspection) introspect(ctx context.Context, token string) (Claims, error) {
+	key := sha256.Sum256([]byte(token))
+	now := i.now()
+
+	i.mu.Lock()
+	entry, ok := i.cache[key]
+	i.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.claims, nil
+	}
+
+	claims, err := i.request(ctx, token)
+	if err != nil || claims == nil {
+		return nil, err
+	}
+	if expires, ok := i.cacheExpiry(claims, now); ok {
+		i.store(key, introspectionEntry{claims: claims, expires: expires})
+	}
+	return claims, nil
+}
+
+// request sends the token to the introspection endpoint.
+func (i *introspection) request(ctx context.Context, token string) (Claims, error) {
+	form := url.Values{
+		"token":           {token},
+		"token_type_hint": {"access_token"},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, i.cfg.Endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create an introspection request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if i.cfg.ClientID != "" {
+		req.SetBasicAuth(url.QueryEscape(i.cfg.ClientID), url.QueryEscape(i.cfg.ClientSecret))
+	}
+
+	resp, err := i.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send an introspection request: %w", err)
+	}
+	defer resp.Body.Close() //nolint:errcheck
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("introspection endpoint returned status %d", resp.StatusCode)
+	}
+
+	var claims Claims
+	if err := json.NewDecoder(resp.Body).Decode(&claims); err != nil {
+		return nil, fmt.Errorf("failed to decode the introspection response: %w", err)
+	}
+	if active, ok := claims["active"].(bool); !ok || !active {
+		return nil, nil
+	}
+	return claims, nil
+}
+
+// cacheExpiry returns until when the result can be cached.
+// A token without "exp" is cached only if cache_ttl is set.
+func (i *introspection) cacheExpiry(claims Claims, now time.Time) (time.Time, bool) {
+	exp, hasExp := claims.time("exp")
+	if i.cfg.CacheTTL > 0 {
+		limit := now.Add(time.Duration(i.cfg.CacheTTL) * time.Second)
+		if !hasExp || limit.Before(exp) {
+			return limit, true
+		}
+	}
+	return exp, hasExp
+}
+
+// store caches the entry. Expired entries are evicted when the cache is full,
+// and the whole cache is dropped if that is not enough to bound the memory usage.
+func (i *introspection) store(key [sha256.Size]byte, entry introspectionEntry) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if len(i.cache) >= maxIntrospectionCacheEntries {
+		now := i.now()
+		for k, e := range i.cache {
+			if !now.Before(e.expires) {
+				delete(i.cache, k)
+			}
+		}
+		if len(i.cache) >= maxIntrospectionCacheEntries {
+			i.cache = map[[sha256.Size]byte]introspectionEntry{}
+		}
+	}
+	i.cache[key] = entry
+}
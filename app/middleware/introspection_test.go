@@ -0,0 +1,169 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/nao1215/hurrah/config"
+)
+
+func TestIntrospection(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if id, secret, ok := r.BasicAuth(); !ok || id != "gateway" || secret != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		resp := map[string]any{"active": false}
+		if r.PostForm.Get("token") == "active-token" {
+			resp = map[string]any{
+				"active":    true,
+				"sub":       "alice",
+				"scope":     "orders.read orders.write",
+				"client_id": "partner-app",
+				"exp":       time.Now().Add(time.Hour).Unix(),
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			t.Errorf("json.Encode() error = %v", err)
+		}
+	}))
+	defer server.Close()
+
+	m, err := Introspection(config.Introspection{
+		Endpoint:     server.URL,
+		ClientID:     "gateway",
+		ClientSecret: "secret",
+	}, time.Second)
+	if err != nil {
+		t.Fatalf("Introspection() error = %v", err)
+	}
+	var (
+		got     Claims
+		gotInfo TokenInfo
+	)
+	handler := Chain(func(ctx context.Context, w http.ResponseWriter, _ *http.Request) error {
+		got, _ = ClaimsFromContext(ctx)
+		gotInfo, _ = TokenInfoFromContext(ctx)
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}, m).AdaptHandler()
+
+	serve := func(authorization string) int {
+		req := httptest.NewRequest(http.MethodGet, "/orders", nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	t.Run("active token is allowed and cached", func(t *testing.T) {
+		calls.Store(0)
+		for range 3 {
+			if diff := cmp.Diff(http.StatusOK, serve("Bearer active-token")); diff != "" {
+				t.Errorf("status mismatch (-want +got):\n%s", diff)
+			}
+		}
+		if diff := cmp.Diff(int32(1), calls.Load()); diff != "" {
+			t.Errorf("introspection calls mismatch (-want +got):\n%s", diff)
+		}
+		for key, want := range map[string]string{"sub": "alice", "scope": "orders.read orders.write", "client_id": "partner-app"} {
+			if diff := cmp.Diff(want, got.String(key)); diff != "" {
+				t.Errorf("claim %s mismatch (-want +got):\n%s", key, diff)
+			}
+		}
+		wantInfo := TokenInfo{Subject: "alice", ClientID: "partner-app", Scopes: []string{"orders.read", "orders.write"}}
+		if diff := cmp.Diff(wantInfo, gotInfo); diff != "" {
+			t.Errorf("TokenInfo mismatch (-want +got):\n%s", diff)
+		}
+		if !gotInfo.HasScope("orders.write") || gotInfo.HasScope("orders") {
+			t.Errorf("HasScope() of %v is wrong", gotInfo.Scopes)
+		}
+	})
+
+	t.Run("inactive token is rejected", func(t *testing.T) {
+		if diff := cmp.Diff(http.StatusUnauthorized, serve("Bearer revoked-token")); diff != "" {
+			t.Errorf("status mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("request without token is rejected", func(t *testing.T) {
+		if diff := cmp.Diff(http.StatusUnauthorized, serve("")); diff != "" {
+			t.Errorf("status mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("unavailable endpoint", func(t *testing.T) {
+		m, err := Introspection(config.Introspection{Endpoint: "http://127.0.0.1:0/introspect"}, time.Second)
+		if err != nil {
+			t.Fatalf("Introspection() error = %v", err)
+		}
+		req := httptest.NewRequest(http.MethodGet, "/orders", nil)
+		req.Header.Set("Authorization", "Bearer active-token")
+		rec := httptest.NewRecorder()
+		Chain(func(context.Context, http.ResponseWriter, *http.Request) error { return nil }, m).AdaptHandler().ServeHTTP(rec, req)
+		if diff := cmp.Diff(http.StatusServiceUnavailable, rec.Code); diff != "" {
+			t.Errorf("status mismatch (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func Test_introspection_cacheExpiry(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(1700000000, 0)
+	tests := []struct {
+		name     string
+		cacheTTL int64
+		claims   Claims
+		want     time.Time
+		wantOK   bool
+	}{
+		{
+			name:   "cached until exp",
+			claims: Claims{"exp": float64(now.Add(time.Hour).Unix())},
+			want:   now.Add(time.Hour),
+			wantOK: true,
+		},
+		{
+			name:     "cache_ttl is shorter than exp",
+			cacheTTL: 60,
+			claims:   Claims{"exp": float64(now.Add(time.Hour).Unix())},
+			want:     now.Add(time.Minute),
+			wantOK:   true,
+		},
+		{
+			name:   "no exp and no cache_ttl",
+			claims: Claims{},
+			wantOK: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			i := &introspection{cfg: config.Introspection{CacheTTL: tt.cacheTTL}}
+			got, ok := i.cacheExpiry(tt.claims, now)
+			if ok != tt.wantOK {
+				t.Fatalf("cacheExpiry() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if ok && !got.Equal(tt.want) {
+				t.Errorf("cacheExpiry() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
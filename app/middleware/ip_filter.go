@@ -0,0 +1,140 @@
+package middleware
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+
+	"github.com/nao1215/hurrah/config"
+)
+
+// prefixSet is a set of IP prefixes. Prefixes are grouped by their length, so
+// that a lookup costs at most one map access per distinct length even for
+// large block lists.
+type prefixSet struct {
+	lengths []int
+	set     map[netip.Prefix]struct{}
+}
+
+// newPrefixSet returns a new prefixSet.
+func newPrefixSet(prefixes []netip.Prefix) *prefixSet {
+	s := &prefixSet{set: make(map[netip.Prefix]struct{}, len(prefixes))}
+	seen := map[int]bool{}
+	for _, p := range prefixes {
+		p = p.Masked()
+		s.set[p] = struct{}{}
+		bits := p.Bits()
+		if p.Addr().Is4() {
+			bits = -bits - 1 // IPv4 lengths are kept apart from IPv6 lengths.
+		}
+		if !seen[bits] {
+			seen[bits] = true
+			s.lengths = append(s.lengths, bits)
+		}
+	}
+	return s
+}
+
+// len returns the number of prefixes.
+func (s *prefixSet) len() int {
+	return len(s.set)
+}
+
+// contains reports whether addr is in one of the prefixes.
+func (s *prefixSet) contains(addr netip.Addr) bool {
+	if !addr.IsValid() {
+		return false
+	}
+	for _, bits := range s.lengths {
+		if addr.Is4() != (bits < 0) {
+			continue
+		}
+		if bits < 0 {
+			bits = -bits - 1
+		}
+		p, err := addr.Prefix(bits)
+		if err != nil {
+			continue
+		}
+		if _, ok := s.set[p]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// IPFilter is a middleware that allows or denies requests by the client IP address
+// (see ClientIP). The deny list is checked first. If the allow list is not empty,
+// only the listed addresses are allowed.
+func IPFilter(cfg config.IPFilter) (Middleware, error) {
+	allow, err := loadPrefixes(cfg.Allow, cfg.AllowFiles)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := loadPrefixes(cfg.Deny, cfg.DenyFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(next HandlerWithCtx) HandlerWithCtx {
+		return func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			addr := clientIP(ctx, r)
+			if deny.contains(addr) || (allow.len() > 0 && !allow.contains(addr)) {
+				slog.Warn("middleware: ip_filter denied the request",
+					slog.String("client_ip", addr.String()), slog.String("method", r.Method), slog.String("path", r.URL.Path))
+				return NewError(http.StatusForbidden, "access from this IP address is not allowed")
+			}
+			return next(ctx, w, r)
+		}
+	}, nil
+}
+
+// loadPrefixes parses the addresses and the addresses in the files.
+func loadPrefixes(values, files []string) (*prefixSet, error) {
+	prefixes, err := ParsePrefixes(values)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		p, err := readPrefixFile(file)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, p...)
+	}
+	return newPrefixSet(prefixes), nil
+}
+
+// readPrefixFile reads IP addresses or CIDRs, one per line. Empty lines and
+// lines starting with "#" are ignored, and "#" starts a trailing comment.
+func readPrefixFile(path string) ([]netip.Prefix, error) {
+	f, err := os.Open(path) //nolint:gosec // The path is given by the administrator.
+	if err != nil {
+		return nil, fmt.Errorf("middleware: failed to open the IP list: %w", err)
+	}
+	defer f.Close() //nolint:errcheck
+
+	var prefixes []netip.Prefix
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		p, err := parsePrefix(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+		prefixes = append(prefixes, p)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("middleware: failed to read the IP list %s: %w", path, err)
+	}
+	return prefixes, nil
+}
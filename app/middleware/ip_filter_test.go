@@ -0,0 +1,100 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/nao1215/hurrah/config"
+)
+
+func TestIPFilter(t *testing.T) {
+	t.Parallel()
+
+	denyFile := filepath.Join(t.TempDir(), "blocklist.txt")
+	if err := os.WriteFile(denyFile, []byte("# scanners\n198.51.100.0/24\n\n2001:db8:bad::/48 # abuse\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ok := func(_ context.Context, w http.ResponseWriter, _ *http.Request) error {
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+
+	tests := []struct {
+		name       string
+		cfg        config.IPFilter
+		remoteAddr string
+		want       int
+	}{
+		{
+			name:       "denied by the file",
+			cfg:        config.IPFilter{DenyFiles: []string{denyFile}},
+			remoteAddr: "198.51.100.7:1234",
+			want:       http.StatusForbidden,
+		},
+		{
+			name:       "denied IPv6 by the file",
+			cfg:        config.IPFilter{DenyFiles: []string{denyFile}},
+			remoteAddr: "[2001:db8:bad::1]:1234",
+			want:       http.StatusForbidden,
+		},
+		{
+			name:       "not in the deny list",
+			cfg:        config.IPFilter{DenyFiles: []string{denyFile}},
+			remoteAddr: "192.0.2.1:1234",
+			want:       http.StatusOK,
+		},
+		{
+			name:       "in the allow list",
+			cfg:        config.IPFilter{Allow: []string{"192.0.2.0/24"}},
+			remoteAddr: "192.0.2.1:1234",
+			want:       http.StatusOK,
+		},
+		{
+			name:       "not in the allow list",
+			cfg:        config.IPFilter{Allow: []string{"192.0.2.0/24"}},
+			remoteAddr: "203.0.113.1:1234",
+			want:       http.StatusForbidden,
+		},
+		{
+			name:       "deny takes precedence over allow",
+			cfg:        config.IPFilter{Allow: []string{"192.0.2.0/24"}, Deny: []string{"192.0.2.1"}},
+			remoteAddr: "192.0.2.1:1234",
+			want:       http.StatusForbidden,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			m, err := IPFilter(tt.cfg)
+			if err != nil {
+				t.Fatalf("IPFilter() error = %v", err)
+			}
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			rec := httptest.NewRecorder()
+			Chain(ok, ClientIP(nil), m).AdaptHandler().ServeHTTP(rec, req)
+
+			if diff := cmp.Diff(tt.want, rec.Code); diff != "" {
+				t.Errorf("status mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	t.Run("invalid entry in the file", func(t *testing.T) {
+		t.Parallel()
+
+		file := filepath.Join(t.TempDir(), "broken.txt")
+		if err := os.WriteFile(file, []byte("192.0.2.0/24\nnot-an-ip\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := IPFilter(config.IPFilter{DenyFiles: []string{file}}); err == nil {
+			t.Error("IPFilter() error = nil, want error")
+		}
+	})
+}
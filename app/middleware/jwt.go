@@ -0,0 +1,466 @@
+package middleware
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nao1215/hurrah/config"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// jwtLeeway is the allowed clock skew when validating time based claims.
+	jwtLeeway = 1 * time.Minute
+	// jwksMinRefreshInterval is the minimum interval between JWKS fetches
+	// triggered by an unknown key ID.
+	jwksMinRefreshInterval = 1 * time.Minute
+	// fetchFailureTTL is how long a failed fetch of the provider metadata or
+	// JWKS is reused before it is retried.
+	fetchFailureTTL = 10 * time.Second
+)
+
+// Claims is a set of claims of an authenticated client.
+type Claims map[string]any
+
+// claimsKey is the context key for Claims.
+type claimsKey struct{}
+
+// withClaims returns a copy of ctx that carries the claims.
+func withClaims(ctx context.Context, claims Claims) context.Context {
+	return context.WithValue(ctx, claimsKey{}, claims)
+}
+
+// ClaimsFromContext returns the claims of the authenticated client stored in ctx.
+func ClaimsFromContext(ctx context.Context) (Claims, bool) {
+	claims, ok := ctx.Value(claimsKey{}).(Claims)
+	return claims, ok
+}
+
+// String returns the claim as a string. It returns "" if the claim is not a string.
+func (c Claims) String(name string) string {
+	s, ok := c[name].(string)
+	if !ok {
+		return ""
+	}
+	return s
+}
+
+// lookup returns the claim at the dot separated path. e.g., realm_access.roles
+func (c Claims) lookup(path string) (any, bool) {
+	var v any = map[string]any(c)
+	for _, name := range strings.Split(path, ".") {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if v, ok = m[name]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// time returns the claim as a NumericDate.
+func (c Claims) time(name string) (time.Time, bool) {
+	switch v := c[name].(type) {
+	case float64:
+		return time.Unix(int64(v), 0), true
+	case json.Number:
+		f, err := v.Float64()
+		if err != nil {
+			return time.Time{}, false
+		}
+		return time.Unix(int64(f), 0), true
+	default:
+		return time.Time{}, false
+	}
+}
+
+// audience returns the "aud" claim. The claim may be a string or an array of strings.
+func (c Claims) audience() []string {
+	switch v := c["aud"].(type) {
+	case string:
+		return []string{v}
+	case []any:
+		aud := make([]string, 0, len(v))
+		for _, a := range v {
+			if s, ok := a.(string); ok {
+				aud = append(aud, s)
+			}
+		}
+		return aud
+	default:
+		return nil
+	}
+}
+
+// validate checks the registered claims "iss", "aud", "exp" and "nbf".
+// The issuer and audience are not checked if they are empty.
+func (c Claims) validate(issuer, audience string, now time.Time) error {
+	if issuer != "" && c.String("iss") != issuer {
+		return fmt.Errorf("unexpected issuer %q", c.String("iss"))
+	}
+	if audience != "" {
+		found := false
+		for _, aud := range c.audience() {
+			if aud == audience {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("token is not issued for %q", audience)
+		}
+	}
+	exp, ok := c.time("exp")
+	if !ok {
+		return errors.New("token has no expiration time")
+	}
+	if now.After(exp.Add(jwtLeeway)) {
+		return errors.New("token is expired")
+	}
+	if nbf, ok := c.time("nbf"); ok && now.Add(jwtLeeway).Before(nbf) {
+		return errors.New("token is not valid yet")
+	}
+	return nil
+}
+
+// jwtHeader is the JOSE header of a JWT.
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// verifyJWT verifies the signature of the compact serialized JWT with the key set
+// and returns its claims. The registered claims are not validated.
+func verifyJWT(ctx context.Context, keys *keySet, token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	rawHeader, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token header: %w", err)
+	}
+	var header jwtHeader
+	if err := json.Unmarshal(rawHeader, &header); err != nil {
+		return nil, fmt.Errorf("malformed token header: %w", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token signature: %w", err)
+	}
+
+	key, err := keys.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, err
+	}
+
+	return decodeJWTClaims(parts[1])
+}
+
+// decodeJWTClaims decodes the claims part of a JWT without verifying the signature.
+func decodeJWTClaims(part string) (Claims, error) {
+	rawClaims, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return nil, fmt.Errorf("malformed token claims: %w", err)
+	}
+	var claims Claims
+	if err := json.Unmarshal(rawClaims, &claims); err != nil {
+		return nil, fmt.Errorf("malformed token claims: %w", err)
+	}
+	return claims, nil
+}
+
+// verifySignature verifies the JWS signature. Only asymmetric algorithms are accepted.
+func verifySignature(alg string, key crypto.PublicKey, input, signature []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "PS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "PS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "PS512", "ES512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported signing algorithm %q", alg)
+	}
+	h := hash.New()
+	h.Write(input)
+	digest := h.Sum(nil)
+
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		switch alg[:2] {
+		case "RS":
+			return rsa.VerifyPKCS1v15(pub, hash, digest, signature)
+		case "PS":
+			return rsa.VerifyPSS(pub, hash, digest, signature, nil)
+		}
+	case *ecdsa.PublicKey:
+		if alg[:2] != "ES" {
+			break
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return errors.New("invalid signature length")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("signing algorithm %q does not match the key type", alg)
+}
+
+// fetchGroup runs one fetch of a remote resource at a time. The fetch runs
+// without holding a lock and is shared by the requests that wait for it, and a
+// failure is reused for fetchFailureTTL, so that requests do not queue behind
+// a slow or failing server one after another.
+type fetchGroup struct {
+	group singleflight.Group
+
+	mu       sync.Mutex
+	err      error
+	failedAt time.Time
+}
+
+// do calls fetch unless a fetch is running or has failed recently. The fetch is
+// not canceled with ctx, because other requests may wait for it; it is bounded
+// by the timeout of the HTTP client.
+func (g *fetchGroup) do(ctx context.Context, fetch func(context.Context) error) error {
+	g.mu.Lock()
+	if g.err != nil && time.Since(g.failedAt) < fetchFailureTTL {
+		err := g.err
+		g.mu.Unlock()
+		return err
+	}
+	g.mu.Unlock()
+
+	result := g.group.DoChan("", func() (any, error) {
+		err := fetch(context.WithoutCancel(ctx))
+		g.mu.Lock()
+		g.err, g.failedAt = err, time.Now()
+		g.mu.Unlock()
+		return nil, err
+	})
+	select {
+	case r := <-result:
+		return r.Err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// keySet is a JSON Web Key Set fetched from a remote URL.
+// Keys are cached and refetched when an unknown key ID is requested.
+type keySet struct {
+	uri    string
+	client *http.Client
+	fetch  fetchGroup
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+}
+
+// newKeySet returns a new keySet that fetches keys from uri.
+func newKeySet(uri string, client *http.Client) *keySet {
+	return &keySet{
+		uri:    uri,
+		client: client,
+	}
+}
+
+// key returns the public key identified by kid.
+func (k *keySet) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	k.mu.Lock()
+	key, ok := k.lookup(kid)
+	fresh := k.keys != nil && time.Since(k.fetchedAt) < jwksMinRefreshInterval
+	k.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+	if fresh {
+		return nil, fmt.Errorf("unknown key ID %q", kid)
+	}
+
+	if err := k.fetch.do(ctx, k.fetchKeys); err != nil {
+		return nil, err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if key, ok := k.lookup(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key ID %q", kid)
+}
+
+// lookup returns the cached key. If kid is empty and the set has exactly one key,
+// the key is returned. The caller must hold k.mu.
+func (k *keySet) lookup(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(k.keys) == 1 {
+		for _, key := range k.keys {
+			return key, true
+		}
+	}
+	key, ok := k.keys[kid]
+	return key, ok
+}
+
+// jwk is a JSON Web Key. Only the public parameters of RSA and EC keys are used.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// fetchKeys fetches the key set and replaces the cached keys.
+func (k *keySet) fetchKeys(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, k.uri, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create a JWKS request: %w", err)
+	}
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to fetch JWKS: %w", err)
+	}
+	defer resp.Body.Close() //nolint:errcheck
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch JWKS: unexpected status %d", resp.StatusCode)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return fmt.Errorf("failed to decode JWKS: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, key := range set.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		pub, err := key.publicKey()
+		if err != nil {
+			continue // Unsupported keys are ignored so that the rest of the set can be used.
+		}
+		keys[key.Kid] = pub
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys = keys
+	k.fetchedAt = time.Now()
+	return nil
+}
+
+// publicKey converts the JWK to a public key.
+func (j jwk) publicKey() (crypto.PublicKey, error) {
+	switch j.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(j.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(j.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch j.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", j.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(j.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(j.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", j.Kty)
+	}
+}
+
+// jwtVerifier verifies bearer JWTs issued by a trusted issuer.
+type jwtVerifier struct {
+	issuer   string
+	audience string
+	keys     *keySet
+	now      func() time.Time
+}
+
+// newJWTVerifier returns a new jwtVerifier.
+func newJWTVerifier(cfg config.JWT, timeout time.Duration) (*jwtVerifier, error) {
+	if cfg.JWKSURL == "" {
+		return nil, errors.New("middleware: jwt requires jwks_url")
+	}
+	return &jwtVerifier{
+		issuer:   cfg.Issuer,
+		audience: cfg.Audience,
+		keys:     newKeySet(cfg.JWKSURL, &http.Client{Timeout: timeout}),
+		now:      time.Now,
+	}, nil
+}
+
+// verify verifies the token and validates its registered claims.
+func (v *jwtVerifier) verify(ctx context.Context, token string) (Claims, error) {
+	claims, err := verifyJWT(ctx, v.keys, token)
+	if err != nil {
+		return nil, err
+	}
+	if err := claims.validate(v.issuer, v.audience, v.now()); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// bearerToken returns the bearer token of the Authorization header.
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
@@ -0,0 +1,92 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestKeySet_key(t *testing.T) {
+	t.Parallel()
+
+	t.Run("concurrent requests share a fetch", func(t *testing.T) {
+		t.Parallel()
+
+		var fetches atomic.Int32
+		release := make(chan struct{})
+		jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			fetches.Add(1)
+			<-release
+			_, _ = w.Write([]byte(`{"keys": []}`)) // The test fails if the response is not written.
+		}))
+		t.Cleanup(jwks.Close)
+		keys := newKeySet(jwks.URL, &http.Client{Timeout: 5 * time.Second})
+
+		var wg sync.WaitGroup
+		for range 10 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := keys.key(context.Background(), "test-key"); err == nil {
+					t.Error("key() error = nil, want error")
+				}
+			}()
+		}
+		time.Sleep(100 * time.Millisecond) // Wait for the requests to wait for the fetch.
+		close(release)
+		wg.Wait()
+
+		if diff := cmp.Diff(int32(1), fetches.Load()); diff != "" {
+			t.Errorf("fetch count mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("waiting request is canceled with its context", func(t *testing.T) {
+		t.Parallel()
+
+		release := make(chan struct{})
+		jwks := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {
+			<-release
+		}))
+		t.Cleanup(jwks.Close)
+		t.Cleanup(func() { close(release) })
+		keys := newKeySet(jwks.URL, &http.Client{Timeout: 5 * time.Second})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		if _, err := keys.key(ctx, "test-key"); err == nil {
+			t.Error("key() error = nil, want error")
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("key() returned after %v, want soon after the context is canceled", elapsed)
+		}
+	})
+
+	t.Run("failure is reused", func(t *testing.T) {
+		t.Parallel()
+
+		var fetches atomic.Int32
+		jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			fetches.Add(1)
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		t.Cleanup(jwks.Close)
+		keys := newKeySet(jwks.URL, &http.Client{Timeout: 5 * time.Second})
+
+		for range 3 {
+			if _, err := keys.key(context.Background(), "test-key"); err == nil {
+				t.Error("key() error = nil, want error")
+			}
+		}
+		if diff := cmp.Diff(int32(1), fetches.Load()); diff != "" {
+			t.Errorf("fetch count mismatch (-want +got):\n%s", diff)
+		}
+	})
+}
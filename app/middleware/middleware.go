@@ -3,9 +3,16 @@ package middleware
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"net/netip"
+	"time"
 
 	"log/slog"
+
+	"github.com/nao1215/hurrah/config"
 )
 
 type (
@@ -16,10 +23,11 @@ type (
 )
 
 // Chain creates a new Middleware by chaining the middlewares.
-// The returned Middleware executes the middlewares in the order they are passed.
+// The returned Middleware executes the middlewares in the order they are passed,
+// so the first middleware is the outermost one.
 func Chain(handler HandlerWithCtx, middlewares ...Middleware) HandlerWithCtx {
-	for _, middleware := range middlewares {
-		handler = middleware(handler)
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
 	}
 	return handler
 }
@@ -38,20 +46,229 @@ func (h HandlerWithCtx) AdaptHandler() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 		if err := h(ctx, w, r); err != nil {
-			slog.Error("middleware: failed to handle the request", slog.String("error", err.Error()))
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			WriteError(w, err)
 		}
 	})
 }
 
+// WriteError writes the error to the client. An *Error is written as a problem
+// details JSON, and other errors are logged and written as 500.
+func WriteError(w http.ResponseWriter, err error) {
+	var e *Error
+	if errors.As(err, &e) {
+		e.write(w)
+		return
+	}
+	slog.Error("middleware: failed to handle the request", slog.String("error", err.Error()))
+	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+}
+
+// Error is an error that is returned to the client as a problem details JSON (RFC 9457).
+// Middlewares return it to reject a request with a status code other than 500.
+type Error struct {
+	Status     int            // Status is the HTTP status code.
+	Detail     string         // Detail is a human-readable explanation of the error.
+	Extensions map[string]any // Extensions is additional members of the problem details. e.g., {"missing": ["role:admin"]}
+}
+
+// NewError returns a new Error.
+func NewError(status int, detail string) *Error {
+	return &Error{
+		Status: status,
+		Detail: detail,
+	}
+}
+
+// Error returns the error message.
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Status, http.StatusText(e.Status), e.Detail)
+}
+
+// write writes the error as a problem details JSON.
+func (e *Error) write(w http.ResponseWriter) {
+	problem := make(map[string]any, len(e.Extensions)+4)
+	for k, v := range e.Extensions {
+		problem[k] = v
+	}
+	problem["type"] = "about:blank"
+	problem["title"] = http.StatusText(e.Status)
+	problem["status"] = e.Status
+	if e.Detail != "" {
+		problem["detail"] = e.Detail
+	}
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(e.Status)
+	if err := json.NewEncoder(w).Encode(problem); err != nil {
+		slog.Error("middleware: failed to write the error response", slog.String("error", err.Error()))
+	}
+}
+
 // Kind represents the kind of the middleware.
 type Kind string
 
 const (
 	// KindBasicAuth is a middleware that checks the basic authentication.
 	KindBasicAuth Kind = "basic_auth"
+	// KindOIDC is a middleware that authenticates browsers with OpenID Connect.
+	KindOIDC Kind = "oidc"
+	// KindRBAC is a middleware that enforces role-based access control.
+	KindRBAC Kind = "rbac"
+	// KindIntrospection is a middleware that validates opaque access tokens by OAuth2 token introspection.
+	KindIntrospection Kind = "introspection"
+	// KindExtAuthz is a middleware that delegates the authorization to an external HTTP service.
+	KindExtAuthz Kind = "ext_authz"
+	// KindPolicy is a middleware that evaluates allow/deny rules written in CEL.
+	KindPolicy Kind = "policy"
+	// KindClientCert is a middleware that authorizes clients by their TLS client certificates.
+	KindClientCert Kind = "client_cert"
+	// KindIPFilter is a middleware that allows or denies requests by the client IP address.
+	KindIPFilter Kind = "ip_filter"
+	// KindRateLimit is a middleware that limits the request rate with token buckets.
+	KindRateLimit Kind = "rate_limit"
+	// KindQuota is a middleware that limits the number of requests per day or month.
+	KindQuota Kind = "quota"
+	// KindCORS is a middleware that handles Cross-Origin Resource Sharing.
+	KindCORS Kind = "cors"
+	// KindSecurityHeaders is a middleware that sets the security response headers.
+	KindSecurityHeaders Kind = "security_headers"
+	// KindRequestLimits is a middleware that limits the size, headers and content type of requests.
+	KindRequestLimits Kind = "request_limits"
+	// KindOpenAPI is a middleware that validates requests against an OpenAPI 3 document.
+	KindOpenAPI Kind = "openapi"
+	// KindWAF is a middleware that inspects requests with the web application firewall rules.
+	KindWAF Kind = "waf"
+	// KindGRPCWeb is a middleware that translates gRPC-Web requests from browsers to gRPC.
+	KindGRPCWeb Kind = "grpc_web"
+	// KindGRPCTranscoding is a middleware that exposes gRPC methods as JSON/REST endpoints.
+	KindGRPCTranscoding Kind = "grpc_transcoding"
 )
 
+// Resources is the resources shared by the middlewares of all routes.
+type Resources struct {
+	QuotaStore     *QuotaStore    // QuotaStore is the store of the quota middleware. It is nil if [quota] is not set.
+	RedisClients   *RedisClients  // RedisClients is the Redis clients of the rate_limit middleware.
+	TrustedProxies []netip.Prefix // TrustedProxies is the proxies of server.trusted_proxies.
+}
+
+// NewMiddlewares creates the middlewares listed in the middleware setting of the route.
+// The returned middlewares are in the same order as the setting.
+func NewMiddlewares(route config.Route, resources Resources) ([]Middleware, error) {
+	timeout := time.Duration(route.Timeout) * time.Second
+
+	middlewares := make([]Middleware, 0, len(route.Middleware))
+	for _, name := range route.Middleware {
+		var (
+			m   Middleware
+			err error
+		)
+		switch Kind(name) {
+		case KindBasicAuth:
+			m = BasicAuth()
+		case KindOIDC:
+			if route.OIDC == nil {
+				return nil, fmt.Errorf("middleware: %s requires [routes.oidc] settings", name)
+			}
+			m, err = OIDC(*route.OIDC, route.Path, timeout)
+		case KindRBAC:
+			if route.RBAC == nil {
+				return nil, fmt.Errorf("middleware: %s requires [routes.rbac] settings", name)
+			}
+			m, err = RBAC(*route.RBAC, timeout, resources.TrustedProxies)
+		case KindIntrospection:
+			if route.Introspection == nil {
+				return nil, fmt.Errorf("middleware: %s requires [routes.introspection] settings", name)
+			}
+			m, err = Introspection(*route.Introspection, timeout)
+		case KindExtAuthz:
+			if route.ExtAuthz == nil {
+				return nil, fmt.Errorf("middleware: %s requires [routes.ext_authz] settings", name)
+			}
+			m, err = ExtAuthz(*route.ExtAuthz, timeout)
+		case KindPolicy:
+			if route.Policy == nil {
+				return nil, fmt.Errorf("middleware: %s requires [routes.policy] settings", name)
+			}
+			m, err = Policy(*route.Policy)
+		case KindClientCert:
+			if route.ClientCert == nil {
+				return nil, fmt.Errorf("middleware: %s requires [routes.client_cert] settings", name)
+			}
+			m = ClientCert(*route.ClientCert)
+		case KindIPFilter:
+			if route.IPFilter == nil {
+				return nil, fmt.Errorf("middleware: %s requires [routes.ip_filter] settings", name)
+			}
+			m, err = IPFilter(*route.IPFilter)
+		case KindRateLimit:
+			if route.RateLimit == nil {
+				return nil, fmt.Errorf("middleware: %s requires [routes.rate_limit] settings", name)
+			}
+			m, err = RateLimit(*route.RateLimit, route.Path, resources.RedisClients)
+		case KindQuota:
+			if route.Quota == nil {
+				return nil, fmt.Errorf("middleware: %s requires [routes.quota] settings", name)
+			}
+			if resources.QuotaStore == nil {
+				return nil, fmt.Errorf("middleware: %s requires [quota] settings", name)
+			}
+			m, err = Quota(*route.Quota, route.Path, resources.QuotaStore)
+		case KindCORS:
+			if route.CORS == nil {
+				return nil, fmt.Errorf("middleware: %s requires [routes.cors] settings", name)
+			}
+			m, err = CORS(*route.CORS)
+		case KindSecurityHeaders:
+			securityHeaders := config.SecurityHeaders{}
+			if route.SecurityHeaders != nil {
+				securityHeaders = *route.SecurityHeaders
+			}
+			m, err = SecurityHeaders(securityHeaders)
+		case KindRequestLimits:
+			if route.RequestLimits == nil {
+				return nil, fmt.Errorf("middleware: %s requires [routes.request_limits] settings", name)
+			}
+			m, err = RequestLimits(*route.RequestLimits)
+		case KindOpenAPI:
+			if route.OpenAPI == nil {
+				return nil, fmt.Errorf("middleware: %s requires [routes.openapi] settings", name)
+			}
+			m, err = OpenAPI(*route.OpenAPI)
+		case KindWAF:
+			waf := config.WAF{}
+			if route.WAF != nil {
+				waf = *route.WAF
+			}
+			m, err = WAF(waf)
+		case KindGRPCWeb:
+			if route.Protocol != config.ProtocolGRPC {
+				return nil, fmt.Errorf("middleware: %s requires protocol = %q", name, config.ProtocolGRPC)
+			}
+			grpcWeb := config.GRPCWeb{}
+			if route.GRPCWeb != nil {
+				grpcWeb = *route.GRPCWeb
+			}
+			m, err = GRPCWeb(grpcWeb)
+		case KindGRPCTranscoding:
+			if route.Protocol != config.ProtocolGRPC {
+				return nil, fmt.Errorf("middleware: %s requires protocol = %q", name, config.ProtocolGRPC)
+			}
+			if route.GRPCTranscoding == nil {
+				return nil, fmt.Errorf("middleware: %s requires [routes.grpc_transcoding] settings", name)
+			}
+			m, err = GRPCTranscoding(*route.GRPCTranscoding)
+		default:
+			return nil, fmt.Errorf("middleware: unknown middleware %q", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		middlewares = append(middlewares, m)
+	}
+	return middlewares, nil
+}
+
 // BasicAuth is a middleware that checks the basic authentication.
 func BasicAuth() Middleware {
 	return func(next HandlerWithCtx) HandlerWithCtx {
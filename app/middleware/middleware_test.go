@@ -0,0 +1,95 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/nao1215/hurrah/config"
+)
+
+func TestChain(t *testing.T) {
+	t.Run("middlewares are executed in the order they are passed", func(t *testing.T) {
+		var got []string
+		record := func(name string) Middleware {
+			return func(next HandlerWithCtx) HandlerWithCtx {
+				return func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+					got = append(got, name)
+					return next(ctx, w, r)
+				}
+			}
+		}
+		handler := func(context.Context, http.ResponseWriter, *http.Request) error {
+			got = append(got, "handler")
+			return nil
+		}
+
+		Chain(handler, record("first"), record("second")).AdaptHandler().
+			ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+		if diff := cmp.Diff([]string{"first", "second", "handler"}, got); diff != "" {
+			t.Errorf("Chain() order mismatch (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestNewMiddlewares(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		route   config.Route
+		want    int
+		wantErr bool
+	}{
+		{
+			name:  "no middleware",
+			route: config.Route{Path: "/service1"},
+			want:  0,
+		},
+		{
+			name:  "basic_auth",
+			route: config.Route{Path: "/service1", Middleware: []string{"basic_auth"}},
+			want:  1,
+		},
+		{
+			name:  "security_headers without settings",
+			route: config.Route{Path: "/service1", Middleware: []string{"security_headers"}},
+			want:  1,
+		},
+		{
+			name:    "oidc without settings",
+			route:   config.Route{Path: "/service1", Middleware: []string{"oidc"}},
+			wantErr: true,
+		},
+		{
+			name: "quota without store",
+			route: config.Route{
+				Path:       "/service1",
+				Middleware: []string{"quota"},
+				Quota:      &config.Quota{Limit: 1},
+			},
+			wantErr: true,
+		},
+		{
+			name:    "unknown middleware",
+			route:   config.Route{Path: "/service1", Middleware: []string{"unknown"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := NewMiddlewares(tt.route, Resources{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewMiddlewares() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if diff := cmp.Diff(tt.want, len(got)); diff != "" {
+				t.Errorf("NewMiddlewares() length mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,625 @@
+package middleware
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nao1215/hurrah/config"
+)
+
+const (
+	// defaultOIDCCookieName is the default name of the session cookie.
+	defaultOIDCCookieName = "hurrah_session"
+	// oidcStateCookieSuffix is appended to the session cookie name to build the login state cookie name.
+	oidcStateCookieSuffix = "_state"
+	// oidcStateLifetime is how long a login attempt may take.
+	oidcStateLifetime = 10 * time.Minute
+	// minOIDCCookieSecretLength is the minimum length of the cookie secret.
+	minOIDCCookieSecretLength = 32
+	// oidcCookieChunkSize is the maximum length of a session cookie value. Browsers
+	// limit a cookie to 4096 bytes including the name and attributes, so a larger
+	// session is split into the cookies <name>, <name>_1, <name>_2 and so on.
+	oidcCookieChunkSize = 3800
+	// maxOIDCCookieChunks is the maximum number of the session cookies.
+	maxOIDCCookieChunks = 5
+)
+
+// oidcProvider is the OpenID Provider metadata obtained by discovery.
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+	EndSessionEndpoint    string `json:"end_session_endpoint"`
+}
+
+// oidcState is the state of a login attempt. It is kept in an encrypted cookie
+// until the OpenID Provider redirects the browser back to the callback.
+type oidcState struct {
+	State        string `json:"state"`
+	Nonce        string `json:"nonce"`
+	CodeVerifier string `json:"code_verifier"`
+	RedirectPath string `json:"redirect_path"`
+}
+
+// oidcSession is the authenticated session kept in an encrypted cookie.
+// The claims are not stored, because they are in the ID token.
+type oidcSession struct {
+	IDToken      string `json:"id_token"`
+	RefreshToken string `json:"refresh_token"`
+	Expiry       int64  `json:"expiry"`
+}
+
+// oidcTokenResponse is the response of the token endpoint.
+type oidcTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	IDToken      string `json:"id_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
+
+// oidc is the OpenID Connect authorization code flow with PKCE.
+type oidc struct {
+	cfg          config.OIDC
+	client       *http.Client
+	aead         cipher.AEAD
+	cookieName   string
+	callbackPath string
+	secure       bool
+	now          func() time.Time
+
+	discovery fetchGroup
+	mu        sync.Mutex
+	provider  *oidcProvider
+	keys      *keySet
+}
+
+// underRoute reports whether the requests to the path are routed to the route.
+// As in http.ServeMux, a route path that ends with a slash matches the paths
+// under it, and other route paths match only themselves.
+func underRoute(route, path string) bool {
+	if strings.HasSuffix(route, "/") {
+		return strings.HasPrefix(path, route)
+	}
+	return path == route
+}
+
+// OIDC is a middleware that authenticates browsers with OpenID Connect.
+// Unauthenticated browsers are redirected to the OpenID Provider, and the
+// authenticated session is kept in an encrypted cookie. The claims of the
+// ID token are stored in the request context (see ClaimsFromContext).
+// The paths of redirect_url and logout_path must be under the route path, so
+// that the callback and logout requests reach the middleware.
+func OIDC(cfg config.OIDC, route string, timeout time.Duration) (Middleware, error) {
+	o, err := newOIDC(cfg, route, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return o.handle, nil
+}
+
+// newOIDC validates the settings and returns a new oidc.
+func newOIDC(cfg config.OIDC, route string, timeout time.Duration) (*oidc, error) {
+	if cfg.Issuer == "" || cfg.ClientID == "" || cfg.RedirectURL == "" {
+		return nil, errors.New("middleware: oidc requires issuer, client_id and redirect_url")
+	}
+	if len(cfg.CookieSecret) < minOIDCCookieSecretLength {
+		return nil, fmt.Errorf("middleware: oidc cookie_secret must be at least %d characters", minOIDCCookieSecretLength)
+	}
+	redirectURL, err := url.Parse(cfg.RedirectURL)
+	if err != nil {
+		return nil, fmt.Errorf("middleware: failed to parse oidc redirect_url: %w", err)
+	}
+	if !underRoute(route, redirectURL.Path) {
+		return nil, fmt.Errorf("middleware: the path of oidc redirect_url %q is not under the route path %s", redirectURL.Path, route)
+	}
+	if cfg.LogoutPath != "" && !underRoute(route, cfg.LogoutPath) {
+		return nil, fmt.Errorf("middleware: oidc logout_path %q is not under the route path %s", cfg.LogoutPath, route)
+	}
+
+	key := sha256.Sum256([]byte(cfg.CookieSecret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, fmt.Errorf("middleware: failed to create a cookie cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("middleware: failed to create a cookie cipher: %w", err)
+	}
+
+	cookieName := cfg.CookieName
+	if cookieName == "" {
+		cookieName = defaultOIDCCookieName
+	}
+	return &oidc{
+		cfg:          cfg,
+		client:       &http.Client{Timeout: timeout},
+		aead:         aead,
+		cookieName:   cookieName,
+		callbackPath: redirectURL.Path,
+		secure:       redirectURL.Scheme == "https",
+		now:          time.Now,
+	}, nil
+}
+
+// handle is the Middleware of the oidc.
+func (o *oidc) handle(next HandlerWithCtx) HandlerWithCtx {
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+		switch {
+		case r.URL.Path == o.callbackPath:
+			return o.callback(ctx, w, r)
+		case o.cfg.LogoutPath != "" && r.URL.Path == o.cfg.LogoutPath:
+			return o.logout(ctx, w, r)
+		}
+
+		var claims Claims
+		session, err := o.session(ctx, w, r)
+		if err == nil {
+			claims, err = session.claims()
+		}
+		if err != nil {
+			slog.Debug("middleware: oidc session is not available", slog.String("error", err.Error()))
+			return o.login(ctx, w, r)
+		}
+		ctx = withClaims(ctx, claims)
+		return next(ctx, w, r.WithContext(ctx))
+	}
+}
+
+// session returns the session of the request. An expired session is renewed
+// with the refresh token, and the renewed session is written to the cookie.
+func (o *oidc) session(ctx context.Context, w http.ResponseWriter, r *http.Request) (*oidcSession, error) {
+	var session oidcSession
+	if err := o.readSession(r, &session); err != nil {
+		return nil, err
+	}
+	if o.now().Before(time.Unix(session.Expiry, 0)) {
+		return &session, nil
+	}
+	if session.RefreshToken == "" {
+		return nil, errors.New("session is expired")
+	}
+
+	renewed, err := o.refresh(ctx, &session)
+	if err != nil {
+		return nil, fmt.Errorf("failed to refresh the session: %w", err)
+	}
+	if err := o.setSession(w, r, renewed); err != nil {
+		return nil, err
+	}
+	return renewed, nil
+}
+
+// login redirects the browser to the authorization endpoint.
+// Requests other than GET and HEAD can not be redirected safely, so they are rejected.
+func (o *oidc) login(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return NewError(http.StatusUnauthorized, "authentication is required")
+	}
+	provider, err := o.discover(ctx)
+	if err != nil {
+		return err
+	}
+
+	state := oidcState{
+		State:        randomString(),
+		Nonce:        randomString(),
+		CodeVerifier: randomString(),
+		RedirectPath: r.URL.RequestURI(),
+	}
+	value, err := o.seal(o.stateCookieName(), state)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     o.stateCookieName(),
+		Value:    value,
+		Path:     o.callbackPath,
+		MaxAge:   int(oidcStateLifetime.Seconds()),
+		Secure:   o.secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	challenge := sha256.Sum256([]byte(state.CodeVerifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {o.cfg.ClientID},
+		"redirect_uri":          {o.cfg.RedirectURL},
+		"scope":                 {o.scope()},
+		"state":                 {state.State},
+		"nonce":                 {state.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	http.Redirect(w, r, addQuery(provider.AuthorizationEndpoint, query), http.StatusFound)
+	return nil
+}
+
+// callback handles the redirect from the OpenID Provider. It exchanges the
+// authorization code for tokens, validates the ID token and starts the session.
+func (o *oidc) callback(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	query := r.URL.Query()
+	if e := query.Get("error"); e != "" {
+		slog.Info("middleware: oidc authorization failed", slog.String("error", e), slog.String("description", query.Get("error_description")))
+		return NewError(http.StatusUnauthorized, "authorization is denied by the OpenID Provider")
+	}
+
+	cookie, err := r.Cookie(o.stateCookieName())
+	if err != nil {
+		return NewError(http.StatusBadRequest, "login state is not found")
+	}
+	var state oidcState
+	if err := o.open(o.stateCookieName(), cookie.Value, &state); err != nil ||
+		subtle.ConstantTimeCompare([]byte(state.State), []byte(query.Get("state"))) != 1 {
+		return NewError(http.StatusBadRequest, "login state mismatch")
+	}
+
+	token, err := o.token(ctx, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {query.Get("code")},
+		"redirect_uri":  {o.cfg.RedirectURL},
+		"code_verifier": {state.CodeVerifier},
+	})
+	if err != nil {
+		slog.Info("middleware: oidc code exchange failed", slog.String("error", err.Error()))
+		return NewError(http.StatusUnauthorized, "failed to exchange the authorization code")
+	}
+	session, err := o.newSession(ctx, token, state.Nonce)
+	if err != nil {
+		slog.Info("middleware: oidc ID token is invalid", slog.String("error", err.Error()))
+		return NewError(http.StatusUnauthorized, "ID token is invalid")
+	}
+	if err := o.setSession(w, r, session); err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     o.stateCookieName(),
+		Path:     o.callbackPath,
+		MaxAge:   -1,
+		Secure:   o.secure,
+		HttpOnly: true,
+	})
+	http.Redirect(w, r, localPath(state.RedirectPath), http.StatusFound)
+	return nil
+}
+
+// logout ends the session and redirects the browser to the end session
+// endpoint of the OpenID Provider if it is advertised.
+func (o *oidc) logout(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	var idToken string
+	var session oidcSession
+	if err := o.readSession(r, &session); err == nil {
+		idToken = session.IDToken
+	}
+	o.deleteSessionCookies(w, r, 0)
+
+	redirect := o.cfg.PostLogoutRedirectURL
+	if redirect == "" {
+		redirect = "/"
+	}
+	provider, err := o.discover(ctx)
+	if err != nil || provider.EndSessionEndpoint == "" {
+		http.Redirect(w, r, redirect, http.StatusFound)
+		return nil // The local session is ended even if the provider is not available.
+	}
+	query := url.Values{"client_id": {o.cfg.ClientID}}
+	if idToken != "" {
+		query.Set("id_token_hint", idToken)
+	}
+	if o.cfg.PostLogoutRedirectURL != "" {
+		query.Set("post_logout_redirect_uri", o.cfg.PostLogoutRedirectURL)
+	}
+	http.Redirect(w, r, addQuery(provider.EndSessionEndpoint, query), http.StatusFound)
+	return nil
+}
+
+// refresh renews the session with the refresh token.
+func (o *oidc) refresh(ctx context.Context, session *oidcSession) (*oidcSession, error) {
+	token, err := o.token(ctx, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {session.RefreshToken},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if token.IDToken == "" {
+		// The OpenID Provider may omit the ID token on refresh. The claims are kept as they are.
+		renewed := &oidcSession{
+			IDToken:      session.IDToken,
+			RefreshToken: session.RefreshToken,
+			Expiry:       o.now().Add(time.Duration(token.ExpiresIn) * time.Second).Unix(),
+		}
+		if token.RefreshToken != "" {
+			renewed.RefreshToken = token.RefreshToken
+		}
+		return renewed, nil
+	}
+	renewed, err := o.newSession(ctx, token, "")
+	if err != nil {
+		return nil, err
+	}
+	if renewed.RefreshToken == "" {
+		renewed.RefreshToken = session.RefreshToken
+	}
+	return renewed, nil
+}
+
+// newSession validates the ID token of the token response and returns a new session.
+// The nonce is not checked if it is empty.
+func (o *oidc) newSession(ctx context.Context, token *oidcTokenResponse, nonce string) (*oidcSession, error) {
+	provider, err := o.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if token.IDToken == "" {
+		return nil, errors.New("token response has no ID token")
+	}
+	claims, err := verifyJWT(ctx, o.keySet(), token.IDToken)
+	if err != nil {
+		return nil, err
+	}
+	if err := claims.validate(provider.Issuer, o.cfg.ClientID, o.now()); err != nil {
+		return nil, err
+	}
+	if nonce != "" && subtle.ConstantTimeCompare([]byte(claims.String("nonce")), []byte(nonce)) != 1 {
+		return nil, errors.New("nonce mismatch")
+	}
+
+	expiry, _ := claims.time("exp") // validate() ensures that "exp" exists.
+	if token.ExpiresIn > 0 {
+		expiry = o.now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	}
+	return &oidcSession{
+		IDToken:      token.IDToken,
+		RefreshToken: token.RefreshToken,
+		Expiry:       expiry.Unix(),
+	}, nil
+}
+
+// token sends a request to the token endpoint with the client credentials.
+func (o *oidc) token(ctx context.Context, form url.Values) (*oidcTokenResponse, error) {
+	provider, err := o.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create a token request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(o.cfg.ClientID), url.QueryEscape(o.cfg.ClientSecret))
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send a token request: %w", err)
+	}
+	defer resp.Body.Close() //nolint:errcheck
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024)) // The body is only used for the error message.
+		return nil, fmt.Errorf("token endpoint returned status %d: %s", resp.StatusCode, body)
+	}
+	var token oidcTokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return nil, fmt.Errorf("failed to decode the token response: %w", err)
+	}
+	return &token, nil
+}
+
+// discover returns the OpenID Provider metadata. The metadata is fetched on
+// first use, so that hurrah can start even if the OpenID Provider is down.
+func (o *oidc) discover(ctx context.Context) (*oidcProvider, error) {
+	o.mu.Lock()
+	provider := o.provider
+	o.mu.Unlock()
+	if provider != nil {
+		return provider, nil
+	}
+
+	if err := o.discovery.do(ctx, o.fetchProvider); err != nil {
+		return nil, err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.provider, nil
+}
+
+// fetchProvider fetches the OpenID Provider metadata and creates the key set.
+func (o *oidc) fetchProvider(ctx context.Context) error {
+	issuer := strings.TrimSuffix(o.cfg.Issuer, "/")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return fmt.Errorf("failed to create a discovery request: %w", err)
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to fetch the provider metadata: %w", err)
+	}
+	defer resp.Body.Close() //nolint:errcheck
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch the provider metadata: unexpected status %d", resp.StatusCode)
+	}
+	var provider oidcProvider
+	if err := json.NewDecoder(resp.Body).Decode(&provider); err != nil {
+		return fmt.Errorf("failed to decode the provider metadata: %w", err)
+	}
+	if strings.TrimSuffix(provider.Issuer, "/") != issuer {
+		return fmt.Errorf("provider metadata has unexpected issuer %q", provider.Issuer)
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.provider = &provider
+	o.keys = newKeySet(provider.JWKSURI, o.client)
+	return nil
+}
+
+// keySet returns the key set of the OpenID Provider. discover must be called beforehand.
+func (o *oidc) keySet() *keySet {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.keys
+}
+
+// readSession reads the session from the cookies written by setSession.
+func (o *oidc) readSession(r *http.Request, session *oidcSession) error {
+	cookie, err := r.Cookie(o.cookieName)
+	if err != nil {
+		return err
+	}
+	value := cookie.Value
+	for i := 1; i < maxOIDCCookieChunks; i++ {
+		chunk, err := r.Cookie(o.sessionCookieName(i))
+		if err != nil {
+			break
+		}
+		value += chunk.Value
+	}
+	return o.open(o.cookieName, value, session)
+}
+
+// setSession writes the session to the cookies. The encrypted session is split
+// into chunks of oidcCookieChunkSize, and the chunks of a previous larger
+// session are deleted.
+func (o *oidc) setSession(w http.ResponseWriter, r *http.Request, session *oidcSession) error {
+	value, err := o.seal(o.cookieName, session)
+	if err != nil {
+		return err
+	}
+	chunks := (len(value) + oidcCookieChunkSize - 1) / oidcCookieChunkSize
+	if chunks > maxOIDCCookieChunks {
+		return fmt.Errorf("session is too large for the cookies (%d bytes)", len(value))
+	}
+	for i := range chunks {
+		http.SetCookie(w, &http.Cookie{
+			Name:     o.sessionCookieName(i),
+			Value:    value[i*oidcCookieChunkSize : min((i+1)*oidcCookieChunkSize, len(value))],
+			Path:     "/",
+			Secure:   o.secure,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	o.deleteSessionCookies(w, r, chunks)
+	return nil
+}
+
+// deleteSessionCookies deletes the session cookies of the request from the chunk
+// at index from.
+func (o *oidc) deleteSessionCookies(w http.ResponseWriter, r *http.Request, from int) {
+	for i := from; i < maxOIDCCookieChunks; i++ {
+		if _, err := r.Cookie(o.sessionCookieName(i)); err != nil {
+			continue
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     o.sessionCookieName(i),
+			Path:     "/",
+			MaxAge:   -1,
+			Secure:   o.secure,
+			HttpOnly: true,
+		})
+	}
+}
+
+// sessionCookieName returns the name of the session cookie of the chunk at index i.
+func (o *oidc) sessionCookieName(i int) string {
+	if i == 0 {
+		return o.cookieName
+	}
+	return fmt.Sprintf("%s_%d", o.cookieName, i)
+}
+
+// claims returns the claims of the ID token. The ID token was verified when the
+// session started, and the session is encrypted, so the signature is not verified again.
+func (s *oidcSession) claims() (Claims, error) {
+	parts := strings.Split(s.IDToken, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed ID token in the session")
+	}
+	return decodeJWTClaims(parts[1])
+}
+
+// seal encrypts v for the cookie. The cookie name is bound as additional data,
+// so that a value can not be moved to another cookie.
+func (o *oidc) seal(name string, v any) (string, error) {
+	plaintext, err := json.Marshal(v)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode the cookie: %w", err)
+	}
+	nonce := make([]byte, o.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate a nonce: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(o.aead.Seal(nonce, nonce, plaintext, []byte(name))), nil
+}
+
+// open decrypts the cookie value sealed by seal.
+func (o *oidc) open(name, value string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return fmt.Errorf("malformed cookie: %w", err)
+	}
+	if len(data) < o.aead.NonceSize() {
+		return errors.New("malformed cookie")
+	}
+	plaintext, err := o.aead.Open(nil, data[:o.aead.NonceSize()], data[o.aead.NonceSize():], []byte(name))
+	if err != nil {
+		return fmt.Errorf("failed to decrypt the cookie: %w", err)
+	}
+	return json.Unmarshal(plaintext, v)
+}
+
+// stateCookieName returns the name of the login state cookie.
+func (o *oidc) stateCookieName() string {
+	return o.cookieName + oidcStateCookieSuffix
+}
+
+// scope returns the scope parameter of the authorization request.
+func (o *oidc) scope() string {
+	scopes := []string{"openid"}
+	for _, s := range o.cfg.Scopes {
+		if s != "openid" {
+			scopes = append(scopes, s)
+		}
+	}
+	return strings.Join(scopes, " ")
+}
+
+// randomString returns a URL safe random string with 256 bits of entropy.
+func randomString() string {
+	b := make([]byte, 32)
+	_, _ = rand.Read(b) // crypto/rand.Read never returns an error.
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// addQuery appends the query to the URL, keeping the existing query parameters.
+func addQuery(rawURL string, query url.Values) string {
+	if strings.Contains(rawURL, "?") {
+		return rawURL + "&" + query.Encode()
+	}
+	return rawURL + "?" + query.Encode()
+}
+
+// localPath returns path if it is a local path. Otherwise it returns "/" to prevent open redirects.
+func localPath(path string) string {
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") || strings.HasPrefix(path, "/\\") {
+		return "/"
+	}
+	return path
+}
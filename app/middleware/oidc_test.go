@@ -0,0 +1,313 @@
+package middleware
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/nao1215/hurrah/config"
+)
+
+// newOIDCTestGateway starts a gateway protected by the oidc middleware.
+// The backend responds with the subject of the authenticated user.
+func newOIDCTestGateway(t *testing.T, idp *testIdP) (*httptest.Server, *oidc) {
+	t.Helper()
+
+	var handler http.Handler
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(gateway.Close)
+
+	o, err := newOIDC(config.OIDC{
+		Issuer:                idp.URL,
+		ClientID:              "hurrah",
+		ClientSecret:          "secret",
+		RedirectURL:           gateway.URL + "/app/callback",
+		Scopes:                []string{"email"},
+		CookieSecret:          strings.Repeat("s", 32),
+		LogoutPath:            "/app/logout",
+		PostLogoutRedirectURL: gateway.URL + "/bye",
+	}, "/app/", 5*time.Second)
+	if err != nil {
+		t.Fatalf("newOIDC() error = %v", err)
+	}
+
+	backend := func(ctx context.Context, w http.ResponseWriter, _ *http.Request) error {
+		claims, ok := ClaimsFromContext(ctx)
+		if !ok {
+			t.Error("claims are not found in the context")
+		}
+		_, err := w.Write([]byte(claims.String("sub")))
+		return err
+	}
+	handler = Chain(backend, o.handle).AdaptHandler()
+	return gateway, o
+}
+
+// newTestClient returns a client with a cookie jar. If follow is false, redirects are not followed.
+func newTestClient(t *testing.T, follow bool) *http.Client {
+	t.Helper()
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Jar: jar}
+	if !follow {
+		client.CheckRedirect = func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	}
+	return client
+}
+
+// doRequest sends a request and returns the status code and the body.
+func doRequest(t *testing.T, client *http.Client, method, url string) (*http.Response, string) {
+	t.Helper()
+
+	req, err := http.NewRequestWithContext(context.Background(), method, url, nil)
+	if err != nil {
+		t.Fatalf("http.NewRequestWithContext() error = %v", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("client.Do() error = %v", err)
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("io.ReadAll() error = %v", err)
+	}
+	return resp, string(body)
+}
+
+func TestOIDC(t *testing.T) {
+	t.Run("login with authorization code flow", func(t *testing.T) {
+		idp := newTestIdP(t, "hurrah")
+		gateway, _ := newOIDCTestGateway(t, idp)
+		client := newTestClient(t, true)
+
+		resp, body := doRequest(t, client, http.MethodGet, gateway.URL+"/app/orders?page=2")
+		if diff := cmp.Diff(http.StatusOK, resp.StatusCode); diff != "" {
+			t.Errorf("status mismatch (-want +got):\n%s", diff)
+		}
+		if diff := cmp.Diff("alice", body); diff != "" {
+			t.Errorf("body mismatch (-want +got):\n%s", diff)
+		}
+		if diff := cmp.Diff("/app/orders?page=2", resp.Request.URL.RequestURI()); diff != "" {
+			t.Errorf("the browser is not redirected to the original URL (-want +got):\n%s", diff)
+		}
+
+		// The session cookie is used for the next request.
+		resp, _ = doRequest(t, newTestClientWithJar(client), http.MethodGet, gateway.URL+"/app/")
+		if diff := cmp.Diff(http.StatusOK, resp.StatusCode); diff != "" {
+			t.Errorf("status mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("large session is split into cookies", func(t *testing.T) {
+		idp := newTestIdP(t, "hurrah")
+		idp.claims = map[string]any{"groups": strings.Repeat("g", 6000)}
+		gateway, _ := newOIDCTestGateway(t, idp)
+		client := newTestClient(t, true)
+
+		resp, body := doRequest(t, client, http.MethodGet, gateway.URL+"/app/")
+		if diff := cmp.Diff(http.StatusOK, resp.StatusCode); diff != "" {
+			t.Errorf("status mismatch (-want +got):\n%s", diff)
+		}
+		if diff := cmp.Diff("alice", body); diff != "" {
+			t.Errorf("body mismatch (-want +got):\n%s", diff)
+		}
+		u, err := url.Parse(gateway.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cookies := client.Jar.Cookies(u)
+		for _, cookie := range cookies {
+			if len(cookie.Value) > oidcCookieChunkSize {
+				t.Errorf("cookie %s has %d bytes, want at most %d", cookie.Name, len(cookie.Value), oidcCookieChunkSize)
+			}
+		}
+		if len(cookies) < 2 {
+			t.Errorf("session is written to %d cookies, want chunks", len(cookies))
+		}
+	})
+
+	t.Run("unauthenticated browser is redirected to the provider", func(t *testing.T) {
+		idp := newTestIdP(t, "hurrah")
+		gateway, _ := newOIDCTestGateway(t, idp)
+
+		resp, _ := doRequest(t, newTestClient(t, false), http.MethodGet, gateway.URL+"/app/")
+		if diff := cmp.Diff(http.StatusFound, resp.StatusCode); diff != "" {
+			t.Errorf("status mismatch (-want +got):\n%s", diff)
+		}
+		location, err := resp.Location()
+		if err != nil {
+			t.Fatalf("resp.Location() error = %v", err)
+		}
+		q := location.Query()
+		for key, want := range map[string]string{
+			"response_type":         "code",
+			"client_id":             "hurrah",
+			"scope":                 "openid email",
+			"code_challenge_method": "S256",
+			"redirect_uri":          gateway.URL + "/app/callback",
+		} {
+			if diff := cmp.Diff(want, q.Get(key)); diff != "" {
+				t.Errorf("query %s mismatch (-want +got):\n%s", key, diff)
+			}
+		}
+		for _, key := range []string{"state", "nonce", "code_challenge"} {
+			if q.Get(key) == "" {
+				t.Errorf("query %s is empty", key)
+			}
+		}
+	})
+
+	t.Run("unauthenticated POST is rejected", func(t *testing.T) {
+		idp := newTestIdP(t, "hurrah")
+		gateway, _ := newOIDCTestGateway(t, idp)
+
+		resp, _ := doRequest(t, newTestClient(t, false), http.MethodPost, gateway.URL+"/app/")
+		if diff := cmp.Diff(http.StatusUnauthorized, resp.StatusCode); diff != "" {
+			t.Errorf("status mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("callback with mismatched state is rejected", func(t *testing.T) {
+		idp := newTestIdP(t, "hurrah")
+		gateway, _ := newOIDCTestGateway(t, idp)
+		client := newTestClient(t, false)
+
+		// Start a login to get the state cookie.
+		doRequest(t, client, http.MethodGet, gateway.URL+"/app/")
+		resp, _ := doRequest(t, client, http.MethodGet, gateway.URL+"/app/callback?code=abc&state=forged")
+		if diff := cmp.Diff(http.StatusBadRequest, resp.StatusCode); diff != "" {
+			t.Errorf("status mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("expired session is renewed with the refresh token", func(t *testing.T) {
+		idp := newTestIdP(t, "hurrah")
+		idp.expiresIn = 60
+		gateway, o := newOIDCTestGateway(t, idp)
+		client := newTestClient(t, true)
+
+		doRequest(t, client, http.MethodGet, gateway.URL+"/app/")
+		o.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+
+		resp, body := doRequest(t, client, http.MethodGet, gateway.URL+"/app/")
+		if diff := cmp.Diff(http.StatusOK, resp.StatusCode); diff != "" {
+			t.Errorf("status mismatch (-want +got):\n%s", diff)
+		}
+		if diff := cmp.Diff("alice", body); diff != "" {
+			t.Errorf("body mismatch (-want +got):\n%s", diff)
+		}
+		if diff := cmp.Diff(1, idp.refreshCount); diff != "" {
+			t.Errorf("refresh count mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("logout ends the session", func(t *testing.T) {
+		idp := newTestIdP(t, "hurrah")
+		gateway, _ := newOIDCTestGateway(t, idp)
+		client := newTestClient(t, true)
+		doRequest(t, client, http.MethodGet, gateway.URL+"/app/")
+
+		noFollow := newTestClientWithJar(client)
+		noFollow.CheckRedirect = func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+		resp, _ := doRequest(t, noFollow, http.MethodGet, gateway.URL+"/app/logout")
+		location, err := resp.Location()
+		if err != nil {
+			t.Fatalf("resp.Location() error = %v", err)
+		}
+		if diff := cmp.Diff(idp.URL+"/logout", location.Scheme+"://"+location.Host+location.Path); diff != "" {
+			t.Errorf("end session endpoint mismatch (-want +got):\n%s", diff)
+		}
+		if location.Query().Get("id_token_hint") == "" {
+			t.Error("id_token_hint is empty")
+		}
+		if diff := cmp.Diff(gateway.URL+"/bye", location.Query().Get("post_logout_redirect_uri")); diff != "" {
+			t.Errorf("post_logout_redirect_uri mismatch (-want +got):\n%s", diff)
+		}
+
+		resp, _ = doRequest(t, noFollow, http.MethodGet, gateway.URL+"/app/")
+		if diff := cmp.Diff(http.StatusFound, resp.StatusCode); diff != "" {
+			t.Errorf("status mismatch after logout (-want +got):\n%s", diff)
+		}
+	})
+}
+
+// newTestClientWithJar returns a client that shares the cookie jar of c.
+func newTestClientWithJar(c *http.Client) *http.Client {
+	return &http.Client{Jar: c.Jar}
+}
+
+func Test_newOIDC(t *testing.T) {
+	t.Parallel()
+
+	valid := config.OIDC{
+		Issuer:       "https://idp.example.com",
+		ClientID:     "hurrah",
+		RedirectURL:  "https://gateway.example.com/app/callback",
+		CookieSecret: strings.Repeat("s", 32),
+	}
+	tests := []struct {
+		name    string
+		modify  func(*config.OIDC)
+		wantErr bool
+	}{
+		{
+			name:    "valid settings",
+			modify:  func(*config.OIDC) {},
+			wantErr: false,
+		},
+		{
+			name:    "issuer is missing",
+			modify:  func(c *config.OIDC) { c.Issuer = "" },
+			wantErr: true,
+		},
+		{
+			name:    "cookie secret is too short",
+			modify:  func(c *config.OIDC) { c.CookieSecret = "short" },
+			wantErr: true,
+		},
+		{
+			name:    "redirect url is not under the route path",
+			modify:  func(c *config.OIDC) { c.RedirectURL = "https://gateway.example.com/callback" },
+			wantErr: true,
+		},
+		{
+			name:    "redirect url is under another route with the same prefix",
+			modify:  func(c *config.OIDC) { c.RedirectURL = "https://gateway.example.com/application/callback" },
+			wantErr: true,
+		},
+		{
+			name:    "logout path is not under the route path",
+			modify:  func(c *config.OIDC) { c.LogoutPath = "/logout" },
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			cfg := valid
+			tt.modify(&cfg)
+			if _, err := newOIDC(cfg, "/app/", time.Second); (err != nil) != tt.wantErr {
+				t.Errorf("newOIDC() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
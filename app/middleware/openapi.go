@@ -0,0 +1,200 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/gorillamux"
+	"github.com/nao1215/hurrah/config"
+)
+
+// defaultOpenAPIMaxBodyBytes is the default maximum size of the body read to validate it.
+const defaultOpenAPIMaxBodyBytes = 1 << 20
+
+// openAPIViolation is a violation of the OpenAPI document.
+type openAPIViolation struct {
+	In      string `json:"in"`             // In is "path", "query", "header", "cookie" or "body".
+	Name    string `json:"name,omitempty"` // Name is the parameter name or the JSON pointer in the body. e.g., "limit", "/items/0/id"
+	Message string `json:"message"`
+}
+
+// openAPI is the request validation against an OpenAPI document.
+type openAPI struct {
+	cfg    config.OpenAPI
+	router routers.Router
+}
+
+// OpenAPI is a middleware that validates the path parameters, query strings,
+// headers, cookies and bodies of requests against an OpenAPI 3 document.
+// Invalid requests get 400 with the violations in the "violations" member of the
+// problem details. Requests that match no operation in the document are
+// forwarded as they are, or rejected with 404 or 405 if reject_unknown_operations is set.
+// The security requirements of the document are not checked; use the
+// authentication middlewares for them. The body is read into memory to validate
+// it, so bodies larger than max_body_bytes get 413.
+func OpenAPI(cfg config.OpenAPI) (Middleware, error) {
+	if cfg.MaxBodyBytes <= 0 {
+		cfg.MaxBodyBytes = defaultOpenAPIMaxBodyBytes
+	}
+	loader := openapi3.NewLoader()
+	doc, err := loader.LoadFromFile(cfg.Spec)
+	if err != nil {
+		return nil, fmt.Errorf("middleware: failed to load the OpenAPI document %s: %w", cfg.Spec, err)
+	}
+	if err := doc.Validate(loader.Context); err != nil {
+		return nil, fmt.Errorf("middleware: invalid OpenAPI document %s: %w", cfg.Spec, err)
+	}
+	doc.Servers, err = openAPIServers(doc.Servers, cfg.BasePath)
+	if err != nil {
+		return nil, err
+	}
+	router, err := gorillamux.NewRouter(doc)
+	if err != nil {
+		return nil, fmt.Errorf("middleware: failed to create the OpenAPI router: %w", err)
+	}
+	o := &openAPI{cfg: cfg, router: router}
+	return o.handle, nil
+}
+
+// openAPIServers returns the servers that have only the paths of the servers, so
+// that the operations match regardless of the host the gateway is accessed by.
+// If basePath is set, it is the only server.
+func openAPIServers(servers openapi3.Servers, basePath string) (openapi3.Servers, error) {
+	if basePath != "" {
+		return openapi3.Servers{{URL: basePath}}, nil
+	}
+	if len(servers) == 0 {
+		return openapi3.Servers{{URL: "/"}}, nil
+	}
+	paths := make(openapi3.Servers, 0, len(servers))
+	for _, server := range servers {
+		u, err := url.Parse(server.URL)
+		if err != nil {
+			return nil, fmt.Errorf("middleware: invalid server url %q in the OpenAPI document: %w", server.URL, err)
+		}
+		path := u.Path
+		if path == "" {
+			path = "/"
+		}
+		paths = append(paths, &openapi3.Server{URL: path, Variables: server.Variables})
+	}
+	return paths, nil
+}
+
+// handle is the Middleware of the openAPI.
+func (o *openAPI) handle(next HandlerWithCtx) HandlerWithCtx {
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+		route, pathParams, err := o.router.FindRoute(r)
+		if err != nil {
+			if !o.cfg.RejectUnknownOperations {
+				return next(ctx, w, r)
+			}
+			if errors.Is(err, routers.ErrMethodNotAllowed) {
+				return NewError(http.StatusMethodNotAllowed, fmt.Sprintf("%s %s is not documented", r.Method, r.URL.Path))
+			}
+			return NewError(http.StatusNotFound, fmt.Sprintf("%s %s is not documented", r.Method, r.URL.Path))
+		}
+
+		if hasBody(r) {
+			if r.ContentLength > o.cfg.MaxBodyBytes {
+				return NewError(http.StatusRequestEntityTooLarge, fmt.Sprintf("request body exceeds %d bytes", o.cfg.MaxBodyBytes))
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, o.cfg.MaxBodyBytes)
+		}
+		err = openapi3filter.ValidateRequest(ctx, &openapi3filter.RequestValidationInput{
+			Request:    r,
+			PathParams: pathParams,
+			Route:      route,
+			Options: &openapi3filter.Options{
+				MultiError:         true,
+				AuthenticationFunc: openapi3filter.NoopAuthenticationFunc,
+			},
+		})
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				return NewError(http.StatusRequestEntityTooLarge, fmt.Sprintf("request body exceeds %d bytes", maxBytesErr.Limit))
+			}
+			e := NewError(http.StatusBadRequest, "request does not conform to the OpenAPI document")
+			e.Extensions = map[string]any{"violations": openAPIViolations(err)}
+			return e
+		}
+		return next(ctx, w, r)
+	}
+}
+
+// openAPIViolations converts the validation error to the violations.
+func openAPIViolations(err error) []openAPIViolation {
+	if multi, ok := err.(openapi3.MultiError); ok { //nolint:errorlint // errors.As finds the MultiError wrapped in a RequestError.
+		var violations []openAPIViolation
+		for _, e := range multi {
+			violations = append(violations, openAPIViolations(e)...)
+		}
+		return violations
+	}
+
+	var reqErr *openapi3filter.RequestError
+	if !errors.As(err, &reqErr) {
+		return []openAPIViolation{{Message: err.Error()}}
+	}
+	switch {
+	case reqErr.Parameter != nil:
+		return []openAPIViolation{{
+			In:      reqErr.Parameter.In,
+			Name:    reqErr.Parameter.Name,
+			Message: openAPIMessage(reqErr),
+		}}
+	case reqErr.RequestBody != nil:
+		var bodyMulti openapi3.MultiError
+		if errors.As(reqErr.Err, &bodyMulti) {
+			violations := make([]openAPIViolation, 0, len(bodyMulti))
+			for _, e := range bodyMulti {
+				violations = append(violations, bodyViolation(e))
+			}
+			// The order of the schema errors depends on the map iteration.
+			slices.SortFunc(violations, func(a, b openAPIViolation) int {
+				return strings.Compare(a.Name, b.Name)
+			})
+			return violations
+		}
+		if reqErr.Err != nil {
+			return []openAPIViolation{bodyViolation(reqErr.Err)}
+		}
+		return []openAPIViolation{{In: "body", Message: reqErr.Reason}}
+	default:
+		return []openAPIViolation{{Message: openAPIMessage(reqErr)}}
+	}
+}
+
+// bodyViolation converts an error of the request body to a violation.
+func bodyViolation(err error) openAPIViolation {
+	var schemaErr *openapi3.SchemaError
+	if errors.As(err, &schemaErr) {
+		return openAPIViolation{
+			In:      "body",
+			Name:    "/" + strings.Join(schemaErr.JSONPointer(), "/"),
+			Message: schemaErr.Reason,
+		}
+	}
+	return openAPIViolation{In: "body", Message: err.Error()}
+}
+
+// openAPIMessage returns the message of the error without the parameter name.
+func openAPIMessage(err *openapi3filter.RequestError) string {
+	var schemaErr *openapi3.SchemaError
+	if errors.As(err.Err, &schemaErr) {
+		return schemaErr.Reason
+	}
+	if err.Err != nil {
+		return err.Err.Error()
+	}
+	return err.Reason
+}
@@ -0,0 +1,263 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/nao1215/hurrah/config"
+)
+
+const testOpenAPISpec = `
+openapi: 3.0.3
+info:
+  title: pets
+  version: 1.0.0
+servers:
+  - url: https://api.example.com/api/v1
+paths:
+  /pets:
+    get:
+      parameters:
+        - name: limit
+          in: query
+          schema:
+            type: integer
+            maximum: 100
+      responses:
+        "200":
+          description: ok
+    post:
+      parameters:
+        - name: X-Request-Id
+          in: header
+          required: true
+          schema:
+            type: string
+      requestBody:
+        required: true
+        content:
+          application/json:
+            schema:
+              type: object
+              required: [name]
+              properties:
+                name:
+                  type: string
+                age:
+                  type: integer
+                  minimum: 0
+      responses:
+        "201":
+          description: created
+  /pets/{id}:
+    get:
+      parameters:
+        - name: id
+          in: path
+          required: true
+          schema:
+            type: integer
+      responses:
+        "200":
+          description: ok
+`
+
+func TestOpenAPI(t *testing.T) {
+	t.Parallel()
+
+	spec := filepath.Join(t.TempDir(), "openapi.yaml")
+	if err := os.WriteFile(spec, []byte(testOpenAPISpec), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ok := func(_ context.Context, w http.ResponseWriter, _ *http.Request) error {
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+
+	tests := []struct {
+		name           string
+		cfg            config.OpenAPI
+		method         string
+		target         string
+		body           string
+		header         http.Header
+		want           int
+		wantViolations []openAPIViolation
+	}{
+		{
+			name:   "valid query",
+			cfg:    config.OpenAPI{Spec: spec},
+			method: http.MethodGet,
+			target: "/api/v1/pets?limit=10",
+			want:   http.StatusOK,
+		},
+		{
+			name:   "invalid query",
+			cfg:    config.OpenAPI{Spec: spec},
+			method: http.MethodGet,
+			target: "/api/v1/pets?limit=1000",
+			want:   http.StatusBadRequest,
+			wantViolations: []openAPIViolation{
+				{In: "query", Name: "limit", Message: "number must be at most 100"},
+			},
+		},
+		{
+			name:   "invalid path parameter",
+			cfg:    config.OpenAPI{Spec: spec},
+			method: http.MethodGet,
+			target: "/api/v1/pets/abc",
+			want:   http.StatusBadRequest,
+			wantViolations: []openAPIViolation{
+				{In: "path", Name: "id", Message: `value abc: an invalid integer: invalid syntax`},
+			},
+		},
+		{
+			name:   "valid body",
+			cfg:    config.OpenAPI{Spec: spec},
+			method: http.MethodPost,
+			target: "/api/v1/pets",
+			body:   `{"name": "tama", "age": 3}`,
+			header: http.Header{"Content-Type": {"application/json"}, "X-Request-Id": {"1"}},
+			want:   http.StatusOK,
+		},
+		{
+			name:   "invalid header and body",
+			cfg:    config.OpenAPI{Spec: spec},
+			method: http.MethodPost,
+			target: "/api/v1/pets",
+			body:   `{"age": -1}`,
+			header: http.Header{"Content-Type": {"application/json"}},
+			want:   http.StatusBadRequest,
+			wantViolations: []openAPIViolation{
+				{In: "header", Name: "X-Request-Id", Message: "value is required but missing"},
+				{In: "body", Name: "/age", Message: "number must be at least 0"},
+				{In: "body", Name: "/name", Message: `property "name" is missing`},
+			},
+		},
+		{
+			name:   "unknown operation is forwarded",
+			cfg:    config.OpenAPI{Spec: spec},
+			method: http.MethodGet,
+			target: "/api/v1/owners",
+			want:   http.StatusOK,
+		},
+		{
+			name:   "unknown path is rejected",
+			cfg:    config.OpenAPI{Spec: spec, RejectUnknownOperations: true},
+			method: http.MethodGet,
+			target: "/api/v1/owners",
+			want:   http.StatusNotFound,
+		},
+		{
+			name:   "unknown method is rejected",
+			cfg:    config.OpenAPI{Spec: spec, RejectUnknownOperations: true},
+			method: http.MethodDelete,
+			target: "/api/v1/pets",
+			want:   http.StatusMethodNotAllowed,
+		},
+		{
+			name:   "base path",
+			cfg:    config.OpenAPI{Spec: spec, BasePath: "/pets-api", RejectUnknownOperations: true},
+			method: http.MethodGet,
+			target: "/pets-api/pets/1",
+			want:   http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			m, err := OpenAPI(tt.cfg)
+			if err != nil {
+				t.Fatalf("OpenAPI() error = %v", err)
+			}
+			req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			for k, v := range tt.header {
+				req.Header[k] = v
+			}
+			rec := httptest.NewRecorder()
+			Chain(ok, m).AdaptHandler().ServeHTTP(rec, req)
+
+			if diff := cmp.Diff(tt.want, rec.Code); diff != "" {
+				t.Fatalf("status mismatch (-want +got):\n%s\nbody: %s", diff, rec.Body.String())
+			}
+			if tt.wantViolations == nil {
+				return
+			}
+			var problem struct {
+				Violations []openAPIViolation `json:"violations"`
+			}
+			if err := json.NewDecoder(rec.Body).Decode(&problem); err != nil {
+				t.Fatalf("failed to decode the problem details: %v", err)
+			}
+			if diff := cmp.Diff(tt.wantViolations, problem.Violations); diff != "" {
+				t.Errorf("violations mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	t.Run("body over max_body_bytes", func(t *testing.T) {
+		t.Parallel()
+
+		m, err := OpenAPI(config.OpenAPI{Spec: spec, MaxBodyBytes: 8})
+		if err != nil {
+			t.Fatalf("OpenAPI() error = %v", err)
+		}
+		for _, contentLength := range []int64{26, -1} {
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/pets", strings.NewReader(`{"name": "tama", "age": 3}`))
+			req.ContentLength = contentLength
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-Request-Id", "1")
+			rec := httptest.NewRecorder()
+			Chain(ok, m).AdaptHandler().ServeHTTP(rec, req)
+
+			if diff := cmp.Diff(http.StatusRequestEntityTooLarge, rec.Code); diff != "" {
+				t.Errorf("status with Content-Length %d mismatch (-want +got):\n%s", contentLength, diff)
+			}
+		}
+	})
+
+	t.Run("body over the request_limits limit", func(t *testing.T) {
+		t.Parallel()
+
+		m, err := OpenAPI(config.OpenAPI{Spec: spec})
+		if err != nil {
+			t.Fatalf("OpenAPI() error = %v", err)
+		}
+		limits, err := RequestLimits(config.RequestLimits{MaxBodyBytes: 8})
+		if err != nil {
+			t.Fatalf("RequestLimits() error = %v", err)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/pets", strings.NewReader(`{"name": "tama", "age": 3}`))
+		req.ContentLength = -1 // The size is known only while the body is read.
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Request-Id", "1")
+		rec := httptest.NewRecorder()
+		Chain(ok, limits, m).AdaptHandler().ServeHTTP(rec, req)
+
+		if diff := cmp.Diff(http.StatusRequestEntityTooLarge, rec.Code); diff != "" {
+			t.Errorf("status mismatch (-want +got):\n%s\nbody: %s", diff, rec.Body.String())
+		}
+	})
+
+	t.Run("invalid document", func(t *testing.T) {
+		t.Parallel()
+
+		broken := filepath.Join(t.TempDir(), "broken.yaml")
+		if err := os.WriteFile(broken, []byte("openapi: 3.0.3\npaths: {}\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		for _, cfg := range []config.OpenAPI{{Spec: broken}, {Spec: filepath.Join(t.TempDir(), "missing.yaml")}} {
+			if _, err := OpenAPI(cfg); err == nil {
+				t.Errorf("OpenAPI(%+v) error = nil, want error", cfg)
+			}
+		}
+	})
+}
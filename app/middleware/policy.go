@@ -0,0 +1,181 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/cel-go/cel"
+	"github.com/nao1215/hurrah/config"
+)
+
+const (
+	// policyAllow is the effect that allows the request.
+	policyAllow = "allow"
+	// policyDeny is the effect that denies the request.
+	policyDeny = "deny"
+)
+
+// policyRule is a compiled rule of the policy.
+type policyRule struct {
+	name    string
+	effect  string
+	program cel.Program
+}
+
+// policy is the set of allow/deny rules.
+type policy struct {
+	rules  []policyRule
+	effect string // effect is the default effect.
+	now    func() time.Time
+}
+
+// newPolicyEnv returns the CEL environment of the policy. The following variables are available:
+//
+//   - method (string): the request method. e.g., "GET"
+//   - path (string): the request path. e.g., "/orders/1"
+//   - host (string): the request host. e.g., "api.example.com"
+//   - headers (map(string, string)): the request headers. The keys are lower case. e.g., headers["user-agent"]
+//   - query (map(string, string)): the first value of each query parameter.
+//   - client_ip (string): the IP address of the client. See ClientIP.
+//   - time (timestamp): the current time. e.g., time.getHours("Asia/Tokyo")
+//   - claims (map(string, dyn)): the claims set by a preceding middleware such as oidc or rbac.
+func newPolicyEnv() (*cel.Env, error) {
+	return cel.NewEnv(
+		cel.Variable("method", cel.StringType),
+		cel.Variable("path", cel.StringType),
+		cel.Variable("host", cel.StringType),
+		cel.Variable("headers", cel.MapType(cel.StringType, cel.StringType)),
+		cel.Variable("query", cel.MapType(cel.StringType, cel.StringType)),
+		cel.Variable("client_ip", cel.StringType),
+		cel.Variable("time", cel.TimestampType),
+		cel.Variable("claims", cel.MapType(cel.StringType, cel.DynType)),
+	)
+}
+
+// Policy is a middleware that allows or denies requests by rules written in CEL
+// (Common Expression Language). The rules are evaluated in order and the first
+// matching rule decides. The expressions are compiled and type-checked when the
+// middleware is created, so that a broken policy fails at startup.
+// A rule that fails to evaluate denies the request.
+func Policy(cfg config.Policy) (Middleware, error) {
+	p, err := newPolicy(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return p.handle, nil
+}
+
+// newPolicy compiles the rules and returns a new policy.
+func newPolicy(cfg config.Policy) (*policy, error) {
+	env, err := newPolicyEnv()
+	if err != nil {
+		return nil, fmt.Errorf("middleware: failed to create a policy environment: %w", err)
+	}
+
+	p := &policy{
+		rules:  make([]policyRule, 0, len(cfg.Rules)),
+		effect: cfg.Default,
+		now:    time.Now,
+	}
+	switch p.effect {
+	case "":
+		p.effect = policyDeny
+	case policyAllow, policyDeny:
+	default:
+		return nil, fmt.Errorf("middleware: unknown policy default %q", cfg.Default)
+	}
+
+	for i, rule := range cfg.Rules {
+		name := rule.Name
+		if name == "" {
+			name = fmt.Sprintf("rules[%d]", i)
+		}
+		if rule.Effect != policyAllow && rule.Effect != policyDeny {
+			return nil, fmt.Errorf("middleware: policy rule %s has unknown effect %q", name, rule.Effect)
+		}
+		ast, issues := env.Compile(rule.Expression)
+		if issues != nil && issues.Err() != nil {
+			return nil, fmt.Errorf("middleware: failed to compile policy rule %s: %w", name, issues.Err())
+		}
+		if ast.OutputType() != cel.BoolType {
+			return nil, fmt.Errorf("middleware: policy rule %s must evaluate to bool, but it is %s", name, ast.OutputType())
+		}
+		program, err := env.Program(ast)
+		if err != nil {
+			return nil, fmt.Errorf("middleware: failed to build policy rule %s: %w", name, err)
+		}
+		p.rules = append(p.rules, policyRule{name: name, effect: rule.Effect, program: program})
+	}
+	return p, nil
+}
+
+// handle is the Middleware of the policy.
+func (p *policy) handle(next HandlerWithCtx) HandlerWithCtx {
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+		rule, effect, err := p.evaluate(ctx, r)
+		if err != nil {
+			slog.Error("middleware: failed to evaluate the policy",
+				slog.String("rule", rule), slog.String("path", r.URL.Path), slog.String("error", err.Error()))
+			return NewError(http.StatusForbidden, "denied by policy")
+		}
+		if effect == policyDeny {
+			slog.Warn("middleware: policy denied the request",
+				slog.String("rule", rule), slog.String("method", r.Method), slog.String("path", r.URL.Path))
+			return NewError(http.StatusForbidden, "denied by policy")
+		}
+		return next(ctx, w, r)
+	}
+}
+
+// evaluate returns the name and the effect of the first matching rule.
+// If no rule matches, the default effect is returned with an empty name.
+func (p *policy) evaluate(ctx context.Context, r *http.Request) (string, string, error) {
+	activation := p.activation(ctx, r)
+	for _, rule := range p.rules {
+		out, _, err := rule.program.ContextEval(ctx, activation)
+		if err != nil {
+			return rule.name, "", err
+		}
+		matched, ok := out.Value().(bool)
+		if !ok {
+			return rule.name, "", errors.New("rule did not evaluate to bool")
+		}
+		if matched {
+			return rule.name, rule.effect, nil
+		}
+	}
+	return "", p.effect, nil
+}
+
+// activation returns the variables of the request.
+func (p *policy) activation(ctx context.Context, r *http.Request) map[string]any {
+	headers := make(map[string]string, len(r.Header))
+	for name, values := range r.Header {
+		headers[strings.ToLower(name)] = strings.Join(values, ", ")
+	}
+	query := map[string]string{}
+	for name, values := range r.URL.Query() {
+		if len(values) > 0 {
+			query[name] = values[0]
+		}
+	}
+	claims, ok := ClaimsFromContext(ctx)
+	if !ok {
+		claims = Claims{}
+	}
+	return map[string]any{
+		"method":    r.Method,
+		"path":      r.URL.Path,
+		"host":      r.Host,
+		"headers":   headers,
+		"query":     query,
+		"client_ip": clientIP(ctx, r).String(),
+		"time":      p.now(),
+		"claims":    map[string]any(claims),
+	}
+}
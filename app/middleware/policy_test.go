@@ -0,0 +1,166 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/nao1215/hurrah/config"
+)
+
+func TestPolicy(t *testing.T) {
+	cfg := config.Policy{
+		Rules: []config.PolicyRule{
+			{
+				Name:       "block-scanners",
+				Effect:     "deny",
+				Expression: `headers["user-agent"].contains("sqlmap")`,
+			},
+			{
+				Name:   "partners-business-hours",
+				Effect: "allow",
+				Expression: `"partners" in claims.groups && method == "GET" && path.startsWith("/orders")` +
+					` && time.getHours("UTC") >= 9 && time.getHours("UTC") < 18`,
+			},
+			{
+				Name:       "internal",
+				Effect:     "allow",
+				Expression: `client_ip == "10.0.0.1"`,
+			},
+		},
+	}
+	ok := func(_ context.Context, w http.ResponseWriter, _ *http.Request) error {
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		hour       int
+		claims     Claims
+		remoteAddr string
+		userAgent  string
+		want       int
+	}{
+		{
+			name:   "partner GET during business hours",
+			method: http.MethodGet,
+			path:   "/orders/1",
+			hour:   10,
+			claims: Claims{"groups": []any{"partners"}},
+			want:   http.StatusOK,
+		},
+		{
+			name:   "partner GET outside business hours",
+			method: http.MethodGet,
+			path:   "/orders/1",
+			hour:   20,
+			claims: Claims{"groups": []any{"partners"}},
+			want:   http.StatusForbidden,
+		},
+		{
+			name:   "partner POST",
+			method: http.MethodPost,
+			path:   "/orders",
+			hour:   10,
+			claims: Claims{"groups": []any{"partners"}},
+			want:   http.StatusForbidden,
+		},
+		{
+			name:       "internal client",
+			method:     http.MethodPost,
+			path:       "/orders",
+			hour:       20,
+			remoteAddr: "10.0.0.1:1234",
+			want:       http.StatusOK,
+		},
+		{
+			name:       "scanner is denied before other rules",
+			method:     http.MethodGet,
+			path:       "/orders",
+			hour:       10,
+			remoteAddr: "10.0.0.1:1234",
+			userAgent:  "sqlmap/1.0",
+			want:       http.StatusForbidden,
+		},
+		{
+			name:   "missing claim denies the request",
+			method: http.MethodGet,
+			path:   "/orders",
+			hour:   10,
+			want:   http.StatusForbidden,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := newPolicy(cfg)
+			if err != nil {
+				t.Fatalf("newPolicy() error = %v", err)
+			}
+			p.now = func() time.Time { return time.Date(2024, 4, 1, tt.hour, 0, 0, 0, time.UTC) }
+
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.remoteAddr != "" {
+				req.RemoteAddr = tt.remoteAddr
+			}
+			req.Header.Set("User-Agent", tt.userAgent)
+			if tt.claims != nil {
+				req = req.WithContext(withClaims(req.Context(), tt.claims))
+			}
+			rec := httptest.NewRecorder()
+			Chain(ok, p.handle).AdaptHandler().ServeHTTP(rec, req)
+
+			if diff := cmp.Diff(tt.want, rec.Code); diff != "" {
+				t.Errorf("status mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestPolicy_compile(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		cfg  config.Policy
+	}{
+		{
+			name: "syntax error",
+			cfg:  config.Policy{Rules: []config.PolicyRule{{Effect: "allow", Expression: `method == `}}},
+		},
+		{
+			name: "type error",
+			cfg:  config.Policy{Rules: []config.PolicyRule{{Effect: "allow", Expression: `method == 1`}}},
+		},
+		{
+			name: "not bool",
+			cfg:  config.Policy{Rules: []config.PolicyRule{{Effect: "allow", Expression: `path`}}},
+		},
+		{
+			name: "unknown variable",
+			cfg:  config.Policy{Rules: []config.PolicyRule{{Effect: "allow", Expression: `user == "alice"`}}},
+		},
+		{
+			name: "unknown effect",
+			cfg:  config.Policy{Rules: []config.PolicyRule{{Effect: "maybe", Expression: `true`}}},
+		},
+		{
+			name: "unknown default",
+			cfg:  config.Policy{Default: "maybe"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if _, err := Policy(tt.cfg); err == nil {
+				t.Error("Policy() error = nil, want error")
+			}
+		})
+	}
+}
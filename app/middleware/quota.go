@@ -0,0 +1,240 @@
+package middleware
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // The timezone of quotas must be loadable on hosts without the tz database.
+
+	"github.com/nao1215/hurrah/config"
+)
+
+const (
+	// quotaPeriodDay resets the quota at midnight.
+	quotaPeriodDay = "day"
+	// quotaPeriodMonth resets the quota at midnight on the first day of the month.
+	quotaPeriodMonth = "month"
+	// DefaultQuotaAdminPath is the default path of the quota admin API.
+	DefaultQuotaAdminPath = "/_hurrah/quotas"
+)
+
+// quota is the long-window quota of a route.
+type quota struct {
+	cfg   config.Quota
+	route string
+	loc   *time.Location
+	store *QuotaStore
+	now   func() time.Time
+}
+
+// Quota is a middleware that limits the number of requests per day or month.
+// The quota applies to the whole route, or to each client IP address, API key or
+// claim value, in the same way as rate_limit. The usage is kept in the QuotaStore,
+// so it persists across restarts. The periods are aligned to calendar boundaries
+// in the configured timezone. Every response has the X-Quota-Limit,
+// X-Quota-Remaining and X-Quota-Reset headers, and requests over the quota get 429.
+func Quota(cfg config.Quota, route string, store *QuotaStore) (Middleware, error) {
+	q, err := newQuota(cfg, route, store)
+	if err != nil {
+		return nil, err
+	}
+	store.register(q)
+	return q.handle, nil
+}
+
+// newQuota validates the settings and returns a new quota.
+func newQuota(cfg config.Quota, route string, store *QuotaStore) (*quota, error) {
+	switch cfg.Key {
+	case "":
+		cfg.Key = consumerKeyRoute
+	case consumerKeyRoute, consumerKeyIP, consumerKeyAPIKey, consumerKeyClaim:
+	default:
+		return nil, fmt.Errorf("middleware: unknown quota key %q", cfg.Key)
+	}
+	switch cfg.Period {
+	case "":
+		cfg.Period = quotaPeriodMonth
+	case quotaPeriodDay, quotaPeriodMonth:
+	default:
+		return nil, fmt.Errorf("middleware: unknown quota period %q", cfg.Period)
+	}
+	if cfg.Limit <= 0 {
+		return nil, errors.New("middleware: quota requires limit greater than 0")
+	}
+	if cfg.Header == "" {
+		cfg.Header = "X-API-Key"
+	}
+	if cfg.Claim == "" {
+		cfg.Claim = "sub"
+	}
+	loc := time.UTC
+	if cfg.Timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(cfg.Timezone); err != nil {
+			return nil, fmt.Errorf("middleware: failed to load the quota timezone: %w", err)
+		}
+	}
+	return &quota{cfg: cfg, route: route, loc: loc, store: store, now: time.Now}, nil
+}
+
+// period returns the name of the period that includes now and the time the period ends.
+// e.g., "2024-05" and 2024-06-01T00:00:00+09:00
+func (q *quota) period(now time.Time) (string, time.Time) {
+	now = now.In(q.loc)
+	if q.cfg.Period == quotaPeriodDay {
+		start := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, q.loc)
+		return start.Format(time.DateOnly), start.AddDate(0, 0, 1)
+	}
+	start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, q.loc)
+	return start.Format("2006-01"), start.AddDate(0, 1, 0)
+}
+
+// handle is the Middleware of the quota.
+func (q *quota) handle(next HandlerWithCtx) HandlerWithCtx {
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+		consumer := consumerKey(ctx, r, q.cfg.Key, q.cfg.Header, q.cfg.Claim)
+		now := q.now()
+		period, end := q.period(now)
+		usage, allowed, err := q.store.consume(q.route, consumer, period, q.cfg.Limit)
+		if err != nil {
+			return err
+		}
+
+		reset := strconv.FormatInt(int64(end.Sub(now).Round(time.Second).Seconds()), 10)
+		w.Header().Set("X-Quota-Limit", strconv.FormatInt(q.cfg.Limit+usage.Credit, 10))
+		w.Header().Set("X-Quota-Remaining", strconv.FormatInt(usage.remaining(q.cfg.Limit), 10))
+		w.Header().Set("X-Quota-Reset", reset)
+		if !allowed {
+			w.Header().Set("Retry-After", reset)
+			slog.Info("middleware: quota exceeded", slog.String("route", q.route), slog.String("period", period))
+			return NewError(http.StatusTooManyRequests, "quota exceeded")
+		}
+		return next(ctx, w, r)
+	}
+}
+
+// quotaStatus is the response of the quota admin API.
+type quotaStatus struct {
+	Route     string    `json:"route"`
+	Consumer  string    `json:"consumer"`
+	Period    string    `json:"period"`
+	Limit     int64     `json:"limit"`
+	Used      int64     `json:"used"`
+	Credit    int64     `json:"credit"`
+	Remaining int64     `json:"remaining"`
+	Reset     time.Time `json:"reset"`
+}
+
+// quotaRequest is the request body of the quota admin API.
+type quotaRequest struct {
+	Route    string `json:"route"`    // Route is the path of the route. e.g., "/api/"
+	Consumer string `json:"consumer"` // Consumer is the consumer key. e.g., "api_key:secret", "ip:192.0.2.1", "route"
+	Requests int64  `json:"requests"` // Requests is the number of requests to add by a top-up.
+}
+
+// SetAdminAPI sets the quota admin API to the mux. All requests must have the
+// token as a bearer token.
+//
+//	GET  {path}?route=/api/&consumer=api_key:secret  returns the usage.
+//	POST {path}/reset   {"route": "/api/", "consumer": "api_key:secret"} resets the usage.
+//	POST {path}/top_up  {"route": "/api/", "consumer": "api_key:secret", "requests": 1000} adds requests to the limit of the current period.
+func (s *QuotaStore) SetAdminAPI(mux *http.ServeMux, path, token string) {
+	path = strings.TrimSuffix(path, "/")
+	auth := quotaAdminAuth(token)
+
+	mux.Handle("GET "+path, Chain(func(_ context.Context, w http.ResponseWriter, r *http.Request) error {
+		return s.writeStatus(w, r.URL.Query().Get("route"), r.URL.Query().Get("consumer"), nil)
+	}, auth).AdaptHandler())
+
+	mux.Handle("POST "+path+"/reset", Chain(func(_ context.Context, w http.ResponseWriter, r *http.Request) error {
+		req, err := decodeQuotaRequest(r)
+		if err != nil {
+			return err
+		}
+		return s.writeStatus(w, req.Route, req.Consumer, func(u *quotaUsage) {
+			u.Used, u.Credit = 0, 0
+		})
+	}, auth).AdaptHandler())
+
+	mux.Handle("POST "+path+"/top_up", Chain(func(_ context.Context, w http.ResponseWriter, r *http.Request) error {
+		req, err := decodeQuotaRequest(r)
+		if err != nil {
+			return err
+		}
+		if req.Requests <= 0 {
+			return NewError(http.StatusBadRequest, "requests must be greater than 0")
+		}
+		return s.writeStatus(w, req.Route, req.Consumer, func(u *quotaUsage) {
+			u.Credit += req.Requests
+		})
+	}, auth).AdaptHandler())
+}
+
+// writeStatus writes the usage of the consumer in the current period after
+// applying update to it. If update is nil, the usage is not changed.
+func (s *QuotaStore) writeStatus(w http.ResponseWriter, route, consumer string, update func(*quotaUsage)) error {
+	if route == "" || consumer == "" {
+		return NewError(http.StatusBadRequest, "route and consumer are required")
+	}
+	q, ok := s.quota(route)
+	if !ok {
+		return NewError(http.StatusNotFound, fmt.Sprintf("no quota for the route %s", route))
+	}
+
+	period, end := q.period(q.now())
+	var (
+		usage quotaUsage
+		err   error
+	)
+	if update == nil {
+		usage, err = s.usage(route, consumer, period)
+	} else {
+		usage, err = s.update(route, consumer, period, update)
+		slog.Info("middleware: quota updated by the admin API", slog.String("route", route), slog.String("period", period))
+	}
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(quotaStatus{
+		Route:     route,
+		Consumer:  consumer,
+		Period:    period,
+		Limit:     q.cfg.Limit,
+		Used:      usage.Used,
+		Credit:    usage.Credit,
+		Remaining: usage.remaining(q.cfg.Limit),
+		Reset:     end,
+	})
+}
+
+// decodeQuotaRequest decodes the request body of the quota admin API.
+func decodeQuotaRequest(r *http.Request) (quotaRequest, error) {
+	var req quotaRequest
+	if err := json.NewDecoder(http.MaxBytesReader(nil, r.Body, 1<<20)).Decode(&req); err != nil {
+		return quotaRequest{}, NewError(http.StatusBadRequest, "invalid request body")
+	}
+	return req, nil
+}
+
+// quotaAdminAuth is a middleware that checks the bearer token of the quota admin API.
+func quotaAdminAuth(token string) Middleware {
+	return func(next HandlerWithCtx) HandlerWithCtx {
+		return func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			got, ok := bearerToken(r)
+			if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="hurrah"`)
+				return NewError(http.StatusUnauthorized, "invalid admin token")
+			}
+			return next(ctx, w, r)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// quotaBucket is the bbolt bucket that has a nested bucket per route.
+var quotaBucket = []byte("quotas")
+
+// quotaPurgeInterval is how often the usage of past periods is deleted.
+const quotaPurgeInterval = time.Hour
+
+// quotaUsage is the usage of a consumer in a period.
+type quotaUsage struct {
+	Period string `json:"period"` // Period is the period the usage belongs to. e.g., "2024-05"
+	Used   int64  `json:"used"`   // Used is the number of requests in the period.
+	Credit int64  `json:"credit"` // Credit is the number of requests added to the limit by top-ups in the period.
+}
+
+// remaining returns the number of requests left within the limit.
+func (u quotaUsage) remaining(limit int64) int64 {
+	return max(0, limit+u.Credit-u.Used)
+}
+
+// QuotaStore keeps the usage of quotas in an embedded on-disk database, so that
+// the usage survives restarts. It is shared by the quota middlewares of all routes.
+//
+// The database has one record per consumer of each route, so its size grows with
+// the number of distinct client IP addresses, API keys or claim values seen in the
+// current period. The records of past periods and of routes without a quota are
+// deleted every quotaPurgeInterval.
+type QuotaStore struct {
+	db *bolt.DB
+
+	mu     sync.RWMutex
+	quotas map[string]*quota // quotas is the quota of each route.
+
+	stop     chan struct{} // stop stops the purge loop.
+	stopOnce sync.Once
+	done     chan struct{} // done is closed when the purge loop returns.
+}
+
+// OpenQuotaStore opens the database file, creating it if it does not exist.
+func OpenQuotaStore(path string) (*QuotaStore, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("middleware: failed to open the quota store %s: %w", path, err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(quotaBucket)
+		return err
+	}); err != nil {
+		_ = db.Close() // The error of the initialization is more important.
+		return nil, fmt.Errorf("middleware: failed to initialize the quota store %s: %w", path, err)
+	}
+	s := &QuotaStore{db: db, quotas: map[string]*quota{}, stop: make(chan struct{}), done: make(chan struct{})}
+	go s.purgeLoop()
+	return s, nil
+}
+
+// Close stops the purge and closes the database file.
+func (s *QuotaStore) Close() error {
+	s.stopOnce.Do(func() { close(s.stop) })
+	<-s.done
+	return s.db.Close()
+}
+
+// purgeLoop calls purge every quotaPurgeInterval until the store is closed.
+func (s *QuotaStore) purgeLoop() {
+	defer close(s.done)
+	ticker := time.NewTicker(quotaPurgeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			if err := s.purge(); err != nil {
+				slog.Error("middleware: failed to purge the quota store", slog.String("error", err.Error()))
+			}
+		}
+	}
+}
+
+// purge deletes the usage of past periods, and the buckets of the routes that no
+// longer have a quota. The usage of a consumer that comes back in a new period is
+// overwritten by consume, so purge is needed only for the consumers that do not.
+func (s *QuotaStore) purge() error {
+	s.mu.RLock()
+	periods := make(map[string]string, len(s.quotas))
+	for route, q := range s.quotas {
+		periods[route], _ = q.period(q.now())
+	}
+	s.mu.RUnlock()
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		root := tx.Bucket(quotaBucket)
+		var routes [][]byte
+		if err := root.ForEachBucket(func(route []byte) error {
+			routes = append(routes, route)
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, route := range routes {
+			period, ok := periods[string(route)]
+			if !ok {
+				if err := root.DeleteBucket(route); err != nil {
+					return err
+				}
+				continue
+			}
+			b := root.Bucket(route)
+			// Keys are collected first because deleting keys while iterating can skip keys.
+			var stale [][]byte
+			if err := b.ForEach(func(k, v []byte) error {
+				var usage quotaUsage
+				if err := json.Unmarshal(v, &usage); err != nil || usage.Period != period {
+					stale = append(stale, k)
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			for _, k := range stale {
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// register registers the quota of the route for the admin API.
+func (s *QuotaStore) register(q *quota) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.quotas[q.route] = q
+}
+
+// quota returns the quota of the route.
+func (s *QuotaStore) quota(route string) (*quota, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	q, ok := s.quotas[route]
+	return q, ok
+}
+
+// consume counts a request of the consumer if the usage is within the limit.
+// The usage of a past period is overwritten by the usage of the current period.
+func (s *QuotaStore) consume(route, consumer, period string, limit int64) (quotaUsage, bool, error) {
+	var (
+		usage   quotaUsage
+		allowed bool
+	)
+	// Batch may run the function more than once, so the results are assigned in it.
+	err := s.db.Batch(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(quotaBucket).CreateBucketIfNotExists([]byte(route))
+		if err != nil {
+			return err
+		}
+		if usage, err = getUsage(b, consumer, period); err != nil {
+			return err
+		}
+		allowed = usage.remaining(limit) > 0
+		if !allowed {
+			return nil
+		}
+		usage.Used++
+		return putUsage(b, consumer, usage)
+	})
+	if err != nil {
+		return quotaUsage{}, false, fmt.Errorf("middleware: failed to update the quota usage: %w", err)
+	}
+	return usage, allowed, nil
+}
+
+// usage returns the usage of the consumer in the period.
+func (s *QuotaStore) usage(route, consumer, period string) (quotaUsage, error) {
+	var usage quotaUsage
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(quotaBucket).Bucket([]byte(route))
+		if b == nil {
+			usage = quotaUsage{Period: period}
+			return nil
+		}
+		var err error
+		usage, err = getUsage(b, consumer, period)
+		return err
+	})
+	if err != nil {
+		return quotaUsage{}, fmt.Errorf("middleware: failed to read the quota usage: %w", err)
+	}
+	return usage, nil
+}
+
+// update applies f to the usage of the consumer in the period and saves it.
+func (s *QuotaStore) update(route, consumer, period string, f func(*quotaUsage)) (quotaUsage, error) {
+	var usage quotaUsage
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(quotaBucket).CreateBucketIfNotExists([]byte(route))
+		if err != nil {
+			return err
+		}
+		if usage, err = getUsage(b, consumer, period); err != nil {
+			return err
+		}
+		f(&usage)
+		return putUsage(b, consumer, usage)
+	})
+	if err != nil {
+		return quotaUsage{}, fmt.Errorf("middleware: failed to update the quota usage: %w", err)
+	}
+	return usage, nil
+}
+
+// getUsage reads the usage of the consumer from the bucket of a route.
+// It returns an empty usage if the saved usage belongs to another period.
+func getUsage(b *bolt.Bucket, consumer, period string) (quotaUsage, error) {
+	usage := quotaUsage{Period: period}
+	v := b.Get(quotaConsumerKey(consumer))
+	if v == nil {
+		return usage, nil
+	}
+	var saved quotaUsage
+	if err := json.Unmarshal(v, &saved); err != nil {
+		return quotaUsage{}, err
+	}
+	if saved.Period != period {
+		return usage, nil
+	}
+	return saved, nil
+}
+
+// putUsage writes the usage of the consumer to the bucket of a route.
+func putUsage(b *bolt.Bucket, consumer string, usage quotaUsage) error {
+	v, err := json.Marshal(usage)
+	if err != nil {
+		return err
+	}
+	return b.Put(quotaConsumerKey(consumer), v)
+}
+
+// quotaConsumerKey returns the database key of the consumer.
+// The consumer may contain an API key, so only its hash is stored.
+func quotaConsumerKey(consumer string) []byte {
+	sum := sha256.Sum256([]byte(consumer))
+	return []byte(hex.EncodeToString(sum[:]))
+}
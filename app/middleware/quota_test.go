@@ -0,0 +1,292 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/nao1215/hurrah/config"
+	bolt "go.etcd.io/bbolt"
+)
+
+func newTestQuotaStore(t *testing.T, path string) *QuotaStore {
+	t.Helper()
+
+	store, err := OpenQuotaStore(path)
+	if err != nil {
+		t.Fatalf("OpenQuotaStore() error = %v", err)
+	}
+	t.Cleanup(func() {
+		_ = store.Close() // It may be closed by the test.
+	})
+	return store
+}
+
+func TestQuota(t *testing.T) {
+	t.Parallel()
+
+	ok := func(_ context.Context, w http.ResponseWriter, _ *http.Request) error {
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+	newHandler := func(t *testing.T, store *QuotaStore, cfg config.Quota, now *time.Time) http.Handler {
+		t.Helper()
+
+		q, err := newQuota(cfg, "/api/", store)
+		if err != nil {
+			t.Fatalf("newQuota() error = %v", err)
+		}
+		q.now = func() time.Time { return *now }
+		store.register(q)
+		return Chain(ok, q.handle).AdaptHandler()
+	}
+	serve := func(h http.Handler, apiKey string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/", nil)
+		req.Header.Set("X-API-Key", apiKey)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("quota is limited per consumer and persists across restarts", func(t *testing.T) {
+		t.Parallel()
+
+		path := filepath.Join(t.TempDir(), "quota.db")
+		store := newTestQuotaStore(t, path)
+		cfg := config.Quota{Key: "api_key", Limit: 2, Period: "day", Timezone: "Asia/Tokyo"}
+		now := time.Date(2024, 5, 31, 14, 0, 0, 0, time.UTC) // 23:00 in Tokyo.
+		h := newHandler(t, store, cfg, &now)
+
+		for i, want := range []struct {
+			status    int
+			remaining string
+		}{
+			{http.StatusOK, "1"},
+			{http.StatusOK, "0"},
+			{http.StatusTooManyRequests, "0"},
+		} {
+			rec := serve(h, "key-a")
+			if diff := cmp.Diff(want.status, rec.Code); diff != "" {
+				t.Errorf("request %d: status mismatch (-want +got):\n%s", i, diff)
+			}
+			if diff := cmp.Diff(want.remaining, rec.Header().Get("X-Quota-Remaining")); diff != "" {
+				t.Errorf("request %d: X-Quota-Remaining mismatch (-want +got):\n%s", i, diff)
+			}
+			if diff := cmp.Diff("3600", rec.Header().Get("X-Quota-Reset")); diff != "" {
+				t.Errorf("request %d: X-Quota-Reset mismatch (-want +got):\n%s", i, diff)
+			}
+		}
+		if diff := cmp.Diff(http.StatusOK, serve(h, "key-b").Code); diff != "" {
+			t.Errorf("status of another consumer mismatch (-want +got):\n%s", diff)
+		}
+
+		if err := store.Close(); err != nil {
+			t.Fatal(err)
+		}
+		h = newHandler(t, newTestQuotaStore(t, path), cfg, &now)
+		if diff := cmp.Diff(http.StatusTooManyRequests, serve(h, "key-a").Code); diff != "" {
+			t.Errorf("status after restart mismatch (-want +got):\n%s", diff)
+		}
+
+		now = now.Add(time.Hour) // Midnight in Tokyo.
+		if diff := cmp.Diff(http.StatusOK, serve(h, "key-a").Code); diff != "" {
+			t.Errorf("status in the next period mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("invalid settings", func(t *testing.T) {
+		t.Parallel()
+
+		store := newTestQuotaStore(t, filepath.Join(t.TempDir(), "quota.db"))
+		for _, cfg := range []config.Quota{
+			{Limit: 0},
+			{Limit: 1, Key: "cookie"},
+			{Limit: 1, Period: "week"},
+			{Limit: 1, Timezone: "Mars/Olympus_Mons"},
+		} {
+			if _, err := Quota(cfg, "/api/", store); err == nil {
+				t.Errorf("Quota(%+v) error = nil, want error", cfg)
+			}
+		}
+	})
+}
+
+func TestQuotaStore_purge(t *testing.T) {
+	t.Parallel()
+
+	store := newTestQuotaStore(t, filepath.Join(t.TempDir(), "quota.db"))
+	q, err := newQuota(config.Quota{Key: "api_key", Limit: 10, Period: "day"}, "/api/", store)
+	if err != nil {
+		t.Fatalf("newQuota() error = %v", err)
+	}
+	now := time.Date(2024, 5, 31, 12, 0, 0, 0, time.UTC)
+	q.now = func() time.Time { return now }
+	store.register(q)
+
+	for _, c := range []struct {
+		route, consumer, period string
+	}{
+		{"/api/", "api_key:old", "2024-05-30"},
+		{"/api/", "api_key:current", "2024-05-31"},
+		{"/removed/", "api_key:current", "2024-05-31"},
+	} {
+		if _, _, err := store.consume(c.route, c.consumer, c.period, 10); err != nil {
+			t.Fatalf("consume() error = %v", err)
+		}
+	}
+	if err := store.purge(); err != nil {
+		t.Fatalf("purge() error = %v", err)
+	}
+
+	var got []string
+	if err := store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(quotaBucket).ForEachBucket(func(route []byte) error {
+			return tx.Bucket(quotaBucket).Bucket(route).ForEach(func(k, _ []byte) error {
+				got = append(got, string(route)+" "+string(k))
+				return nil
+			})
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"/api/ " + string(quotaConsumerKey("api_key:current"))}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("records after purge mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func Test_quota_period(t *testing.T) {
+	t.Parallel()
+
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 1, 31, 16, 0, 0, 0, time.UTC) // 2024-02-01 01:00 in Tokyo.
+
+	tests := []struct {
+		name       string
+		cfg        config.Quota
+		wantPeriod string
+		wantEnd    time.Time
+	}{
+		{
+			name:       "month in UTC",
+			cfg:        config.Quota{Limit: 1},
+			wantPeriod: "2024-01",
+			wantEnd:    time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:       "month in Tokyo",
+			cfg:        config.Quota{Limit: 1, Timezone: "Asia/Tokyo"},
+			wantPeriod: "2024-02",
+			wantEnd:    time.Date(2024, 3, 1, 0, 0, 0, 0, tokyo),
+		},
+		{
+			name:       "day in Tokyo",
+			cfg:        config.Quota{Limit: 1, Period: "day", Timezone: "Asia/Tokyo"},
+			wantPeriod: "2024-02-01",
+			wantEnd:    time.Date(2024, 2, 2, 0, 0, 0, 0, tokyo),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			q, err := newQuota(tt.cfg, "/api/", nil)
+			if err != nil {
+				t.Fatalf("newQuota() error = %v", err)
+			}
+			period, end := q.period(now)
+			if diff := cmp.Diff(tt.wantPeriod, period); diff != "" {
+				t.Errorf("period mismatch (-want +got):\n%s", diff)
+			}
+			if !end.Equal(tt.wantEnd) {
+				t.Errorf("end = %v, want %v", end, tt.wantEnd)
+			}
+		})
+	}
+}
+
+func TestQuotaStore_SetAdminAPI(t *testing.T) {
+	t.Parallel()
+
+	store := newTestQuotaStore(t, filepath.Join(t.TempDir(), "quota.db"))
+	if _, err := Quota(config.Quota{Key: "api_key", Limit: 1}, "/api/", store); err != nil {
+		t.Fatalf("Quota() error = %v", err)
+	}
+	if _, _, err := store.consume("/api/", "api_key:key-a", time.Now().UTC().Format("2006-01"), 1); err != nil {
+		t.Fatalf("consume() error = %v", err)
+	}
+	mux := http.NewServeMux()
+	store.SetAdminAPI(mux, DefaultQuotaAdminPath, "admin-token")
+
+	do := func(method, target, body, token string) (*httptest.ResponseRecorder, quotaStatus) {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		var status quotaStatus
+		if rec.Code == http.StatusOK {
+			if err := json.NewDecoder(rec.Body).Decode(&status); err != nil {
+				t.Fatalf("failed to decode the response: %v", err)
+			}
+		}
+		return rec, status
+	}
+
+	t.Run("invalid token", func(t *testing.T) {
+		t.Parallel()
+
+		rec, _ := do(http.MethodGet, "/_hurrah/quotas?route=/api/&consumer=api_key:key-a", "", "wrong")
+		if diff := cmp.Diff(http.StatusUnauthorized, rec.Code); diff != "" {
+			t.Errorf("status mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("unknown route", func(t *testing.T) {
+		t.Parallel()
+
+		rec, _ := do(http.MethodGet, "/_hurrah/quotas?route=/other/&consumer=api_key:key-a", "", "admin-token")
+		if diff := cmp.Diff(http.StatusNotFound, rec.Code); diff != "" {
+			t.Errorf("status mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("get, top up and reset", func(t *testing.T) {
+		t.Parallel()
+
+		rec, got := do(http.MethodGet, "/_hurrah/quotas?route=/api/&consumer=api_key:key-a", "", "admin-token")
+		if diff := cmp.Diff(http.StatusOK, rec.Code); diff != "" {
+			t.Fatalf("status mismatch (-want +got):\n%s", diff)
+		}
+		if diff := cmp.Diff([]int64{1, 1, 0, 0}, []int64{got.Limit, got.Used, got.Credit, got.Remaining}); diff != "" {
+			t.Errorf("usage mismatch (-want +got):\n%s", diff)
+		}
+
+		body := `{"route": "/api/", "consumer": "api_key:key-a", "requests": 10}`
+		_, got = do(http.MethodPost, "/_hurrah/quotas/top_up", body, "admin-token")
+		if diff := cmp.Diff([]int64{1, 10, 10}, []int64{got.Used, got.Credit, got.Remaining}); diff != "" {
+			t.Errorf("usage after top up mismatch (-want +got):\n%s", diff)
+		}
+
+		body = `{"route": "/api/", "consumer": "api_key:key-a"}`
+		_, got = do(http.MethodPost, "/_hurrah/quotas/reset", body, "admin-token")
+		if diff := cmp.Diff([]int64{0, 0, 1}, []int64{got.Used, got.Credit, got.Remaining}); diff != "" {
+			t.Errorf("usage after reset mismatch (-want +got):\n%s", diff)
+		}
+
+		rec, _ = do(http.MethodPost, "/_hurrah/quotas/top_up", body, "admin-token")
+		if diff := cmp.Diff(http.StatusBadRequest, rec.Code); diff != "" {
+			t.Errorf("status of a top up without requests mismatch (-want +got):\n%s", diff)
+		}
+	})
+}
@@ -0,0 +1,274 @@
+package middleware
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nao1215/hurrah/config"
+)
+
+const (
+	// consumerKeyRoute treats all requests to the route as one consumer.
+	consumerKeyRoute = "route"
+	// consumerKeyIP identifies consumers by the client IP address.
+	consumerKeyIP = "ip"
+	// consumerKeyAPIKey identifies consumers by the API key.
+	consumerKeyAPIKey = "api_key"
+	// consumerKeyClaim identifies consumers by the claim value of the authenticated client.
+	consumerKeyClaim = "claim"
+	// defaultRateLimitMaxKeys is the default maximum number of buckets kept in memory.
+	defaultRateLimitMaxKeys = 10000
+)
+
+// rateLimitResult is the result of taking a token.
+type rateLimitResult struct {
+	allowed    bool
+	limit      int64         // limit is the bucket size.
+	remaining  int64         // remaining is the number of tokens left in the bucket.
+	reset      time.Duration // reset is the time until the bucket is full.
+	retryAfter time.Duration // retryAfter is the time until a token is available. It is zero if allowed.
+}
+
+// limiter takes a token from the bucket of the key.
+type limiter interface {
+	take(ctx context.Context, key string, now time.Time) (rateLimitResult, error)
+}
+
+// tokenBucket is the rate and the size of token buckets.
+type tokenBucket struct {
+	rate  float64 // rate is the number of tokens added per second.
+	burst float64 // burst is the bucket size.
+}
+
+// take takes a token from the bucket that had tokens at last and returns the result
+// and the number of tokens left.
+func (b tokenBucket) take(tokens float64, last, now time.Time) (rateLimitResult, float64) {
+	if elapsed := now.Sub(last).Seconds(); elapsed > 0 {
+		tokens = math.Min(b.burst, tokens+elapsed*b.rate)
+	}
+	allowed := tokens >= 1
+	if allowed {
+		tokens--
+	}
+	return b.result(allowed, tokens), tokens
+}
+
+// result returns the result of taking a token when tokens are left in the bucket.
+func (b tokenBucket) result(allowed bool, tokens float64) rateLimitResult {
+	result := rateLimitResult{
+		allowed:   allowed,
+		limit:     int64(b.burst),
+		remaining: int64(math.Floor(tokens)),
+		reset:     b.duration(b.burst - tokens),
+	}
+	if !allowed {
+		result.retryAfter = b.duration(1 - tokens)
+	}
+	return result
+}
+
+// duration returns the time to refill the tokens, rounded up to seconds.
+func (b tokenBucket) duration(tokens float64) time.Duration {
+	return time.Duration(math.Ceil(tokens/b.rate)) * time.Second
+}
+
+// localBucket is the state of a bucket kept in memory.
+type localBucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+// localLimiter keeps token buckets in memory. The least recently used bucket is
+// evicted when the number of buckets exceeds maxKeys, so that memory usage stays
+// bounded under high-cardinality keys.
+type localLimiter struct {
+	bucket  tokenBucket
+	maxKeys int
+
+	mu      sync.Mutex
+	lru     *list.List // lru is the buckets ordered from the most recently used.
+	buckets map[string]*list.Element
+}
+
+// newLocalLimiter returns a new localLimiter.
+func newLocalLimiter(bucket tokenBucket, maxKeys int) *localLimiter {
+	return &localLimiter{
+		bucket:  bucket,
+		maxKeys: maxKeys,
+		lru:     list.New(),
+		buckets: map[string]*list.Element{},
+	}
+}
+
+// take takes a token from the bucket of the key.
+func (l *localLimiter) take(_ context.Context, key string, now time.Time) (rateLimitResult, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e, ok := l.buckets[key]
+	if ok {
+		l.lru.MoveToFront(e)
+	} else {
+		e = l.lru.PushFront(&localBucket{key: key, tokens: l.bucket.burst, last: now})
+		l.buckets[key] = e
+		for l.lru.Len() > l.maxKeys {
+			oldest := l.lru.Back()
+			l.lru.Remove(oldest)
+			delete(l.buckets, oldest.Value.(*localBucket).key) //nolint:forcetypeassert // The list only has *localBucket.
+		}
+	}
+
+	b := e.Value.(*localBucket) //nolint:forcetypeassert // The list only has *localBucket.
+	result, tokens := l.bucket.take(b.tokens, b.last, now)
+	b.tokens = tokens
+	if now.After(b.last) {
+		b.last = now
+	}
+	return result, nil
+}
+
+// rateLimit is the rate limiting.
+type rateLimit struct {
+	cfg     config.RateLimit
+	route   string
+	limiter limiter
+	now     func() time.Time
+}
+
+// RateLimit is a middleware that limits the request rate with token buckets.
+// The limit applies to the whole route, or to each client IP address, API key or
+// claim value (e.g., "sub" set by rbac or introspection). Requests without an
+// API key or a claim are limited by the client IP address. Every response has the
+// RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers, and rejected
+// requests get 429 with the Retry-After header.
+// The buckets are kept in memory, or in a Redis compatible store if it is
+// configured so that multiple hurrah instances share the limits. The Redis
+// clients are taken from redisClients.
+func RateLimit(cfg config.RateLimit, route string, redisClients *RedisClients) (Middleware, error) {
+	rl, bucket, err := newRateLimit(cfg, route)
+	if err != nil {
+		return nil, err
+	}
+	maxKeys := cfg.MaxKeys
+	if maxKeys <= 0 {
+		maxKeys = defaultRateLimitMaxKeys
+	}
+	local := newLocalLimiter(bucket, maxKeys)
+	rl.limiter = local
+	if cfg.Redis != nil {
+		if redisClients == nil {
+			return nil, errors.New("middleware: rate limit with redis requires the redis clients")
+		}
+		client, err := redisClients.client(*cfg.Redis)
+		if err != nil {
+			return nil, err
+		}
+		rl.limiter = newRedisLimiter(client, bucket, local)
+	}
+	return rl.handle, nil
+}
+
+// newRateLimit validates the settings and returns a new rateLimit without a limiter.
+func newRateLimit(cfg config.RateLimit, route string) (*rateLimit, tokenBucket, error) {
+	switch cfg.Key {
+	case "":
+		cfg.Key = consumerKeyRoute
+	case consumerKeyRoute, consumerKeyIP, consumerKeyAPIKey, consumerKeyClaim:
+	default:
+		return nil, tokenBucket{}, fmt.Errorf("middleware: unknown rate limit key %q", cfg.Key)
+	}
+	if cfg.Requests <= 0 {
+		return nil, tokenBucket{}, errors.New("middleware: rate limit requires requests greater than 0")
+	}
+	if cfg.Period <= 0 {
+		cfg.Period = 1
+	}
+	if cfg.Burst <= 0 {
+		cfg.Burst = cfg.Requests
+	}
+	if cfg.Header == "" {
+		cfg.Header = "X-API-Key"
+	}
+	if cfg.Claim == "" {
+		cfg.Claim = "sub"
+	}
+
+	bucket := tokenBucket{
+		rate:  float64(cfg.Requests) / float64(cfg.Period),
+		burst: float64(cfg.Burst),
+	}
+	return &rateLimit{cfg: cfg, route: route, now: time.Now}, bucket, nil
+}
+
+// handle is the Middleware of the rateLimit.
+func (rl *rateLimit) handle(next HandlerWithCtx) HandlerWithCtx {
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+		key := rl.key(ctx, r)
+		result, err := rl.limiter.take(ctx, key, rl.now())
+		if err != nil {
+			return err
+		}
+
+		w.Header().Set("RateLimit-Limit", strconv.FormatInt(result.limit, 10))
+		w.Header().Set("RateLimit-Remaining", strconv.FormatInt(result.remaining, 10))
+		w.Header().Set("RateLimit-Reset", strconv.FormatInt(int64(result.reset.Seconds()), 10))
+		if !result.allowed {
+			w.Header().Set("Retry-After", strconv.FormatInt(int64(result.retryAfter.Seconds()), 10))
+			slog.Info("middleware: rate limit exceeded", slog.String("route", rl.route), slog.String("consumer", rl.logKey(key)))
+			return NewError(http.StatusTooManyRequests, "rate limit exceeded")
+		}
+		return next(ctx, w, r)
+	}
+}
+
+// key returns the bucket key of the request. e.g., "/api/:ip:192.0.2.1"
+func (rl *rateLimit) key(ctx context.Context, r *http.Request) string {
+	return rl.route + ":" + consumerKey(ctx, r, rl.cfg.Key, rl.cfg.Header, rl.cfg.Claim)
+}
+
+// logKey returns the kind of the consumer of the bucket key and a truncated hash
+// of the key for logs. The key may contain an API key, so it is not logged as it
+// is. e.g., "api_key:3f2a9c1b0d4e"
+func (rl *rateLimit) logKey(key string) string {
+	kind, _, _ := strings.Cut(strings.TrimPrefix(key, rl.route+":"), ":")
+	sum := sha256.Sum256([]byte(key))
+	return kind + ":" + hex.EncodeToString(sum[:6])
+}
+
+// consumerKey returns the key of the client that sent the request. The kind is
+// "route", "ip", "api_key" or "claim", and the API key is read from the header and
+// the claim value from the claim path. Requests without an API key or a claim are
+// identified by the client IP address. e.g., "api_key:secret", "ip:192.0.2.1"
+func consumerKey(ctx context.Context, r *http.Request, kind, header, claim string) string {
+	var parts []string
+	switch kind {
+	case consumerKeyRoute:
+		parts = []string{consumerKeyRoute}
+	case consumerKeyAPIKey:
+		if v := r.Header.Get(header); v != "" {
+			parts = []string{consumerKeyAPIKey, v}
+		}
+	case consumerKeyClaim:
+		if claims, ok := ClaimsFromContext(ctx); ok {
+			if v, ok := claims.lookup(claim); ok {
+				parts = []string{consumerKeyClaim, fmt.Sprint(v)}
+			}
+		}
+	}
+	if parts == nil {
+		parts = []string{consumerKeyIP, clientIP(ctx, r).String()}
+	}
+	return strings.Join(parts, ":")
+}
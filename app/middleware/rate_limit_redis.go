@@ -0,0 +1,194 @@
+package middleware
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nao1215/hurrah/config"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// defaultRedisTimeout is the default timeout of a Redis command.
+	defaultRedisTimeout = 100 * time.Millisecond
+	// redisRateLimitKeyPrefix is the prefix of the bucket keys in Redis.
+	redisRateLimitKeyPrefix = "hurrah:rate_limit:"
+	// redisRetryInterval is how long the local limiter is used without trying
+	// the store after the store failed.
+	redisRetryInterval = 5 * time.Second
+)
+
+// RedisClients is the Redis clients shared by the rate limits of all routes.
+// A client is created for each URL and timeout on first use.
+type RedisClients struct {
+	mu      sync.Mutex
+	clients map[config.Redis]*redis.Client
+}
+
+// NewRedisClients returns a new RedisClients. Close it when the clients are no longer used.
+func NewRedisClients() *RedisClients {
+	return &RedisClients{clients: map[config.Redis]*redis.Client{}}
+}
+
+// client returns the client of the settings.
+func (c *RedisClients) client(cfg config.Redis) (*redis.Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if client, ok := c.clients[cfg]; ok {
+		return client, nil
+	}
+
+	opts, err := redis.ParseURL(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("middleware: failed to parse the redis url: %w", err)
+	}
+	timeout := defaultRedisTimeout
+	if cfg.TimeoutMS > 0 {
+		timeout = time.Duration(cfg.TimeoutMS) * time.Millisecond
+	}
+	opts.DialTimeout = timeout
+	opts.ReadTimeout = timeout
+	opts.WriteTimeout = timeout
+	opts.MaxRetries = -1 // The local limiter is used instead of retrying.
+
+	client := redis.NewClient(opts)
+	c.clients[cfg] = client
+	return client, nil
+}
+
+// Close closes all clients.
+func (c *RedisClients) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var errs []error
+	for cfg, client := range c.clients {
+		if err := client.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("middleware: failed to close the redis client: %w", err))
+		}
+		delete(c.clients, cfg)
+	}
+	return errors.Join(errs...)
+}
+
+// redisTokenBucketScript takes a token from the bucket atomically.
+// The bucket is a hash of "tokens" and "last" (unix milliseconds), and it expires
+// when it would be full again.
+//
+//	KEYS[1]: the bucket key
+//	ARGV[1]: the number of tokens added per second
+//	ARGV[2]: the bucket size
+//	ARGV[3]: the current unix time in milliseconds
+//
+// It returns {allowed (1 or 0), the number of tokens left as a string}.
+var redisTokenBucketScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+
+local state = redis.call("HMGET", KEYS[1], "tokens", "last")
+local tokens = tonumber(state[1])
+local last = tonumber(state[2])
+if tokens == nil or last == nil then
+	tokens = burst
+	last = now
+end
+if now > last then
+	tokens = math.min(burst, tokens + (now - last) / 1000 * rate)
+	last = now
+end
+
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "last", tostring(last))
+redis.call("PEXPIRE", KEYS[1], math.ceil(burst / rate * 1000))
+return {allowed, tostring(tokens)}
+`)
+
+// redisLimiter keeps token buckets in a Redis compatible store, so that multiple
+// hurrah instances share the limits. If the store is unreachable, the local
+// limiter is used, and the store is tried again every redisRetryInterval, so
+// that requests do not wait for the timeout of the store one after another.
+type redisLimiter struct {
+	client   *redis.Client
+	bucket   tokenBucket
+	fallback limiter
+	failing  atomic.Bool
+	retryAt  atomic.Int64 // retryAt is the unix time in nanoseconds after which the failing store is tried again.
+}
+
+// newRedisLimiter returns a new redisLimiter.
+func newRedisLimiter(client *redis.Client, bucket tokenBucket, fallback limiter) *redisLimiter {
+	return &redisLimiter{
+		client:   client,
+		bucket:   bucket,
+		fallback: fallback,
+	}
+}
+
+// take takes a token from the bucket of the key in the store.
+func (l *redisLimiter) take(ctx context.Context, key string, now time.Time) (rateLimitResult, error) {
+	if l.failing.Load() && now.UnixNano() < l.retryAt.Load() {
+		return l.fallback.take(ctx, key, now)
+	}
+	result, err := l.takeRemote(ctx, key, now)
+	if err != nil && ctx.Err() != nil {
+		// The request is canceled or timed out by itself, which says nothing about the store.
+		return rateLimitResult{}, fmt.Errorf("middleware: rate limit request is aborted: %w", ctx.Err())
+	}
+	if err != nil {
+		l.retryAt.Store(now.Add(redisRetryInterval).UnixNano())
+		if !l.failing.Swap(true) {
+			slog.Warn("middleware: rate limit store is unreachable, falling back to local limits", slog.String("error", err.Error()))
+		}
+		return l.fallback.take(ctx, key, now)
+	}
+	if l.failing.Swap(false) {
+		slog.Info("middleware: rate limit store is reachable again")
+	}
+	return result, nil
+}
+
+// takeRemote runs the token bucket script.
+func (l *redisLimiter) takeRemote(ctx context.Context, key string, now time.Time) (rateLimitResult, error) {
+	// The key may contain an API key, so only its hash is stored.
+	sum := sha256.Sum256([]byte(key))
+	keys := []string{redisRateLimitKeyPrefix + hex.EncodeToString(sum[:])}
+	args := []any{
+		strconv.FormatFloat(l.bucket.rate, 'f', -1, 64),
+		strconv.FormatFloat(l.bucket.burst, 'f', -1, 64),
+		now.UnixMilli(),
+	}
+
+	values, err := redisTokenBucketScript.Run(ctx, l.client, keys, args...).Slice()
+	if err != nil {
+		return rateLimitResult{}, err
+	}
+	if len(values) != 2 {
+		return rateLimitResult{}, fmt.Errorf("unexpected script result %v", values)
+	}
+	allowed, ok := values[0].(int64)
+	if !ok {
+		return rateLimitResult{}, fmt.Errorf("unexpected script result %v", values)
+	}
+	rawTokens, ok := values[1].(string)
+	if !ok {
+		return rateLimitResult{}, fmt.Errorf("unexpected script result %v", values)
+	}
+	tokens, err := strconv.ParseFloat(rawTokens, 64)
+	if err != nil {
+		return rateLimitResult{}, fmt.Errorf("unexpected script result %v: %w", values, err)
+	}
+	return l.bucket.result(allowed == 1, tokens), nil
+}
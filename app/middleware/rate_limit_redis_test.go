@@ -0,0 +1,182 @@
+package middleware
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/google/go-cmp/cmp"
+	"github.com/nao1215/hurrah/config"
+)
+
+func Test_redisLimiter(t *testing.T) {
+	t.Parallel()
+
+	bucket := tokenBucket{rate: 1.0 / 60, burst: 2}
+	newLimiter := func(t *testing.T, s *miniredis.Miniredis) *redisLimiter {
+		t.Helper()
+
+		// Each limiter has its own clients as if it were another hurrah instance.
+		clients := NewRedisClients()
+		t.Cleanup(func() {
+			_ = clients.Close() // The test is over.
+		})
+		client, err := clients.client(config.Redis{URL: "redis://" + s.Addr()})
+		if err != nil {
+			t.Fatalf("client() error = %v", err)
+		}
+		return newRedisLimiter(client, bucket, newLocalLimiter(bucket, 10))
+	}
+
+	t.Run("instances share the limit", func(t *testing.T) {
+		t.Parallel()
+
+		s := miniredis.RunT(t)
+		a, b := newLimiter(t, s), newLimiter(t, s)
+		now := time.Unix(1700000000, 0)
+
+		for i, want := range []struct {
+			l         *redisLimiter
+			allowed   bool
+			remaining int64
+		}{
+			{a, true, 1},
+			{b, true, 0},
+			{a, false, 0},
+		} {
+			got, err := want.l.take(context.Background(), "/api/:route", now)
+			if err != nil {
+				t.Fatalf("take() error = %v", err)
+			}
+			if diff := cmp.Diff(want.allowed, got.allowed); diff != "" {
+				t.Errorf("request %d: allowed mismatch (-want +got):\n%s", i, diff)
+			}
+			if diff := cmp.Diff(want.remaining, got.remaining); diff != "" {
+				t.Errorf("request %d: remaining mismatch (-want +got):\n%s", i, diff)
+			}
+		}
+
+		got, err := b.take(context.Background(), "/api/:route", now.Add(time.Minute))
+		if err != nil {
+			t.Fatalf("take() error = %v", err)
+		}
+		if !got.allowed {
+			t.Error("request after refill is not allowed")
+		}
+		if diff := cmp.Diff(1, len(s.Keys())); diff != "" {
+			t.Errorf("number of keys mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("falls back to local limits when the store is down", func(t *testing.T) {
+		t.Parallel()
+
+		s := miniredis.RunT(t)
+		l := newLimiter(t, s)
+		s.Close()
+		now := time.Unix(1700000000, 0)
+
+		for i, want := range []bool{true, true, false} {
+			got, err := l.take(context.Background(), "/api/:route", now)
+			if err != nil {
+				t.Fatalf("take() error = %v", err)
+			}
+			if diff := cmp.Diff(want, got.allowed); diff != "" {
+				t.Errorf("request %d: allowed mismatch (-want +got):\n%s", i, diff)
+			}
+		}
+		if !l.failing.Load() {
+			t.Error("failing is false, want true")
+		}
+	})
+
+	t.Run("store is tried again after the retry interval", func(t *testing.T) {
+		t.Parallel()
+
+		s := miniredis.RunT(t)
+		l := newLimiter(t, s)
+		s.Close()
+		now := time.Unix(1700000000, 0)
+		if _, err := l.take(context.Background(), "/api/:route", now); err != nil {
+			t.Fatalf("take() error = %v", err)
+		}
+
+		if err := s.Restart(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := l.take(context.Background(), "/api/:route", now.Add(redisRetryInterval/2)); err != nil {
+			t.Fatalf("take() error = %v", err)
+		}
+		if diff := cmp.Diff(0, len(s.Keys())); diff != "" {
+			t.Errorf("the store is used during the retry interval (-want +got):\n%s", diff)
+		}
+
+		if _, err := l.take(context.Background(), "/api/:route", now.Add(redisRetryInterval)); err != nil {
+			t.Fatalf("take() error = %v", err)
+		}
+		if diff := cmp.Diff(1, len(s.Keys())); diff != "" {
+			t.Errorf("the store is not used after the retry interval (-want +got):\n%s", diff)
+		}
+		if l.failing.Load() {
+			t.Error("failing is true, want false")
+		}
+	})
+
+	t.Run("canceled request does not switch to local limits", func(t *testing.T) {
+		t.Parallel()
+
+		s := miniredis.RunT(t)
+		l := newLimiter(t, s)
+		now := time.Unix(1700000000, 0)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := l.take(ctx, "/api/:route", now); err == nil {
+			t.Error("take() error = nil, want error")
+		}
+		if l.failing.Load() {
+			t.Error("failing is true after a canceled request, want false")
+		}
+
+		if _, err := l.take(context.Background(), "/api/:route", now); err != nil {
+			t.Fatalf("take() error = %v", err)
+		}
+		if diff := cmp.Diff(1, len(s.Keys())); diff != "" {
+			t.Errorf("the store is not used after a canceled request (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("clients are shared and closed", func(t *testing.T) {
+		t.Parallel()
+
+		s := miniredis.RunT(t)
+		clients := NewRedisClients()
+		cfg := config.Redis{URL: "redis://" + s.Addr()}
+		a, err := clients.client(cfg)
+		if err != nil {
+			t.Fatalf("client() error = %v", err)
+		}
+		b, err := clients.client(cfg)
+		if err != nil {
+			t.Fatalf("client() error = %v", err)
+		}
+		if a != b {
+			t.Error("client() returned another client for the same settings")
+		}
+		if err := clients.Close(); err != nil {
+			t.Fatalf("Close() error = %v", err)
+		}
+		if err := a.Ping(context.Background()).Err(); err == nil {
+			t.Error("Ping() error = nil after Close(), want error")
+		}
+	})
+
+	t.Run("invalid url", func(t *testing.T) {
+		t.Parallel()
+
+		if _, err := RateLimit(config.RateLimit{Requests: 1, Redis: &config.Redis{URL: "http://localhost"}}, "/api/", NewRedisClients()); err == nil {
+			t.Error("RateLimit() error = nil, want error")
+		}
+	})
+}
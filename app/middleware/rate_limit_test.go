@@ -0,0 +1,185 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/nao1215/hurrah/config"
+)
+
+func TestRateLimit(t *testing.T) {
+	t.Parallel()
+
+	ok := func(_ context.Context, w http.ResponseWriter, _ *http.Request) error {
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+	newHandler := func(t *testing.T, cfg config.RateLimit, now *time.Time) http.Handler {
+		t.Helper()
+
+		rl, bucket, err := newRateLimit(cfg, "/api/")
+		if err != nil {
+			t.Fatalf("newRateLimit() error = %v", err)
+		}
+		rl.limiter = newLocalLimiter(bucket, 2)
+		rl.now = func() time.Time { return *now }
+		return Chain(ok, rl.handle).AdaptHandler()
+	}
+	serve := func(h http.Handler, remoteAddr, apiKey string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/", nil)
+		req.RemoteAddr = remoteAddr
+		if apiKey != "" {
+			req.Header.Set("X-API-Key", apiKey)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("burst is allowed and then limited", func(t *testing.T) {
+		t.Parallel()
+
+		now := time.Unix(1700000000, 0)
+		h := newHandler(t, config.RateLimit{Requests: 1, Period: 10, Burst: 2}, &now)
+
+		for i, want := range []struct {
+			status    int
+			remaining string
+			reset     string
+		}{
+			{http.StatusOK, "1", "10"},
+			{http.StatusOK, "0", "20"},
+			{http.StatusTooManyRequests, "0", "20"},
+		} {
+			rec := serve(h, "192.0.2.1:1234", "")
+			if diff := cmp.Diff(want.status, rec.Code); diff != "" {
+				t.Errorf("request %d: status mismatch (-want +got):\n%s", i, diff)
+			}
+			if diff := cmp.Diff("2", rec.Header().Get("RateLimit-Limit")); diff != "" {
+				t.Errorf("request %d: RateLimit-Limit mismatch (-want +got):\n%s", i, diff)
+			}
+			if diff := cmp.Diff(want.remaining, rec.Header().Get("RateLimit-Remaining")); diff != "" {
+				t.Errorf("request %d: RateLimit-Remaining mismatch (-want +got):\n%s", i, diff)
+			}
+			if diff := cmp.Diff(want.reset, rec.Header().Get("RateLimit-Reset")); diff != "" {
+				t.Errorf("request %d: RateLimit-Reset mismatch (-want +got):\n%s", i, diff)
+			}
+		}
+		if diff := cmp.Diff("10", serve(h, "192.0.2.1:1234", "").Header().Get("Retry-After")); diff != "" {
+			t.Errorf("Retry-After mismatch (-want +got):\n%s", diff)
+		}
+
+		now = now.Add(10 * time.Second)
+		if diff := cmp.Diff(http.StatusOK, serve(h, "192.0.2.1:1234", "").Code); diff != "" {
+			t.Errorf("status after refill mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("limits are per client IP", func(t *testing.T) {
+		t.Parallel()
+
+		now := time.Unix(1700000000, 0)
+		h := newHandler(t, config.RateLimit{Key: "ip", Requests: 1, Period: 60}, &now)
+
+		if diff := cmp.Diff(http.StatusOK, serve(h, "192.0.2.1:1234", "").Code); diff != "" {
+			t.Errorf("status mismatch (-want +got):\n%s", diff)
+		}
+		if diff := cmp.Diff(http.StatusTooManyRequests, serve(h, "192.0.2.1:1234", "").Code); diff != "" {
+			t.Errorf("status mismatch (-want +got):\n%s", diff)
+		}
+		if diff := cmp.Diff(http.StatusOK, serve(h, "192.0.2.2:1234", "").Code); diff != "" {
+			t.Errorf("status of another client mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("limits are per API key", func(t *testing.T) {
+		t.Parallel()
+
+		now := time.Unix(1700000000, 0)
+		h := newHandler(t, config.RateLimit{Key: "api_key", Requests: 1, Period: 60}, &now)
+
+		if diff := cmp.Diff(http.StatusOK, serve(h, "192.0.2.1:1234", "key-a").Code); diff != "" {
+			t.Errorf("status mismatch (-want +got):\n%s", diff)
+		}
+		if diff := cmp.Diff(http.StatusTooManyRequests, serve(h, "192.0.2.2:1234", "key-a").Code); diff != "" {
+			t.Errorf("status mismatch (-want +got):\n%s", diff)
+		}
+		if diff := cmp.Diff(http.StatusOK, serve(h, "192.0.2.1:1234", "key-b").Code); diff != "" {
+			t.Errorf("status of another key mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("invalid settings", func(t *testing.T) {
+		t.Parallel()
+
+		for _, cfg := range []config.RateLimit{
+			{Requests: 0},
+			{Key: "cookie", Requests: 1},
+		} {
+			if _, err := RateLimit(cfg, "/api/", nil); err == nil {
+				t.Errorf("RateLimit(%+v) error = nil, want error", cfg)
+			}
+		}
+	})
+}
+
+func Test_rateLimit_key(t *testing.T) {
+	t.Parallel()
+
+	rl, _, err := newRateLimit(config.RateLimit{Key: "claim", Claim: "tenant.id", Requests: 1}, "/api/")
+	if err != nil {
+		t.Fatalf("newRateLimit() error = %v", err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/api/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+
+	ctx := withClaims(context.Background(), Claims{"tenant": map[string]any{"id": "acme"}})
+	if diff := cmp.Diff("/api/:claim:acme", rl.key(ctx, req)); diff != "" {
+		t.Errorf("key() mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff("/api/:ip:192.0.2.1", rl.key(context.Background(), req)); diff != "" {
+		t.Errorf("key() without claims mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func Test_rateLimit_logKey(t *testing.T) {
+	t.Parallel()
+
+	rl, _, err := newRateLimit(config.RateLimit{Key: "api_key", Requests: 1}, "/api/")
+	if err != nil {
+		t.Fatalf("newRateLimit() error = %v", err)
+	}
+	got := rl.logKey("/api/:api_key:secret-key")
+	if strings.Contains(got, "secret-key") {
+		t.Errorf("logKey() = %q, want no API key", got)
+	}
+	if !strings.HasPrefix(got, "api_key:") || len(got) != len("api_key:")+12 {
+		t.Errorf("logKey() = %q, want the kind and a truncated hash", got)
+	}
+	if got == rl.logKey("/api/:api_key:another-key") {
+		t.Error("logKey() of different keys are the same")
+	}
+}
+
+func Test_localLimiter_eviction(t *testing.T) {
+	t.Parallel()
+
+	l := newLocalLimiter(tokenBucket{rate: 1, burst: 1}, 2)
+	now := time.Unix(1700000000, 0)
+	for _, key := range []string{"a", "b", "c"} {
+		if _, err := l.take(context.Background(), key, now); err != nil {
+			t.Fatalf("take() error = %v", err)
+		}
+	}
+	if diff := cmp.Diff(2, len(l.buckets)); diff != "" {
+		t.Errorf("number of buckets mismatch (-want +got):\n%s", diff)
+	}
+	if _, ok := l.buckets["a"]; ok {
+		t.Error("the least recently used bucket is not evicted")
+	}
+}
@@ -0,0 +1,231 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/nao1215/hurrah/config"
+)
+
+const (
+	// rbacSourceJWT reads the permissions from the claims of the bearer JWT.
+	rbacSourceJWT = "jwt"
+	// rbacSourceHeader reads the permissions from the identity headers set by a trusted upstream.
+	rbacSourceHeader = "header"
+)
+
+// permissions is the roles, scopes and groups granted to a client.
+type permissions struct {
+	roles  []string
+	scopes []string
+	groups []string
+}
+
+// rbac is the role-based access control.
+type rbac struct {
+	cfg              config.RBAC
+	verifier         *jwtVerifier
+	trustedUpstreams *prefixSet // trustedUpstreams is the peers whose identity headers are trusted.
+}
+
+// RBAC is a middleware that allows a request only if the client has all of the
+// required roles, scopes and groups. The permissions are read from the claims of
+// the bearer JWT, the claims set by a preceding middleware such as oidc, or the
+// identity headers set by a trusted upstream. The identity headers are trusted only
+// if the peer is in trusted_upstreams, or in trustedProxies if it is not set.
+// Denied requests are rejected with 403 and the missing permissions.
+func RBAC(cfg config.RBAC, timeout time.Duration, trustedProxies []netip.Prefix) (Middleware, error) {
+	r, err := newRBAC(cfg, timeout, trustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	return r.handle, nil
+}
+
+// newRBAC applies the default settings and returns a new rbac.
+func newRBAC(cfg config.RBAC, timeout time.Duration, trustedProxies []netip.Prefix) (*rbac, error) {
+	if cfg.Source == "" {
+		cfg.Source = rbacSourceJWT
+	}
+	if cfg.RolesClaim == "" {
+		cfg.RolesClaim = "roles"
+	}
+	if cfg.ScopesClaim == "" {
+		cfg.ScopesClaim = "scope"
+	}
+	if cfg.GroupsClaim == "" {
+		cfg.GroupsClaim = "groups"
+	}
+	if cfg.RolesHeader == "" {
+		cfg.RolesHeader = "X-Auth-Roles"
+	}
+	if cfg.ScopesHeader == "" {
+		cfg.ScopesHeader = "X-Auth-Scopes"
+	}
+	if cfg.GroupsHeader == "" {
+		cfg.GroupsHeader = "X-Auth-Groups"
+	}
+
+	r := &rbac{cfg: cfg}
+	switch cfg.Source {
+	case rbacSourceJWT:
+		if cfg.JWT.JWKSURL != "" {
+			verifier, err := newJWTVerifier(cfg.JWT, timeout)
+			if err != nil {
+				return nil, err
+			}
+			r.verifier = verifier
+		}
+	case rbacSourceHeader:
+		upstreams := trustedProxies
+		if len(cfg.TrustedUpstreams) > 0 {
+			var err error
+			if upstreams, err = ParsePrefixes(cfg.TrustedUpstreams); err != nil {
+				return nil, err
+			}
+		}
+		if len(upstreams) == 0 {
+			return nil, errors.New("middleware: rbac source \"header\" requires trusted_upstreams or server.trusted_proxies")
+		}
+		r.trustedUpstreams = newPrefixSet(upstreams)
+	default:
+		return nil, fmt.Errorf("middleware: unknown rbac source %q", cfg.Source)
+	}
+	return r, nil
+}
+
+// handle is the Middleware of the rbac.
+func (rb *rbac) handle(next HandlerWithCtx) HandlerWithCtx {
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+		perms, claims, err := rb.permissions(ctx, r)
+		if err != nil {
+			slog.Info("middleware: rbac failed to authenticate the request",
+				slog.String("method", r.Method), slog.String("path", r.URL.Path), slog.String("error", err.Error()))
+			if rb.cfg.Source == rbacSourceJWT {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			}
+			return NewError(http.StatusUnauthorized, "valid credentials are required")
+		}
+
+		if missing := rb.missing(perms); len(missing) > 0 {
+			slog.Warn("middleware: rbac denied the request",
+				slog.String("method", r.Method),
+				slog.String("path", r.URL.Path),
+				slog.String("subject", claims.String("sub")),
+				slog.Any("missing", missing))
+			return &Error{
+				Status:     http.StatusForbidden,
+				Detail:     "insufficient permissions",
+				Extensions: map[string]any{"missing": missing},
+			}
+		}
+
+		if claims != nil {
+			ctx = withClaims(ctx, claims)
+			r = r.WithContext(ctx)
+		}
+		return next(ctx, w, r)
+	}
+}
+
+// permissions returns the permissions of the request and the claims they were read from.
+// The claims are nil if the source is "header".
+func (rb *rbac) permissions(ctx context.Context, r *http.Request) (permissions, Claims, error) {
+	if rb.cfg.Source == rbacSourceHeader {
+		if peer := peerIP(r); !rb.trustedUpstreams.contains(peer) {
+			// The client may forge the headers, so they are removed before the backend gets them.
+			forged := false
+			for _, name := range []string{rb.cfg.RolesHeader, rb.cfg.ScopesHeader, rb.cfg.GroupsHeader} {
+				forged = forged || r.Header.Get(name) != ""
+				r.Header.Del(name)
+			}
+			if forged {
+				slog.Warn("middleware: rbac ignored the identity headers from an untrusted peer",
+					slog.String("peer", peer.String()), slog.String("method", r.Method), slog.String("path", r.URL.Path))
+			}
+			return permissions{}, nil, nil
+		}
+		return permissions{
+			roles:  splitList(r.Header.Get(rb.cfg.RolesHeader)),
+			scopes: splitList(r.Header.Get(rb.cfg.ScopesHeader)),
+			groups: splitList(r.Header.Get(rb.cfg.GroupsHeader)),
+		}, nil, nil
+	}
+
+	var claims Claims
+	if token, ok := bearerToken(r); ok && rb.verifier != nil {
+		c, err := rb.verifier.verify(ctx, token)
+		if err != nil {
+			return permissions{}, nil, err
+		}
+		claims = c
+	} else if c, ok := ClaimsFromContext(ctx); ok {
+		claims = c
+	} else {
+		return permissions{}, nil, errors.New("no credentials")
+	}
+	return permissions{
+		roles:  claimValues(claims, rb.cfg.RolesClaim),
+		scopes: claimValues(claims, rb.cfg.ScopesClaim),
+		groups: claimValues(claims, rb.cfg.GroupsClaim),
+	}, claims, nil
+}
+
+// missing returns the required permissions that are not granted, such as "role:admin".
+func (rb *rbac) missing(perms permissions) []string {
+	var missing []string
+	for _, role := range rb.cfg.Roles {
+		if !slices.Contains(perms.roles, role) {
+			missing = append(missing, "role:"+role)
+		}
+	}
+	for _, scope := range rb.cfg.Scopes {
+		if !slices.Contains(perms.scopes, scope) {
+			missing = append(missing, "scope:"+scope)
+		}
+	}
+	for _, group := range rb.cfg.Groups {
+		if !slices.Contains(perms.groups, group) {
+			missing = append(missing, "group:"+group)
+		}
+	}
+	return missing
+}
+
+// claimValues returns the values of the claim at path. The claim may be an array
+// of strings or a space separated string such as the "scope" claim.
+func claimValues(claims Claims, path string) []string {
+	v, ok := claims.lookup(path)
+	if !ok {
+		return nil
+	}
+	switch v := v.(type) {
+	case string:
+		return strings.Fields(v)
+	case []any:
+		values := make([]string, 0, len(v))
+		for _, e := range v {
+			if s, ok := e.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	default:
+		return nil
+	}
+}
+
+// splitList splits a comma or space separated list.
+func splitList(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+}
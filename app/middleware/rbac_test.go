@@ -0,0 +1,180 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/nao1215/hurrah/config"
+)
+
+func TestRBAC(t *testing.T) {
+	idp := newTestIdP(t, "hurrah")
+	okHandler := func(_ context.Context, w http.ResponseWriter, _ *http.Request) error {
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+	token := func(claims map[string]any) string {
+		claims["iss"] = idp.URL
+		claims["exp"] = time.Now().Add(time.Hour).Unix()
+		return idp.sign(claims)
+	}
+
+	jwtConfig := config.RBAC{
+		Roles:      []string{"admin"},
+		Scopes:     []string{"orders.read"},
+		RolesClaim: "realm_access.roles",
+		JWT: config.JWT{
+			Issuer:  idp.URL,
+			JWKSURL: idp.URL + "/jwks",
+		},
+	}
+
+	tests := []struct {
+		name        string
+		cfg         config.RBAC
+		header      http.Header
+		wantStatus  int
+		wantMissing []any
+	}{
+		{
+			name: "allowed by the bearer JWT",
+			cfg:  jwtConfig,
+			header: http.Header{"Authorization": {"Bearer " + token(map[string]any{
+				"realm_access": map[string]any{"roles": []string{"admin", "user"}},
+				"scope":        "orders.read orders.write",
+			})}},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name: "denied with the missing permissions",
+			cfg:  jwtConfig,
+			header: http.Header{"Authorization": {"Bearer " + token(map[string]any{
+				"realm_access": map[string]any{"roles": []string{"user"}},
+				"scope":        "orders.write",
+			})}},
+			wantStatus:  http.StatusForbidden,
+			wantMissing: []any{"role:admin", "scope:orders.read"},
+		},
+		{
+			name:       "no bearer token",
+			cfg:        jwtConfig,
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "expired bearer token",
+			cfg:  jwtConfig,
+			header: http.Header{"Authorization": {"Bearer " + idp.sign(map[string]any{
+				"iss": idp.URL,
+				"exp": time.Now().Add(-time.Hour).Unix(),
+			})}},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "allowed by the identity headers",
+			cfg: config.RBAC{
+				Source:           "header",
+				Groups:           []string{"partners"},
+				TrustedUpstreams: []string{"192.0.2.0/24"}, // httptest.NewRequest uses 192.0.2.1.
+			},
+			header:     http.Header{"X-Auth-Groups": {"staff, partners"}},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name: "denied by the identity headers",
+			cfg: config.RBAC{
+				Source:           "header",
+				Groups:           []string{"partners"},
+				TrustedUpstreams: []string{"192.0.2.0/24"}, // httptest.NewRequest uses 192.0.2.1.
+			},
+			header:      http.Header{"X-Auth-Groups": {"staff"}},
+			wantStatus:  http.StatusForbidden,
+			wantMissing: []any{"group:partners"},
+		},
+		{
+			name: "identity headers from an untrusted peer are ignored",
+			cfg: config.RBAC{
+				Source:           "header",
+				Groups:           []string{"partners"},
+				TrustedUpstreams: []string{"10.0.0.0/8"},
+			},
+			header:      http.Header{"X-Auth-Groups": {"partners"}},
+			wantStatus:  http.StatusForbidden,
+			wantMissing: []any{"group:partners"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := RBAC(tt.cfg, time.Second, nil)
+			if err != nil {
+				t.Fatalf("RBAC() error = %v", err)
+			}
+			req := httptest.NewRequest(http.MethodGet, "/orders", nil)
+			req.Header = tt.header
+			if req.Header == nil {
+				req.Header = http.Header{}
+			}
+			rec := httptest.NewRecorder()
+			Chain(okHandler, m).AdaptHandler().ServeHTTP(rec, req)
+
+			if diff := cmp.Diff(tt.wantStatus, rec.Code); diff != "" {
+				t.Errorf("status mismatch (-want +got):\n%s", diff)
+			}
+			if tt.wantMissing == nil {
+				return
+			}
+			var problem map[string]any
+			if err := json.Unmarshal(rec.Body.Bytes(), &problem); err != nil {
+				t.Fatalf("json.Unmarshal() error = %v", err)
+			}
+			if diff := cmp.Diff(tt.wantMissing, problem["missing"]); diff != "" {
+				t.Errorf("missing permissions mismatch (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff("application/problem+json", rec.Header().Get("Content-Type")); diff != "" {
+				t.Errorf("content type mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	t.Run("unknown source", func(t *testing.T) {
+		if _, err := RBAC(config.RBAC{Source: "cookie"}, time.Second, nil); err == nil {
+			t.Error("RBAC() error = nil, want error")
+		}
+	})
+
+	t.Run("header source without trusted upstreams", func(t *testing.T) {
+		if _, err := RBAC(config.RBAC{Source: "header"}, time.Second, nil); err == nil {
+			t.Error("RBAC() error = nil, want error")
+		}
+	})
+
+	t.Run("identity headers from untrusted peers are not forwarded", func(t *testing.T) {
+		trustedProxies, err := ParsePrefixes([]string{"10.0.0.1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := RBAC(config.RBAC{Source: "header"}, time.Second, trustedProxies)
+		if err != nil {
+			t.Fatalf("RBAC() error = %v", err)
+		}
+		backend := func(_ context.Context, w http.ResponseWriter, r *http.Request) error {
+			_, err := w.Write([]byte(r.Header.Get("X-Auth-Roles")))
+			return err
+		}
+		for remoteAddr, want := range map[string]string{"10.0.0.1:1234": "admin", "192.0.2.1:1234": ""} {
+			req := httptest.NewRequest(http.MethodGet, "/orders", nil)
+			req.RemoteAddr = remoteAddr
+			req.Header.Set("X-Auth-Roles", "admin")
+			rec := httptest.NewRecorder()
+			Chain(backend, m).AdaptHandler().ServeHTTP(rec, req)
+
+			if diff := cmp.Diff(want, rec.Body.String()); diff != "" {
+				t.Errorf("%s: X-Auth-Roles mismatch (-want +got):\n%s", remoteAddr, diff)
+			}
+		}
+	})
+}
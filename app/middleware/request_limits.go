@@ -0,0 +1,92 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/nao1215/hurrah/config"
+)
+
+// RequestLimits is a middleware that rejects requests over the limits of the route
+// before they reach the backend: 414 for a long URL, 431 for too many or too large
+// header fields, 415 for a content type that is not allowed and 413 for a large body.
+// The body size is checked while the body is streamed to the backend, so the body
+// is never buffered. If the body exceeds the limit in the middle of the stream,
+// the proxy responds with 413 (see proxy.SetProxy).
+func RequestLimits(cfg config.RequestLimits) (Middleware, error) {
+	for _, contentType := range cfg.AllowedContentTypes {
+		if _, _, err := mime.ParseMediaType(contentType); err != nil {
+			return nil, fmt.Errorf("middleware: invalid content type %q: %w", contentType, err)
+		}
+	}
+
+	return func(next HandlerWithCtx) HandlerWithCtx {
+		return func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			if cfg.MaxURLLength > 0 && len(r.RequestURI) > cfg.MaxURLLength {
+				return NewError(http.StatusRequestURITooLong, fmt.Sprintf("URL exceeds %d bytes", cfg.MaxURLLength))
+			}
+			if err := checkHeaderLimits(r.Header, cfg.MaxHeaderCount, cfg.MaxHeaderBytes); err != nil {
+				return err
+			}
+			if len(cfg.AllowedContentTypes) > 0 && hasBody(r) && !allowContentType(cfg.AllowedContentTypes, r.Header.Get("Content-Type")) {
+				return NewError(http.StatusUnsupportedMediaType, fmt.Sprintf("content type %q is not allowed", r.Header.Get("Content-Type")))
+			}
+			if cfg.MaxBodyBytes > 0 && hasBody(r) {
+				if r.ContentLength > cfg.MaxBodyBytes {
+					return NewError(http.StatusRequestEntityTooLarge, fmt.Sprintf("request body exceeds %d bytes", cfg.MaxBodyBytes))
+				}
+				r.Body = http.MaxBytesReader(w, r.Body, cfg.MaxBodyBytes)
+			}
+			return next(ctx, w, r)
+		}
+	}, nil
+}
+
+// checkHeaderLimits returns an error if the header has too many or too large fields.
+// The size of a field is counted as "Name: value\r\n".
+func checkHeaderLimits(h http.Header, maxCount, maxBytes int) error {
+	if maxCount <= 0 && maxBytes <= 0 {
+		return nil
+	}
+	count, size := 0, 0
+	for k, values := range h {
+		for _, v := range values {
+			count++
+			size += len(k) + len(v) + len(": \r\n")
+		}
+	}
+	if maxCount > 0 && count > maxCount {
+		return NewError(http.StatusRequestHeaderFieldsTooLarge, fmt.Sprintf("request has more than %d header fields", maxCount))
+	}
+	if maxBytes > 0 && size > maxBytes {
+		return NewError(http.StatusRequestHeaderFieldsTooLarge, fmt.Sprintf("request header fields exceed %d bytes", maxBytes))
+	}
+	return nil
+}
+
+// hasBody returns true if the request has a body.
+func hasBody(r *http.Request) bool {
+	return r.Body != nil && r.Body != http.NoBody && r.ContentLength != 0
+}
+
+// allowContentType returns true if the media type of the Content-Type header matches
+// one of the allowed media types. An allowed media type may have a wildcard subtype, e.g., "text/*".
+func allowContentType(allowed []string, contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, a := range allowed {
+		a, _, _ = mime.ParseMediaType(a) // It is validated by RequestLimits.
+		if a == "*/*" || a == mediaType {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(a, "/*"); ok && strings.HasPrefix(mediaType, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
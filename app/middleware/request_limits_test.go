@@ -0,0 +1,149 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/nao1215/hurrah/config"
+)
+
+func TestRequestLimits(t *testing.T) {
+	t.Parallel()
+
+	m, err := RequestLimits(config.RequestLimits{
+		MaxBodyBytes:        8,
+		MaxHeaderCount:      3,
+		MaxHeaderBytes:      64,
+		MaxURLLength:        20,
+		AllowedContentTypes: []string{"application/json", "text/*"},
+	})
+	if err != nil {
+		t.Fatalf("RequestLimits() error = %v", err)
+	}
+	// The backend reads the body like httputil.ReverseProxy.
+	backend := func(_ context.Context, w http.ResponseWriter, r *http.Request) error {
+		if _, err := io.ReadAll(r.Body); err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				return NewError(http.StatusRequestEntityTooLarge, err.Error())
+			}
+			return err
+		}
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+	h := Chain(backend, m).AdaptHandler()
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   io.Reader
+		header http.Header
+		want   int
+	}{
+		{
+			name:   "within the limits",
+			method: http.MethodPost,
+			target: "/api/",
+			body:   strings.NewReader(`{"a":1}`),
+			header: http.Header{"Content-Type": {"application/json; charset=utf-8"}},
+			want:   http.StatusOK,
+		},
+		{
+			name:   "GET without a content type",
+			method: http.MethodGet,
+			target: "/api/",
+			want:   http.StatusOK,
+		},
+		{
+			name:   "long URL",
+			method: http.MethodGet,
+			target: "/api/?q=" + strings.Repeat("a", 20),
+			want:   http.StatusRequestURITooLong,
+		},
+		{
+			name:   "too many header fields",
+			method: http.MethodGet,
+			target: "/api/",
+			header: http.Header{"A": {"1"}, "B": {"2"}, "C": {"3", "4"}},
+			want:   http.StatusRequestHeaderFieldsTooLarge,
+		},
+		{
+			name:   "large header fields",
+			method: http.MethodGet,
+			target: "/api/",
+			header: http.Header{"Cookie": {strings.Repeat("a", 64)}},
+			want:   http.StatusRequestHeaderFieldsTooLarge,
+		},
+		{
+			name:   "content type is not allowed",
+			method: http.MethodPost,
+			target: "/api/",
+			body:   strings.NewReader("a=1"),
+			header: http.Header{"Content-Type": {"application/x-www-form-urlencoded"}},
+			want:   http.StatusUnsupportedMediaType,
+		},
+		{
+			name:   "wildcard content type",
+			method: http.MethodPost,
+			target: "/api/",
+			body:   strings.NewReader("hello"),
+			header: http.Header{"Content-Type": {"text/plain"}},
+			want:   http.StatusOK,
+		},
+		{
+			name:   "body without a content type",
+			method: http.MethodPost,
+			target: "/api/",
+			body:   strings.NewReader("hello"),
+			want:   http.StatusUnsupportedMediaType,
+		},
+		{
+			name:   "Content-Length over the limit",
+			method: http.MethodPost,
+			target: "/api/",
+			body:   strings.NewReader(`{"a":"123456789"}`),
+			header: http.Header{"Content-Type": {"application/json"}},
+			want:   http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:   "streamed body over the limit",
+			method: http.MethodPost,
+			target: "/api/",
+			body:   io.MultiReader(strings.NewReader(`{"a":`), strings.NewReader(`"123456789"}`)),
+			header: http.Header{"Content-Type": {"application/json"}},
+			want:   http.StatusRequestEntityTooLarge,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			req := httptest.NewRequest(tt.method, tt.target, tt.body)
+			for k, v := range tt.header {
+				req.Header[k] = v
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if diff := cmp.Diff(tt.want, rec.Code); diff != "" {
+				t.Errorf("status mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	t.Run("invalid content type", func(t *testing.T) {
+		t.Parallel()
+
+		if _, err := RequestLimits(config.RequestLimits{AllowedContentTypes: []string{"application/"}}); err == nil {
+			t.Error("RequestLimits() error = nil, want error")
+		}
+	})
+}
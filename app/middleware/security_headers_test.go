@@ -0,0 +1,103 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/nao1215/hurrah/config"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	t.Parallel()
+
+	backend := func(_ context.Context, w http.ResponseWriter, _ *http.Request) error {
+		w.Header().Set("Server", "nginx/1.25.0")
+		w.Header().Set("X-Powered-By", "Express")
+		w.Header().Set("X-Frame-Options", "ALLOWALL")
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+	unauthorized := func(_ context.Context, _ http.ResponseWriter, _ *http.Request) error {
+		return NewError(http.StatusUnauthorized, "missing token")
+	}
+
+	tests := []struct {
+		name    string
+		cfg     config.SecurityHeaders
+		handler HandlerWithCtx
+		want    http.Header
+	}{
+		{
+			name:    "api preset by default",
+			handler: backend,
+			want: http.Header{
+				"Strict-Transport-Security": {"max-age=31536000; includeSubDomains"},
+				"Content-Security-Policy":   {"default-src 'none'; frame-ancestors 'none'"},
+				"X-Content-Type-Options":    {"nosniff"},
+				"Referrer-Policy":           {"no-referrer"},
+				"X-Frame-Options":           {"DENY"},
+				"Server":                    nil,
+				"X-Powered-By":              nil,
+				"Permissions-Policy":        nil,
+			},
+		},
+		{
+			name: "strict preset with overrides",
+			cfg: config.SecurityHeaders{
+				Preset: "strict",
+				Headers: map[string]string{
+					"content-security-policy": "default-src 'self' https://cdn.example.com",
+					"X-Frame-Options":         "",
+				},
+				StripHeaders: []string{"X-Powered-By"},
+			},
+			handler: backend,
+			want: http.Header{
+				"Content-Security-Policy": {"default-src 'self' https://cdn.example.com"},
+				"Permissions-Policy":      {"camera=(), microphone=(), geolocation=(), payment=(), usb=()"},
+				"Referrer-Policy":         {"strict-origin-when-cross-origin"},
+				"X-Frame-Options":         {"ALLOWALL"},
+				"Server":                  {"nginx/1.25.0"},
+				"X-Powered-By":            nil,
+			},
+		},
+		{
+			name:    "error responses of the gateway",
+			handler: unauthorized,
+			want: http.Header{
+				"Content-Type":            {"application/problem+json"},
+				"Content-Security-Policy": {"default-src 'none'; frame-ancestors 'none'"},
+				"X-Frame-Options":         {"DENY"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			m, err := SecurityHeaders(tt.cfg)
+			if err != nil {
+				t.Fatalf("SecurityHeaders() error = %v", err)
+			}
+			rec := httptest.NewRecorder()
+			Chain(tt.handler, m).AdaptHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			for k, want := range tt.want {
+				if diff := cmp.Diff(want, rec.Header().Values(k)); diff != "" {
+					t.Errorf("%s header mismatch (-want +got):\n%s", k, diff)
+				}
+			}
+		})
+	}
+
+	t.Run("unknown preset", func(t *testing.T) {
+		t.Parallel()
+
+		if _, err := SecurityHeaders(config.SecurityHeaders{Preset: "lax"}); err == nil {
+			t.Error("SecurityHeaders() error = nil, want error")
+		}
+	})
+}
@@ -0,0 +1,296 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/nao1215/hurrah/config"
+)
+
+const (
+	// wafModeBlock rejects the requests that match a rule with 403.
+	wafModeBlock = "block"
+	// wafModeDetect only logs the requests that match a rule.
+	wafModeDetect = "detect"
+	// defaultWAFMaxBodyBytes is the default maximum size of the body inspected.
+	defaultWAFMaxBodyBytes = 128 << 10
+)
+
+// wafRule is a rule of the waf middleware.
+type wafRule struct {
+	id      string
+	message string
+	targets []string // targets is the target patterns. e.g., "path", "query:*"
+	pattern *regexp.Regexp
+}
+
+// wafValue is a normalized value of a target of the request.
+type wafValue struct {
+	target string // target is the name of the value. e.g., "path", "query:q", "header:cookie", "body:name"
+	value  string
+}
+
+// wafMatch is a rule that matched a value.
+type wafMatch struct {
+	rule   *wafRule
+	target string
+}
+
+// waf is the web application firewall of a route.
+type waf struct {
+	cfg        config.WAF
+	rules      []wafRule
+	exclusions []config.WAFExclusion
+}
+
+// WAF is a middleware that inspects the path, query, headers and body of requests
+// with the built-in ruleset (SQL injection, XSS, path traversal and scanner user
+// agents) and the custom rules. The values are percent-decoded, HTML-unescaped
+// and lower-cased before the rules are evaluated. Every match is logged with the
+// rule ID and the target, so that false positives can be excluded per route. In
+// block mode, the requests that match a rule get 403.
+func WAF(cfg config.WAF) (Middleware, error) {
+	w, err := newWAF(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return w.handle, nil
+}
+
+// newWAF validates the settings and returns a new waf.
+func newWAF(cfg config.WAF) (*waf, error) {
+	switch cfg.Mode {
+	case "":
+		cfg.Mode = wafModeBlock
+	case wafModeBlock, wafModeDetect:
+	default:
+		return nil, fmt.Errorf("middleware: unknown waf mode %q", cfg.Mode)
+	}
+	if cfg.MaxBodyBytes <= 0 {
+		cfg.MaxBodyBytes = defaultWAFMaxBodyBytes
+	}
+
+	rules := append([]wafRule{}, wafBuiltinRules...)
+	for _, r := range cfg.Rules {
+		if r.ID == "" || len(r.Targets) == 0 {
+			return nil, fmt.Errorf("middleware: waf rule %q requires id and targets", r.ID)
+		}
+		pattern, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("middleware: invalid pattern of waf rule %s: %w", r.ID, err)
+		}
+		rules = append(rules, wafRule{id: r.ID, message: r.Message, targets: r.Targets, pattern: pattern})
+	}
+	return &waf{cfg: cfg, rules: rules, exclusions: cfg.Exclusions}, nil
+}
+
+// handle is the Middleware of the waf.
+func (w *waf) handle(next HandlerWithCtx) HandlerWithCtx {
+	return func(ctx context.Context, rw http.ResponseWriter, r *http.Request) error {
+		values, err := w.values(r)
+		if err != nil {
+			return err
+		}
+		matches := w.evaluate(values)
+		if len(matches) == 0 {
+			return next(ctx, rw, r)
+		}
+
+		for _, m := range matches {
+			slog.Warn("middleware: waf rule matched",
+				slog.String("rule", m.rule.id),
+				slog.String("message", m.rule.message),
+				slog.String("target", m.target),
+				slog.String("mode", w.cfg.Mode),
+				slog.String("method", r.Method),
+				slog.String("path", r.URL.Path),
+				slog.String("client_ip", clientIP(ctx, r).String()),
+			)
+		}
+		if w.cfg.Mode == wafModeDetect {
+			return next(ctx, rw, r)
+		}
+		return NewError(http.StatusForbidden, "request blocked by the web application firewall")
+	}
+}
+
+// evaluate returns the rules that match the values. A rule matches at most once.
+func (w *waf) evaluate(values []wafValue) []wafMatch {
+	var matches []wafMatch
+	for i := range w.rules {
+		rule := &w.rules[i]
+		for _, v := range values {
+			if !matchAny(rule.targets, v.target) || w.excluded(rule.id, v.target) {
+				continue
+			}
+			if rule.pattern.MatchString(v.value) {
+				matches = append(matches, wafMatch{rule: rule, target: v.target})
+				break
+			}
+		}
+	}
+	return matches
+}
+
+// excluded returns true if the rule is excluded for the target.
+func (w *waf) excluded(id, target string) bool {
+	for _, e := range w.exclusions {
+		if matchAny(e.Rules, id) && (len(e.Targets) == 0 || matchAny(e.Targets, target)) {
+			return true
+		}
+	}
+	return false
+}
+
+// values returns the normalized values of the request. The inspected part of the
+// body is read and put back, so the body is still streamed to the backend.
+func (w *waf) values(r *http.Request) ([]wafValue, error) {
+	path := r.URL.EscapedPath()
+	values := []wafValue{{target: "path", value: normalizeWAFValue(path)}}
+
+	for name, vs := range r.URL.Query() {
+		for _, v := range vs {
+			values = append(values, wafValue{target: "query:" + strings.ToLower(name), value: normalizeWAFValue(name + "=" + v)})
+		}
+	}
+	for name, vs := range r.Header {
+		for _, v := range vs {
+			values = append(values, wafValue{target: "header:" + strings.ToLower(name), value: normalizeWAFValue(v)})
+		}
+	}
+
+	bodyValues, err := w.bodyValues(r)
+	if err != nil {
+		return nil, err
+	}
+	return append(values, bodyValues...), nil
+}
+
+// bodyValues returns the normalized values of the form, JSON or text body.
+// Other bodies, such as multipart and binary, are not inspected. In block mode,
+// the bodies larger than max_body_bytes get 413, because only the first
+// max_body_bytes are inspected.
+func (w *waf) bodyValues(r *http.Request) ([]wafValue, error) {
+	if !hasBody(r) {
+		return nil, nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")) // An invalid content type is not inspected.
+	isForm := mediaType == "application/x-www-form-urlencoded"
+	isJSON := mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+	isText := strings.HasPrefix(mediaType, "text/") || mediaType == "application/xml" || strings.HasSuffix(mediaType, "+xml")
+	if !isForm && !isJSON && !isText {
+		return nil, nil
+	}
+
+	if w.cfg.Mode == wafModeBlock && r.ContentLength > w.cfg.MaxBodyBytes {
+		return nil, NewError(http.StatusRequestEntityTooLarge, fmt.Sprintf("request body exceeds %d bytes", w.cfg.MaxBodyBytes))
+	}
+	// One more byte is read to know whether the body is larger than the limit.
+	body, err := io.ReadAll(io.LimitReader(r.Body, w.cfg.MaxBodyBytes+1))
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return nil, NewError(http.StatusRequestEntityTooLarge, fmt.Sprintf("request body exceeds %d bytes", maxBytesErr.Limit))
+		}
+		return nil, NewError(http.StatusBadRequest, "failed to read the request body")
+	}
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+	if int64(len(body)) > w.cfg.MaxBodyBytes {
+		// The rest of the body is not inspected, so a payload after padding would pass.
+		if w.cfg.Mode == wafModeBlock {
+			return nil, NewError(http.StatusRequestEntityTooLarge, fmt.Sprintf("request body exceeds %d bytes", w.cfg.MaxBodyBytes))
+		}
+		slog.Warn("middleware: waf inspects only the beginning of the request body", slog.Int64("max_body_bytes", w.cfg.MaxBodyBytes))
+		body = body[:w.cfg.MaxBodyBytes]
+	}
+
+	switch {
+	case isForm:
+		form, err := url.ParseQuery(string(body))
+		if err == nil {
+			var values []wafValue
+			for name, vs := range form {
+				for _, v := range vs {
+					values = append(values, wafValue{target: "body:" + strings.ToLower(name), value: normalizeWAFValue(name + "=" + v)})
+				}
+			}
+			return values, nil
+		}
+	case isJSON:
+		// The strings are decoded so that escapes such as \u003c do not hide the payload.
+		var v any
+		if err := json.Unmarshal(body, &v); err == nil {
+			var values []wafValue
+			walkJSONStrings(v, func(s string) {
+				values = append(values, wafValue{target: "body", value: normalizeWAFValue(s)})
+			})
+			return values, nil
+		}
+	}
+	return []wafValue{{target: "body", value: normalizeWAFValue(string(body))}}, nil
+}
+
+// walkJSONStrings calls f with the keys and string values in the JSON value.
+func walkJSONStrings(v any, f func(string)) {
+	switch v := v.(type) {
+	case string:
+		f(v)
+	case []any:
+		for _, e := range v {
+			walkJSONStrings(e, f)
+		}
+	case map[string]any:
+		for k, e := range v {
+			f(k)
+			walkJSONStrings(e, f)
+		}
+	}
+}
+
+// normalizeWAFValue percent-decodes the value up to twice to reveal double encoding,
+// unescapes the HTML entities, removes NUL bytes and lower-cases it.
+func normalizeWAFValue(v string) string {
+	for range 2 {
+		decoded, err := url.PathUnescape(v)
+		if err != nil || decoded == v {
+			break
+		}
+		v = decoded
+	}
+	v = html.UnescapeString(v)
+	v = strings.ReplaceAll(v, "\x00", "")
+	return strings.ToLower(v)
+}
+
+// matchAny returns true if the name matches one of the patterns. A pattern with a
+// trailing "*" matches the prefix, and the match is case-insensitive.
+func matchAny(patterns []string, name string) bool {
+	name = strings.ToLower(name)
+	for _, p := range patterns {
+		p = strings.ToLower(p)
+		if prefix, ok := strings.CutSuffix(p, "*"); ok {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+			continue
+		}
+		if p == name {
+			return true
+		}
+	}
+	return false
+}
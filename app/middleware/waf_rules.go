@@ -0,0 +1,83 @@
+package middleware
+
+import "regexp"
+
+// wafTargetsInjection is the targets inspected for SQL injection and XSS.
+var wafTargetsInjection = []string{"path", "query:*", "body*", "header:cookie", "header:referer", "header:user-agent"}
+
+// wafBuiltinRules is the built-in ruleset of the waf middleware. The patterns are
+// matched against the normalized values, so they are written in lower case.
+var wafBuiltinRules = []wafRule{
+	{
+		id:      "sqli-union",
+		message: "SQL injection: UNION SELECT",
+		targets: wafTargetsInjection,
+		pattern: regexp.MustCompile(`\bunion\b[\s/*()]+(all[\s/*()]+|distinct[\s/*()]+)?select\b`),
+	},
+	{
+		id:      "sqli-tautology",
+		message: "SQL injection: tautology",
+		targets: wafTargetsInjection,
+		pattern: regexp.MustCompile(`['"\x60]\s*(or|and|\|\||&&)\s+['"\x60]?[\w]+['"\x60]?\s*(=|<>|!=|\blike\b)\s*['"\x60]?[\w]+|['"\x60]\s*(or|\|\|)\s+(true|1)\b`),
+	},
+	{
+		id:      "sqli-comment",
+		message: "SQL injection: quote followed by a comment",
+		targets: wafTargetsInjection,
+		pattern: regexp.MustCompile(`['"\x60]\s*(--|#|/\*)`),
+	},
+	{
+		id:      "sqli-stacked-query",
+		message: "SQL injection: stacked query",
+		targets: wafTargetsInjection,
+		pattern: regexp.MustCompile(`;\s*(drop|delete|insert|update|alter|create|truncate|exec|execute|shutdown)\s`),
+	},
+	{
+		id:      "sqli-function",
+		message: "SQL injection: time-based or file function",
+		targets: wafTargetsInjection,
+		pattern: regexp.MustCompile(`\b(sleep|benchmark|pg_sleep|load_file)\s*\(|\bwaitfor\s+delay\b|\binto\s+(out|dump)file\b`),
+	},
+	{
+		id:      "xss-script",
+		message: "XSS: script tag",
+		targets: wafTargetsInjection,
+		pattern: regexp.MustCompile(`<\s*/?\s*script\b`),
+	},
+	{
+		id:      "xss-event-handler",
+		message: "XSS: event handler attribute",
+		targets: wafTargetsInjection,
+		pattern: regexp.MustCompile(`<[^>]*[\s/"']on[a-z]+\s*=`),
+	},
+	{
+		id:      "xss-javascript-uri",
+		message: "XSS: javascript or vbscript URI",
+		targets: wafTargetsInjection,
+		pattern: regexp.MustCompile(`\b(javascript|vbscript)\s*:\s*\S`),
+	},
+	{
+		id:      "xss-dangerous-tag",
+		message: "XSS: tag that can run scripts",
+		targets: wafTargetsInjection,
+		pattern: regexp.MustCompile(`<\s*(iframe|object|embed|svg|math|base|meta)\b`),
+	},
+	{
+		id:      "path-traversal",
+		message: "Path traversal: parent directory",
+		targets: []string{"path", "query:*"},
+		pattern: regexp.MustCompile(`(^|[\\/=])\.\.([\\/]|$)`),
+	},
+	{
+		id:      "path-sensitive-file",
+		message: "Path traversal: sensitive file",
+		targets: []string{"path", "query:*"},
+		pattern: regexp.MustCompile(`/etc/(passwd|shadow|group|hosts)\b|\bwin\.ini\b|/proc/self/|(^|[/=])\.(git|svn|hg|env|htaccess|htpasswd)(/|$)`),
+	},
+	{
+		id:      "scanner-user-agent",
+		message: "Scanner: known security scanner user agent",
+		targets: []string{"header:user-agent"},
+		pattern: regexp.MustCompile(`\b(sqlmap|nikto|nmap|masscan|acunetix|nessus|openvas|wpscan|dirbuster|gobuster|nuclei|zgrab|havij|w3af)\b`),
+	},
+}
@@ -0,0 +1,240 @@
+package middleware
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/nao1215/hurrah/config"
+)
+
+func TestWAF(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		cfg    config.WAF
+		method string
+		target string
+		header http.Header
+		body   string
+		want   int
+	}{
+		{
+			name:   "clean request",
+			method: http.MethodGet,
+			target: "/api/items?q=" + url.QueryEscape("o'reilly books") + "&sort=name",
+			header: http.Header{"User-Agent": {"Mozilla/5.0"}, "Cookie": {"session=abc"}},
+			want:   http.StatusOK,
+		},
+		{
+			name:   "SQL injection in the query",
+			method: http.MethodGet,
+			target: "/api/items?id=" + url.QueryEscape("1 UNION/**/SELECT password FROM users"),
+			want:   http.StatusForbidden,
+		},
+		{
+			name:   "double encoded tautology",
+			method: http.MethodGet,
+			target: "/api/items?id=%2527%2520or%25201%253D1",
+			want:   http.StatusForbidden,
+		},
+		{
+			name:   "XSS in the form body",
+			method: http.MethodPost,
+			target: "/api/comments",
+			header: http.Header{"Content-Type": {"application/x-www-form-urlencoded"}},
+			body:   "comment=" + url.QueryEscape(`<img src=x onerror=alert(1)>`),
+			want:   http.StatusForbidden,
+		},
+		{
+			name:   "escaped XSS in the JSON body",
+			method: http.MethodPost,
+			target: "/api/comments",
+			header: http.Header{"Content-Type": {"application/json"}},
+			body:   `{"comment": "\u003cscript\u003ealert(1)\u003c/script\u003e"}`,
+			want:   http.StatusForbidden,
+		},
+		{
+			name:   "path traversal",
+			method: http.MethodGet,
+			target: "/api/files/%2e%2e/%2e%2e/etc/passwd",
+			want:   http.StatusForbidden,
+		},
+		{
+			name:   "path traversal in the query",
+			method: http.MethodGet,
+			target: "/api/download?file=../config.toml",
+			want:   http.StatusForbidden,
+		},
+		{
+			name:   "scanner user agent",
+			method: http.MethodGet,
+			target: "/",
+			header: http.Header{"User-Agent": {"sqlmap/1.7.2#stable (https://sqlmap.org)"}},
+			want:   http.StatusForbidden,
+		},
+		{
+			name:   "detect mode",
+			cfg:    config.WAF{Mode: "detect"},
+			method: http.MethodGet,
+			target: "/?q=" + url.QueryEscape("<script>"),
+			want:   http.StatusOK,
+		},
+		{
+			name: "excluded rule for the target",
+			cfg: config.WAF{Exclusions: []config.WAFExclusion{
+				{Rules: []string{"xss-*"}, Targets: []string{"body:html"}},
+			}},
+			method: http.MethodPost,
+			target: "/api/pages",
+			header: http.Header{"Content-Type": {"application/x-www-form-urlencoded"}},
+			body:   "html=" + url.QueryEscape("<script>track()</script>"),
+			want:   http.StatusOK,
+		},
+		{
+			name: "excluded rule for another target",
+			cfg: config.WAF{Exclusions: []config.WAFExclusion{
+				{Rules: []string{"xss-*"}, Targets: []string{"body:html"}},
+			}},
+			method: http.MethodPost,
+			target: "/api/pages",
+			header: http.Header{"Content-Type": {"application/x-www-form-urlencoded"}},
+			body:   "title=" + url.QueryEscape("<script>track()</script>"),
+			want:   http.StatusForbidden,
+		},
+		{
+			name: "custom rule",
+			cfg: config.WAF{Rules: []config.WAFRule{
+				{ID: "custom-wp-admin", Targets: []string{"path"}, Pattern: `^/wp-(admin|login)`, Message: "WordPress probe"},
+			}},
+			method: http.MethodGet,
+			target: "/wp-login.php",
+			want:   http.StatusForbidden,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			m, err := WAF(tt.cfg)
+			if err != nil {
+				t.Fatalf("WAF() error = %v", err)
+			}
+			var gotBody string
+			backend := func(_ context.Context, w http.ResponseWriter, r *http.Request) error {
+				b, err := io.ReadAll(r.Body)
+				if err != nil {
+					return err
+				}
+				gotBody = string(b)
+				w.WriteHeader(http.StatusOK)
+				return nil
+			}
+			req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			for k, v := range tt.header {
+				req.Header[k] = v
+			}
+			rec := httptest.NewRecorder()
+			Chain(backend, m).AdaptHandler().ServeHTTP(rec, req)
+
+			if diff := cmp.Diff(tt.want, rec.Code); diff != "" {
+				t.Errorf("status mismatch (-want +got):\n%s", diff)
+			}
+			if rec.Code == http.StatusOK {
+				if diff := cmp.Diff(tt.body, gotBody); diff != "" {
+					t.Errorf("body forwarded to the backend mismatch (-want +got):\n%s", diff)
+				}
+			}
+		})
+	}
+
+	t.Run("payload after padding", func(t *testing.T) {
+		t.Parallel()
+
+		body := `{"padding": "` + strings.Repeat("a", 64) + `", "q": "<script>alert(1)</script>"}`
+		for _, tt := range []struct {
+			mode          string
+			contentLength int64
+			want          int
+		}{
+			{mode: "block", contentLength: int64(len(body)), want: http.StatusRequestEntityTooLarge},
+			{mode: "block", contentLength: -1, want: http.StatusRequestEntityTooLarge},
+			{mode: "detect", contentLength: -1, want: http.StatusOK},
+		} {
+			m, err := WAF(config.WAF{Mode: tt.mode, MaxBodyBytes: 32})
+			if err != nil {
+				t.Fatalf("WAF() error = %v", err)
+			}
+			var gotBody string
+			backend := func(_ context.Context, w http.ResponseWriter, r *http.Request) error {
+				b, err := io.ReadAll(r.Body)
+				if err != nil {
+					return err
+				}
+				gotBody = string(b)
+				w.WriteHeader(http.StatusOK)
+				return nil
+			}
+			req := httptest.NewRequest(http.MethodPost, "/api/items", strings.NewReader(body))
+			req.ContentLength = tt.contentLength
+			req.Header.Set("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+			Chain(backend, m).AdaptHandler().ServeHTTP(rec, req)
+
+			if diff := cmp.Diff(tt.want, rec.Code); diff != "" {
+				t.Errorf("%s mode with Content-Length %d: status mismatch (-want +got):\n%s", tt.mode, tt.contentLength, diff)
+			}
+			if tt.want == http.StatusOK {
+				if diff := cmp.Diff(body, gotBody); diff != "" {
+					t.Errorf("%s mode: body forwarded to the backend mismatch (-want +got):\n%s", tt.mode, diff)
+				}
+			}
+		}
+	})
+
+	t.Run("body over the request_limits limit", func(t *testing.T) {
+		t.Parallel()
+
+		m, err := WAF(config.WAF{})
+		if err != nil {
+			t.Fatalf("WAF() error = %v", err)
+		}
+		limits, err := RequestLimits(config.RequestLimits{MaxBodyBytes: 8})
+		if err != nil {
+			t.Fatalf("RequestLimits() error = %v", err)
+		}
+		ok := func(_ context.Context, w http.ResponseWriter, _ *http.Request) error {
+			w.WriteHeader(http.StatusOK)
+			return nil
+		}
+		req := httptest.NewRequest(http.MethodPost, "/api/items", strings.NewReader(`{"name": "tama"}`))
+		req.ContentLength = -1 // The size is known only while the body is read.
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		Chain(ok, limits, m).AdaptHandler().ServeHTTP(rec, req)
+
+		if diff := cmp.Diff(http.StatusRequestEntityTooLarge, rec.Code); diff != "" {
+			t.Errorf("status mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("invalid settings", func(t *testing.T) {
+		t.Parallel()
+
+		for _, cfg := range []config.WAF{
+			{Mode: "audit"},
+			{Rules: []config.WAFRule{{ID: "custom", Pattern: "a"}}},
+			{Rules: []config.WAFRule{{ID: "custom", Targets: []string{"path"}, Pattern: "("}}},
+		} {
+			if _, err := WAF(cfg); err == nil {
+				t.Errorf("WAF(%+v) error = nil, want error", cfg)
+			}
+		}
+	})
+}
@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"time"
+
+	"github.com/nao1215/hurrah/app/middleware"
+	"golang.org/x/net/http2"
+)
+
+// newGRPCProxy creates a reverse proxy to the given gRPC backend. The requests are
+// forwarded over HTTP/2: h2c for "http" backends and TLS for "https" backends.
+// The responses are flushed immediately, so that both directions of streaming RPCs
+// work, and the trailers (grpc-status, grpc-message) are passed to the client.
+// The timeout applies to connecting to the backend, not to the RPCs, because
+// streaming RPCs can last long.
+func newGRPCProxy(target string, timeout int64, tlsConfig *tls.Config) (*httputil.ReverseProxy, error) {
+	url, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse target URL: %w", err)
+	}
+	dialer := &net.Dialer{Timeout: time.Duration(timeout) * time.Second}
+	transport := &http2.Transport{
+		TLSClientConfig: tlsConfig,
+		ReadIdleTimeout: 30 * time.Second,
+		PingTimeout:     15 * time.Second,
+	}
+	switch url.Scheme {
+	case "http":
+		transport.AllowHTTP = true
+		transport.DialTLSContext = func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		}
+	case "https":
+		transport.DialTLSContext = func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return (&tls.Dialer{NetDialer: dialer, Config: cfg}).DialContext(ctx, network, addr)
+		}
+	default:
+		return nil, fmt.Errorf("gRPC backend must be http (h2c) or https: %s", target)
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(url)
+	proxy.Transport = transport
+	proxy.FlushInterval = -1
+	proxy.ErrorHandler = grpcErrorHandler
+	return proxy, nil
+}
+
+// grpcErrorHandler handles the errors of forwarding a gRPC request. It responds with
+// the gRPC status: the status of the *middleware.Error returned by a request body
+// wrapped by a middleware (e.g., an invalid gRPC-Web text body), RESOURCE_EXHAUSTED
+// if the request body exceeds the limit, DEADLINE_EXCEEDED if the request times
+// out, and UNAVAILABLE otherwise.
+func grpcErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	var maxBytesErr *http.MaxBytesError
+	var gatewayErr *middleware.Error
+	switch {
+	case errors.As(err, &gatewayErr):
+		middleware.WriteGRPCError(w, gatewayErr)
+	case errors.As(err, &maxBytesErr):
+		middleware.WriteGRPCError(w, middleware.NewError(http.StatusRequestEntityTooLarge, fmt.Sprintf("request body exceeds %d bytes", maxBytesErr.Limit)))
+	case errors.Is(err, context.DeadlineExceeded):
+		middleware.WriteGRPCError(w, middleware.NewError(http.StatusGatewayTimeout, "backend did not respond in time"))
+	default:
+		slog.Warn("proxy: failed to forward the gRPC request", slog.String("path", r.URL.Path), slog.String("error", err.Error()))
+		middleware.WriteGRPCError(w, middleware.NewError(http.StatusBadGateway, "backend is unavailable"))
+	}
+}
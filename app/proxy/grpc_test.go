@@ -0,0 +1,327 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/nao1215/hurrah/app/middleware"
+	"github.com/nao1215/hurrah/config"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	reflectionpb "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// newGRPCBackend starts a gRPC server with the health and reflection (v1 and v1alpha) services.
+func newGRPCBackend(t *testing.T) (string, *health.Server) {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer(grpc.UnaryInterceptor(func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		_ = grpc.SetTrailer(ctx, metadata.Pairs("x-backend", "health")) // The test checks the trailer.
+		return handler(ctx, req)
+	}))
+	healthServer := health.NewServer()
+	healthpb.RegisterHealthServer(srv, healthServer)
+	reflection.Register(srv)
+	go srv.Serve(lis) //nolint:errcheck // The error after Stop is expected.
+	t.Cleanup(srv.Stop)
+	return lis.Addr().String(), healthServer
+}
+
+// newGRPCGateway starts the gateway with h2c and returns a gRPC client connected to it.
+func newGRPCGateway(t *testing.T, routes []config.Route) *grpc.ClientConn {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	if err := SetProxy(mux, routes, middleware.Resources{}); err != nil {
+		t.Fatalf("SetProxy() error = %v", err)
+	}
+	gateway := httptest.NewServer(h2c.NewHandler(mux, &http2.Server{}))
+	t.Cleanup(gateway.Close)
+
+	conn, err := grpc.NewClient(strings.TrimPrefix(gateway.URL, "http://"), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() }) // The connection is only for the test.
+	return conn
+}
+
+func TestSetProxy_grpc(t *testing.T) {
+	t.Parallel()
+
+	backend, healthServer := newGRPCBackend(t)
+	conn := newGRPCGateway(t, []config.Route{
+		{Path: "/grpc.health.v1.Health/", Backend: "http://" + backend, Timeout: 5, Protocol: config.ProtocolGRPC},
+		{Path: "/grpc.reflection.v1.ServerReflection/", Backend: "http://" + backend, Timeout: 5, Protocol: config.ProtocolGRPC},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	t.Run("unary RPC with trailers", func(t *testing.T) {
+		var trailer metadata.MD
+		resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{}, grpc.Trailer(&trailer))
+		if err != nil {
+			t.Fatalf("Check() error = %v", err)
+		}
+		if diff := cmp.Diff(healthpb.HealthCheckResponse_SERVING, resp.GetStatus()); diff != "" {
+			t.Errorf("status mismatch (-want +got):\n%s", diff)
+		}
+		if diff := cmp.Diff([]string{"health"}, trailer.Get("x-backend")); diff != "" {
+			t.Errorf("trailer mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("status of the backend", func(t *testing.T) {
+		_, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{Service: "unknown"})
+		if diff := cmp.Diff(codes.NotFound, status.Code(err)); diff != "" {
+			t.Errorf("code mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("server streaming RPC", func(t *testing.T) {
+		stream, err := healthpb.NewHealthClient(conn).Watch(ctx, &healthpb.HealthCheckRequest{Service: "greeter"})
+		if err != nil {
+			t.Fatalf("Watch() error = %v", err)
+		}
+		// The first message is sent before the status changes, so the response is not buffered.
+		want := []healthpb.HealthCheckResponse_ServingStatus{
+			healthpb.HealthCheckResponse_SERVICE_UNKNOWN,
+			healthpb.HealthCheckResponse_SERVING,
+		}
+		for i, w := range want {
+			resp, err := stream.Recv()
+			if err != nil {
+				t.Fatalf("Recv() error = %v", err)
+			}
+			if diff := cmp.Diff(w, resp.GetStatus()); diff != "" {
+				t.Errorf("message %d mismatch (-want +got):\n%s", i, diff)
+			}
+			if i == 0 {
+				healthServer.SetServingStatus("greeter", healthpb.HealthCheckResponse_SERVING)
+			}
+		}
+	})
+
+	t.Run("bidirectional streaming RPC", func(t *testing.T) {
+		stream, err := reflectionpb.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+		if err != nil {
+			t.Fatalf("ServerReflectionInfo() error = %v", err)
+		}
+		for range 2 {
+			if err := stream.Send(&reflectionpb.ServerReflectionRequest{
+				MessageRequest: &reflectionpb.ServerReflectionRequest_ListServices{},
+			}); err != nil {
+				t.Fatalf("Send() error = %v", err)
+			}
+			resp, err := stream.Recv()
+			if err != nil {
+				t.Fatalf("Recv() error = %v", err)
+			}
+			if diff := cmp.Diff(3, len(resp.GetListServicesResponse().GetService())); diff != "" {
+				t.Errorf("services mismatch (-want +got):\n%s", diff)
+			}
+		}
+		if err := stream.CloseSend(); err != nil {
+			t.Fatalf("CloseSend() error = %v", err)
+		}
+	})
+}
+
+func TestSetProxy_grpcErrors(t *testing.T) {
+	t.Parallel()
+
+	backend, _ := newGRPCBackend(t)
+	unavailable, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unavailableAddr := unavailable.Addr().String()
+	_ = unavailable.Close() // Nothing listens on the address.
+
+	tests := []struct {
+		name        string
+		route       config.Route
+		wantCode    codes.Code
+		wantMessage string
+	}{
+		{
+			name: "middleware error",
+			route: config.Route{
+				Path: "/grpc.health.v1.Health/", Backend: "http://" + backend, Timeout: 5, Protocol: config.ProtocolGRPC,
+				Middleware: []string{"ip_filter"},
+				IPFilter:   &config.IPFilter{Deny: []string{"127.0.0.1", "::1"}},
+			},
+			wantCode:    codes.PermissionDenied,
+			wantMessage: "access from this IP address is not allowed",
+		},
+		{
+			name:        "backend is unavailable",
+			route:       config.Route{Path: "/grpc.health.v1.Health/", Backend: "http://" + unavailableAddr, Timeout: 5, Protocol: config.ProtocolGRPC},
+			wantCode:    codes.Unavailable,
+			wantMessage: "backend is unavailable",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			conn := newGRPCGateway(t, []config.Route{tt.route})
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			_, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+			if diff := cmp.Diff(tt.wantCode, status.Code(err)); diff != "" {
+				t.Errorf("code mismatch (-want +got):\n%s", diff)
+			}
+			if !strings.Contains(status.Convert(err).Message(), tt.wantMessage) {
+				t.Errorf("message = %q, want %q", status.Convert(err).Message(), tt.wantMessage)
+			}
+		})
+	}
+}
+
+func TestSetProxy_invalidProtocol(t *testing.T) {
+	t.Parallel()
+
+	for _, route := range []config.Route{
+		{Path: "/", Backend: "http://localhost", Protocol: "websocket"},
+		{Path: "/", Backend: "grpc://localhost", Protocol: config.ProtocolGRPC},
+	} {
+		if err := SetProxy(http.NewServeMux(), []config.Route{route}, middleware.Resources{}); err == nil {
+			t.Errorf("SetProxy() with %+v error = nil, want error", route)
+		}
+	}
+}
+
+func TestSetProxy_grpcWeb(t *testing.T) {
+	t.Parallel()
+
+	backend, _ := newGRPCBackend(t)
+	mux := http.NewServeMux()
+	if err := SetProxy(mux, []config.Route{{
+		Path: "/grpc.health.v1.Health/", Backend: "http://" + backend, Timeout: 5, Protocol: config.ProtocolGRPC,
+		Middleware: []string{"grpc_web"},
+	}}, middleware.Resources{}); err != nil {
+		t.Fatalf("SetProxy() error = %v", err)
+	}
+	// Browsers may send gRPC-Web over HTTP/1.1, so the gateway does not need h2c.
+	gateway := httptest.NewServer(mux)
+	t.Cleanup(gateway.Close)
+
+	// The request is an empty HealthCheckRequest in a frame without compression.
+	resp, err := http.Post(gateway.URL+"/grpc.health.v1.Health/Check", "application/grpc-web+proto", bytes.NewReader([]byte{0, 0, 0, 0, 0}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff("application/grpc-web+proto", resp.Header.Get("Content-Type")); diff != "" {
+		t.Errorf("Content-Type mismatch (-want +got):\n%s", diff)
+	}
+	// The message is HealthCheckResponse{status: SERVING}, followed by the trailer frame.
+	wantMessage := []byte{0, 0, 0, 0, 2, 0x08, 0x01}
+	if !bytes.HasPrefix(body, wantMessage) {
+		t.Fatalf("body = %x, want prefix %x", body, wantMessage)
+	}
+	trailer := body[len(wantMessage):]
+	if len(trailer) < 5 || trailer[0] != 0x80 {
+		t.Fatalf("trailer frame = %x, want the trailer flag", trailer)
+	}
+	for _, want := range []string{"grpc-status: 0\r\n", "x-backend: health\r\n"} {
+		if !strings.Contains(string(trailer[5:]), want) {
+			t.Errorf("trailers = %q, want %q", trailer[5:], want)
+		}
+	}
+}
+
+func TestSetProxy_grpcTranscoding(t *testing.T) {
+	t.Parallel()
+
+	// The descriptor set is the health service with the google.api.http annotation of Check.
+	file := protodesc.ToFileDescriptorProto(healthpb.File_grpc_health_v1_health_proto)
+	for _, method := range file.GetService()[0].GetMethod() {
+		if method.GetName() == "Check" {
+			method.Options = &descriptorpb.MethodOptions{}
+			proto.SetExtension(method.Options, annotations.E_Http, &annotations.HttpRule{Pattern: &annotations.HttpRule_Get{Get: "/v1/health/{service}"}})
+		}
+	}
+	data, err := proto.Marshal(&descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{file}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	descriptorSet := filepath.Join(t.TempDir(), "health.pb")
+	if err := os.WriteFile(descriptorSet, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	backend, healthServer := newGRPCBackend(t)
+	healthServer.SetServingStatus("greeter", healthpb.HealthCheckResponse_NOT_SERVING)
+	mux := http.NewServeMux()
+	if err := SetProxy(mux, []config.Route{{
+		Path: "/v1/", Backend: "http://" + backend, Timeout: 5, Protocol: config.ProtocolGRPC,
+		Middleware:      []string{"grpc_transcoding"},
+		GRPCTranscoding: &config.GRPCTranscoding{DescriptorSet: descriptorSet},
+	}}, middleware.Resources{}); err != nil {
+		t.Fatalf("SetProxy() error = %v", err)
+	}
+	gateway := httptest.NewServer(mux)
+	t.Cleanup(gateway.Close)
+
+	tests := []struct {
+		path       string
+		wantStatus int
+		wantKey    string
+		wantValue  any
+	}{
+		{path: "/v1/health/greeter", wantStatus: http.StatusOK, wantKey: "status", wantValue: "NOT_SERVING"},
+		{path: "/v1/health/unknown", wantStatus: http.StatusNotFound, wantKey: "detail", wantValue: "unknown service"},
+	}
+	for _, tt := range tests {
+		resp, err := http.Get(gateway.URL + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body map[string]any
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		_ = resp.Body.Close() // The body has been read.
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(tt.wantStatus, resp.StatusCode); diff != "" {
+			t.Errorf("%s: status mismatch (-want +got):\n%s", tt.path, diff)
+		}
+		if diff := cmp.Diff(tt.wantValue, body[tt.wantKey]); diff != "" {
+			t.Errorf("%s: %s mismatch (-want +got):\n%s", tt.path, tt.wantKey, diff)
+		}
+	}
+}
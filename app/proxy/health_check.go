@@ -2,6 +2,7 @@ package proxy
 
 import (
 	"context"
+	"crypto/tls"
 	"log/slog"
 	"net/http"
 	"time"
@@ -10,7 +11,16 @@ import (
 // periodicHealthCheck checks the backend health every specified interval.
 // TODO: configuable interval
 // TODO: metric for health check
-func periodicHealthCheck(ctx context.Context, backend string, timeout int64, interval time.Duration) {
+// The TLS settings of the route are used for HTTPS backends.
+func periodicHealthCheck(ctx context.Context, backend string, timeout int64, tlsConfig *tls.Config, interval time.Duration) {
+	client := http.Client{
+		Timeout: time.Duration(timeout) * time.Second,
+	}
+	if tlsConfig != nil {
+		transport := &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig}
+		defer transport.CloseIdleConnections()
+		client.Transport = transport
+	}
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
@@ -21,9 +31,6 @@ func periodicHealthCheck(ctx context.Context, backend string, timeout int64, int
 		}
 
 		func() {
-			client := http.Client{
-				Timeout: time.Duration(timeout) * time.Second,
-			}
 			req, err := http.NewRequestWithContext(ctx, http.MethodGet, backend, nil)
 			if err != nil {
 				slog.Error("proxy: failed to create a health check request", slog.String("backend", backend), slog.String("error", err.Error()))
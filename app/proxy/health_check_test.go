@@ -23,7 +23,7 @@ func Test_periodicHealthCheck(t *testing.T) {
 		defer server.Close()
 
 		ctx, cancel := context.WithCancel(context.Background())
-		go periodicHealthCheck(ctx, server.URL, 2, 100*time.Millisecond)
+		go periodicHealthCheck(ctx, server.URL, 2, nil, 100*time.Millisecond)
 		defer cancel()
 
 		select {
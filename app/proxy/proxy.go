@@ -3,6 +3,8 @@ package proxy
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
@@ -16,9 +18,22 @@ import (
 )
 
 // SetProxy sets the proxy server settings.
-func SetProxy(mux *http.ServeMux, routes []config.Route, middlewares ...middleware.Middleware) error {
+// The middlewares are applied to all routes before the middlewares of each route.
+func SetProxy(mux *http.ServeMux, routes []config.Route, resources middleware.Resources, middlewares ...middleware.Middleware) error {
 	for _, route := range routes {
-		proxy, err := newReverseProxy(route.Backend, route.Timeout)
+		tlsConfig, err := newBackendTLSConfig(route.BackendTLS, route.Backend)
+		if err != nil {
+			return fmt.Errorf("proxy: invalid backend_tls for route %s: %w", route.Path, err)
+		}
+		var proxy *httputil.ReverseProxy
+		switch route.Protocol {
+		case "", config.ProtocolHTTP:
+			proxy, err = newReverseProxy(route.Backend, route.Timeout, tlsConfig)
+		case config.ProtocolGRPC:
+			proxy, err = newGRPCProxy(route.Backend, route.Timeout, tlsConfig)
+		default:
+			err = fmt.Errorf("unknown protocol %q", route.Protocol)
+		}
 		if err != nil {
 			return fmt.Errorf("proxy: failed to create a reverse proxy for route %s: %w", route.Path, err)
 		}
@@ -28,18 +43,39 @@ func SetProxy(mux *http.ServeMux, routes []config.Route, middlewares ...middlewa
 				return fmt.Errorf("proxy: failed to get health check URL for route %s: %w", route.Path, err)
 			}
 			ctx := context.Background() // TODO: use a context with cancellation.
-			go periodicHealthCheck(ctx, u, route.Timeout, 1*time.Second)
+			go periodicHealthCheck(ctx, u, route.Timeout, tlsConfig, 1*time.Second)
+		}
+
+		routeMiddlewares, err := middleware.NewMiddlewares(route, resources)
+		if err != nil {
+			return fmt.Errorf("proxy: failed to create middlewares for route %s: %w", route.Path, err)
+		}
+		routeMiddlewares = append(append([]middleware.Middleware{}, middlewares...), routeMiddlewares...)
+		if route.Protocol == config.ProtocolGRPC {
+			routeMiddlewares = append([]middleware.Middleware{middleware.GRPCErrors}, routeMiddlewares...)
 		}
 
-		handlerWithMiddleware := middleware.Chain(middleware.ToHandlerWithCtx(proxy), middlewares...)
+		handler := middleware.ToHandlerWithCtx(proxy)
+		if route.WebSocket != nil {
+			if route.Protocol == config.ProtocolGRPC {
+				return fmt.Errorf("proxy: websocket cannot be used with protocol = %q for route %s", config.ProtocolGRPC, route.Path)
+			}
+			ws, err := newWebSocketProxy(route, tlsConfig)
+			if err != nil {
+				return fmt.Errorf("proxy: invalid websocket for route %s: %w", route.Path, err)
+			}
+			handler = ws.handle(handler)
+		}
+		handlerWithMiddleware := middleware.Chain(handler, routeMiddlewares...)
 		mux.Handle(route.Path, handlerWithMiddleware.AdaptHandler())
 		slog.Debug("proxy: set a reverse proxy", slog.String("path", route.Path), slog.String("backend", route.Backend))
 	}
 	return nil
 }
 
-// newReverseProxy creates a reverse proxy to the given backend URL
-func newReverseProxy(target string, timeout int64) (*httputil.ReverseProxy, error) {
+// newReverseProxy creates a reverse proxy to the given backend URL.
+// If tlsConfig is nil, the connections to HTTPS backends use the system roots.
+func newReverseProxy(target string, timeout int64, tlsConfig *tls.Config) (*httputil.ReverseProxy, error) {
 	url, err := url.Parse(target)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse target URL: %w", err)
@@ -53,6 +89,20 @@ func newReverseProxy(target string, timeout int64) (*httputil.ReverseProxy, erro
 		}).DialContext,
 		ResponseHeaderTimeout: time.Duration(timeout) * time.Second,
 		TLSHandshakeTimeout:   time.Duration(timeout) * time.Second,
+		TLSClientConfig:       tlsConfig,
 	}
+	proxy.ErrorHandler = errorHandler
 	return proxy, nil
 }
+
+// errorHandler handles the errors of forwarding a request. It responds with 413 if
+// the request body exceeds the limit of the request_limits middleware, and with 502 otherwise.
+func errorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		middleware.WriteError(w, middleware.NewError(http.StatusRequestEntityTooLarge, fmt.Sprintf("request body exceeds %d bytes", maxBytesErr.Limit)))
+		return
+	}
+	slog.Warn("proxy: failed to forward the request", slog.String("path", r.URL.Path), slog.String("error", err.Error()))
+	w.WriteHeader(http.StatusBadGateway)
+}
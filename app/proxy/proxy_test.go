@@ -7,10 +7,12 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/nao1215/hurrah/app/middleware"
 	"github.com/nao1215/hurrah/config"
 )
 
@@ -48,7 +50,7 @@ func TestSetProxy(t *testing.T) {
 		}
 
 		mux := http.NewServeMux()
-		err := SetProxy(mux, routes)
+		err := SetProxy(mux, routes, middleware.Resources{})
 		if err != nil {
 			t.Errorf("SetProxy() error = %v", err)
 		}
@@ -119,14 +121,14 @@ func TestSetProxy(t *testing.T) {
 			},
 		}
 		mux := http.NewServeMux()
-		if err := SetProxy(mux, routes); err == nil {
+		if err := SetProxy(mux, routes, middleware.Resources{}); err == nil {
 			t.Error("SetProxy() error = nil, want error")
 		}
 	})
 
 	t.Run("SetProxy without route settings", func(t *testing.T) {
 		mux := http.NewServeMux()
-		if err := SetProxy(mux, nil); err != nil {
+		if err := SetProxy(mux, nil, middleware.Resources{}); err != nil {
 			t.Errorf("SetProxy() error = %v", err)
 		}
 	})
@@ -150,7 +152,7 @@ func TestSetProxy(t *testing.T) {
 		}
 
 		mux := http.NewServeMux()
-		err := SetProxy(mux, routes)
+		err := SetProxy(mux, routes, middleware.Resources{})
 		if err != nil {
 			t.Errorf("SetProxy() error = %v", err)
 		}
@@ -175,4 +177,46 @@ func TestSetProxy(t *testing.T) {
 			t.Errorf("resp.StatusCode mismatch (-got +want):\n%s", diff)
 		}
 	})
+
+	t.Run("Request body over the limit while streaming", func(t *testing.T) {
+		backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, err := io.Copy(io.Discard, r.Body); err != nil {
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer backendServer.Close()
+
+		routes := []config.Route{
+			{
+				Path:          "/service1",
+				Backend:       backendServer.URL,
+				Timeout:       1,
+				Middleware:    []string{"request_limits"},
+				RequestLimits: &config.RequestLimits{MaxBodyBytes: 1024},
+			},
+		}
+		mux := http.NewServeMux()
+		if err := SetProxy(mux, routes, middleware.Resources{}); err != nil {
+			t.Fatalf("SetProxy() error = %v", err)
+		}
+		testServer := httptest.NewServer(mux)
+		defer testServer.Close()
+
+		// The body has no Content-Length, so the limit is checked while streaming.
+		body := io.MultiReader(strings.NewReader(strings.Repeat("a", 1024)), strings.NewReader("a"))
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, testServer.URL+"/service1", body)
+		if err != nil {
+			t.Fatalf("http.NewRequestWithContext() error = %v", err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("http.DefaultClient.Do() error = %v", err)
+		}
+		defer resp.Body.Close() //nolint:errcheck
+
+		if diff := cmp.Diff(http.StatusRequestEntityTooLarge, resp.StatusCode); diff != "" {
+			t.Errorf("resp.StatusCode mismatch (-want +got):\n%s", diff)
+		}
+	})
 }
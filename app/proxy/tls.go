@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/nao1215/hurrah/config"
+)
+
+// newBackendTLSConfig creates the TLS settings of the connections to a backend.
+// It returns nil if cfg is nil, so that the transport uses the defaults.
+func newBackendTLSConfig(cfg *config.BackendTLS, backend string) (*tls.Config, error) {
+	if cfg == nil {
+		return nil, nil //nolint:nilnil // nil means the default TLS settings.
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify, //nolint:gosec // It is set explicitly by the administrator.
+	}
+	if cfg.InsecureSkipVerify {
+		slog.Warn("proxy: the certificate of the backend is not verified", slog.String("backend", backend))
+	}
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile) //nolint:gosec // The path is given by the administrator.
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the CA bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate is found in the CA bundle %s", cfg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	switch {
+	case cfg.CertFile != "" && cfg.KeyFile != "":
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the client certificate %s: %w", cfg.CertFile, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	case cfg.CertFile != "" || cfg.KeyFile != "":
+		return nil, errors.New("backend_tls requires both cert_file and key_file")
+	}
+	return tlsConfig, nil
+}
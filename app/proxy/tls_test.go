@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/nao1215/hurrah/app/middleware"
+	"github.com/nao1215/hurrah/config"
+)
+
+func TestSetProxy_backendTLS(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	clientCAs, clientCert, clientKey := writeClientCertificate(t, dir)
+
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	backend.TLS = &tls.Config{ClientAuth: tls.VerifyClientCertIfGiven, ClientCAs: clientCAs, MinVersion: tls.VersionTLS12}
+	backend.StartTLS()
+	t.Cleanup(backend.Close)
+	// The certificate of httptest is valid for example.com and 127.0.0.1.
+	caFile := filepath.Join(dir, "backend-ca.pem")
+	writePEM(t, caFile, "CERTIFICATE", backend.Certificate().Raw)
+
+	tests := []struct {
+		name       string
+		backendTLS *config.BackendTLS
+		wantStatus int
+	}{
+		{
+			name:       "system roots do not trust the private CA",
+			wantStatus: http.StatusBadGateway,
+		},
+		{
+			name:       "CA bundle",
+			backendTLS: &config.BackendTLS{CAFile: caFile},
+			wantStatus: http.StatusNoContent,
+		},
+		{
+			name:       "server name override",
+			backendTLS: &config.BackendTLS{CAFile: caFile, ServerName: "example.com"},
+			wantStatus: http.StatusNoContent,
+		},
+		{
+			name:       "server name not in the certificate",
+			backendTLS: &config.BackendTLS{CAFile: caFile, ServerName: "api.internal"},
+			wantStatus: http.StatusBadGateway,
+		},
+		{
+			name:       "insecure skip verify",
+			backendTLS: &config.BackendTLS{InsecureSkipVerify: true},
+			wantStatus: http.StatusNoContent,
+		},
+		{
+			name:       "client certificate",
+			backendTLS: &config.BackendTLS{CAFile: caFile, CertFile: clientCert, KeyFile: clientKey},
+			wantStatus: http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			mux := http.NewServeMux()
+			routes := []config.Route{{Path: "/", Backend: backend.URL, Timeout: 5, BackendTLS: tt.backendTLS}}
+			if err := SetProxy(mux, routes, middleware.Resources{}); err != nil {
+				t.Fatalf("SetProxy() error = %v", err)
+			}
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+			if diff := cmp.Diff(tt.wantStatus, rec.Code); diff != "" {
+				t.Errorf("status mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestSetProxy_invalidBackendTLS(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	emptyFile := filepath.Join(dir, "empty.pem")
+	if err := os.WriteFile(emptyFile, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, certFile, keyFile := writeClientCertificate(t, dir)
+
+	for _, backendTLS := range []*config.BackendTLS{
+		{CAFile: filepath.Join(dir, "missing.pem")},
+		{CAFile: emptyFile},
+		{CertFile: certFile},
+		{CertFile: keyFile, KeyFile: certFile},
+	} {
+		routes := []config.Route{{Path: "/", Backend: "https://localhost", BackendTLS: backendTLS}}
+		if err := SetProxy(http.NewServeMux(), routes, middleware.Resources{}); err == nil {
+			t.Errorf("SetProxy() with %+v error = nil, want error", backendTLS)
+		}
+	}
+}
+
+// writeClientCertificate issues a client certificate from a new CA, and writes it to
+// files in dir. It returns the pool of the CA and the paths of the certificate and the key.
+func writeClientCertificate(t *testing.T, dir string) (*x509.CertPool, string, string) {
+	t.Helper()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "hurrah test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "hurrah"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, "client.crt")
+	keyFile := filepath.Join(dir, "client.key")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	return pool, certFile, keyFile
+}
+
+// writePEM writes a PEM block to path.
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	t.Helper()
+
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,440 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/nao1215/hurrah/app/middleware"
+	"github.com/nao1215/hurrah/config"
+)
+
+const (
+	// DefaultWebSocketPingInterval is the default seconds between pings to the client.
+	DefaultWebSocketPingInterval = 30
+	// DefaultWebSocketPingTimeout is the default seconds to wait for the pong.
+	DefaultWebSocketPingTimeout = 10
+	// webSocketCloseTimeout is how long the close handshake is waited for before the connection is dropped.
+	webSocketCloseTimeout = 5 * time.Second
+)
+
+// webSocketHandshakeHeaders is the headers of the handshake that the dialer sets
+// for the backend, and the hop-by-hop headers that are not forwarded.
+var webSocketHandshakeHeaders = []string{
+	"Connection", "Upgrade", "Keep-Alive", "Proxy-Connection", "Te", "Trailer", "Transfer-Encoding",
+	"Sec-Websocket-Key", "Sec-Websocket-Version", "Sec-Websocket-Extensions",
+}
+
+// webSocketProxy proxies the WebSocket connections of a route with limits.
+type webSocketProxy struct {
+	backend      *url.URL
+	dialer       *websocket.Dialer
+	upgrader     websocket.Upgrader
+	allowOrigin  func(string) bool // allowOrigin is nil if only the same origin is allowed.
+	slots        chan struct{}     // slots limits the concurrent connections. It is nil if unlimited.
+	maxMessage   int64
+	idleTimeout  time.Duration
+	pingInterval time.Duration
+	pingTimeout  time.Duration
+}
+
+// newWebSocketProxy creates a WebSocket proxy to the backend of the route.
+// The timeout of the route applies to the handshake with the backend, not to
+// the connection, which is kept alive with pings.
+func newWebSocketProxy(route config.Route, tlsConfig *tls.Config) (*webSocketProxy, error) {
+	cfg := *route.WebSocket
+	if cfg.MaxConnections < 0 || cfg.MaxMessageBytes < 0 || cfg.IdleTimeout < 0 || cfg.PingInterval < 0 || cfg.PingTimeout < 0 {
+		return nil, errors.New("websocket limits and timeouts must not be negative")
+	}
+	if cfg.PingInterval == 0 {
+		cfg.PingInterval = DefaultWebSocketPingInterval
+	}
+	if cfg.PingTimeout == 0 {
+		cfg.PingTimeout = DefaultWebSocketPingTimeout
+	}
+
+	backend, err := url.Parse(route.Backend)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse target URL: %w", err)
+	}
+	switch backend.Scheme {
+	case "http", "ws":
+		backend.Scheme = "ws"
+	case "https", "wss":
+		backend.Scheme = "wss"
+	default:
+		return nil, fmt.Errorf("WebSocket backend must be http or https: %s", route.Backend)
+	}
+
+	timeout := time.Duration(route.Timeout) * time.Second
+	p := &webSocketProxy{
+		backend: backend,
+		dialer: &websocket.Dialer{
+			Proxy:            http.ProxyFromEnvironment,
+			NetDialContext:   (&net.Dialer{Timeout: timeout}).DialContext,
+			HandshakeTimeout: timeout,
+			TLSClientConfig:  tlsConfig,
+		},
+		// The origin is checked before the backend is dialed.
+		upgrader:     websocket.Upgrader{CheckOrigin: func(*http.Request) bool { return true }},
+		maxMessage:   cfg.MaxMessageBytes,
+		idleTimeout:  time.Duration(cfg.IdleTimeout) * time.Second,
+		pingInterval: time.Duration(cfg.PingInterval) * time.Second,
+		pingTimeout:  time.Duration(cfg.PingTimeout) * time.Second,
+	}
+	if len(cfg.AllowOrigins) > 0 {
+		if p.allowOrigin, err = middleware.AllowOrigin(cfg.AllowOrigins); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.MaxConnections > 0 {
+		p.slots = make(chan struct{}, cfg.MaxConnections)
+	}
+	return p, nil
+}
+
+// handle proxies the WebSocket upgrade requests, and passes the other requests to next.
+func (p *webSocketProxy) handle(next middleware.HandlerWithCtx) middleware.HandlerWithCtx {
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+		if !websocket.IsWebSocketUpgrade(r) {
+			return next(ctx, w, r)
+		}
+		if !p.checkOrigin(r) {
+			return middleware.NewError(http.StatusForbidden, "WebSocket connections from this origin are not allowed")
+		}
+		if p.slots != nil {
+			select {
+			case p.slots <- struct{}{}:
+				defer func() { <-p.slots }()
+			default:
+				return middleware.NewError(http.StatusServiceUnavailable, "too many WebSocket connections")
+			}
+		}
+		return p.proxy(ctx, w, r)
+	}
+}
+
+// checkOrigin returns true if the origin of the request is allowed. Requests
+// without Origin are not from browsers and allowed.
+func (p *webSocketProxy) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if p.allowOrigin != nil {
+		return p.allowOrigin(origin)
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// proxy connects to the backend, upgrades the client connection and relays the
+// messages until either side closes the connection.
+func (p *webSocketProxy) proxy(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	backendConn, resp, err := p.dialer.DialContext(ctx, p.backendURL(r), p.backendHeader(r))
+	if err != nil {
+		if resp != nil {
+			// The backend rejected the handshake, e.g., with 401. The client gets the response as it is.
+			defer resp.Body.Close()
+			for key, values := range resp.Header {
+				w.Header()[key] = values
+			}
+			w.WriteHeader(resp.StatusCode)
+			_, _ = io.Copy(w, resp.Body) // The client has gone if it fails.
+			return nil
+		}
+		slog.Warn("proxy: failed to connect to the WebSocket backend", slog.String("path", r.URL.Path), slog.String("error", err.Error()))
+		return middleware.NewError(http.StatusBadGateway, "backend is unavailable")
+	}
+
+	header := http.Header{}
+	if cookies := resp.Header.Values("Set-Cookie"); len(cookies) > 0 {
+		header["Set-Cookie"] = cookies
+	}
+	if protocol := backendConn.Subprotocol(); protocol != "" {
+		header.Set("Sec-Websocket-Protocol", protocol)
+	}
+	clientConn, err := p.upgrader.Upgrade(hijacker{w}, r, header)
+	if err != nil {
+		// The upgrader has written the error response.
+		_ = backendConn.Close() // The connection is not used.
+		return nil
+	}
+
+	c := &webSocketConn{proxy: p, client: clientConn, backend: backendConn, done: make(chan struct{})}
+	webSockets.add(c)
+	defer webSockets.remove(c)
+	start := time.Now()
+	code := c.relay()
+
+	clientIP := r.RemoteAddr
+	if addr, ok := middleware.ClientIPFromContext(ctx); ok {
+		clientIP = addr.String()
+	}
+	slog.Info("proxy: websocket connection closed",
+		slog.String("path", r.URL.Path),
+		slog.String("client_ip", clientIP),
+		slog.Duration("duration", time.Since(start)),
+		slog.Int64("bytes_from_client", c.bytesFromClient.Load()),
+		slog.Int64("bytes_to_client", c.bytesToClient.Load()),
+		slog.Int("close_code", code),
+	)
+	return nil
+}
+
+// backendURL returns the URL of the backend for the request, joining the paths
+// and queries as httputil.NewSingleHostReverseProxy does.
+func (p *webSocketProxy) backendURL(r *http.Request) string {
+	u := *p.backend
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + strings.TrimPrefix(r.URL.Path, "/")
+	u.RawPath = ""
+	switch {
+	case u.RawQuery == "":
+		u.RawQuery = r.URL.RawQuery
+	case r.URL.RawQuery != "":
+		u.RawQuery += "&" + r.URL.RawQuery
+	}
+	return u.String()
+}
+
+// backendHeader returns the header of the handshake with the backend. The headers
+// of the client are forwarded except the ones of the handshake, and the client IP
+// address is appended to X-Forwarded-For.
+func (p *webSocketProxy) backendHeader(r *http.Request) http.Header {
+	header := r.Header.Clone()
+	for _, key := range webSocketHandshakeHeaders {
+		header.Del(key)
+	}
+	header.Set("Host", r.Host)
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if prior := header.Values("X-Forwarded-For"); len(prior) > 0 {
+			host = strings.Join(prior, ", ") + ", " + host
+		}
+		header.Set("X-Forwarded-For", host)
+	}
+	return header
+}
+
+// hijacker hijacks the connection through the http.ResponseWriter wrapped by the
+// middlewares, because the upgrader requires http.Hijacker.
+type hijacker struct {
+	http.ResponseWriter
+}
+
+// Hijack hijacks the connection with http.ResponseController.
+func (h hijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(h.ResponseWriter).Hijack()
+}
+
+// webSocketConn is a pair of the client and backend connections.
+type webSocketConn struct {
+	proxy           *webSocketProxy
+	client          *websocket.Conn
+	backend         *websocket.Conn
+	lastActivity    atomic.Int64 // lastActivity is the Unix time in nanoseconds of the last message.
+	bytesFromClient atomic.Int64
+	bytesToClient   atomic.Int64
+	done            chan struct{} // done is closed when the connection is closed.
+}
+
+// relay relays the messages in both directions until either side closes the
+// connection or a limit is exceeded. It returns the close code of the side that
+// closed first.
+func (c *webSocketConn) relay() int {
+	defer close(c.done)
+	c.client.SetReadLimit(c.proxy.maxMessage)
+	c.backend.SetReadLimit(c.proxy.maxMessage)
+	c.touch()
+
+	// The client must answer a ping, or send a message, within the ping interval and timeout.
+	keepAlive := func() error {
+		return c.client.SetReadDeadline(time.Now().Add(c.proxy.pingInterval + c.proxy.pingTimeout))
+	}
+	_ = keepAlive() // The deadline is set on the new connection.
+	c.client.SetPongHandler(func(string) error { return keepAlive() })
+	stop := make(chan struct{})
+	defer close(stop)
+	go c.ping(stop)
+	if c.proxy.idleTimeout > 0 {
+		go c.closeIdle(stop)
+	}
+
+	results := make(chan webSocketResult, 2)
+	go func() { results <- c.copy(c.backend, c.client, &c.bytesFromClient, keepAlive) }()
+	go func() { results <- c.copy(c.client, c.backend, &c.bytesToClient, nil) }()
+
+	// The side that sent a close frame has got the reply from the websocket package,
+	// so the close code is forwarded to the other side. If the connection is broken
+	// or exceeds a limit, the other side gets 1001 (going away).
+	first := <-results
+	code, forward, text := websocket.CloseAbnormalClosure, websocket.CloseGoingAway, ""
+	var closeErr *websocket.CloseError
+	switch {
+	case errors.As(first.err, &closeErr):
+		code = closeErr.Code
+		if code != websocket.CloseAbnormalClosure {
+			forward, text = closeErr.Code, closeErr.Text
+		}
+	case errors.Is(first.err, websocket.ErrReadLimit):
+		code = websocket.CloseMessageTooBig
+	}
+	other := c.client
+	if first.src == c.client {
+		other = c.backend
+	}
+	writeClose(other, forward, text)
+
+	select {
+	case <-results:
+	case <-time.After(webSocketCloseTimeout):
+	}
+	_ = c.client.Close()  // The connection is done.
+	_ = c.backend.Close() // The connection is done.
+	return code
+}
+
+// webSocketResult is the result of copying the messages.
+type webSocketResult struct {
+	src *websocket.Conn // src is the connection that failed or was closed.
+	err error
+}
+
+// copy copies the messages from src to dst until reading or writing fails. The
+// messages are streamed without buffering them as a whole.
+func (c *webSocketConn) copy(dst, src *websocket.Conn, n *atomic.Int64, onMessage func() error) webSocketResult {
+	for {
+		messageType, r, err := src.NextReader()
+		if err != nil {
+			return webSocketResult{src: src, err: err}
+		}
+		c.touch()
+		if onMessage != nil {
+			_ = onMessage() // The connection fails on the next read if it fails.
+		}
+		w, err := dst.NextWriter(messageType)
+		if err != nil {
+			return webSocketResult{src: dst, err: err}
+		}
+		written, err := io.Copy(w, r)
+		n.Add(written)
+		if err != nil {
+			_ = w.Close() // The error of copying is returned.
+			return webSocketResult{src: src, err: err}
+		}
+		if err := w.Close(); err != nil {
+			return webSocketResult{src: dst, err: err}
+		}
+	}
+}
+
+// ping sends pings to the client until stop is closed.
+func (c *webSocketConn) ping(stop <-chan struct{}) {
+	ticker := time.NewTicker(c.proxy.pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := c.client.WriteControl(websocket.PingMessage, nil, time.Now().Add(c.proxy.pingTimeout)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// touch records the time of the last message.
+func (c *webSocketConn) touch() {
+	c.lastActivity.Store(time.Now().UnixNano())
+}
+
+// closeIdle closes the connection if no messages have been relayed for the idle
+// timeout, until stop is closed.
+func (c *webSocketConn) closeIdle(stop <-chan struct{}) {
+	timer := time.NewTimer(c.proxy.idleTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-timer.C:
+			idle := time.Since(time.Unix(0, c.lastActivity.Load()))
+			if idle >= c.proxy.idleTimeout {
+				c.close(websocket.CloseGoingAway, "idle timeout")
+				return
+			}
+			timer.Reset(c.proxy.idleTimeout - idle)
+		}
+	}
+}
+
+// close sends the close frames to both sides. The connection ends when they reply.
+func (c *webSocketConn) close(code int, text string) {
+	writeClose(c.client, code, text)
+	writeClose(c.backend, code, text)
+}
+
+// writeClose sends the close frame. The error is ignored because the connection
+// is closed anyway.
+func writeClose(conn *websocket.Conn, code int, text string) {
+	_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), time.Now().Add(time.Second))
+}
+
+// webSocketConns is the open WebSocket connections of the process.
+type webSocketConns struct {
+	mu    sync.Mutex
+	conns map[*webSocketConn]struct{}
+}
+
+// webSockets is the open WebSocket connections closed by CloseWebSockets.
+var webSockets = &webSocketConns{conns: map[*webSocketConn]struct{}{}}
+
+// add adds the connection.
+func (s *webSocketConns) add(c *webSocketConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conns[c] = struct{}{}
+}
+
+// remove removes the connection.
+func (s *webSocketConns) remove(c *webSocketConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, c)
+}
+
+// CloseWebSockets sends the close frames (1001 going away) to both sides of the
+// open WebSocket connections and waits for them to be closed, or for ctx to be
+// done. Call it on shutdown, because http.Server.Shutdown does not close the
+// hijacked connections.
+func CloseWebSockets(ctx context.Context) {
+	webSockets.mu.Lock()
+	conns := make([]*webSocketConn, 0, len(webSockets.conns))
+	for c := range webSockets.conns {
+		conns = append(conns, c)
+	}
+	webSockets.mu.Unlock()
+
+	for _, c := range conns {
+		c.close(websocket.CloseGoingAway, "server is shutting down")
+	}
+	for _, c := range conns {
+		select {
+		case <-c.done:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
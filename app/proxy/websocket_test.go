@@ -0,0 +1,297 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/gorilla/websocket"
+	"github.com/nao1215/hurrah/app/middleware"
+	"github.com/nao1215/hurrah/config"
+)
+
+// newWebSocketBackend starts an echo WebSocket server with the "chat" subprotocol.
+// It sends the close code of each connection to the returned channel.
+// Requests to /unauthorized are rejected with 401.
+func newWebSocketBackend(t *testing.T) (string, <-chan int) {
+	t.Helper()
+
+	closes := make(chan int, 10)
+	// The origin is checked by the gateway.
+	upgrader := websocket.Upgrader{Subprotocols: []string{"chat"}, CheckOrigin: func(*http.Request) bool { return true }}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/unauthorized" {
+			http.Error(w, "missing token", http.StatusUnauthorized)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			messageType, message, err := conn.ReadMessage()
+			if err != nil {
+				var closeErr *websocket.CloseError
+				if errors.As(err, &closeErr) {
+					closes <- closeErr.Code
+				} else {
+					closes <- websocket.CloseAbnormalClosure
+				}
+				return
+			}
+			if err := conn.WriteMessage(messageType, append([]byte(r.URL.RequestURI()+" "), message...)); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(backend.Close)
+	return backend.URL, closes
+}
+
+// newWebSocketGateway starts the gateway with a WebSocket route to the backend
+// and returns the WebSocket URL of the gateway.
+func newWebSocketGateway(t *testing.T, backend string, cfg config.WebSocket) string {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	if err := SetProxy(mux, []config.Route{{Path: "/", Backend: backend, Timeout: 5, WebSocket: &cfg}}, middleware.Resources{}); err != nil {
+		t.Fatalf("SetProxy() error = %v", err)
+	}
+	gateway := httptest.NewServer(mux)
+	t.Cleanup(gateway.Close)
+	return "ws" + strings.TrimPrefix(gateway.URL, "http")
+}
+
+// dialWebSocket connects to the gateway and closes the connection on cleanup.
+func dialWebSocket(t *testing.T, url string, header http.Header) *websocket.Conn {
+	t.Helper()
+
+	conn, resp, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	_ = resp.Body.Close() // The body of 101 is empty.
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+// wantCloseCode reads from the connection until it is closed and checks the close code.
+func wantCloseCode(t *testing.T, conn *websocket.Conn, want int) {
+	t.Helper()
+
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second)) // The test fails on timeout.
+	for {
+		_, _, err := conn.ReadMessage()
+		if err == nil {
+			continue
+		}
+		if !websocket.IsCloseError(err, want) {
+			t.Errorf("ReadMessage() error = %v, want close %d", err, want)
+		}
+		return
+	}
+}
+
+// wantBackendClose checks the close code the backend got.
+func wantBackendClose(t *testing.T, closes <-chan int, want int) {
+	t.Helper()
+
+	select {
+	case got := <-closes:
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("backend close code mismatch (-want +got):\n%s", diff)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("the backend connection is not closed")
+	}
+}
+
+func TestSetProxy_websocket(t *testing.T) {
+	t.Parallel()
+
+	t.Run("relay messages and close frames", func(t *testing.T) {
+		t.Parallel()
+
+		backend, closes := newWebSocketBackend(t)
+		gateway := newWebSocketGateway(t, backend, config.WebSocket{})
+		conn, resp, err := (&websocket.Dialer{Subprotocols: []string{"chat"}}).Dial(gateway+"/chat?room=1", nil)
+		if err != nil {
+			t.Fatalf("Dial() error = %v", err)
+		}
+		_ = resp.Body.Close() // The body of 101 is empty.
+		defer conn.Close()
+
+		if diff := cmp.Diff("chat", conn.Subprotocol()); diff != "" {
+			t.Errorf("subprotocol mismatch (-want +got):\n%s", diff)
+		}
+		for _, message := range []string{"hello", strings.Repeat("x", 100000)} {
+			if err := conn.WriteMessage(websocket.TextMessage, []byte(message)); err != nil {
+				t.Fatalf("WriteMessage() error = %v", err)
+			}
+			_, got, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatalf("ReadMessage() error = %v", err)
+			}
+			if diff := cmp.Diff("/chat?room=1 "+message, string(got)); diff != "" {
+				t.Errorf("message mismatch (-want +got):\n%s", diff)
+			}
+		}
+
+		if err := conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(4000, "bye")); err != nil {
+			t.Fatalf("WriteMessage() error = %v", err)
+		}
+		wantCloseCode(t, conn, 4000)
+		wantBackendClose(t, closes, 4000)
+	})
+
+	t.Run("handshake rejected by the backend", func(t *testing.T) {
+		t.Parallel()
+
+		backend, _ := newWebSocketBackend(t)
+		gateway := newWebSocketGateway(t, backend, config.WebSocket{})
+		_, resp, err := websocket.DefaultDialer.Dial(gateway+"/unauthorized", nil)
+		if err == nil {
+			t.Fatal("Dial() error = nil, want error")
+		}
+		defer resp.Body.Close()
+		if diff := cmp.Diff(http.StatusUnauthorized, resp.StatusCode); diff != "" {
+			t.Errorf("status mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("max message size", func(t *testing.T) {
+		t.Parallel()
+
+		backend, closes := newWebSocketBackend(t)
+		conn := dialWebSocket(t, newWebSocketGateway(t, backend, config.WebSocket{MaxMessageBytes: 16}), nil)
+		if err := conn.WriteMessage(websocket.BinaryMessage, make([]byte, 17)); err != nil {
+			t.Fatalf("WriteMessage() error = %v", err)
+		}
+		wantCloseCode(t, conn, websocket.CloseMessageTooBig)
+		wantBackendClose(t, closes, websocket.CloseGoingAway)
+	})
+
+	t.Run("max connections", func(t *testing.T) {
+		t.Parallel()
+
+		backend, _ := newWebSocketBackend(t)
+		gateway := newWebSocketGateway(t, backend, config.WebSocket{MaxConnections: 1})
+		dialWebSocket(t, gateway, nil)
+		_, resp, err := websocket.DefaultDialer.Dial(gateway, nil)
+		if err == nil {
+			t.Fatal("Dial() error = nil, want error")
+		}
+		defer resp.Body.Close()
+		if diff := cmp.Diff(http.StatusServiceUnavailable, resp.StatusCode); diff != "" {
+			t.Errorf("status mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("idle timeout", func(t *testing.T) {
+		t.Parallel()
+
+		backend, closes := newWebSocketBackend(t)
+		conn := dialWebSocket(t, newWebSocketGateway(t, backend, config.WebSocket{IdleTimeout: 1}), nil)
+		wantCloseCode(t, conn, websocket.CloseGoingAway)
+		wantBackendClose(t, closes, websocket.CloseGoingAway)
+	})
+
+	t.Run("ping", func(t *testing.T) {
+		t.Parallel()
+
+		backend, _ := newWebSocketBackend(t)
+		conn := dialWebSocket(t, newWebSocketGateway(t, backend, config.WebSocket{PingInterval: 1}), nil)
+		pinged := make(chan struct{}, 1)
+		conn.SetPingHandler(func(string) error {
+			select {
+			case pinged <- struct{}{}:
+			default:
+			}
+			return nil
+		})
+		go conn.ReadMessage() //nolint:errcheck // The pings are handled while reading.
+		select {
+		case <-pinged:
+		case <-time.After(5 * time.Second):
+			t.Error("the gateway did not send a ping")
+		}
+	})
+}
+
+func TestSetProxy_websocketOrigin(t *testing.T) {
+	t.Parallel()
+
+	backend, _ := newWebSocketBackend(t)
+	tests := []struct {
+		name       string
+		cfg        config.WebSocket
+		origin     string
+		wantStatus int
+	}{
+		{name: "no origin", cfg: config.WebSocket{}, origin: "", wantStatus: http.StatusSwitchingProtocols},
+		{name: "cross origin is denied by default", cfg: config.WebSocket{}, origin: "https://evil.example.com", wantStatus: http.StatusForbidden},
+		{name: "allowed origin", cfg: config.WebSocket{AllowOrigins: []string{"https://*.example.com"}}, origin: "https://app.example.com", wantStatus: http.StatusSwitchingProtocols},
+		{name: "origin not allowed", cfg: config.WebSocket{AllowOrigins: []string{"https://app.example.com"}}, origin: "https://evil.example.com", wantStatus: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			header := http.Header{}
+			if tt.origin != "" {
+				header.Set("Origin", tt.origin)
+			}
+			conn, resp, err := websocket.DefaultDialer.Dial(newWebSocketGateway(t, backend, tt.cfg), header)
+			if err == nil {
+				_ = conn.Close() // Only the handshake is tested.
+			}
+			if resp == nil {
+				t.Fatalf("Dial() error = %v", err)
+			}
+			_ = resp.Body.Close() // Only the status is tested.
+			if diff := cmp.Diff(tt.wantStatus, resp.StatusCode); diff != "" {
+				t.Errorf("status mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestSetProxy_invalidWebSocket(t *testing.T) {
+	t.Parallel()
+
+	for _, route := range []config.Route{
+		{Path: "/", Backend: "http://localhost", WebSocket: &config.WebSocket{MaxConnections: -1}},
+		{Path: "/", Backend: "http://localhost", WebSocket: &config.WebSocket{AllowOrigins: []string{"https://*example.com"}}},
+		{Path: "/", Backend: "http://localhost", Protocol: config.ProtocolGRPC, WebSocket: &config.WebSocket{}},
+	} {
+		if err := SetProxy(http.NewServeMux(), []config.Route{route}, middleware.Resources{}); err == nil {
+			t.Errorf("SetProxy() with %+v error = nil, want error", route.WebSocket)
+		}
+	}
+}
+
+// TestCloseWebSockets is not parallel, because it closes all WebSocket connections of the process.
+func TestCloseWebSockets(t *testing.T) {
+	backend, closes := newWebSocketBackend(t)
+	conn := dialWebSocket(t, newWebSocketGateway(t, backend, config.WebSocket{}), nil)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		wantCloseCode(t, conn, websocket.CloseGoingAway)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	CloseWebSockets(ctx)
+	<-done
+	wantBackendClose(t, closes, websocket.CloseGoingAway)
+	if ctx.Err() != nil {
+		t.Error("CloseWebSockets() did not return before the timeout")
+	}
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/nao1215/hurrah/config"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	// DefaultACMECacheDir is the default directory of the account key and certificates.
+	DefaultACMECacheDir = "acme"
+	// DefaultACMEHTTPAddr is the default address of the listener for HTTP-01 challenges.
+	DefaultACMEHTTPAddr = ":80"
+	// defaultACMERenewBeforeDays is the default days before expiry when certificates are renewed.
+	defaultACMERenewBeforeDays = 30
+)
+
+// ACME obtains the certificates of the domains from an ACME server with the
+// TLS-ALPN-01 or HTTP-01 challenge, and stores them in the cache directory.
+// A certificate is obtained on the first TLS handshake for the domain, and renewed
+// in the background before it expires. The renewed certificate is used from the
+// next handshake, so established connections are not dropped.
+type ACME struct {
+	manager  *autocert.Manager
+	next     func(*tls.ClientHelloInfo) (*tls.Certificate, error) // next returns the certificates of the files.
+	domains  []string
+	httpAddr string
+}
+
+// NewACME validates the settings and returns a new ACME.
+func NewACME(cfg config.ACME) (*ACME, error) {
+	if len(cfg.Domains) == 0 {
+		return nil, errors.New("server: acme requires domains")
+	}
+	domains := make([]string, 0, len(cfg.Domains))
+	for _, domain := range cfg.Domains {
+		if domain == "" || strings.ContainsAny(domain, "*:/") {
+			return nil, fmt.Errorf("server: invalid acme domain %q", domain)
+		}
+		domains = append(domains, strings.ToLower(domain))
+	}
+	if cfg.RenewBeforeDays < 0 {
+		return nil, fmt.Errorf("server: invalid renew_before_days %d", cfg.RenewBeforeDays)
+	}
+	renewBeforeDays := cfg.RenewBeforeDays
+	if renewBeforeDays == 0 {
+		renewBeforeDays = defaultACMERenewBeforeDays
+	}
+	cacheDir := cfg.CacheDir
+	if cacheDir == "" {
+		cacheDir = DefaultACMECacheDir
+	}
+	httpAddr := cfg.HTTPAddr
+	if httpAddr == "" {
+		httpAddr = DefaultACMEHTTPAddr
+	}
+
+	client := &acme.Client{DirectoryURL: cfg.DirectoryURL}
+	if client.DirectoryURL == "" {
+		client.DirectoryURL = autocert.DefaultACMEDirectory
+	}
+	if cfg.CAFile != "" {
+		pool, err := loadCertPool(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		client.HTTPClient = &http.Client{
+			Timeout: time.Minute,
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12},
+			},
+		}
+	}
+
+	return &ACME{
+		manager: &autocert.Manager{
+			Prompt:      autocert.AcceptTOS,
+			Cache:       autocert.DirCache(cacheDir),
+			HostPolicy:  autocert.HostWhitelist(domains...),
+			RenewBefore: time.Duration(renewBeforeDays) * 24 * time.Hour,
+			Client:      client,
+			Email:       cfg.Email,
+		},
+		domains:  domains,
+		httpAddr: httpAddr,
+	}, nil
+}
+
+// SetTLSConfig makes the TLS settings serve the certificates of the domains and
+// answer TLS-ALPN-01 challenges. The certificate files are still used for the
+// other server names.
+func (a *ACME) SetTLSConfig(tlsConfig *tls.Config) {
+	a.next = tlsConfig.GetCertificate
+	tlsConfig.GetCertificate = a.getCertificate
+	if !slices.Contains(tlsConfig.NextProtos, acme.ALPNProto) {
+		tlsConfig.NextProtos = append(tlsConfig.NextProtos, acme.ALPNProto)
+	}
+}
+
+// getCertificate returns the certificate of the domain. The certificate files are
+// used for the other server names.
+func (a *ACME) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if !slices.Contains(a.domains, strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))) {
+		if a.next != nil {
+			return a.next(hello)
+		}
+		return nil, nil //nolint:nilnil // crypto/tls reports that no certificate is configured.
+	}
+	return a.manager.GetCertificate(hello)
+}
+
+// HTTPAddr returns the address of the listener for HTTP-01 challenges.
+func (a *ACME) HTTPAddr() string {
+	return a.httpAddr
+}
+
+// HTTPHandler returns the handler that answers HTTP-01 challenges. The other
+// requests are passed to fallback, or redirected to HTTPS if fallback is nil.
+func (a *ACME) HTTPHandler(fallback http.Handler) http.Handler {
+	return a.manager.HTTPHandler(fallback)
+}
@@ -0,0 +1,190 @@
+package server
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/nao1215/hurrah/config"
+)
+
+func TestNewACME_invalidSettings(t *testing.T) {
+	t.Parallel()
+
+	for _, cfg := range []config.ACME{
+		{},
+		{Domains: []string{"*.example.com"}},
+		{Domains: []string{"example.com:443"}},
+		{Domains: []string{"example.com"}, RenewBeforeDays: -1},
+		{Domains: []string{"example.com"}, CAFile: filepath.Join(t.TempDir(), "missing.pem")},
+	} {
+		if _, err := NewACME(cfg); err == nil {
+			t.Errorf("NewACME(%+v) error = nil, want error", cfg)
+		}
+	}
+}
+
+func TestACME(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issueFiles(t, dir, "localhost", "localhost")
+	cfg := config.TLS{
+		CertFile: certFile,
+		KeyFile:  keyFile,
+		ACME: &config.ACME{
+			Domains:      []string{"acme.example.com"},
+			CacheDir:     filepath.Join(dir, "acme"),
+			DirectoryURL: "http://127.0.0.1:1/directory", // Unreachable; the tests must not contact it.
+		},
+	}
+	tlsConfig, err := NewTLSConfig(cfg)
+	if err != nil {
+		t.Fatalf("NewTLSConfig() error = %v", err)
+	}
+	acme, err := NewACME(*cfg.ACME)
+	if err != nil {
+		t.Fatalf("NewACME() error = %v", err)
+	}
+	acme.SetTLSConfig(tlsConfig)
+
+	t.Run("ALPN has the TLS-ALPN-01 protocol", func(t *testing.T) {
+		t.Parallel()
+
+		if diff := cmp.Diff([]string{"h2", "http/1.1", "acme-tls/1"}, tlsConfig.NextProtos); diff != "" {
+			t.Errorf("NextProtos mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("certificate files are used for the other server names", func(t *testing.T) {
+		t.Parallel()
+
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		srv.TLS = tlsConfig
+		srv.StartTLS()
+		defer srv.Close()
+
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: ca.pool(), ServerName: "localhost", MinVersion: tls.VersionTLS12},
+		}}
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatalf("GET error = %v", err)
+		}
+		defer resp.Body.Close() //nolint:errcheck // The body is not read.
+		if diff := cmp.Diff(http.StatusNoContent, resp.StatusCode); diff != "" {
+			t.Errorf("status mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("HTTP handler redirects to HTTPS", func(t *testing.T) {
+		t.Parallel()
+
+		tests := []struct {
+			name       string
+			target     string
+			wantStatus int
+		}{
+			{name: "other request", target: "http://acme.example.com/v1/users?id=1", wantStatus: http.StatusFound},
+			{name: "unknown challenge token", target: "http://acme.example.com/.well-known/acme-challenge/unknown", wantStatus: http.StatusNotFound},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				t.Parallel()
+
+				rec := httptest.NewRecorder()
+				acme.HTTPHandler(nil).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.target, nil))
+				if diff := cmp.Diff(tt.wantStatus, rec.Code); diff != "" {
+					t.Errorf("status mismatch (-want +got):\n%s", diff)
+				}
+			})
+		}
+	})
+}
+
+// TestACME_pebble obtains a certificate from Pebble (https://github.com/letsencrypt/pebble).
+// It is skipped unless HURRAH_TEST_ACME_DIRECTORY is set. Run Pebble with the default
+// tlsPort 5001, e.g., "PEBBLE_VA_NOSLEEP=1 pebble -config test/config/pebble-config.json",
+// and set HURRAH_TEST_ACME_DIRECTORY=https://localhost:14000/dir and
+// HURRAH_TEST_ACME_CA_FILE=test/certs/pebble.minica.pem.
+func TestACME_pebble(t *testing.T) {
+	directoryURL := os.Getenv("HURRAH_TEST_ACME_DIRECTORY")
+	if directoryURL == "" {
+		t.Skip("HURRAH_TEST_ACME_DIRECTORY is not set")
+	}
+	domain := os.Getenv("HURRAH_TEST_ACME_DOMAIN")
+	if domain == "" {
+		domain = "localhost"
+	}
+	addr := os.Getenv("HURRAH_TEST_ACME_TLS_ADDR")
+	if addr == "" {
+		addr = ":5001"
+	}
+
+	cacheDir := t.TempDir()
+	cfg := config.TLS{
+		ACME: &config.ACME{
+			Domains:      []string{domain},
+			Email:        "admin@example.com",
+			CacheDir:     cacheDir,
+			DirectoryURL: directoryURL,
+			CAFile:       os.Getenv("HURRAH_TEST_ACME_CA_FILE"),
+		},
+	}
+	tlsConfig, err := NewTLSConfig(cfg)
+	if err != nil {
+		t.Fatalf("NewTLSConfig() error = %v", err)
+	}
+	acme, err := NewACME(*cfg.ACME)
+	if err != nil {
+		t.Fatalf("NewACME() error = %v", err)
+	}
+	acme.SetTLSConfig(tlsConfig)
+
+	// Pebble validates the TLS-ALPN-01 challenge on this listener.
+	ln, err := tls.Listen("tcp", addr, tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close() //nolint:errcheck // The listener is only for the test.
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_ = conn.(*tls.Conn).Handshake() //nolint:forcetypeassert // tls.Listen returns *tls.Conn.
+				_ = conn.Close()                 // The handshake is all that matters.
+			}()
+		}
+	}()
+
+	dialer := &net.Dialer{Timeout: 2 * time.Minute}
+	conn, err := tls.DialWithDialer(dialer, "tcp", ln.Addr().String(), &tls.Config{
+		ServerName:         domain,
+		InsecureSkipVerify: true, //nolint:gosec // Pebble issues certificates from a random root.
+		MinVersion:         tls.VersionTLS12,
+	})
+	if err != nil {
+		t.Fatalf("handshake error = %v", err)
+	}
+	defer conn.Close() //nolint:errcheck // The connection is only for the test.
+
+	leaf := conn.ConnectionState().PeerCertificates[0]
+	if err := leaf.VerifyHostname(domain); err != nil {
+		t.Errorf("VerifyHostname() error = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(cacheDir, domain)); err != nil {
+		t.Errorf("the certificate is not cached: %v", err)
+	}
+}
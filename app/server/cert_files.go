@@ -0,0 +1,123 @@
+package server
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nao1215/hurrah/config"
+)
+
+// defaultReloadInterval is the default interval to check the certificate files for changes.
+const defaultReloadInterval = 10 * time.Second
+
+// fileStamp is the modification time and the size of a file.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// certFiles is the certificates loaded from the files. The files are checked for
+// changes on TLS handshakes, at most once per interval, and the certificates are
+// swapped atomically when the files change. Handshakes in progress keep the
+// certificate they selected, so no connection is dropped. If the new files are
+// invalid, e.g., the key does not match the certificate, the current certificates
+// are kept and the error is logged.
+type certFiles struct {
+	pairs    []config.Certificate
+	interval time.Duration
+	certs    atomic.Pointer[[]tls.Certificate]
+
+	mu      sync.Mutex  // mu serializes the reloads.
+	checked time.Time   // checked is the time the files were checked last. It is guarded by mu.
+	stamps  []fileStamp // stamps is the stamps of the files when they were checked last. It is guarded by mu.
+}
+
+// newCertFiles loads the certificate files.
+func newCertFiles(pairs []config.Certificate, interval time.Duration) (*certFiles, error) {
+	f := &certFiles{pairs: pairs, interval: interval}
+	certs, err := loadCertificates(pairs)
+	if err != nil {
+		return nil, err
+	}
+	stamps, err := f.stat()
+	if err != nil {
+		return nil, err
+	}
+	f.certs.Store(&certs)
+	f.checked = time.Now()
+	f.stamps = stamps
+	return f, nil
+}
+
+// getCertificate is tls.Config.GetCertificate. It selects the first certificate that
+// supports the client, or the first certificate, in the same way as crypto/tls does
+// with tls.Config.Certificates.
+func (f *certFiles) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	f.reload(time.Now())
+
+	certs := *f.certs.Load()
+	if len(certs) == 0 {
+		return nil, nil //nolint:nilnil // crypto/tls reports that no certificate is configured.
+	}
+	for i := range certs {
+		if hello.SupportsCertificate(&certs[i]) == nil {
+			return &certs[i], nil
+		}
+	}
+	return &certs[0], nil
+}
+
+// reload reloads the certificate files if the interval has passed since the last
+// check and the files have changed. Handshakes do not wait for a reload in progress.
+func (f *certFiles) reload(now time.Time) {
+	if len(f.pairs) == 0 || !f.mu.TryLock() {
+		return
+	}
+	defer f.mu.Unlock()
+	if now.Sub(f.checked) < f.interval {
+		return
+	}
+	f.checked = now
+
+	stamps, err := f.stat()
+	if err != nil {
+		slog.Error("server: failed to reload the certificates; the current certificates are kept", slog.String("error", err.Error()))
+		return
+	}
+	if slices.Equal(stamps, f.stamps) {
+		return
+	}
+	// The stamps are updated even if the load fails, so that the error is logged once
+	// per change. A certificate and a key written one after the other are retried
+	// when the second file changes.
+	f.stamps = stamps
+	certs, err := loadCertificates(f.pairs)
+	if err != nil {
+		slog.Error("server: failed to reload the certificates; the current certificates are kept", slog.String("error", err.Error()))
+		return
+	}
+	f.certs.Store(&certs)
+	slog.Info("server: reloaded the certificates", slog.Int("count", len(certs)))
+}
+
+// stat returns the stamps of the certificate and key files. The symbolic links are
+// followed, so the files replaced by updating a link, as Kubernetes does for
+// secrets, are detected.
+func (f *certFiles) stat() ([]fileStamp, error) {
+	stamps := make([]fileStamp, 0, 2*len(f.pairs))
+	for _, pair := range f.pairs {
+		for _, path := range []string{pair.CertFile, pair.KeyFile} {
+			info, err := os.Stat(path)
+			if err != nil {
+				return nil, err
+			}
+			stamps = append(stamps, fileStamp{modTime: info.ModTime(), size: info.Size()})
+		}
+	}
+	return stamps, nil
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"crypto/tls"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/nao1215/hurrah/config"
+)
+
+func TestCertFiles_reload(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	pair := config.Certificate{CertFile: filepath.Join(dir, "tls.crt"), KeyFile: filepath.Join(dir, "tls.key")}
+	stamp := time.Now()
+	// rotate writes the files of a certificate. The modification time is advanced
+	// explicitly because the files may be written within the resolution of the file system.
+	rotate := func(certPEM, keyPEM []byte) {
+		t.Helper()
+		writeFile(t, pair.CertFile, certPEM)
+		writeFile(t, pair.KeyFile, keyPEM)
+		stamp = stamp.Add(time.Hour)
+		for _, path := range []string{pair.CertFile, pair.KeyFile} {
+			if err := os.Chtimes(path, stamp, stamp); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	commonName := func(f *certFiles) string {
+		t.Helper()
+		cert, err := f.getCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+		if err != nil {
+			t.Fatalf("getCertificate() error = %v", err)
+		}
+		return cert.Leaf.Subject.CommonName
+	}
+
+	rotate(ca.issue(t, "first"))
+	f, err := newCertFiles([]config.Certificate{pair}, time.Minute)
+	if err != nil {
+		t.Fatalf("newCertFiles() error = %v", err)
+	}
+	now := time.Now()
+
+	steps := []struct {
+		name   string
+		rotate func()
+		after  time.Duration
+		want   string
+	}{
+		{
+			name:   "files are not checked within the interval",
+			rotate: func() { rotate(ca.issue(t, "second")) },
+			after:  30 * time.Second,
+			want:   "first",
+		},
+		{
+			name:  "changed files are reloaded after the interval",
+			after: 2 * time.Minute,
+			want:  "second",
+		},
+		{
+			name: "mismatched key keeps the current certificate",
+			rotate: func() {
+				certPEM, _ := ca.issue(t, "third")
+				_, keyPEM := ca.issue(t, "other")
+				rotate(certPEM, keyPEM)
+			},
+			after: 4 * time.Minute,
+			want:  "second",
+		},
+		{
+			name:   "broken files keep the current certificate",
+			rotate: func() { rotate([]byte("broken"), []byte("broken")) },
+			after:  6 * time.Minute,
+			want:   "second",
+		},
+		{
+			name:   "valid files are reloaded after a failure",
+			rotate: func() { rotate(ca.issue(t, "fourth")) },
+			after:  8 * time.Minute,
+			want:   "fourth",
+		},
+	}
+	for _, step := range steps {
+		if step.rotate != nil {
+			step.rotate()
+		}
+		f.reload(now.Add(step.after))
+		if diff := cmp.Diff(step.want, commonName(f)); diff != "" {
+			t.Errorf("%s: certificate mismatch (-want +got):\n%s", step.name, diff)
+		}
+	}
+}
+
+func TestCertFiles_removedFiles(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issueFiles(t, dir, "localhost", "localhost")
+	f, err := newCertFiles([]config.Certificate{{CertFile: certFile, KeyFile: keyFile}}, time.Second)
+	if err != nil {
+		t.Fatalf("newCertFiles() error = %v", err)
+	}
+	if err := os.Remove(keyFile); err != nil {
+		t.Fatal(err)
+	}
+
+	f.reload(time.Now().Add(time.Minute))
+	if diff := cmp.Diff(1, len(*f.certs.Load())); diff != "" {
+		t.Errorf("certificates mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/nao1215/hurrah/config"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// defaultAltSvcMaxAge is the default seconds clients remember that HTTP/3 is available.
+const defaultAltSvcMaxAge = 86400
+
+// ConfigureHTTP2 configures HTTP/2 of the server. Set srv.TLSConfig and srv.Handler
+// before calling it. Over TLS, HTTP/2 is negotiated with ALPN, so it is disabled if
+// the ALPN protocols do not have "h2". Without TLS, HTTP/2 is served only if h2c is
+// set, with both prior knowledge and the Upgrade header.
+func ConfigureHTTP2(srv *http.Server, cfg *config.HTTP2) error {
+	h2s := &http2.Server{}
+	h2cEnabled := false
+	if cfg != nil {
+		h2s.MaxConcurrentStreams = cfg.MaxConcurrentStreams
+		h2cEnabled = cfg.H2C
+	}
+
+	if srv.TLSConfig == nil {
+		if h2cEnabled {
+			srv.Handler = h2c.NewHandler(srv.Handler, h2s)
+		}
+		return nil
+	}
+	if h2cEnabled {
+		return errors.New("server: http2.h2c is for the listener without tls")
+	}
+	if !slices.Contains(srv.TLSConfig.NextProtos, http2.NextProtoTLS) {
+		// net/http enables HTTP/2 unless TLSNextProto is non-nil.
+		srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+		return nil
+	}
+	if err := http2.ConfigureServer(srv, h2s); err != nil {
+		return fmt.Errorf("server: failed to configure HTTP/2: %w", err)
+	}
+	return nil
+}
+
+// NewHTTP3Server creates the HTTP/3 server that listens on the UDP port with the
+// TLS settings of the listener. addr is the address of the TCP listener, and its
+// port is used if cfg.Port is empty.
+func NewHTTP3Server(cfg config.HTTP3, addr string, tlsConfig *tls.Config, handler http.Handler) (*http3.Server, error) {
+	if tlsConfig == nil {
+		return nil, errors.New("server: http3 requires tls")
+	}
+	port := cfg.Port
+	if port == "" {
+		_, p, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("server: invalid address %q: %w", addr, err)
+		}
+		port = p
+	}
+	udpPort, err := strconv.Atoi(port)
+	if err != nil || udpPort <= 0 || udpPort > 65535 {
+		return nil, fmt.Errorf("server: invalid http3 port %q", port)
+	}
+
+	return &http3.Server{
+		Addr:      ":" + strconv.Itoa(udpPort),
+		Port:      udpPort,
+		TLSConfig: http3.ConfigureTLSConfig(tlsConfig),
+		Handler:   handler,
+	}, nil
+}
+
+// AltSvc returns a handler that advertises the HTTP/3 server with the Alt-Svc header,
+// so that clients switch to QUIC from the next request.
+func AltSvc(next http.Handler, h3 *http3.Server, cfg config.HTTP3) http.Handler {
+	maxAge := cfg.AltSvcMaxAge
+	if maxAge <= 0 {
+		maxAge = defaultAltSvcMaxAge
+	}
+	altSvc := fmt.Sprintf(`h3=":%d"; ma=%d`, h3.Port, maxAge)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Alt-Svc", altSvc)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/nao1215/hurrah/config"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
+)
+
+// protoHandler responds with the protocol of the request.
+var protoHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	_, _ = w.Write([]byte(r.Proto)) // The client checks the body.
+})
+
+// getProto sends a request with the client and returns the protocol of the response and the body.
+func getProto(t *testing.T, client *http.Client, url string) (string, string) {
+	t.Helper()
+
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatalf("GET error = %v", err)
+	}
+	defer resp.Body.Close() //nolint:errcheck // The body is read below.
+	var body [16]byte
+	n, _ := resp.Body.Read(body[:]) // The body is short enough.
+	return resp.Proto, string(body[:n])
+}
+
+func TestConfigureHTTP2(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issueFiles(t, dir, "localhost", "localhost")
+
+	t.Run("h2c", func(t *testing.T) {
+		t.Parallel()
+
+		srv := &http.Server{Handler: protoHandler} //nolint:gosec // The test server is closed by httptest.
+		if err := ConfigureHTTP2(srv, &config.HTTP2{H2C: true}); err != nil {
+			t.Fatalf("ConfigureHTTP2() error = %v", err)
+		}
+		ts := httptest.NewServer(srv.Handler)
+		defer ts.Close()
+
+		client := &http.Client{Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, addr)
+			},
+		}}
+		_, body := getProto(t, client, ts.URL)
+		if diff := cmp.Diff("HTTP/2.0", body); diff != "" {
+			t.Errorf("protocol mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	tests := []struct {
+		name string
+		alpn []string
+		want string
+	}{
+		{name: "HTTP/2 over TLS by default", want: "HTTP/2.0"},
+		{name: "HTTP/2 is disabled without h2 in ALPN", alpn: []string{"http/1.1"}, want: "HTTP/1.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			tlsConfig, err := NewTLSConfig(config.TLS{CertFile: certFile, KeyFile: keyFile, ALPN: tt.alpn})
+			if err != nil {
+				t.Fatalf("NewTLSConfig() error = %v", err)
+			}
+			srv := &http.Server{Handler: protoHandler, TLSConfig: tlsConfig} //nolint:gosec // The server is closed by the test.
+			if err := ConfigureHTTP2(srv, &config.HTTP2{MaxConcurrentStreams: 100}); err != nil {
+				t.Fatalf("ConfigureHTTP2() error = %v", err)
+			}
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			go srv.ServeTLS(ln, "", "") //nolint:errcheck // The error after Close is expected.
+			defer srv.Close()           //nolint:errcheck // The server is only for the test.
+
+			client := &http.Client{Transport: &http.Transport{
+				TLSClientConfig:   &tls.Config{RootCAs: ca.pool(), ServerName: "localhost", MinVersion: tls.VersionTLS12},
+				ForceAttemptHTTP2: true,
+			}}
+			proto, _ := getProto(t, client, "https://"+ln.Addr().String())
+			if diff := cmp.Diff(tt.want, proto); diff != "" {
+				t.Errorf("protocol mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	t.Run("h2c requires the listener without tls", func(t *testing.T) {
+		t.Parallel()
+
+		srv := &http.Server{Handler: protoHandler, TLSConfig: &tls.Config{MinVersion: tls.VersionTLS12}} //nolint:gosec // The server is not started.
+		if err := ConfigureHTTP2(srv, &config.HTTP2{H2C: true}); err == nil {
+			t.Error("ConfigureHTTP2() error = nil, want error")
+		}
+	})
+}
+
+func TestNewHTTP3Server(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issueFiles(t, dir, "localhost", "localhost")
+	tlsConfig, err := NewTLSConfig(config.TLS{CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatalf("NewTLSConfig() error = %v", err)
+	}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := conn.LocalAddr().(*net.UDPAddr).Port //nolint:forcetypeassert // ListenPacket("udp") returns *net.UDPConn.
+	cfg := config.HTTP3{Port: strconv.Itoa(port)}
+	h3, err := NewHTTP3Server(cfg, ":8443", tlsConfig, protoHandler)
+	if err != nil {
+		t.Fatalf("NewHTTP3Server() error = %v", err)
+	}
+	go h3.Serve(conn) //nolint:errcheck // The error after Close is expected.
+	defer h3.Close()  //nolint:errcheck // The server is only for the test.
+
+	t.Run("request over QUIC", func(t *testing.T) {
+		transport := &http3.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: ca.pool(), ServerName: "localhost", MinVersion: tls.VersionTLS13},
+		}
+		defer transport.Close() //nolint:errcheck // The transport is only for the test.
+		proto, body := getProto(t, &http.Client{Transport: transport}, "https://"+conn.LocalAddr().String())
+		if diff := cmp.Diff("HTTP/3.0", proto); diff != "" {
+			t.Errorf("protocol mismatch (-want +got):\n%s", diff)
+		}
+		if diff := cmp.Diff("HTTP/3.0", body); diff != "" {
+			t.Errorf("request protocol mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("Alt-Svc advertises HTTP/3", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		AltSvc(protoHandler, h3, config.HTTP3{AltSvcMaxAge: 3600}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		want := `h3=":` + strconv.Itoa(port) + `"; ma=3600`
+		if diff := cmp.Diff(want, rec.Header().Get("Alt-Svc")); diff != "" {
+			t.Errorf("Alt-Svc mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("invalid settings", func(t *testing.T) {
+		for _, tt := range []struct {
+			cfg       config.HTTP3
+			addr      string
+			tlsConfig *tls.Config
+		}{
+			{cfg: config.HTTP3{}, addr: ":8443"},
+			{cfg: config.HTTP3{Port: "quic"}, addr: ":8443", tlsConfig: tlsConfig},
+			{cfg: config.HTTP3{}, addr: "8443", tlsConfig: tlsConfig},
+		} {
+			if _, err := NewHTTP3Server(tt.cfg, tt.addr, tt.tlsConfig, protoHandler); err == nil {
+				t.Errorf("NewHTTP3Server(%+v, %q) error = nil, want error", tt.cfg, tt.addr)
+			}
+		}
+	})
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/nao1215/hurrah/config"
+)
+
+// DefaultRedirectPort is the default port number of the redirect listener.
+const DefaultRedirectPort = "80"
+
+// NewRedirectHandler returns the handler of the plaintext listener. It redirects
+// the requests to the same host and path over HTTPS, responds to the health path
+// with 200, and passes the requests to the except hosts to handler.
+// httpsAddr is the address of the HTTPS listener, and its port is used in the
+// redirect URLs unless https_port is set.
+func NewRedirectHandler(cfg config.Redirect, httpsAddr string, handler http.Handler) (http.Handler, error) {
+	status := cfg.Status
+	switch status {
+	case 0:
+		status = http.StatusPermanentRedirect
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return nil, fmt.Errorf("server: invalid redirect status %d; use 301, 302, 307 or 308", cfg.Status)
+	}
+	httpsPort := cfg.HTTPSPort
+	if httpsPort == "" {
+		_, port, err := net.SplitHostPort(httpsAddr)
+		if err != nil {
+			return nil, fmt.Errorf("server: invalid address %q: %w", httpsAddr, err)
+		}
+		httpsPort = port
+	}
+	for _, host := range cfg.ExceptHosts {
+		if host == "" || strings.Contains(strings.TrimPrefix(host, "*."), "*") {
+			return nil, fmt.Errorf("server: invalid except_hosts %q", host)
+		}
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cfg.HealthPath != "" && r.URL.Path == cfg.HealthPath {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if matchHost(cfg.ExceptHosts, host) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		if host == "" {
+			http.Error(w, "Host header is required", http.StatusBadRequest)
+			return
+		}
+		switch {
+		case httpsPort != "443":
+			host = net.JoinHostPort(host, httpsPort)
+		case strings.Contains(host, ":"):
+			host = "[" + host + "]" // IPv6 address
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), status)
+	}), nil
+}
+
+// matchHost returns true if the host matches one of the patterns. A pattern with a
+// leading "*." matches the subdomains, and the match is case-insensitive.
+func matchHost(patterns []string, host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, p := range patterns {
+		p = strings.ToLower(p)
+		if suffix, ok := strings.CutPrefix(p, "*"); ok {
+			if strings.HasSuffix(host, suffix) && len(host) > len(suffix) {
+				return true
+			}
+			continue
+		}
+		if p == host {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/nao1215/hurrah/config"
+)
+
+func TestNewRedirectHandler(t *testing.T) {
+	t.Parallel()
+
+	backend := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+
+	tests := []struct {
+		name         string
+		cfg          config.Redirect
+		httpsAddr    string
+		target       string
+		wantStatus   int
+		wantLocation string
+	}{
+		{
+			name:         "permanent redirect by default",
+			httpsAddr:    ":443",
+			target:       "http://api.example.com/v1/users?id=1",
+			wantStatus:   http.StatusPermanentRedirect,
+			wantLocation: "https://api.example.com/v1/users?id=1",
+		},
+		{
+			name:         "port of the HTTPS listener",
+			cfg:          config.Redirect{Status: http.StatusMovedPermanently},
+			httpsAddr:    ":8443",
+			target:       "http://api.example.com:8080/",
+			wantStatus:   http.StatusMovedPermanently,
+			wantLocation: "https://api.example.com:8443/",
+		},
+		{
+			name:         "https_port overrides the listener port",
+			cfg:          config.Redirect{HTTPSPort: "443"},
+			httpsAddr:    ":8443",
+			target:       "http://api.example.com/",
+			wantStatus:   http.StatusPermanentRedirect,
+			wantLocation: "https://api.example.com/",
+		},
+		{
+			name:         "IPv6 address",
+			httpsAddr:    ":443",
+			target:       "http://[::1]:80/",
+			wantStatus:   http.StatusPermanentRedirect,
+			wantLocation: "https://[::1]/",
+		},
+		{
+			name:       "health path",
+			cfg:        config.Redirect{HealthPath: "/healthz"},
+			httpsAddr:  ":443",
+			target:     "http://api.example.com/healthz",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "except host",
+			cfg:        config.Redirect{ExceptHosts: []string{"legacy.example.com"}},
+			httpsAddr:  ":443",
+			target:     "http://LEGACY.example.com/",
+			wantStatus: http.StatusTeapot,
+		},
+		{
+			name:       "except subdomain",
+			cfg:        config.Redirect{ExceptHosts: []string{"*.legacy.example.com"}},
+			httpsAddr:  ":443",
+			target:     "http://iot.legacy.example.com:80/",
+			wantStatus: http.StatusTeapot,
+		},
+		{
+			name:         "wildcard does not match the parent domain",
+			cfg:          config.Redirect{ExceptHosts: []string{"*.legacy.example.com"}},
+			httpsAddr:    ":443",
+			target:       "http://legacy.example.com/",
+			wantStatus:   http.StatusPermanentRedirect,
+			wantLocation: "https://legacy.example.com/",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			h, err := NewRedirectHandler(tt.cfg, tt.httpsAddr, backend)
+			if err != nil {
+				t.Fatalf("NewRedirectHandler() error = %v", err)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.target, nil))
+			if diff := cmp.Diff(tt.wantStatus, rec.Code); diff != "" {
+				t.Errorf("status mismatch (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tt.wantLocation, rec.Header().Get("Location")); diff != "" {
+				t.Errorf("Location mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestNewRedirectHandler_invalidSettings(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		cfg       config.Redirect
+		httpsAddr string
+	}{
+		{cfg: config.Redirect{Status: http.StatusOK}, httpsAddr: ":443"},
+		{cfg: config.Redirect{}, httpsAddr: "443"},
+		{cfg: config.Redirect{ExceptHosts: []string{"legacy.*.example.com"}}, httpsAddr: ":443"},
+	} {
+		if _, err := NewRedirectHandler(tt.cfg, tt.httpsAddr, http.NotFoundHandler()); err == nil {
+			t.Errorf("NewRedirectHandler(%+v, %q) error = nil, want error", tt.cfg, tt.httpsAddr)
+		}
+	}
+}
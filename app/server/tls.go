@@ -0,0 +1,197 @@
+// Package server provides the listener settings of the hurrah command.
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/nao1215/hurrah/config"
+)
+
+const (
+	// ClientAuthNone does not request client certificates.
+	ClientAuthNone = "none"
+	// ClientAuthOptional verifies client certificates if they are given.
+	// Routes that require a certificate use the client_cert middleware.
+	ClientAuthOptional = "optional"
+	// ClientAuthRequired rejects TLS handshakes without a verified client certificate.
+	ClientAuthRequired = "required"
+)
+
+// NewTLSConfig creates the TLS settings of the listener.
+// The certificate is selected by the SNI of the client from cert_file and
+// certificates, and cert_file (or the first of certificates) is used when no
+// certificate matches. The certificate files are reloaded when they change, so
+// rotated certificates are used without a restart. The certificates of acme are
+// not set; use ACME.SetTLSConfig.
+func NewTLSConfig(cfg config.TLS) (*tls.Config, error) {
+	pairs, err := certificatePairs(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.ReloadInterval < 0 {
+		return nil, fmt.Errorf("server: invalid reload_interval %d", cfg.ReloadInterval)
+	}
+	reloadInterval := time.Duration(cfg.ReloadInterval) * time.Second
+	if reloadInterval == 0 {
+		reloadInterval = defaultReloadInterval
+	}
+	files, err := newCertFiles(pairs, reloadInterval)
+	if err != nil {
+		return nil, err
+	}
+	minVersion, err := parseTLSVersion(cfg.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	cipherSuites, err := parseCipherSuites(cfg.CipherSuites)
+	if err != nil {
+		return nil, err
+	}
+	nextProtos := cfg.ALPN
+	if len(nextProtos) == 0 {
+		nextProtos = []string{"h2", "http/1.1"}
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:     minVersion,
+		CipherSuites:   cipherSuites,
+		NextProtos:     nextProtos,
+		GetCertificate: files.getCertificate,
+	}
+	if err := setClientAuth(tlsConfig, cfg); err != nil {
+		return nil, err
+	}
+	return tlsConfig, nil
+}
+
+// certificatePairs returns cert_file and certificates. The certificate files are
+// optional if acme is set.
+func certificatePairs(cfg config.TLS) ([]config.Certificate, error) {
+	pairs := cfg.Certificates
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		pairs = append([]config.Certificate{{CertFile: cfg.CertFile, KeyFile: cfg.KeyFile}}, pairs...)
+	}
+	if len(pairs) == 0 && cfg.ACME == nil {
+		return nil, errors.New("server: tls requires cert_file and key_file, certificates or acme")
+	}
+	return pairs, nil
+}
+
+// loadCertificates loads the pairs of certificates and private keys.
+func loadCertificates(pairs []config.Certificate) ([]tls.Certificate, error) {
+	certs := make([]tls.Certificate, 0, len(pairs))
+	for _, pair := range pairs {
+		cert, err := loadCertificate(pair)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// loadCertificate loads a pair of a certificate and a private key.
+func loadCertificate(pair config.Certificate) (tls.Certificate, error) {
+	if pair.CertFile == "" || pair.KeyFile == "" {
+		return tls.Certificate{}, fmt.Errorf("server: certificate %q requires both cert_file and key_file", pair.CertFile)
+	}
+	for _, path := range []string{pair.CertFile, pair.KeyFile} {
+		if _, err := os.Stat(path); err != nil {
+			return tls.Certificate{}, fmt.Errorf("server: failed to read %s: %w", path, err)
+		}
+	}
+	cert, err := tls.LoadX509KeyPair(pair.CertFile, pair.KeyFile)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("server: the certificate %s and the key %s are not a valid pair: %w", pair.CertFile, pair.KeyFile, err)
+	}
+	return cert, nil
+}
+
+// parseTLSVersion parses the minimum TLS version.
+func parseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("server: unsupported min_version %q; use \"1.2\" or \"1.3\"", version)
+	}
+}
+
+// parseCipherSuites parses the names of the cipher suites. Insecure cipher suites are rejected.
+// TLS 1.3 cipher suites are not configurable in crypto/tls, so they are rejected too.
+func parseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	supported := map[string]uint16{}
+	for _, suite := range tls.CipherSuites() {
+		for _, version := range suite.SupportedVersions {
+			if version == tls.VersionTLS12 {
+				supported[suite.Name] = suite.ID
+			}
+		}
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := supported[name]
+		if !ok {
+			return nil, fmt.Errorf("server: unsupported cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// setClientAuth sets the client certificate verification.
+func setClientAuth(tlsConfig *tls.Config, cfg config.TLS) error {
+	mode := cfg.ClientAuth
+	if mode == "" {
+		mode = ClientAuthNone
+		if cfg.ClientCAFile != "" {
+			mode = ClientAuthOptional
+		}
+	}
+
+	switch mode {
+	case ClientAuthNone:
+		tlsConfig.ClientAuth = tls.NoClientCert
+		return nil
+	case ClientAuthOptional:
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	case ClientAuthRequired:
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return fmt.Errorf("server: unknown client_auth %q", cfg.ClientAuth)
+	}
+
+	if cfg.ClientCAFile == "" {
+		return fmt.Errorf("server: client_auth %q requires client_ca_file", mode)
+	}
+	pool, err := loadCertPool(cfg.ClientCAFile)
+	if err != nil {
+		return err
+	}
+	tlsConfig.ClientCAs = pool
+	return nil
+}
+
+// loadCertPool loads a PEM encoded CA bundle.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path) //nolint:gosec // The path is given by the administrator.
+	if err != nil {
+		return nil, fmt.Errorf("server: failed to read the CA bundle: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("server: no certificate is found in the CA bundle %s", path)
+	}
+	return pool, nil
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/nao1215/hurrah/config"
+)
+
+func TestNewTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	caFile := filepath.Join(dir, "ca.pem")
+	writeFile(t, caFile, ca.pem)
+	certFile, keyFile := ca.issueFiles(t, dir, "localhost", "localhost")
+
+	t.Run("client_auth modes", func(t *testing.T) {
+		tests := []struct {
+			name    string
+			cfg     config.TLS
+			want    tls.ClientAuthType
+			wantErr bool
+		}{
+			{
+				name: "no client CA",
+				cfg:  config.TLS{CertFile: certFile, KeyFile: keyFile},
+				want: tls.NoClientCert,
+			},
+			{
+				name: "optional by default with client CA",
+				cfg:  config.TLS{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile},
+				want: tls.VerifyClientCertIfGiven,
+			},
+			{
+				name: "required",
+				cfg:  config.TLS{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile, ClientAuth: "required"},
+				want: tls.RequireAndVerifyClientCert,
+			},
+			{
+				name:    "required without client CA",
+				cfg:     config.TLS{CertFile: certFile, KeyFile: keyFile, ClientAuth: "required"},
+				wantErr: true,
+			},
+			{
+				name:    "unknown client_auth",
+				cfg:     config.TLS{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile, ClientAuth: "maybe"},
+				wantErr: true,
+			},
+			{
+				name:    "missing key file",
+				cfg:     config.TLS{CertFile: certFile, KeyFile: filepath.Join(dir, "not-exist.key")},
+				wantErr: true,
+			},
+			{
+				name:    "mismatched key file",
+				cfg:     config.TLS{CertFile: certFile, KeyFile: certFile},
+				wantErr: true,
+			},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				got, err := NewTLSConfig(tt.cfg)
+				if (err != nil) != tt.wantErr {
+					t.Fatalf("NewTLSConfig() error = %v, wantErr %v", err, tt.wantErr)
+				}
+				if err != nil {
+					return
+				}
+				if diff := cmp.Diff(tt.want, got.ClientAuth); diff != "" {
+					t.Errorf("ClientAuth mismatch (-want +got):\n%s", diff)
+				}
+			})
+		}
+	})
+
+	t.Run("required client certificate", func(t *testing.T) {
+		tlsConfig, err := NewTLSConfig(config.TLS{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile, ClientAuth: "required"})
+		if err != nil {
+			t.Fatalf("NewTLSConfig() error = %v", err)
+		}
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(r.TLS.VerifiedChains[0][0].Subject.CommonName)) // The write error is not important in this test.
+		}))
+		server.TLS = tlsConfig
+		server.StartTLS()
+		defer server.Close()
+
+		newClient := func(certs ...tls.Certificate) *http.Client {
+			return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+				RootCAs:      ca.pool(),
+				ServerName:   "localhost",
+				Certificates: certs,
+				MinVersion:   tls.VersionTLS12,
+			}}}
+		}
+
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := newClient(ca.keyPair(t, "partner")).Do(req)
+		if err != nil {
+			t.Fatalf("client.Do() error = %v", err)
+		}
+		resp.Body.Close() //nolint:errcheck
+		if diff := cmp.Diff(http.StatusOK, resp.StatusCode); diff != "" {
+			t.Errorf("status mismatch (-want +got):\n%s", diff)
+		}
+
+		if resp, err := newClient().Do(req); err == nil {
+			resp.Body.Close() //nolint:errcheck
+			t.Error("client.Do() without certificate error = nil, want error")
+		}
+	})
+
+	t.Run("certificate is selected by SNI", func(t *testing.T) {
+		apiCert, apiKey := ca.issueFiles(t, dir, "api.example.com", "api.example.com")
+		wwwCert, wwwKey := ca.issueFiles(t, dir, "www.example.com", "www.example.com", "*.www.example.com")
+		tlsConfig, err := NewTLSConfig(config.TLS{
+			CertFile: certFile,
+			KeyFile:  keyFile,
+			Certificates: []config.Certificate{
+				{CertFile: apiCert, KeyFile: apiKey},
+				{CertFile: wwwCert, KeyFile: wwwKey},
+			},
+		})
+		if err != nil {
+			t.Fatalf("NewTLSConfig() error = %v", err)
+		}
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+		server.TLS = tlsConfig
+		server.StartTLS()
+		defer server.Close()
+
+		for _, tt := range []struct {
+			serverName string
+			want       string
+		}{
+			{"api.example.com", "api.example.com"},
+			{"img.www.example.com", "www.example.com"},
+			{"unknown.example.com", "localhost"},
+		} {
+			conn, err := tls.Dial("tcp", server.Listener.Addr().String(), &tls.Config{
+				ServerName:         tt.serverName,
+				InsecureSkipVerify: true, //nolint:gosec // The certificate is checked below.
+				MinVersion:         tls.VersionTLS12,
+			})
+			if err != nil {
+				t.Fatalf("tls.Dial() error = %v", err)
+			}
+			got := conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+			conn.Close() //nolint:errcheck
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("certificate for %s mismatch (-want +got):\n%s", tt.serverName, diff)
+			}
+		}
+	})
+
+	t.Run("versions, cipher suites and ALPN", func(t *testing.T) {
+		tlsConfig, err := NewTLSConfig(config.TLS{
+			CertFile:     certFile,
+			KeyFile:      keyFile,
+			MinVersion:   "1.3",
+			CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"},
+			ALPN:         []string{"http/1.1"},
+		})
+		if err != nil {
+			t.Fatalf("NewTLSConfig() error = %v", err)
+		}
+		if diff := cmp.Diff(uint16(tls.VersionTLS13), tlsConfig.MinVersion); diff != "" {
+			t.Errorf("MinVersion mismatch (-want +got):\n%s", diff)
+		}
+		if diff := cmp.Diff([]uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}, tlsConfig.CipherSuites); diff != "" {
+			t.Errorf("CipherSuites mismatch (-want +got):\n%s", diff)
+		}
+		if diff := cmp.Diff([]string{"http/1.1"}, tlsConfig.NextProtos); diff != "" {
+			t.Errorf("NextProtos mismatch (-want +got):\n%s", diff)
+		}
+
+		for _, cfg := range []config.TLS{
+			{CertFile: certFile, KeyFile: keyFile, MinVersion: "1.0"},
+			{CertFile: certFile, KeyFile: keyFile, CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}},
+			{CertFile: certFile, KeyFile: keyFile, CipherSuites: []string{"TLS_AES_128_GCM_SHA256"}},
+			{Certificates: []config.Certificate{{CertFile: certFile}}},
+			{},
+		} {
+			if _, err := NewTLSConfig(cfg); err == nil {
+				t.Errorf("NewTLSConfig(%+v) error = nil, want error", cfg)
+			}
+		}
+	})
+}
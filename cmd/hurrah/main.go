@@ -3,14 +3,21 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"net/netip"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
+	"github.com/nao1215/hurrah/app/middleware"
 	"github.com/nao1215/hurrah/app/proxy"
+	"github.com/nao1215/hurrah/app/server"
 	"github.com/nao1215/hurrah/config"
 )
 
@@ -33,6 +40,7 @@ func run() int {
 		slog.Error("failed to initialize hurrah command", slog.String("error", err.Error()))
 		return ExitCodeError
 	}
+	defer hurrah.close()
 	if err := hurrah.run(); err != nil {
 		slog.Error("failed to run hurrah command", slog.String("error", err.Error()))
 		return ExitCodeError
@@ -45,6 +53,10 @@ type hurrah struct {
 	flag   *config.Flag   // flag is the flag at command startup.
 	config *config.Config // config is the configuration of the hurrah command.
 	mux    *http.ServeMux // mux is the HTTP request multiplexer.
+	// quotaStore is the store of the quota middleware. It is nil if [quota] is not set.
+	quotaStore *middleware.QuotaStore
+	// redisClients is the Redis clients of the rate_limit middleware.
+	redisClients *middleware.RedisClients
 }
 
 // newHurrah reads the command line flags and returns a new hurrah.
@@ -56,29 +68,217 @@ func newHurrah() (*hurrah, error) {
 	}
 	slog.SetDefault(config.NewStructuredLogger(os.Stderr, flag.Debug || cfg.Server.Debug))
 
+	trustedProxies, err := middleware.ParsePrefixes(cfg.Server.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	middlewares, err := newGlobalMiddlewares(cfg, trustedProxies)
+	if err != nil {
+		return nil, err
+	}
 	mux := http.NewServeMux()
-	if err := proxy.SetProxy(mux, cfg.Routes); err != nil {
+	resources := middleware.Resources{RedisClients: middleware.NewRedisClients(), TrustedProxies: trustedProxies}
+	if cfg.Quota != nil {
+		store, err := middleware.OpenQuotaStore(cfg.Quota.Path)
+		if err != nil {
+			return nil, err
+		}
+		resources.QuotaStore = store
+		if cfg.Quota.AdminToken != "" {
+			adminPath := cfg.Quota.AdminPath
+			if adminPath == "" {
+				adminPath = middleware.DefaultQuotaAdminPath
+			}
+			store.SetAdminAPI(mux, adminPath, cfg.Quota.AdminToken)
+		}
+	}
+	h := &hurrah{
+		flag:         flag,
+		config:       cfg,
+		mux:          mux,
+		quotaStore:   resources.QuotaStore,
+		redisClients: resources.RedisClients,
+	}
+	if err := proxy.SetProxy(mux, cfg.Routes, resources, middlewares...); err != nil {
+		h.close() // The error of the proxy settings is more important.
 		return nil, err
 	}
+	return h, nil
+}
 
-	return &hurrah{
-		flag:   flag,
-		config: cfg,
-		mux:    mux,
-	}, nil
+// newGlobalMiddlewares creates the middlewares applied to all routes.
+func newGlobalMiddlewares(cfg *config.Config, trustedProxies []netip.Prefix) ([]middleware.Middleware, error) {
+	middlewares := []middleware.Middleware{middleware.ClientIP(trustedProxies)}
+
+	if cfg.IPFilter != nil {
+		ipFilter, err := middleware.IPFilter(*cfg.IPFilter)
+		if err != nil {
+			return nil, err
+		}
+		middlewares = append(middlewares, ipFilter)
+	}
+	return middlewares, nil
+}
+
+// shutdownTimeout is how long the servers wait for the requests and WebSocket connections on shutdown.
+const shutdownTimeout = 10 * time.Second
+
+// shutdowner is a server that can be shut down gracefully.
+type shutdowner interface {
+	Shutdown(ctx context.Context) error
 }
 
 // run runs the main logic of the hurrah command.
+// It runs until a server fails or SIGINT or SIGTERM is received.
 func (h *hurrah) run() error {
 	h.logStartupInfo()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	server := &http.Server{
+	srv := &http.Server{
 		Addr:              h.port(),
 		Handler:           h.mux,
 		ReadHeaderTimeout: time.Duration(10) * time.Second, // TODO: Use can be configured.
 	}
-	slog.Info("starting the server", slog.String("address", server.Addr))
-	return server.ListenAndServe()
+	if h.config.Server.TLS == nil {
+		if h.config.Server.HTTP3 != nil {
+			return errors.New("server: http3 requires tls")
+		}
+		if h.config.Server.Redirect != nil {
+			return errors.New("server: redirect requires tls")
+		}
+		if err := server.ConfigureHTTP2(srv, h.config.Server.HTTP2); err != nil {
+			return err
+		}
+		errs := make(chan error, 1)
+		go func() {
+			slog.Info("starting the server", slog.String("address", srv.Addr))
+			errs <- srv.ListenAndServe()
+		}()
+		return wait(ctx, errs, srv)
+	}
+
+	tlsConfig, err := server.NewTLSConfig(*h.config.Server.TLS)
+	if err != nil {
+		return err
+	}
+	var acme *server.ACME
+	if h.config.Server.TLS.ACME != nil {
+		acme, err = server.NewACME(*h.config.Server.TLS.ACME)
+		if err != nil {
+			return err
+		}
+		acme.SetTLSConfig(tlsConfig)
+	}
+	srv.TLSConfig = tlsConfig
+	if err := server.ConfigureHTTP2(srv, h.config.Server.HTTP2); err != nil {
+		return err
+	}
+
+	errs := make(chan error, 3)
+	servers := []shutdowner{srv}
+	if h.config.Server.Redirect != nil {
+		redirectSrv, err := h.newRedirectServer(srv.Addr, acme)
+		if err != nil {
+			return err
+		}
+		servers = append(servers, redirectSrv)
+		go func() {
+			slog.Info("starting the redirect server", slog.String("address", redirectSrv.Addr))
+			errs <- redirectSrv.ListenAndServe()
+		}()
+	} else if acme != nil {
+		servers = append(servers, serveACMEChallenges(acme))
+	}
+	if h.config.Server.HTTP3 != nil {
+		h3, err := server.NewHTTP3Server(*h.config.Server.HTTP3, srv.Addr, tlsConfig, h.mux)
+		if err != nil {
+			return err
+		}
+		srv.Handler = server.AltSvc(srv.Handler, h3, *h.config.Server.HTTP3)
+		servers = append(servers, h3)
+		go func() {
+			slog.Info("starting the HTTP/3 server", slog.String("address", h3.Addr))
+			errs <- h3.ListenAndServe()
+		}()
+	}
+	go func() {
+		slog.Info("starting the server", slog.String("address", srv.Addr), slog.Bool("tls", true))
+		errs <- srv.ListenAndServeTLS("", "")
+	}()
+	return wait(ctx, errs, servers...)
+}
+
+// wait waits until a server fails or ctx is done. Then the servers are shut down
+// gracefully, and the WebSocket clients get close frames. If a server fails, its
+// error is returned with the errors of the shutdown.
+func wait(ctx context.Context, errs <-chan error, servers ...shutdowner) error {
+	var err error
+	select {
+	case err = <-errs:
+	case <-ctx.Done():
+	}
+
+	slog.Info("shutting down the server")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, s := range servers {
+		err = errors.Join(err, s.Shutdown(ctx))
+	}
+	proxy.CloseWebSockets(ctx)
+	return err
+}
+
+// newRedirectServer creates the plaintext listener that redirects requests to HTTPS.
+// If acme is not nil, the listener also answers HTTP-01 challenges.
+func (h *hurrah) newRedirectServer(httpsAddr string, acme *server.ACME) (*http.Server, error) {
+	cfg := *h.config.Server.Redirect
+	handler, err := server.NewRedirectHandler(cfg, httpsAddr, h.mux)
+	if err != nil {
+		return nil, err
+	}
+	if acme != nil {
+		handler = acme.HTTPHandler(handler)
+	}
+	port := cfg.Port
+	if port == "" {
+		port = server.DefaultRedirectPort
+	}
+	return &http.Server{
+		Addr:              ":" + strings.TrimPrefix(port, ":"),
+		Handler:           handler,
+		ReadHeaderTimeout: time.Duration(10) * time.Second,
+	}, nil
+}
+
+// serveACMEChallenges starts the server that serves HTTP-01 challenges and redirects
+// the other requests to HTTPS, and returns it so that it is shut down with the others.
+// TLS-ALPN-01 challenges still work if the listener fails, so the error is only logged.
+func serveACMEChallenges(acme *server.ACME) *http.Server {
+	srv := &http.Server{
+		Addr:              acme.HTTPAddr(),
+		Handler:           acme.HTTPHandler(nil),
+		ReadHeaderTimeout: time.Duration(10) * time.Second,
+	}
+	go func() {
+		slog.Info("starting the ACME challenge server", slog.String("address", srv.Addr))
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("failed to run the ACME challenge server", slog.String("error", err.Error()))
+		}
+	}()
+	return srv
+}
+
+// close releases the resources of the hurrah command.
+func (h *hurrah) close() {
+	if h.quotaStore != nil {
+		if err := h.quotaStore.Close(); err != nil {
+			slog.Error("failed to close the quota store", slog.String("error", err.Error()))
+		}
+	}
+	if err := h.redisClients.Close(); err != nil {
+		slog.Error("failed to close the redis clients", slog.String("error", err.Error()))
+	}
 }
 
 // port returns the port number to listen on.
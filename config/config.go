@@ -12,15 +12,38 @@ const (
 	DefaultTimeout int64 = 30
 	// DefaultPort is the default port number to listen on.
 	DefaultPort string = ":8080"
+	// ProtocolHTTP is the protocol of routes that proxy HTTP/1.1 and HTTP/2 requests.
+	ProtocolHTTP string = "http"
+	// ProtocolGRPC is the protocol of routes that proxy gRPC over HTTP/2.
+	ProtocolGRPC string = "grpc"
 )
 
 // Route is a struct that represents a route.
 type Route struct {
-	Path            string   `toml:"path"`              // Path is the path of the route. e.g., /api/v1/users
-	Backend         string   `toml:"backend"`           // Backend is the backend URL of the route. e.g., http://localhost:8080
-	Timeout         int64    `toml:"timeout"`           // Timeout is the timeout of the route. e.g., 10
-	HealthCheckPath string   `toml:"health_check_path"` // HealthCheckPath is the path of the health check. e.g., /health
-	Middleware      []string `toml:"middleware"`        // Middleware is the middleware of the route. e.g., [basic_auth, rate_limit]
+	Path            string           `toml:"path"`              // Path is the path of the route. e.g., /api/v1/users
+	Backend         string           `toml:"backend"`           // Backend is the backend URL of the route. e.g., http://localhost:8080
+	Timeout         int64            `toml:"timeout"`           // Timeout is the timeout of the route. e.g., 10
+	Protocol        string           `toml:"protocol"`          // Protocol is "http" or "grpc". By default, it is "http".
+	HealthCheckPath string           `toml:"health_check_path"` // HealthCheckPath is the path of the health check. e.g., /health
+	BackendTLS      *BackendTLS      `toml:"backend_tls"`       // BackendTLS is the TLS settings of the connections to the backend.
+	WebSocket       *WebSocket       `toml:"websocket"`         // WebSocket is the settings of the WebSocket connections. If nil, upgrades are passed through without limits.
+	Middleware      []string         `toml:"middleware"`        // Middleware is the middleware of the route. e.g., [basic_auth, rate_limit]
+	OIDC            *OIDC            `toml:"oidc"`              // OIDC is the settings of the oidc middleware.
+	RBAC            *RBAC            `toml:"rbac"`              // RBAC is the settings of the rbac middleware.
+	Introspection   *Introspection   `toml:"introspection"`     // Introspection is the settings of the introspection middleware.
+	ExtAuthz        *ExtAuthz        `toml:"ext_authz"`         // ExtAuthz is the settings of the ext_authz middleware.
+	Policy          *Policy          `toml:"policy"`            // Policy is the settings of the policy middleware.
+	ClientCert      *ClientCert      `toml:"client_cert"`       // ClientCert is the settings of the client_cert middleware.
+	IPFilter        *IPFilter        `toml:"ip_filter"`         // IPFilter is the settings of the ip_filter middleware.
+	RateLimit       *RateLimit       `toml:"rate_limit"`        // RateLimit is the settings of the rate_limit middleware.
+	Quota           *Quota           `toml:"quota"`             // Quota is the settings of the quota middleware.
+	CORS            *CORS            `toml:"cors"`              // CORS is the settings of the cors middleware.
+	SecurityHeaders *SecurityHeaders `toml:"security_headers"`  // SecurityHeaders is the settings of the security_headers middleware.
+	RequestLimits   *RequestLimits   `toml:"request_limits"`    // RequestLimits is the settings of the request_limits middleware.
+	OpenAPI         *OpenAPI         `toml:"openapi"`           // OpenAPI is the settings of the openapi middleware.
+	WAF             *WAF             `toml:"waf"`               // WAF is the settings of the waf middleware.
+	GRPCWeb         *GRPCWeb         `toml:"grpc_web"`          // GRPCWeb is the settings of the grpc_web middleware.
+	GRPCTranscoding *GRPCTranscoding `toml:"grpc_transcoding"`  // GRPCTranscoding is the settings of the grpc_transcoding middleware.
 }
 
 // HealthCheckEnabled returns true if the health check is enabled.
@@ -46,14 +69,92 @@ func (r Route) HealthCheckURL() (string, error) {
 
 // Server is a struct that represents a server.
 type Server struct {
-	Port  string `toml:"port"`  // Port is the port number to listen on.
-	Debug bool   `toml:"debug"` // Debug is whether to run in debug mode. By default, only output info/warning/error logs.
+	Port           string    `toml:"port"`            // Port is the port number to listen on.
+	Debug          bool      `toml:"debug"`           // Debug is whether to run in debug mode. By default, only output info/warning/error logs.
+	TLS            *TLS      `toml:"tls"`             // TLS is the TLS settings of the listener. If nil, the server listens on plain HTTP.
+	HTTP2          *HTTP2    `toml:"http2"`           // HTTP2 is the HTTP/2 settings of the listener.
+	Redirect       *Redirect `toml:"redirect"`        // Redirect is the plaintext listener that redirects requests to HTTPS. If nil, it is disabled. It requires tls.
+	HTTP3          *HTTP3    `toml:"http3"`           // HTTP3 is the HTTP/3 (QUIC) listener. If nil, HTTP/3 is disabled. It requires tls.
+	TrustedProxies []string  `toml:"trusted_proxies"` // TrustedProxies is the CIDRs of proxies whose X-Forwarded-For and Forwarded headers are trusted. e.g., [10.0.0.0/8]
+}
+
+// Redirect is a struct that represents the plaintext listener that redirects requests to HTTPS.
+type Redirect struct {
+	Port        string   `toml:"port"`         // Port is the port number to listen on. By default, it is "80".
+	Status      int      `toml:"status"`       // Status is the status code of the redirects, 301, 302, 307 or 308. By default, it is 308.
+	HTTPSPort   string   `toml:"https_port"`   // HTTPSPort is the port number in the redirect URLs. By default, it is server.port, and it is omitted if it is 443.
+	HealthPath  string   `toml:"health_path"`  // HealthPath is the path that responds with 200 instead of a redirect. e.g., /healthz
+	ExceptHosts []string `toml:"except_hosts"` // ExceptHosts is the hosts served over plain HTTP instead of redirected, for legacy clients. e.g., [legacy.example.com, *.legacy.example.com]
+}
+
+// HTTP2 is a struct that represents the HTTP/2 settings of the listener.
+type HTTP2 struct {
+	H2C                  bool   `toml:"h2c"`                    // H2C enables HTTP/2 over cleartext on the listener without tls.
+	MaxConcurrentStreams uint32 `toml:"max_concurrent_streams"` // MaxConcurrentStreams is the maximum number of concurrent streams per connection. By default, it is 250.
+}
+
+// HTTP3 is a struct that represents the HTTP/3 (QUIC) listener.
+type HTTP3 struct {
+	Port         string `toml:"port"`            // Port is the UDP port number to listen on. By default, it is the same as server.port.
+	AltSvcMaxAge int    `toml:"alt_svc_max_age"` // AltSvcMaxAge is the seconds clients remember that HTTP/3 is available. By default, it is 86400.
+}
+
+// TLS is a struct that represents the TLS settings of the listener.
+type TLS struct {
+	CertFile       string        `toml:"cert_file"`       // CertFile is the path to the PEM encoded server certificate chain. It is used when no certificate matches the SNI.
+	KeyFile        string        `toml:"key_file"`        // KeyFile is the path to the PEM encoded private key of the server certificate.
+	Certificates   []Certificate `toml:"certificates"`    // Certificates is the additional certificates selected by the SNI of the client.
+	MinVersion     string        `toml:"min_version"`     // MinVersion is the minimum TLS version, "1.2" or "1.3". By default, it is "1.2".
+	CipherSuites   []string      `toml:"cipher_suites"`   // CipherSuites is the TLS 1.2 cipher suites. e.g., [TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256]. By default, it is the Go defaults.
+	ALPN           []string      `toml:"alpn"`            // ALPN is the application protocols in order of preference. By default, it is [h2, http/1.1].
+	ClientCAFile   string        `toml:"client_ca_file"`  // ClientCAFile is the path to the PEM encoded CA bundle that verifies client certificates.
+	ClientAuth     string        `toml:"client_auth"`     // ClientAuth is "none", "optional" or "required". By default, it is "optional" if client_ca_file is set.
+	ReloadInterval int           `toml:"reload_interval"` // ReloadInterval is the interval in seconds to check the certificate files for changes. By default, it is 10 seconds.
+	ACME           *ACME         `toml:"acme"`            // ACME is the automatic certificate management. If nil, only the certificate files are used.
+}
+
+// ACME is a struct that represents the settings of the automatic certificate management (RFC 8555).
+type ACME struct {
+	Domains         []string `toml:"domains"`           // Domains is the hostnames whose certificates are obtained. e.g., [api.example.com]
+	Email           string   `toml:"email"`             // Email is the contact address of the ACME account.
+	CacheDir        string   `toml:"cache_dir"`         // CacheDir is the directory where the account key and certificates are stored. By default, it is "acme".
+	DirectoryURL    string   `toml:"directory_url"`     // DirectoryURL is the directory URL of the ACME server. By default, it is Let's Encrypt.
+	CAFile          string   `toml:"ca_file"`           // CAFile is the path to the PEM encoded CA bundle that verifies the ACME server. e.g., the CA of Pebble.
+	HTTPAddr        string   `toml:"http_addr"`         // HTTPAddr is the address of the listener for HTTP-01 challenges. By default, it is ":80".
+	RenewBeforeDays int      `toml:"renew_before_days"` // RenewBeforeDays is the days before expiry when certificates are renewed. By default, it is 30.
+}
+
+// BackendTLS is a struct that represents the TLS settings of the connections to a backend.
+type BackendTLS struct {
+	CAFile             string `toml:"ca_file"`              // CAFile is the path to the PEM encoded CA bundle that verifies the backend. By default, the system roots are used.
+	CertFile           string `toml:"cert_file"`            // CertFile is the path to the PEM encoded client certificate chain for mTLS.
+	KeyFile            string `toml:"key_file"`             // KeyFile is the path to the PEM encoded private key of the client certificate.
+	ServerName         string `toml:"server_name"`          // ServerName is the name sent in SNI and verified in the certificate. By default, it is the host of the backend URL.
+	InsecureSkipVerify bool   `toml:"insecure_skip_verify"` // InsecureSkipVerify disables the verification of the backend certificate. Use it only for development.
+}
+
+// WebSocket is a struct that represents the settings of the WebSocket connections of a route.
+type WebSocket struct {
+	MaxConnections  int      `toml:"max_connections"`   // MaxConnections is the maximum number of concurrent connections. If 0, it is unlimited.
+	MaxMessageBytes int64    `toml:"max_message_bytes"` // MaxMessageBytes is the maximum size of a message in bytes in both directions. If 0, it is unlimited.
+	IdleTimeout     int      `toml:"idle_timeout"`      // IdleTimeout is the seconds without messages in either direction before the connection is closed. If 0, there is no idle timeout.
+	PingInterval    int      `toml:"ping_interval"`     // PingInterval is the seconds between pings to the client. By default, it is 30.
+	PingTimeout     int      `toml:"ping_timeout"`      // PingTimeout is the seconds to wait for the pong before the connection is closed. By default, it is 10.
+	AllowOrigins    []string `toml:"allow_origins"`     // AllowOrigins is the allowed origins of browsers. e.g., [https://app.example.com]. By default, only the same origin is allowed.
+}
+
+// Certificate is a struct that represents a pair of a certificate and a private key.
+type Certificate struct {
+	CertFile string `toml:"cert_file"` // CertFile is the path to the PEM encoded certificate chain.
+	KeyFile  string `toml:"key_file"`  // KeyFile is the path to the PEM encoded private key.
 }
 
 // Config is a struct that represents a configuration.
 type Config struct {
-	Server Server  `toml:"server"`
-	Routes []Route `toml:"routes"`
+	Server   Server      `toml:"server"`
+	Routes   []Route     `toml:"routes"`
+	IPFilter *IPFilter   `toml:"ip_filter"` // IPFilter is the ip_filter applied to all routes.
+	Quota    *QuotaStore `toml:"quota"`     // Quota is the store of the quota middleware.
 }
 
 // NewConfig creates a new Config.
@@ -0,0 +1,197 @@
+package config
+
+// OIDC is a struct that represents the settings of the OpenID Connect middleware.
+type OIDC struct {
+	Issuer                string   `toml:"issuer"`                   // Issuer is the issuer URL of the OpenID Provider. e.g., https://idp.example.com
+	ClientID              string   `toml:"client_id"`                // ClientID is the client ID registered with the OpenID Provider.
+	ClientSecret          string   `toml:"client_secret"`            // ClientSecret is the client secret registered with the OpenID Provider.
+	RedirectURL           string   `toml:"redirect_url"`             // RedirectURL is the callback URL. Its path must be under the route path. e.g., https://gateway.example.com/app/callback
+	Scopes                []string `toml:"scopes"`                   // Scopes is the requested scopes. "openid" is always requested. e.g., [profile, email]
+	CookieName            string   `toml:"cookie_name"`              // CookieName is the name of the session cookie. By default, it is "hurrah_session".
+	CookieSecret          string   `toml:"cookie_secret"`            // CookieSecret is the secret used to encrypt the session cookie. It must be at least 32 characters.
+	LogoutPath            string   `toml:"logout_path"`              // LogoutPath is the path that ends the session. It must be under the route path. e.g., /app/logout
+	PostLogoutRedirectURL string   `toml:"post_logout_redirect_url"` // PostLogoutRedirectURL is the URL to redirect to after logout.
+}
+
+// JWT is a struct that represents the settings to validate bearer JWTs.
+type JWT struct {
+	Issuer   string `toml:"issuer"`   // Issuer is the expected "iss" claim. It is not checked if empty.
+	Audience string `toml:"audience"` // Audience is the expected "aud" claim. It is not checked if empty.
+	JWKSURL  string `toml:"jwks_url"` // JWKSURL is the URL of the JSON Web Key Set used to verify signatures.
+}
+
+// RBAC is a struct that represents the settings of the role-based access control middleware.
+// A request is allowed only if it has all of the required roles, scopes and groups.
+type RBAC struct {
+	Source       string   `toml:"source"`        // Source is where the claims are read from: "jwt" (default) or "header".
+	Roles        []string `toml:"roles"`         // Roles is the required roles. e.g., [admin]
+	Scopes       []string `toml:"scopes"`        // Scopes is the required scopes. e.g., [orders.read]
+	Groups       []string `toml:"groups"`        // Groups is the required groups. e.g., [partners]
+	RolesClaim   string   `toml:"roles_claim"`   // RolesClaim is the claim path of the roles. By default, it is "roles". e.g., realm_access.roles
+	ScopesClaim  string   `toml:"scopes_claim"`  // ScopesClaim is the claim path of the scopes. By default, it is "scope".
+	GroupsClaim  string   `toml:"groups_claim"`  // GroupsClaim is the claim path of the groups. By default, it is "groups".
+	RolesHeader  string   `toml:"roles_header"`  // RolesHeader is the header of the roles when source is "header". By default, it is "X-Auth-Roles".
+	ScopesHeader string   `toml:"scopes_header"` // ScopesHeader is the header of the scopes when source is "header". By default, it is "X-Auth-Scopes".
+	GroupsHeader string   `toml:"groups_header"` // GroupsHeader is the header of the groups when source is "header". By default, it is "X-Auth-Groups".
+	JWT          JWT      `toml:"jwt"`           // JWT is the settings to validate the bearer JWT when source is "jwt".
+	// TrustedUpstreams is the IP addresses or CIDRs of the peers whose identity headers are trusted when
+	// source is "header". By default, server.trusted_proxies is used. e.g., [10.0.0.0/8]
+	TrustedUpstreams []string `toml:"trusted_upstreams"`
+}
+
+// Introspection is a struct that represents the settings of the OAuth2 token introspection (RFC 7662) middleware.
+type Introspection struct {
+	Endpoint     string `toml:"endpoint"`      // Endpoint is the URL of the introspection endpoint. e.g., https://auth.example.com/introspect
+	ClientID     string `toml:"client_id"`     // ClientID is the client ID used to authenticate to the introspection endpoint.
+	ClientSecret string `toml:"client_secret"` // ClientSecret is the client secret used to authenticate to the introspection endpoint.
+	CacheTTL     int64  `toml:"cache_ttl"`     // CacheTTL is the maximum seconds to cache an active result. By default, results are cached until the token expires.
+}
+
+// ExtAuthz is a struct that represents the settings of the external authorization middleware.
+type ExtAuthz struct {
+	URL             string   `toml:"url"`              // URL is the URL of the authorization service. e.g., http://authz.internal:9000/check
+	TimeoutMS       int64    `toml:"timeout_ms"`       // TimeoutMS is the timeout of the authorization request in milliseconds. By default, the route timeout is used.
+	FailureMode     string   `toml:"failure_mode"`     // FailureMode is how to handle an unavailable authorization service: "closed" (default) or "open".
+	Headers         []string `toml:"headers"`          // Headers is the request headers sent to the authorization service. e.g., [Authorization, Cookie]
+	UpstreamHeaders []string `toml:"upstream_headers"` // UpstreamHeaders is the headers of an allowing response that are added to the request to the backend. e.g., [X-User-ID]
+	ClientHeaders   []string `toml:"client_headers"`   // ClientHeaders is the headers of a denying response that are returned to the client. e.g., [WWW-Authenticate, Location]
+}
+
+// Policy is a struct that represents the settings of the policy middleware.
+type Policy struct {
+	Rules   []PolicyRule `toml:"rules"`   // Rules is evaluated in order, and the first matching rule decides.
+	Default string       `toml:"default"` // Default is the effect when no rule matches: "deny" (default) or "allow".
+}
+
+// PolicyRule is a struct that represents a rule of the policy middleware.
+type PolicyRule struct {
+	Name       string `toml:"name"`       // Name is the name of the rule shown in logs. e.g., partners-business-hours
+	Effect     string `toml:"effect"`     // Effect is "allow" or "deny".
+	Expression string `toml:"expression"` // Expression is a CEL expression that evaluates to bool. e.g., method == "GET"
+}
+
+// ClientCert is a struct that represents the settings of the client certificate middleware.
+type ClientCert struct {
+	Required        bool     `toml:"required"`         // Required is whether a verified client certificate is required.
+	AllowedSubjects []string `toml:"allowed_subjects"` // AllowedSubjects is the allowed subject common names or distinguished names. e.g., [partner.example.com]
+	AllowedSANs     []string `toml:"allowed_sans"`     // AllowedSANs is the allowed DNS, email, IP or URI subject alternative names.
+	ForwardHeader   string   `toml:"forward_header"`   // ForwardHeader is the header that forwards the certificate to the backend. e.g., X-Client-Cert
+}
+
+// IPFilter is a struct that represents the settings of the IP address filter middleware.
+// The deny list is checked first. If the allow list is not empty, only the listed addresses are allowed.
+type IPFilter struct {
+	Allow      []string `toml:"allow"`       // Allow is the allowed IP addresses or CIDRs. e.g., [192.0.2.0/24]
+	Deny       []string `toml:"deny"`        // Deny is the denied IP addresses or CIDRs. e.g., [198.51.100.7]
+	AllowFiles []string `toml:"allow_files"` // AllowFiles is the files of allowed IP addresses or CIDRs, one per line.
+	DenyFiles  []string `toml:"deny_files"`  // DenyFiles is the files of denied IP addresses or CIDRs, one per line.
+}
+
+// RateLimit is a struct that represents the settings of the token bucket rate limiting middleware.
+type RateLimit struct {
+	Key      string `toml:"key"`      // Key is what the limit applies to: "route" (default), "ip", "api_key" or "claim".
+	Header   string `toml:"header"`   // Header is the API key header when key is "api_key". By default, it is "X-API-Key".
+	Claim    string `toml:"claim"`    // Claim is the claim path when key is "claim". By default, it is "sub".
+	Requests int64  `toml:"requests"` // Requests is the number of requests allowed per period.
+	Period   int64  `toml:"period"`   // Period is the period in seconds. By default, it is 1.
+	Burst    int64  `toml:"burst"`    // Burst is the bucket size. By default, it is the same as requests.
+	MaxKeys  int    `toml:"max_keys"` // MaxKeys is the maximum number of buckets kept in memory. By default, it is 10000.
+	Redis    *Redis `toml:"redis"`    // Redis is the store shared by hurrah instances. If nil, the buckets are kept in memory.
+}
+
+// Redis is a struct that represents the settings of a Redis compatible store.
+type Redis struct {
+	URL       string `toml:"url"`        // URL is the URL of the store. e.g., redis://:password@localhost:6379/0
+	TimeoutMS int64  `toml:"timeout_ms"` // TimeoutMS is the timeout of a command in milliseconds. By default, it is 100.
+}
+
+// Quota is a struct that represents the settings of the quota middleware.
+type Quota struct {
+	Key      string `toml:"key"`      // Key is what the quota applies to: "route", "ip", "api_key" or "claim". By default, it is "route".
+	Header   string `toml:"header"`   // Header is the API key header when key is "api_key". By default, it is "X-API-Key".
+	Claim    string `toml:"claim"`    // Claim is the claim path when key is "claim". By default, it is "sub".
+	Limit    int64  `toml:"limit"`    // Limit is the number of requests allowed per period.
+	Period   string `toml:"period"`   // Period is "day" or "month". By default, it is "month".
+	Timezone string `toml:"timezone"` // Timezone is the IANA time zone of the period boundaries. e.g., Asia/Tokyo. By default, it is UTC.
+}
+
+// QuotaStore is a struct that represents the settings of the on-disk store of quotas.
+type QuotaStore struct {
+	Path       string `toml:"path"`        // Path is the path to the database file. e.g., /var/lib/hurrah/quota.db
+	AdminPath  string `toml:"admin_path"`  // AdminPath is the path of the quota admin API. By default, it is /_hurrah/quotas.
+	AdminToken string `toml:"admin_token"` // AdminToken is the bearer token of the quota admin API. If empty, the API is disabled.
+}
+
+// CORS is a struct that represents the settings of the cors middleware.
+type CORS struct {
+	AllowOrigins        []string `toml:"allow_origins"`         // AllowOrigins is the allowed origins. "*" allows any origin, and "https://*.example.com" allows the subdomains.
+	AllowOriginPatterns []string `toml:"allow_origin_patterns"` // AllowOriginPatterns is the regular expressions of the allowed origins. e.g., ^https://pr-[0-9]+\.example\.com$
+	AllowMethods        []string `toml:"allow_methods"`         // AllowMethods is the allowed methods. By default, it is [GET, HEAD, POST].
+	AllowHeaders        []string `toml:"allow_headers"`         // AllowHeaders is the allowed request headers. "*" allows any header.
+	ExposeHeaders       []string `toml:"expose_headers"`        // ExposeHeaders is the response headers that browsers expose to scripts.
+	AllowCredentials    bool     `toml:"allow_credentials"`     // AllowCredentials is whether to allow cookies and the Authorization header.
+	MaxAge              int64    `toml:"max_age"`               // MaxAge is how long the preflight response is cached in seconds. If 0, the header is not sent.
+}
+
+// SecurityHeaders is a struct that represents the settings of the security_headers middleware.
+type SecurityHeaders struct {
+	Preset       string            `toml:"preset"`        // Preset is "strict" for web pages or "api" for APIs. By default, it is "api".
+	Headers      map[string]string `toml:"headers"`       // Headers overrides the headers of the preset. An empty value removes the header. e.g., {"Content-Security-Policy" = "default-src 'self'"}
+	StripHeaders []string          `toml:"strip_headers"` // StripHeaders is the headers removed from the backend responses. By default, it is [Server, X-Powered-By, X-AspNet-Version, X-AspNetMvc-Version].
+}
+
+// RequestLimits is a struct that represents the settings of the request_limits middleware.
+// A zero value means no limit.
+type RequestLimits struct {
+	MaxBodyBytes        int64    `toml:"max_body_bytes"`        // MaxBodyBytes is the maximum size of the request body in bytes. e.g., 10485760
+	MaxHeaderCount      int      `toml:"max_header_count"`      // MaxHeaderCount is the maximum number of request header fields.
+	MaxHeaderBytes      int      `toml:"max_header_bytes"`      // MaxHeaderBytes is the maximum total size of the request header fields in bytes.
+	MaxURLLength        int      `toml:"max_url_length"`        // MaxURLLength is the maximum length of the request target (path and query).
+	AllowedContentTypes []string `toml:"allowed_content_types"` // AllowedContentTypes is the media types allowed for requests with a body. e.g., [application/json, text/*]
+}
+
+// OpenAPI is a struct that represents the settings of the openapi middleware.
+type OpenAPI struct {
+	Spec                    string `toml:"spec"`                      // Spec is the path to the OpenAPI 3 document in YAML or JSON. e.g., ./openapi.yaml
+	BasePath                string `toml:"base_path"`                 // BasePath is the path the operations are under. e.g., /api/v1. By default, it is the paths of the servers in the document.
+	RejectUnknownOperations bool   `toml:"reject_unknown_operations"` // RejectUnknownOperations is whether to reject requests that match no operation with 404 or 405.
+	MaxBodyBytes            int64  `toml:"max_body_bytes"`            // MaxBodyBytes is the maximum size of the body read to validate it in bytes. By default, it is 1048576.
+}
+
+// WAF is a struct that represents the settings of the waf middleware.
+type WAF struct {
+	Mode         string         `toml:"mode"`           // Mode is "block" or "detect". "detect" only logs the matches. By default, it is "block".
+	MaxBodyBytes int64          `toml:"max_body_bytes"` // MaxBodyBytes is the maximum size of the body inspected in bytes. Larger bodies get 413 in block mode. By default, it is 131072.
+	Exclusions   []WAFExclusion `toml:"exclusions"`     // Exclusions is the rules that are not evaluated for some targets.
+	Rules        []WAFRule      `toml:"rules"`          // Rules is the custom rules evaluated in addition to the built-in rules.
+}
+
+// WAFExclusion is a struct that represents rules that are not evaluated.
+type WAFExclusion struct {
+	Rules   []string `toml:"rules"`   // Rules is the rule IDs. A trailing "*" matches the prefix. e.g., [sqli-*]
+	Targets []string `toml:"targets"` // Targets is the targets the rules are excluded for. A trailing "*" matches the prefix. By default, it is all targets. e.g., [header:cookie, query:q]
+}
+
+// WAFRule is a struct that represents a custom rule of the waf middleware.
+type WAFRule struct {
+	ID      string   `toml:"id"`      // ID is the rule ID logged on a match. e.g., custom-wp-admin
+	Targets []string `toml:"targets"` // Targets is the targets the rule inspects. A trailing "*" matches the prefix. e.g., [path, query:*]
+	Pattern string   `toml:"pattern"` // Pattern is the regular expression matched against the normalized (decoded and lower-cased) targets.
+	Message string   `toml:"message"` // Message is the description of the rule logged on a match.
+}
+
+// GRPCWeb is a struct that represents the settings of the grpc_web middleware.
+type GRPCWeb struct {
+	AllowOrigins     []string `toml:"allow_origins"`     // AllowOrigins is the origins of the browsers allowed by CORS. e.g., [https://app.example.com]. By default, CORS is not handled.
+	AllowHeaders     []string `toml:"allow_headers"`     // AllowHeaders is the request headers allowed in addition to the gRPC-Web headers. e.g., [authorization]
+	AllowCredentials bool     `toml:"allow_credentials"` // AllowCredentials is whether to allow cookies and the Authorization header.
+	MaxAge           int64    `toml:"max_age"`           // MaxAge is how long the preflight response is cached in seconds. If 0, the header is not sent.
+}
+
+// GRPCTranscoding is a struct that represents the settings of the grpc_transcoding middleware.
+type GRPCTranscoding struct {
+	DescriptorSet    string   `toml:"descriptor_set"`     // DescriptorSet is the path to the FileDescriptorSet built with "protoc --include_imports --descriptor_set_out". e.g., ./api.pb
+	Services         []string `toml:"services"`           // Services is the full names of the services exposed as REST. e.g., [helloworld.Greeter]. By default, it is all services in the descriptor set.
+	MaxBodyBytes     int64    `toml:"max_body_bytes"`     // MaxBodyBytes is the maximum size of the JSON request body in bytes. By default, it is 4194304.
+	MaxResponseBytes int64    `toml:"max_response_bytes"` // MaxResponseBytes is the maximum size of the gRPC response of the backend in bytes. By default, it is 4194304.
+}